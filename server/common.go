@@ -9,6 +9,8 @@ import (
 type HttpRes struct {
 	Message    string `json:"message,omitempty" example:"status ok"`
 	StatusCode int    `json:"statusCode,omitempty" example:"200"`
+	// Code machine readable reason of the error, set where the client has to tell errors apart
+	Code string `json:"code,omitempty" example:"stake_too_small"`
 }
 
 func HttpResOk() HttpRes {
@@ -25,6 +27,12 @@ func HttpResError(errMsg string, statusCode int) (int, HttpRes) {
 	}
 }
 
+func HttpResErrorWithCode(errMsg string, statusCode int, code string, log *log.Entry) (int, HttpRes) {
+	statusCode, res := HttpResErrorWithLog(errMsg, statusCode, log)
+	res.Code = code
+	return statusCode, res
+}
+
 func HttpResErrorWithLog(errMsg string, statusCode int, log *log.Entry) (int, HttpRes) {
 	if log != nil {
 		log.Error(errMsg)
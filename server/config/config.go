@@ -6,17 +6,102 @@ import (
 	"github.com/caarlos0/env/v6"
 )
 
+const (
+	MainNet = "-239"
+	TestNet = "-3"
+)
+
 var Config = struct {
-	Port  int `env:"PORT" envDefault:"8081"`
+	Port int `env:"PORT" envDefault:"8081"`
+	// Network global id of TON network: "-239" mainnet or "-3" testnet
+	Network string `env:"NETWORK" envDefault:"-239"`
+	// Secret values are read from the env or from the file named by the *_FILE variable,
+	// the seed may be read from the keystore as well, see loadSecrets
+	Secret struct {
+		Seed     string `env:"SEED,unset"`
+		SeedFile string `env:"SEED_FILE,file"`
+		// Keystore content of the encrypted seed file, see EncryptKeystore
+		Keystore               string `env:"KEYSTORE_FILE,file"`
+		KeystorePassphrase     string `env:"KEYSTORE_PASSPHRASE,unset"`
+		KeystorePassphraseFile string `env:"KEYSTORE_PASSPHRASE_FILE,file"`
+		// BankAddress of the wallet derived from the seed, the server refuses to start on mismatch
+		BankAddress string `env:"BANK_ADDR,required"`
+		// AdminKeys accepted keys of the admin api, comma separated, a new key is added before the old one is removed
+		AdminKeys     []string `env:"ADMIN_KEYS,unset" envSeparator:","`
+		AdminKeysFile string   `env:"ADMIN_KEYS_FILE,file"`
+	}
+	DB struct {
+		URL     string `env:"DB_URL,unset"`
+		URLFile string `env:"DB_URL_FILE,file"`
+	}
 	Proof struct {
 		PayloadSignatureKey string `env:"TONPROOF_PAYLOAD_SIGNATURE_KEY,required"`
 		PayloadLifeTimeSec  int64  `env:"TONPROOF_PAYLOAD_LIFETIME_SEC" envDefault:"300"`
 		ProofLifeTimeSec    int64  `env:"TONPROOF_PROOF_LIFETIME_SEC" envDefault:"300"`
 	}
+	Payout struct {
+		// VoidRefundFee in event collateral, kept from each stake refunded by a voided event
+		VoidRefundFee float64 `env:"PAYOUT_VOID_REFUND_FEE" envDefault:"0"`
+		// CashOutFeePercent percent of the cash-out value kept by the house
+		CashOutFeePercent float64 `env:"PAYOUT_CASHOUT_FEE_PERCENT" envDefault:"2"`
+	}
+	Deposit struct {
+		// UnderpayPolicy is "decline" to refund underpaid deal or "pro_rata" to credit received amount
+		UnderpayPolicy string `env:"DEPOSIT_UNDERPAY_POLICY" envDefault:"decline"`
+		// RefundFee in collateral of the transfer, kept from deposit refunds, smaller surpluses are not refunded
+		RefundFee float64 `env:"DEPOSIT_REFUND_FEE" envDefault:"0.01"`
+	}
+	Jetton struct {
+		// List accepted jetton collaterals as "SYMBOL:master:decimals", comma separated
+		List []string `env:"JETTONS" envSeparator:","`
+		// TransferTon in TON, attached to jetton transfers to pay jetton wallet fees, excess returns to the sender
+		TransferTon float64 `env:"JETTON_TRANSFER_TON" envDefault:"0.05"`
+		// ForwardTon in TON, forwarded to the recipient with the transfer notification
+		ForwardTon float64 `env:"JETTON_FORWARD_TON" envDefault:"0.01"`
+	}
+	Treasury struct {
+		// ColdAddress receives excess of the hot bank wallet, sweeps are disabled if empty.
+		// Sweeps are bounceable, the cold wallet must be deployed.
+		ColdAddress string `env:"TREASURY_COLD_ADDR"`
+		// RefillAddresses operator wallets besides cold that top up the hot wallet
+		RefillAddresses []string `env:"TREASURY_REFILL_ADDRS" envSeparator:","`
+		// MinHot in TON, an alert is raised below it, the hot wallet is refilled from cold manually.
+		// Transfers from cold and refill addresses are kept as top-ups, never matched to deals or refunded.
+		MinHot float64 `env:"TREASURY_MIN_HOT" envDefault:"10"`
+		// MaxHot in TON, excess above it is swept to the cold address
+		MaxHot float64 `env:"TREASURY_MAX_HOT" envDefault:"1000"`
+		// MinSweep in TON, smaller excess stays in the hot wallet
+		MinSweep float64 `env:"TREASURY_MIN_SWEEP" envDefault:"1"`
+	}
+	Stake struct {
+		// Min and Max of a single stake in whole units of the event collateral, 0 Max means no limit
+		Min float64 `env:"STAKE_MIN" envDefault:"0.1"`
+		Max float64 `env:"STAKE_MAX" envDefault:"1000"`
+		// MaxUserExposure collateral of a user staked on all outcomes of an event, 0 means no limit
+		MaxUserExposure float64 `env:"STAKE_MAX_USER_EXPOSURE" envDefault:"5000"`
+	}
+	Pricing struct {
+		// LmsrLiquidity default LMSR parameter b of events in whole units of the collateral,
+		// larger b moves prices slower and raises max house loss b * ln(outcomes)
+		LmsrLiquidity float64 `env:"LMSR_LIQUIDITY" envDefault:"100"`
+	}
+	Fee struct {
+		// default policy for events without event or tag policy, see market.FeePolicy
+		Kind    string  `env:"FEE_KIND" envDefault:"flat"`
+		Flat    float64 `env:"FEE_FLAT" envDefault:"0.007"`
+		Percent float64 `env:"FEE_PERCENT" envDefault:"0"`
+		Min     float64 `env:"FEE_MIN" envDefault:"0"`
+	}
 }{}
 
 func LoadConfig() {
 	if err := env.Parse(&Config); err != nil {
 		log.Fatalf("config parsing failed: %v\n", err)
 	}
+	if Config.Network != MainNet && Config.Network != TestNet {
+		log.Fatalf("config parsing failed: unknown network: %s\n", Config.Network)
+	}
+	if err := loadSecrets(); err != nil {
+		log.Fatalf("config parsing failed: %v\n", err)
+	}
 }
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+var ErrSecret = errors.New("secret config invalid")
+
+// loadSecrets resolves secrets set by value or by file, setting both is an error.
+// The keystore is used if the seed is not set directly.
+func loadSecrets() error {
+	s := &Config.Secret
+
+	var err error
+	if s.Seed, err = pickSecret("SEED", s.Seed, s.SeedFile); err != nil {
+		return err
+	}
+	if s.KeystorePassphrase, err = pickSecret("KEYSTORE_PASSPHRASE", s.KeystorePassphrase, s.KeystorePassphraseFile); err != nil {
+		return err
+	}
+	switch {
+	case s.Seed != "" && s.Keystore != "":
+		return fmt.Errorf("%w: both SEED and KEYSTORE_FILE are set", ErrSecret)
+	case s.Keystore != "":
+		if s.Seed, err = DecryptKeystore([]byte(s.Keystore), s.KeystorePassphrase); err != nil {
+			return err
+		}
+	case s.Seed == "":
+		return fmt.Errorf("%w: one of SEED, SEED_FILE or KEYSTORE_FILE is required", ErrSecret)
+	}
+	s.Keystore, s.KeystorePassphrase, s.SeedFile, s.KeystorePassphraseFile = "", "", "", ""
+
+	// keys of the file are separated by commas or new lines
+	if s.AdminKeysFile != "" {
+		if len(s.AdminKeys) > 0 {
+			return fmt.Errorf("%w: both ADMIN_KEYS and ADMIN_KEYS_FILE are set", ErrSecret)
+		}
+		s.AdminKeys = strings.FieldsFunc(s.AdminKeysFile, func(r rune) bool {
+			return r == ',' || r == '\n' || r == '\r'
+		})
+		s.AdminKeysFile = ""
+	}
+	keyList := make([]string, 0, len(s.AdminKeys))
+	for _, key := range s.AdminKeys {
+		if key = strings.TrimSpace(key); key != "" {
+			keyList = append(keyList, key)
+		}
+	}
+	if len(keyList) == 0 {
+		return fmt.Errorf("%w: one of ADMIN_KEYS or ADMIN_KEYS_FILE is required", ErrSecret)
+	}
+	s.AdminKeys = keyList
+
+	if Config.DB.URL, err = pickSecret("DB_URL", Config.DB.URL, Config.DB.URLFile); err != nil {
+		return err
+	}
+	if Config.DB.URL == "" {
+		return fmt.Errorf("%w: one of DB_URL or DB_URL_FILE is required", ErrSecret)
+	}
+	Config.DB.URLFile = ""
+
+	return nil
+}
+
+// pickSecret returns the value or the trimmed file content
+func pickSecret(name, value, fileContent string) (string, error) {
+	if value != "" && fileContent != "" {
+		return "", fmt.Errorf("%w: both %s and %s_FILE are set", ErrSecret, name, name)
+	}
+	if fileContent != "" {
+		return strings.TrimSpace(fileContent), nil
+	}
+	return value, nil
+}
+
+// keystore seed encrypted by AES-256-GCM with the key derived from the passphrase by scrypt
+type keystore struct {
+	Version    int    `json:"version"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       string `json:"salt"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+const (
+	keystoreVersion = 1
+	keystoreN       = 1 << 15
+	keystoreR       = 8
+	keystoreP       = 1
+)
+
+// EncryptKeystore returns keystore file content with the encrypted seed
+func EncryptKeystore(seed, passphrase string) ([]byte, error) {
+	if seed == "" || passphrase == "" {
+		return nil, fmt.Errorf("%w: keystore needs seed and passphrase", ErrSecret)
+	}
+
+	ks := keystore{Version: keystoreVersion, N: keystoreN, R: keystoreR, P: keystoreP}
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := keystoreCipher(passphrase, salt, ks)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	ks.Salt = hex.EncodeToString(salt)
+	ks.Nonce = hex.EncodeToString(nonce)
+	ks.Ciphertext = hex.EncodeToString(gcm.Seal(nil, nonce, []byte(seed), nil))
+	return json.MarshalIndent(ks, "", "  ")
+}
+
+// DecryptKeystore returns the seed of the keystore file content
+func DecryptKeystore(data []byte, passphrase string) (string, error) {
+	if passphrase == "" {
+		return "", fmt.Errorf("%w: KEYSTORE_PASSPHRASE is required to unlock the keystore", ErrSecret)
+	}
+
+	var ks keystore
+	if err := json.Unmarshal(data, &ks); err != nil {
+		return "", fmt.Errorf("%w: keystore: %w", ErrSecret, err)
+	}
+	if ks.Version != keystoreVersion {
+		return "", fmt.Errorf("%w: keystore version: %d is not supported", ErrSecret, ks.Version)
+	}
+	salt, err := hex.DecodeString(ks.Salt)
+	if err != nil {
+		return "", fmt.Errorf("%w: keystore salt: %w", ErrSecret, err)
+	}
+	nonce, err := hex.DecodeString(ks.Nonce)
+	if err != nil {
+		return "", fmt.Errorf("%w: keystore nonce: %w", ErrSecret, err)
+	}
+	ciphertext, err := hex.DecodeString(ks.Ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("%w: keystore ciphertext: %w", ErrSecret, err)
+	}
+
+	gcm, err := keystoreCipher(passphrase, salt, ks)
+	if err != nil {
+		return "", err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return "", fmt.Errorf("%w: keystore nonce size", ErrSecret)
+	}
+	seed, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: keystore can't be unlocked, wrong passphrase or damaged keystore", ErrSecret)
+	}
+	return string(seed), nil
+}
+
+func keystoreCipher(passphrase string, salt []byte, ks keystore) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, ks.N, ks.R, ks.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%w: keystore key: %w", ErrSecret, err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
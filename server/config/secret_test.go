@@ -0,0 +1,148 @@
+package config
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+const testSeed = "abandon ability able about above absent absorb abstract absurd abuse access accident"
+
+func TestKeystoreRoundTrip(t *testing.T) {
+	data, err := EncryptKeystore(testSeed, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed, err := DecryptKeystore(data, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seed != testSeed {
+		t.Fatalf("seed = %q, want %q", seed, testSeed)
+	}
+
+	// salt and nonce are random, the same seed is never encrypted twice the same way
+	other, err := EncryptKeystore(testSeed, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(other) == string(data) {
+		t.Fatal("keystores of the same seed are equal")
+	}
+}
+
+func TestEncryptKeystoreEmpty(t *testing.T) {
+	if _, err := EncryptKeystore("", "passphrase"); !errors.Is(err, ErrSecret) {
+		t.Fatalf("empty seed err = %v, want %v", err, ErrSecret)
+	}
+	if _, err := EncryptKeystore(testSeed, ""); !errors.Is(err, ErrSecret) {
+		t.Fatalf("empty passphrase err = %v, want %v", err, ErrSecret)
+	}
+}
+
+func TestDecryptKeystoreFails(t *testing.T) {
+	data, err := EncryptKeystore(testSeed, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tamper flips the first byte of the hex field
+	tamper := func(field func(ks *keystore) *string) []byte {
+		var ks keystore
+		if err := json.Unmarshal(data, &ks); err != nil {
+			t.Fatal(err)
+		}
+		b, err := hex.DecodeString(*field(&ks))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[0] ^= 0xff
+		*field(&ks) = hex.EncodeToString(b)
+		tampered, err := json.Marshal(ks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tampered
+	}
+
+	var unsupported keystore
+	if err := json.Unmarshal(data, &unsupported); err != nil {
+		t.Fatal(err)
+	}
+	unsupported.Version = keystoreVersion + 1
+	unsupportedData, err := json.Marshal(unsupported)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		data       []byte
+		passphrase string
+	}{
+		{"wrong passphrase", data, "passphrase2"},
+		{"empty passphrase", data, ""},
+		{"tampered ciphertext", tamper(func(ks *keystore) *string { return &ks.Ciphertext }), "passphrase"},
+		{"tampered nonce", tamper(func(ks *keystore) *string { return &ks.Nonce }), "passphrase"},
+		{"tampered salt", tamper(func(ks *keystore) *string { return &ks.Salt }), "passphrase"},
+		{"truncated ciphertext", func() []byte {
+			var ks keystore
+			if err := json.Unmarshal(data, &ks); err != nil {
+				t.Fatal(err)
+			}
+			ks.Ciphertext = ks.Ciphertext[:len(ks.Ciphertext)-2]
+			b, err := json.Marshal(ks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b
+		}(), "passphrase"},
+		{"unsupported version", unsupportedData, "passphrase"},
+		{"not json", []byte("seed"), "passphrase"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seed, err := DecryptKeystore(tt.data, tt.passphrase)
+			if !errors.Is(err, ErrSecret) {
+				t.Fatalf("err = %v, want %v", err, ErrSecret)
+			}
+			if seed != "" {
+				t.Fatalf("seed = %q is returned with error", seed)
+			}
+		})
+	}
+}
+
+func TestLoadSecretsKeystore(t *testing.T) {
+	saved := Config
+	t.Cleanup(func() { Config = saved })
+
+	data, err := EncryptKeystore(testSeed, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Config.Secret.Keystore = string(data)
+	Config.Secret.KeystorePassphraseFile = "passphrase\n"
+	Config.Secret.AdminKeys = []string{"key"}
+	Config.DB.URL = "postgres://localhost/test"
+
+	if err := loadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if Config.Secret.Seed != testSeed {
+		t.Fatalf("seed = %q, want %q", Config.Secret.Seed, testSeed)
+	}
+	if Config.Secret.Keystore != "" || Config.Secret.KeystorePassphrase != "" {
+		t.Fatal("keystore and passphrase are kept after unlock")
+	}
+
+	// seed set directly and keystore are ambiguous
+	Config.Secret.Seed, Config.Secret.Keystore = testSeed, string(data)
+	Config.Secret.KeystorePassphrase = "passphrase"
+	if err := loadSecrets(); !errors.Is(err, ErrSecret) {
+		t.Fatalf("err = %v, want %v", err, ErrSecret)
+	}
+}
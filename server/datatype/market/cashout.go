@@ -0,0 +1,127 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/TON-Market/tma/server/config"
+	"github.com/TON-Market/tma/server/datatype/token"
+	"github.com/google/uuid"
+	"github.com/tonkeeper/tongo/tlb"
+	"log"
+	"time"
+)
+
+var (
+	ErrNoPosition           = errors.New("no position on the outcome")
+	ErrInsufficientPosition = errors.New("position is smaller than the cash-out size")
+	ErrCashOutTooSmall      = errors.New("cash-out value does not cover fee")
+)
+
+type CashOutDTO struct {
+	DealID   uuid.UUID   `json:"dealId"`
+	EventID  uuid.UUID   `json:"eventId"`
+	Token    token.Token `json:"token"`
+	Currency string      `json:"currency"`
+	// Size sold and Collateral taken off the position
+	Size       string `json:"size"`
+	Collateral string `json:"collateral"`
+	// Payout sent to the user, Fee kept from the cash-out value
+	Payout string `json:"payout"`
+	Fee    string `json:"fee"`
+}
+
+// CashOut sells size of the user position before resolution, zero size sells the whole position.
+// Parimutuel stake is withdrawn from the pool, LMSR shares are sold back at the current price.
+// The value minus fee is paid by the payout processor.
+func (m *Market) CashOut(ctx context.Context, addr string, eventID uuid.UUID, t token.Token,
+	size tlb.Grams) (*CashOutDTO, error) {
+	eventCopy, err := m.persistor.getCopyByID(ctx, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("market cash out failed: %w", err)
+	}
+	if err := eventCopy.checkWindow(time.Now()); err != nil {
+		return nil, fmt.Errorf("market cash out failed: %w", err)
+	}
+	es, err := m.runtimer.getEventState(ctx, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("market cash out failed: %w", err)
+	}
+	if !es.isActive {
+		return nil, fmt.Errorf("market cash out failed: %w", ErrEventClosed)
+	}
+	if _, ok := es.betStateMap[t]; !ok {
+		return nil, fmt.Errorf("market cash out failed: %w: %s", ErrUnknownOutcome, t)
+	}
+	c, err := m.currencyOf(eventCopy.Jetton)
+	if err != nil {
+		return nil, fmt.Errorf("market cash out failed: %w", err)
+	}
+
+	asset, err := m.persistor.getAsset(ctx, addr, eventID, t)
+	if err != nil {
+		return nil, fmt.Errorf("market cash out failed: %w", err)
+	}
+	if size == 0 {
+		size = asset.Size
+	}
+	if size > asset.Size {
+		return nil, fmt.Errorf("market cash out failed: %w: %s of %s", ErrInsufficientPosition,
+			c.Format(size), c.Format(asset.Size))
+	}
+
+	// collateral leaves the asset in proportion to the sold size
+	collateral := asset.CollateralStaked
+	if size < asset.Size {
+		collateral = tlb.Grams(float64(asset.CollateralStaked) * float64(size) / float64(asset.Size))
+	}
+
+	deal := &Deal{
+		ID:          uuid.New(),
+		EventID:     eventID,
+		UserRawAddr: addr,
+		Token:       t,
+		Collateral:  collateral,
+		Size:        size,
+		DealStatus:  CashedOut,
+	}
+	var userProfit *UserProfit
+
+	err = m.runtimer.sell(ctx, eventID, t, collateral, size, func(value tlb.Grams) error {
+		fee := tlb.Grams(float64(value) * config.Config.Payout.CashOutFeePercent / 100)
+		if value <= fee {
+			return fmt.Errorf("%w: value: %s %s", ErrCashOutTooSmall, c.Format(value), c.Symbol)
+		}
+		deal.Refunded = value
+		userProfit = &UserProfit{
+			ID:             uuid.New(),
+			Kind:           PayoutCashOut,
+			UserRawAddress: addr,
+			Grams:          value - fee,
+			Jetton:         c.Jetton,
+			Fee:            fee,
+			EventID:        eventID,
+			Comment:        "cash out: " + deal.ID.String(),
+			State:          PayoutPending,
+		}
+		return m.persistor.cashOut(ctx, deal, userProfit)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("market cash out failed: %w", err)
+	}
+
+	log.Printf("[INFO] deal: %s cashed out %s of event: %s, token: %s for %s %s\n\n", deal.ID.String(),
+		c.Format(size), eventID.String(), t, c.Format(deal.Refunded), c.Symbol)
+	m.notifyEvent(ctx, eventID)
+
+	return &CashOutDTO{
+		DealID:     deal.ID,
+		EventID:    eventID,
+		Token:      t,
+		Currency:   c.Symbol,
+		Size:       c.Format(size),
+		Collateral: c.Format(collateral),
+		Payout:     c.Format(userProfit.Grams),
+		Fee:        c.Format(userProfit.Fee),
+	}, nil
+}
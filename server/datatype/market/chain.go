@@ -0,0 +1,330 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tonkeeper/tongo/boc"
+	"github.com/tonkeeper/tongo/liteapi"
+	"github.com/tonkeeper/tongo/tlb"
+	"github.com/tonkeeper/tongo/ton"
+	"github.com/tonkeeper/tongo/wallet"
+	"log"
+	"time"
+)
+
+// Chain is the blockchain gateway of the market, all money flow goes through it
+type Chain interface {
+	// BankAddress returns address of the bank wallet
+	BankAddress() ton.AccountID
+	// Balance returns TON balance of the account, zero if the account does not exist
+	Balance(ctx context.Context, id ton.AccountID) (tlb.Grams, error)
+	// LastTransaction returns lt and hash of the last account transaction, zero lt if there is none
+	LastTransaction(ctx context.Context, id ton.AccountID) (uint64, ton.Bits256, error)
+	// Transactions returns up to count account transactions from lt and hash back in time, newest first
+	Transactions(ctx context.Context, id ton.AccountID, lt uint64, hash ton.Bits256, count int) ([]ChainTx, error)
+	// Send sends up to chainBatchLimit transfers from the bank wallet in one external message.
+	// The batch is returned with the error too if the message was built, it may still be accepted.
+	Send(ctx context.Context, transferList ...ChainTransfer) (ChainBatch, error)
+	// IsProcessed reports whether the bank wallet won't process the batch with the query id anymore,
+	// it has processed the batch or has forgotten the query. It doesn't tell the messages were emitted,
+	// the bank transactions do.
+	IsProcessed(ctx context.Context, queryID uint64) (bool, error)
+	// JettonWallet returns jetton wallet address of the owner
+	JettonWallet(ctx context.Context, master, owner ton.AccountID) (ton.AccountID, error)
+	// JettonBalance returns balance of the jetton wallet in minimal units
+	JettonBalance(ctx context.Context, jettonWallet ton.AccountID) (tlb.Grams, error)
+}
+
+// chainBatchLimit max number of messages in one external message of the highload wallet
+const chainBatchLimit = 254
+
+var ErrBatchTooLarge = errors.New("too many transfers in one batch")
+
+// ChainBatch external message of the bank wallet
+type ChainBatch struct {
+	// QueryID bounded query id of the highload wallet, valid until time in the high 32 bits
+	QueryID    uint64
+	MsgHash    ton.Bits256
+	ValidUntil time.Time
+}
+
+// ChainTx account transaction, only internal messages are kept
+type ChainTx struct {
+	Lt       uint64
+	Hash     ton.Bits256
+	PrevLt   uint64
+	PrevHash ton.Bits256
+	Time     time.Time
+	// In nil if transaction was not started by an internal message
+	In  *ChainMsg
+	Out []ChainMsg
+}
+
+// ChainMsg internal message
+type ChainMsg struct {
+	Src     ton.AccountID
+	Dest    ton.AccountID
+	Amount  tlb.Grams
+	Bounced bool
+	// Comment empty if body is not a text comment
+	Comment string
+	// Body nil if message has no body
+	Body *boc.Cell
+}
+
+// ChainTransfer outgoing transfer of the bank wallet
+type ChainTransfer struct {
+	To      ton.AccountID
+	Amount  tlb.Grams
+	Comment string
+	// Body sent instead of the comment if set
+	Body       *boc.Cell
+	Bounceable bool
+}
+
+// LiteChain Chain on top of liteapi client and bank wallet
+type LiteChain struct {
+	client *liteapi.Client
+	// wallet highload wallet of the bank
+	wallet *wallet.Wallet
+	// lifetime of the external message, expired message is rejected by the wallet
+	lifetime time.Duration
+}
+
+func NewLiteChain(client *liteapi.Client, w *wallet.Wallet, lifetime time.Duration) *LiteChain {
+	return &LiteChain{client, w, lifetime}
+}
+
+func (c *LiteChain) BankAddress() ton.AccountID {
+	return c.wallet.GetAddress()
+}
+
+func (c *LiteChain) Balance(ctx context.Context, id ton.AccountID) (tlb.Grams, error) {
+	state, err := c.client.GetAccountState(ctx, id)
+	if err != nil {
+		return 0, fmt.Errorf("get account: %s state failed: %w", id.ToRaw(), err)
+	}
+	return state.Account.Account.Storage.Balance.Grams, nil
+}
+
+func (c *LiteChain) LastTransaction(ctx context.Context, id ton.AccountID) (uint64, ton.Bits256, error) {
+	state, err := c.client.GetAccountState(ctx, id)
+	if err != nil {
+		return 0, ton.Bits256{}, fmt.Errorf("get account: %s state failed: %w", id.ToRaw(), err)
+	}
+	return state.LastTransLt, ton.Bits256(state.LastTransHash), nil
+}
+
+func (c *LiteChain) Transactions(ctx context.Context, id ton.AccountID, lt uint64, hash ton.Bits256, count int) ([]ChainTx, error) {
+	trxList, err := c.client.GetTransactions(ctx, uint32(count), id, lt, hash)
+	if err != nil {
+		return nil, fmt.Errorf("get account: %s transactions failed: %w", id.ToRaw(), err)
+	}
+
+	txList := make([]ChainTx, 0, len(trxList))
+	for _, trx := range trxList {
+		txList = append(txList, toChainTx(trx))
+	}
+	return txList, nil
+}
+
+// Send signs the highload wallet message itself, the query id is needed to track the batch
+func (c *LiteChain) Send(ctx context.Context, transferList ...ChainTransfer) (ChainBatch, error) {
+	if len(transferList) > chainBatchLimit {
+		return ChainBatch{}, fmt.Errorf("%w: %d", ErrBatchTooLarge, len(transferList))
+	}
+	bank := c.BankAddress()
+
+	state, err := c.client.GetAccountState(ctx, bank)
+	if err != nil {
+		return ChainBatch{}, fmt.Errorf("get bank state failed: %w", err)
+	}
+	var init *tlb.StateInit
+	if status := state.Account.Status(); status == tlb.AccountUninit || status == tlb.AccountNone {
+		if init, err = c.wallet.StateInit(); err != nil {
+			return ChainBatch{}, fmt.Errorf("bank state init failed: %w", err)
+		}
+	}
+
+	validUntil := time.Now().Add(c.lifetime).Truncate(time.Second)
+	body, err := c.wallet.CreateMessageBody(wallet.MessageConfig{ValidUntil: validUntil}, toSendableList(transferList)...)
+	if err != nil {
+		return ChainBatch{}, fmt.Errorf("build bank message failed: %w", err)
+	}
+	queryID, err := highloadQueryID(body)
+	if err != nil {
+		return ChainBatch{}, fmt.Errorf("read bank message query id failed: %w", err)
+	}
+
+	extMsg, err := ton.CreateExternalMessage(bank, body, init, tlb.VarUInteger16{})
+	if err != nil {
+		return ChainBatch{}, fmt.Errorf("build external message failed: %w", err)
+	}
+	cell := boc.NewCell()
+	if err := tlb.Marshal(cell, extMsg); err != nil {
+		return ChainBatch{}, fmt.Errorf("build external message failed: %w", err)
+	}
+	msgHash, err := cell.Hash256()
+	if err != nil {
+		return ChainBatch{}, fmt.Errorf("build external message failed: %w", err)
+	}
+	payload, err := cell.ToBocCustom(false, false, false, 0)
+	if err != nil {
+		return ChainBatch{}, fmt.Errorf("build external message failed: %w", err)
+	}
+
+	batch := ChainBatch{QueryID: queryID, MsgHash: ton.Bits256(msgHash), ValidUntil: validUntil}
+	if _, err := c.client.SendMessage(ctx, payload); err != nil {
+		return batch, fmt.Errorf("send bank message failed: %w", err)
+	}
+	return batch, nil
+}
+
+// IsProcessed calls processed? get method of the highload wallet, -1 means processed.
+// Queries up to last_cleaned are forgotten by the wallet and reported as processed too,
+// whether they were processed or expired.
+func (c *LiteChain) IsProcessed(ctx context.Context, queryID uint64) (bool, error) {
+	params := tlb.VmStack{{SumType: "VmStkTinyInt", VmStkTinyInt: int64(queryID)}}
+	exitCode, stack, err := c.client.RunSmcMethod(ctx, c.BankAddress(), "processed?", params)
+	if err != nil {
+		return false, fmt.Errorf("get query: %d state failed: %w", queryID, err)
+	}
+	if exitCode != 0 && exitCode != 1 {
+		return false, fmt.Errorf("get query: %d state failed: exit code %d", queryID, exitCode)
+	}
+	if len(stack) != 1 || stack[0].SumType != "VmStkTinyInt" {
+		return false, fmt.Errorf("get query: %d state failed: unexpected result", queryID)
+	}
+	return stack[0].VmStkTinyInt == -1, nil
+}
+
+func toSendableList(transferList []ChainTransfer) []wallet.Sendable {
+	messageList := make([]wallet.Sendable, 0, len(transferList))
+	for _, t := range transferList {
+		if t.Body != nil {
+			messageList = append(messageList, wallet.Message{
+				Amount:  t.Amount,
+				Address: t.To,
+				Body:    t.Body,
+				Bounce:  t.Bounceable,
+				Mode:    wallet.DefaultMessageMode,
+			})
+			continue
+		}
+		messageList = append(messageList, wallet.SimpleTransfer{
+			Amount:     t.Amount,
+			Address:    t.To,
+			Comment:    t.Comment,
+			Bounceable: t.Bounceable,
+		})
+	}
+	return messageList
+}
+
+// highloadQueryID reads bounded query id of the signed highload wallet message body
+func highloadQueryID(body *boc.Cell) (uint64, error) {
+	defer body.ResetCounters()
+
+	var signed wallet.SignedMsgBody
+	if err := tlb.Unmarshal(body, &signed); err != nil {
+		return 0, err
+	}
+	payload := boc.Cell(signed.Message)
+	var msg wallet.HighloadV2Message
+	if err := tlb.Unmarshal(&payload, &msg); err != nil {
+		return 0, err
+	}
+	return msg.BoundedQueryID, nil
+}
+
+func (c *LiteChain) JettonWallet(ctx context.Context, master, owner ton.AccountID) (ton.AccountID, error) {
+	id, err := c.client.GetJettonWallet(ctx, master, owner)
+	if err != nil {
+		return ton.AccountID{}, fmt.Errorf("get jetton: %s wallet of: %s failed: %w", master.ToRaw(), owner.ToRaw(), err)
+	}
+	return id, nil
+}
+
+func (c *LiteChain) JettonBalance(ctx context.Context, jettonWallet ton.AccountID) (tlb.Grams, error) {
+	balance, err := c.client.GetJettonBalance(ctx, jettonWallet)
+	if err != nil {
+		return 0, fmt.Errorf("get jetton wallet: %s balance failed: %w", jettonWallet.ToRaw(), err)
+	}
+	if !balance.IsUint64() {
+		return 0, fmt.Errorf("get jetton wallet: %s balance failed: %s out of range", jettonWallet.ToRaw(), balance)
+	}
+	return tlb.Grams(balance.Uint64()), nil
+}
+
+func toChainTx(trx ton.Transaction) ChainTx {
+	hash := trx.Hash()
+	tx := ChainTx{
+		Lt:       trx.Lt,
+		Hash:     ton.Bits256(hash),
+		PrevLt:   trx.PrevTransLt,
+		PrevHash: ton.Bits256(trx.PrevTransHash),
+		Time:     time.Unix(int64(trx.Now), 0),
+	}
+
+	if trx.Msgs.InMsg.Exists {
+		if msg, ok := toChainMsg(trx.Msgs.InMsg.Value.Value); ok {
+			tx.In = &msg
+		}
+	}
+	for _, out := range trx.Msgs.OutMsgs.Values() {
+		if msg, ok := toChainMsg(out.Value); ok {
+			tx.Out = append(tx.Out, msg)
+		}
+	}
+	return tx
+}
+
+// toChainMsg converts internal message, external messages and messages with external addresses are skipped
+func toChainMsg(m tlb.Message) (msg ChainMsg, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("[ALARM] Recovered in toChainMsg", r)
+			msg, ok = ChainMsg{}, false
+		}
+	}()
+
+	if m.Info.SumType != "IntMsgInfo" {
+		return ChainMsg{}, false
+	}
+	info := m.Info.IntMsgInfo
+
+	src, err := ton.AccountIDFromTlb(info.Src)
+	if err != nil || src == nil {
+		return ChainMsg{}, false
+	}
+	dest, err := ton.AccountIDFromTlb(info.Dest)
+	if err != nil || dest == nil {
+		return ChainMsg{}, false
+	}
+
+	msg = ChainMsg{
+		Src:     *src,
+		Dest:    *dest,
+		Amount:  info.Value.Grams,
+		Bounced: info.Bounced,
+	}
+
+	body := boc.Cell(m.Body.Value)
+	if body.BitsAvailableForRead() > 0 || body.RefsAvailableForRead() > 0 {
+		msg.Body = &body
+		msg.Comment = decodeComment(msg.Body)
+	}
+	return msg, true
+}
+
+// decodeComment returns text comment of the body, empty if body is not a comment
+func decodeComment(body *boc.Cell) string {
+	defer body.ResetCounters()
+
+	var comment wallet.TextComment
+	if err := tlb.Unmarshal(body, &comment); err != nil {
+		return ""
+	}
+	return string(comment)
+}
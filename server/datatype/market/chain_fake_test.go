@@ -0,0 +1,397 @@
+package market
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/tonkeeper/tongo/boc"
+	"github.com/tonkeeper/tongo/tlb"
+	"github.com/tonkeeper/tongo/ton"
+	"github.com/tonkeeper/tongo/wallet"
+	"math/big"
+	"sync"
+	"time"
+)
+
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+type fakeAccount struct {
+	balance tlb.Grams
+	// txList oldest first
+	txList []ChainTx
+}
+
+type fakeJettonWallet struct {
+	master  ton.AccountID
+	owner   ton.AccountID
+	balance tlb.Grams
+}
+
+// FakeChain deterministic in-memory Chain, transfers are applied instantly,
+// lt and hashes depend only on the order of calls, transactions are timed by the wall clock like the db rows.
+// Jetton wallets are not accounts, a jetton transfer is seen by the recipient as the notification only.
+type FakeChain struct {
+	sync.Mutex
+	bank            ton.AccountID
+	lt              uint64
+	batchSeq        uint32
+	processedMap    map[uint64]bool
+	accountMap      map[ton.AccountID]*fakeAccount
+	jettonWalletMap map[ton.AccountID]*fakeJettonWallet
+	// bouncingMap accounts bouncing bounceable TON transfers
+	bouncingMap map[ton.AccountID]bool
+	// skippedMap recipients of the bank transfers skipped in the action phase
+	skippedMap map[ton.AccountID]bool
+}
+
+func NewFakeChain(bank ton.AccountID) *FakeChain {
+	return &FakeChain{
+		bank:            bank,
+		processedMap:    make(map[uint64]bool),
+		accountMap:      make(map[ton.AccountID]*fakeAccount),
+		jettonWalletMap: make(map[ton.AccountID]*fakeJettonWallet),
+		bouncingMap:     make(map[ton.AccountID]bool),
+		skippedMap:      make(map[ton.AccountID]bool),
+	}
+}
+
+// SetBouncing makes the account bounce bounceable TON transfers back to the sender
+func (c *FakeChain) SetBouncing(id ton.AccountID) {
+	c.Lock()
+	defer c.Unlock()
+	c.bouncingMap[id] = true
+}
+
+// SetSkipped makes the bank skip transfers to the account in the action phase, like ones it can't pay for
+func (c *FakeChain) SetSkipped(id ton.AccountID) {
+	c.Lock()
+	defer c.Unlock()
+	c.skippedMap[id] = true
+}
+
+// Fund credits the account without a transaction
+func (c *FakeChain) Fund(id ton.AccountID, amount tlb.Grams) {
+	c.Lock()
+	defer c.Unlock()
+	c.account(id).balance += amount
+}
+
+func (c *FakeChain) Balance(_ context.Context, id ton.AccountID) (tlb.Grams, error) {
+	c.Lock()
+	defer c.Unlock()
+	return c.account(id).balance, nil
+}
+
+// Transfer sends text comment transfer, like a user paying the bank from a wallet app
+func (c *FakeChain) Transfer(from, to ton.AccountID, amount tlb.Grams, comment string) (ChainTx, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.account(from).balance < amount {
+		return ChainTx{}, fmt.Errorf("%w: %s", ErrInsufficientFunds, from.ToRaw())
+	}
+	return c.transfer(from, to, amount, comment), nil
+}
+
+// MintJetton credits jetton wallet of the owner without a transaction
+func (c *FakeChain) MintJetton(master, owner ton.AccountID, amount tlb.Grams) {
+	c.Lock()
+	defer c.Unlock()
+	c.jettonWallet(master, owner).balance += amount
+}
+
+// JettonBalance returns zero for an unknown jetton wallet
+func (c *FakeChain) JettonBalance(_ context.Context, jettonWallet ton.AccountID) (tlb.Grams, error) {
+	c.Lock()
+	defer c.Unlock()
+	w, ok := c.jettonWalletMap[jettonWallet]
+	if !ok {
+		return 0, nil
+	}
+	return w.balance, nil
+}
+
+// TransferJetton sends jettons with forwarded text comment, like a user paying the bank from a wallet app
+func (c *FakeChain) TransferJetton(from, master, to ton.AccountID, amount tlb.Grams, comment string) (ChainTx, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.jettonWallet(master, from).balance < amount {
+		return ChainTx{}, fmt.Errorf("%w: %s jettons", ErrInsufficientFunds, from.ToRaw())
+	}
+	return c.transferJetton(from, master, to, amount, comment)
+}
+
+func (c *FakeChain) BankAddress() ton.AccountID {
+	return c.bank
+}
+
+func (c *FakeChain) LastTransaction(_ context.Context, id ton.AccountID) (uint64, ton.Bits256, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	a, ok := c.accountMap[id]
+	if !ok || len(a.txList) == 0 {
+		return 0, ton.Bits256{}, nil
+	}
+	last := a.txList[len(a.txList)-1]
+	return last.Lt, last.Hash, nil
+}
+
+func (c *FakeChain) Transactions(_ context.Context, id ton.AccountID, lt uint64, hash ton.Bits256, count int) ([]ChainTx, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	a, ok := c.accountMap[id]
+	if !ok {
+		return nil, nil
+	}
+
+	txList := make([]ChainTx, 0, count)
+	for i := len(a.txList) - 1; i >= 0 && len(txList) < count; i-- {
+		tx := a.txList[i]
+		if len(txList) == 0 && (tx.Lt != lt || tx.Hash != hash) {
+			continue
+		}
+		txList = append(txList, tx)
+	}
+	return txList, nil
+}
+
+// Send applies all transfers from the bank or none of them if the bank balance is insufficient,
+// a transfer with jetton transfer body to the bank jetton wallet sends jettons.
+// The batch is processed instantly in one bank transaction emitting every not skipped transfer,
+// it expires a minute after the bank transaction.
+func (c *FakeChain) Send(_ context.Context, transferList ...ChainTransfer) (ChainBatch, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(transferList) > chainBatchLimit {
+		return ChainBatch{}, fmt.Errorf("%w: %d", ErrBatchTooLarge, len(transferList))
+	}
+
+	var total tlb.Grams
+	jettonTotalMap := make(map[ton.AccountID]tlb.Grams)
+	for _, t := range transferList {
+		total += t.Amount
+		if w, jt, ok := c.parseBankJettonTransfer(t); ok {
+			jettonTotalMap[w.master] += jt.Amount
+		}
+	}
+	if c.account(c.bank).balance < total {
+		return ChainBatch{}, fmt.Errorf("%w: bank needs %v", ErrInsufficientFunds, total)
+	}
+	for master, jettonTotal := range jettonTotalMap {
+		if c.jettonWallet(master, c.bank).balance < jettonTotal {
+			return ChainBatch{}, fmt.Errorf("%w: bank needs %v jettons", ErrInsufficientFunds, jettonTotal)
+		}
+	}
+
+	sendList := make([]ChainTransfer, 0, len(transferList))
+	outList := make([]ChainMsg, 0, len(transferList))
+	// attached TON of jetton transfers is spent by jetton wallets
+	bank := c.account(c.bank)
+	for _, t := range transferList {
+		if c.skippedMap[t.To] {
+			continue
+		}
+		sendList = append(sendList, t)
+		outList = append(outList, ChainMsg{Src: c.bank, Dest: t.To, Amount: t.Amount, Comment: t.Comment, Body: t.Body})
+		bank.balance -= t.Amount
+	}
+	bankTx := c.appendTx(c.bank, bank, nil, outList)
+
+	h := sha256.New()
+	h.Write(bankTx.Hash[:])
+	for i, t := range sendList {
+		w, jt, ok := c.parseBankJettonTransfer(t)
+		if !ok {
+			recipient := c.account(t.To)
+			c.appendTx(t.To, recipient, &outList[i], nil)
+			if t.Bounceable && c.bouncingMap[t.To] {
+				if err := c.bounce(t); err != nil {
+					return ChainBatch{}, err
+				}
+				continue
+			}
+			recipient.balance += t.Amount
+			continue
+		}
+		if _, err := c.transferJetton(c.bank, w.master, jt.Peer, jt.Amount, jt.Comment); err != nil {
+			return ChainBatch{}, err
+		}
+	}
+
+	c.batchSeq++
+	validUntil := bankTx.Time.Add(time.Minute)
+	batch := ChainBatch{
+		QueryID:    uint64(validUntil.Unix())<<32 + uint64(c.batchSeq),
+		ValidUntil: validUntil,
+	}
+	copy(batch.MsgHash[:], h.Sum(nil))
+	c.processedMap[batch.QueryID] = true
+	return batch, nil
+}
+
+// bounce returns the transfer to the bank, the bounced body carries the start of the transfer body
+func (c *FakeChain) bounce(t ChainTransfer) error {
+	body, err := transferBody(t)
+	if err != nil {
+		return err
+	}
+	defer body.ResetCounters()
+
+	bounced := boc.NewCell()
+	if err := bounced.WriteUint(bouncedPrefix, 32); err != nil {
+		return err
+	}
+	for range min(body.BitsAvailableForRead(), 256) {
+		bit, err := body.ReadBit()
+		if err != nil {
+			return err
+		}
+		if err := bounced.WriteBit(bit); err != nil {
+			return err
+		}
+	}
+
+	bank := c.account(c.bank)
+	bank.balance += t.Amount
+	c.appendTx(c.bank, bank, &ChainMsg{Src: t.To, Dest: c.bank, Amount: t.Amount, Bounced: true, Body: bounced}, nil)
+	return nil
+}
+
+func (c *FakeChain) IsProcessed(_ context.Context, queryID uint64) (bool, error) {
+	c.Lock()
+	defer c.Unlock()
+	return c.processedMap[queryID], nil
+}
+
+func (c *FakeChain) JettonWallet(_ context.Context, master, owner ton.AccountID) (ton.AccountID, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.jettonWallet(master, owner)
+	return c.jettonWalletAddress(master, owner), nil
+}
+
+func (c *FakeChain) jettonWalletAddress(master, owner ton.AccountID) ton.AccountID {
+	h := sha256.New()
+	h.Write(master.Address[:])
+	h.Write(owner.Address[:])
+
+	id := ton.AccountID{Workchain: owner.Workchain}
+	copy(id.Address[:], h.Sum(nil))
+	return id
+}
+
+func (c *FakeChain) jettonWallet(master, owner ton.AccountID) *fakeJettonWallet {
+	id := c.jettonWalletAddress(master, owner)
+	w, ok := c.jettonWalletMap[id]
+	if !ok {
+		w = &fakeJettonWallet{master: master, owner: owner}
+		c.jettonWalletMap[id] = w
+	}
+	return w
+}
+
+// parseBankJettonTransfer returns bank jetton wallet and decoded transfer if t sends jettons
+func (c *FakeChain) parseBankJettonTransfer(t ChainTransfer) (*fakeJettonWallet, *jettonTransfer, bool) {
+	w, ok := c.jettonWalletMap[t.To]
+	if !ok || w.owner != c.bank {
+		return nil, nil, false
+	}
+	jt, ok := parseJettonTransfer(t.Body)
+	if !ok {
+		return nil, nil, false
+	}
+	return w, jt, true
+}
+
+// transferJetton moves jettons and records the notification transaction of the recipient
+func (c *FakeChain) transferJetton(from, master, to ton.AccountID, amount tlb.Grams, comment string) (ChainTx, error) {
+	body, err := buildJettonNotify(amount, from, comment)
+	if err != nil {
+		return ChainTx{}, err
+	}
+
+	c.jettonWallet(master, from).balance -= amount
+	c.jettonWallet(master, to).balance += amount
+
+	msg := ChainMsg{
+		Src:  c.jettonWalletAddress(master, to),
+		Dest: to,
+		Body: body,
+	}
+	return c.appendTx(to, c.account(to), &msg, nil), nil
+}
+
+func buildJettonNotify(amount tlb.Grams, sender ton.AccountID, comment string) (*boc.Cell, error) {
+	payload := boc.NewCell()
+	if err := tlb.Marshal(payload, wallet.TextComment(comment)); err != nil {
+		return nil, err
+	}
+
+	body := jettonNotifyBody{
+		Amount:         tlb.VarUInteger16(*new(big.Int).SetUint64(uint64(amount))),
+		Sender:         sender.ToMsgAddress(),
+		ForwardPayload: tlb.EitherRef[tlb.Any]{IsRight: true, Value: tlb.Any(*payload)},
+	}
+
+	cell := boc.NewCell()
+	if err := tlb.Marshal(cell, body); err != nil {
+		return nil, err
+	}
+	return cell, nil
+}
+
+func (c *FakeChain) account(id ton.AccountID) *fakeAccount {
+	a, ok := c.accountMap[id]
+	if !ok {
+		a = &fakeAccount{}
+		c.accountMap[id] = a
+	}
+	return a
+}
+
+// transfer records outgoing transaction of the sender and incoming transaction of the recipient
+func (c *FakeChain) transfer(from, to ton.AccountID, amount tlb.Grams, comment string) ChainTx {
+	msg := ChainMsg{
+		Src:     from,
+		Dest:    to,
+		Amount:  amount,
+		Comment: comment,
+	}
+
+	sender := c.account(from)
+	sender.balance -= amount
+	c.appendTx(from, sender, nil, []ChainMsg{msg})
+
+	recipient := c.account(to)
+	recipient.balance += amount
+	return c.appendTx(to, recipient, &msg, nil)
+}
+
+func (c *FakeChain) appendTx(id ton.AccountID, a *fakeAccount, in *ChainMsg, out []ChainMsg) ChainTx {
+	c.lt++
+	tx := ChainTx{
+		Lt:   c.lt,
+		Time: time.Now(),
+		In:   in,
+		Out:  out,
+	}
+	if len(a.txList) > 0 {
+		prev := a.txList[len(a.txList)-1]
+		tx.PrevLt, tx.PrevHash = prev.Lt, prev.Hash
+	}
+
+	h := sha256.New()
+	h.Write(id.Address[:])
+	h.Write(binary.BigEndian.AppendUint64(nil, tx.Lt))
+	h.Write(tx.PrevHash[:])
+	copy(tx.Hash[:], h.Sum(nil))
+
+	a.txList = append(a.txList, tx)
+	return tx
+}
@@ -0,0 +1,111 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/TON-Market/tma/server/datatype/token"
+	"github.com/google/uuid"
+	"github.com/tonkeeper/tongo/tlb"
+	"log"
+	"time"
+)
+
+const consistencyCheckPeriod = time.Minute
+
+// restoreRuntime rebuilds runtime pool totals from verified stakes
+func (m *Market) restoreRuntime(ctx context.Context) error {
+	totals, err := m.persistor.getStakedTotals(ctx)
+	if err != nil {
+		return fmt.Errorf("market restore runtime failed: %w", err)
+	}
+
+	for eventID, tokenTotals := range totals {
+		err := m.runtimer.restore(ctx, eventID, tokenTotals)
+		if errors.Is(err, ErrRuntimeEventNotExist) {
+			log.Printf("[WARNING] assets of unknown event: %s skipped\n\n", eventID.String())
+			continue
+		}
+		if errors.Is(err, ErrUnknownOutcome) {
+			log.Printf("[ALARM] assets of event: %s not restored: %s\n\n", eventID.String(), err.Error())
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("market restore runtime failed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+type drift struct {
+	eventID uuid.UUID
+	token   token.Token
+	runtime tlb.Grams
+	db      tlb.Grams
+}
+
+// findDrift compares in-memory pool totals with the db. Runtime state is read
+// before and after the db query, outcomes changed in between are skipped.
+func (m *Market) findDrift(ctx context.Context) ([]*drift, error) {
+	before := m.runtimer.snapshot(ctx)
+
+	totals, err := m.persistor.getStakedTotals(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("find drift failed: %w", err)
+	}
+
+	after := m.runtimer.snapshot(ctx)
+
+	driftList := make([]*drift, 0)
+
+	for eventID, state := range after {
+		prev, ok := before[eventID]
+		if !ok {
+			continue
+		}
+		for t, bs := range state.betStateMap {
+			prevBs, ok := prev.betStateMap[t]
+			if !ok || prevBs.collateral != bs.collateral {
+				continue
+			}
+			dbGrams := totals[eventID][t].collateral
+			if dbGrams != bs.collateral {
+				driftList = append(driftList, &drift{eventID, t, bs.collateral, dbGrams})
+			}
+		}
+		// assets of an outcome the event no longer has are never in the runtime
+		for t, total := range totals[eventID] {
+			if _, ok := state.betStateMap[t]; !ok {
+				driftList = append(driftList, &drift{eventID, t, 0, total.collateral})
+			}
+		}
+	}
+
+	for eventID := range totals {
+		if _, ok := after[eventID]; !ok {
+			log.Printf("[WARNING] assets of unknown event: %s\n\n", eventID.String())
+		}
+	}
+
+	return driftList, nil
+}
+
+func (m *Market) startConsistencyCheck(ctx context.Context) {
+	ticker := time.NewTicker(consistencyCheckPeriod)
+
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			driftList, err := m.findDrift(ctx)
+			if err != nil {
+				log.Printf("[ERROR] consistency check failed: %s\n\n", err.Error())
+				continue
+			}
+			for _, d := range driftList {
+				log.Printf("[ALARM] runtime drift event: %s, token: %s, runtime: %v, db: %v\n\n",
+					d.eventID.String(), d.token, d.runtime, d.db)
+			}
+		}
+	}()
+}
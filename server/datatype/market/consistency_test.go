@@ -0,0 +1,32 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"github.com/TON-Market/tma/server/datatype/token"
+	"github.com/tonkeeper/tongo/tlb"
+	"testing"
+)
+
+// TestRestoreUnknownOutcome restores known outcomes of the event with assets of a removed outcome
+func TestRestoreUnknownOutcome(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMarket(t, nil, nil)
+	e := addTestEvent(t, m)
+
+	totals := map[token.Token]stakeTotal{
+		token.A:  {collateral: 10e9, size: 10e9},
+		"TokenC": {collateral: 5e9, size: 5e9},
+	}
+	if err := m.runtimer.restore(ctx, e.ID, totals); !errors.Is(err, ErrUnknownOutcome) {
+		t.Fatalf("err = %v, want %v", err, ErrUnknownOutcome)
+	}
+
+	es, err := m.runtimer.getEventState(ctx, e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := es.betStateMap[token.A].collateral; got != 10e9 {
+		t.Fatalf("restored collateral of %s = %d, want %d", token.A, got, tlb.Grams(10e9))
+	}
+}
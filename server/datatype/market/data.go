@@ -2,19 +2,17 @@ package market
 
 import (
 	"errors"
+	"fmt"
 	"github.com/TON-Market/tma/server/datatype/token"
 	"github.com/google/uuid"
 	"github.com/tonkeeper/tongo/tlb"
+	"slices"
 	"sync"
+	"time"
 )
 
 type DepositStatus int
 
-const (
-	BANK_ADDR = "EQBRW9rjhRUNL-Sy4swYbMzm2MgvlhC2DWIZFhYp2JnSoJaA"
-	SEED      = "example consider fiscal mail guitar tiger duck exhibit ancient series differ wealth mix kitchen cactus upgrade unable yellow impact confirm denial mesh during dove"
-)
-
 const (
 	OK DepositStatus = iota
 	ERROR
@@ -36,6 +34,7 @@ type AssetDTO struct {
 	BetTitle         string `json:"betTitle"`
 	CollateralStaked string `json:"collateralStaked"`
 	Size             string `json:"size"`
+	Currency         string `json:"currency"`
 }
 
 type Asset struct {
@@ -54,11 +53,22 @@ type BetDTO struct {
 }
 
 type EventDTO struct {
-	ID              uuid.UUID `json:"id"`
-	Tag             Tag       `json:"tag"`
-	LogoLink        string    `json:"logoLink"`
-	Title           string    `json:"title"`
-	Collateral      string    `json:"collateral"`
+	ID         uuid.UUID   `json:"id"`
+	Tag        Tag         `json:"tag"`
+	Status     EventStatus `json:"status"`
+	IsActive   bool        `json:"isActive"`
+	OpensAt    *time.Time  `json:"opensAt,omitempty"`
+	LocksAt    *time.Time  `json:"locksAt,omitempty"`
+	ResolvesAt *time.Time  `json:"resolvesAt,omitempty"`
+	LogoLink   string      `json:"logoLink"`
+	Title      string      `json:"title"`
+	Collateral string      `json:"collateral"`
+	Currency   string      `json:"currency"`
+	Jetton     string      `json:"jetton,omitempty"`
+	// Pricing is set for LMSR event, bet percentage is then the outcome share price,
+	// OutcomeCap max collateral of each outcome pool, empty if pools are not capped
+	Pricing         *PricingSpec `json:"pricing,omitempty"`
+	OutcomeCap      string       `json:"outcomeCap,omitempty"`
 	CollateralGrams tlb.Grams
 	Bets            []*BetDTO `json:"bets"`
 }
@@ -69,6 +79,22 @@ const (
 	Unchecked DealStatus = iota
 	Verified
 	Declined
+	// CashedOut exit of the position before resolution, Collateral and Size are taken off the asset
+	CashedOut
+)
+
+type DepositOutcome int
+
+const (
+	DepositAwaiting DepositOutcome = iota
+	DepositExact
+	DepositOverpaid
+	DepositProRata
+	DepositUnderpaidDeclined
+	// DepositOrphaned transfer came after the event closed and is refunded by reconciliation
+	DepositOrphaned
+	// DepositLimitDeclined stake broke limits at confirmation, the transfer is refunded
+	DepositLimitDeclined
 )
 
 // Deal persist user deal
@@ -81,6 +107,11 @@ type Deal struct {
 	Size       tlb.Grams
 	DealStatus DealStatus
 	Attempts   int
+	// Received and Refunded are amounts of the bank transfer paying the deal,
+	// Refunded of CashedOut deal is the cash-out value before fee
+	Received       tlb.Grams
+	Refunded       tlb.Grams
+	DepositOutcome DepositOutcome
 }
 
 // Bet persist data
@@ -91,18 +122,255 @@ type Bet struct {
 	LogoLink string
 }
 
+type EventStatus int
+
+const (
+	EventActive EventStatus = iota
+	EventSuspended
+	EventResolved
+	EventVoided
+	// EventResolving close with the WinToken is in progress, payouts are not saved yet
+	EventResolving
+	// EventVoiding void is in progress, refunds are not saved yet
+	EventVoiding
+)
+
 // Event persist data
 type Event struct {
 	ID       uuid.UUID
 	Tag      Tag
 	LogoLink string
 	Title    string
+	Status   EventStatus
 	BetMap   map[token.Token]*Bet
+	// WinToken outcome the event is resolving or resolved to, empty otherwise
+	WinToken token.Token
+	// OpensAt, LocksAt and ResolvesAt are optional, zero value means not set
+	OpensAt    time.Time
+	LocksAt    time.Time
+	ResolvesAt time.Time
+	// Resolver optional oracle settling the event at ResolvesAt
+	Resolver *ResolverSpec
+	// FeePolicy optional, tag or default policy is used when not set
+	FeePolicy *FeePolicy
+	// Jetton master raw address of the collateral, empty for TON, can't be changed after creation
+	Jetton string
+	// Pricing optional, nil means parimutuel, can't be changed after creation
+	Pricing *PricingSpec
+	// OutcomeCap max collateral staked on each outcome in whole units of the collateral, 0 means no cap
+	OutcomeCap float64
+}
+
+// EventPatch event fields editable after creation, nil fields stay unchanged
+type EventPatch struct {
+	Tag      *Tag
+	LogoLink *string
+	Title    *string
+	BetMap   map[token.Token]*BetPatch
+	// OpensAt, LocksAt and ResolvesAt set to zero time are unset
+	OpensAt    *time.Time
+	LocksAt    *time.Time
+	ResolvesAt *time.Time
+	// Resolver with empty kind unbinds the resolver
+	Resolver *ResolverSpec
+	// FeePolicy with empty kind unbinds the policy
+	FeePolicy *FeePolicy
+	// OutcomeCap set to 0 removes the cap, pools above a lowered cap only stop taking stakes
+	OutcomeCap *float64
+}
+
+// BetPatch bet fields editable after creation, nil fields stay unchanged
+type BetPatch struct {
+	Title    *string
+	LogoLink *string
+}
+
+const (
+	MinOutcomes = 2
+	// MaxOutcomes can't exceed token.MaxCount, outcome tokens are indexed by letter
+	MaxOutcomes = 20
+)
+
+var (
+	ErrInvalidOutcomes = errors.New("invalid event outcomes")
+	ErrUnknownOutcome  = errors.New("unknown event outcome")
+)
+
+// Tokens returns event outcome tokens in stable order
+func (e *Event) Tokens() []token.Token {
+	tokens := make([]token.Token, 0, len(e.BetMap))
+	for t := range e.BetMap {
+		tokens = append(tokens, t)
+	}
+	slices.Sort(tokens)
+	return tokens
+}
+
+func (e *Event) validateOutcomes() error {
+	if len(e.BetMap) < MinOutcomes || len(e.BetMap) > MaxOutcomes {
+		return fmt.Errorf("%w: expected from %d to %d outcomes, got %d",
+			ErrInvalidOutcomes, MinOutcomes, MaxOutcomes, len(e.BetMap))
+	}
+	for t, b := range e.BetMap {
+		if t == "" || b == nil {
+			return fmt.Errorf("%w: empty outcome", ErrInvalidOutcomes)
+		}
+		if b.Token != "" && b.Token != t {
+			return fmt.Errorf("%w: outcome key %s mismatch bet token %s", ErrInvalidOutcomes, t, b.Token)
+		}
+	}
+	return nil
+}
+
+var (
+	ErrEventNotActive    = errors.New("event is not active")
+	ErrEventNotSuspended = errors.New("event is not suspended")
+	ErrEventFinished     = errors.New("event is already resolved or voided")
+	ErrEventClosing      = errors.New("event is being resolved or voided")
+)
+
+var (
+	ErrInvalidSchedule = errors.New("invalid event schedule")
+	ErrBettingNotOpen  = errors.New("betting is not open yet")
+	ErrBettingLocked   = errors.New("betting is locked")
+)
+
+func (e *Event) validateSchedule() error {
+	if !e.OpensAt.IsZero() && !e.LocksAt.IsZero() && !e.LocksAt.After(e.OpensAt) {
+		return fmt.Errorf("%w: locks at must be after opens at", ErrInvalidSchedule)
+	}
+	if !e.LocksAt.IsZero() && !e.ResolvesAt.IsZero() && e.ResolvesAt.Before(e.LocksAt) {
+		return fmt.Errorf("%w: resolves at must not be before locks at", ErrInvalidSchedule)
+	}
+	return nil
+}
+
+// checkWindow reports why betting is closed at t by the schedule, nil if it is open.
+// Event without locks at is locked at resolves at, the result may be known after it.
+func (e *Event) checkWindow(t time.Time) error {
+	if !e.OpensAt.IsZero() && t.Before(e.OpensAt) {
+		return ErrBettingNotOpen
+	}
+	locksAt := e.LocksAt
+	if locksAt.IsZero() {
+		locksAt = e.ResolvesAt
+	}
+	if !locksAt.IsZero() && !t.Before(locksAt) {
+		return ErrBettingLocked
+	}
+	return nil
+}
+
+// isBettingOpen reports whether the event accepts bets at t
+func (e *Event) isBettingOpen(t time.Time) bool {
+	return e.Status == EventActive && e.checkWindow(t) == nil
+}
+
+func (e *Event) isFinished() bool {
+	return e.Status == EventResolved || e.Status == EventVoided
+}
+
+func (e *Event) isClosing() bool {
+	return e.Status == EventResolving || e.Status == EventVoiding
+}
+
+// checkClose checks that the event can move to closing status with the win token, empty for void.
+// Interrupted close can be repeated only with the same status and win token.
+func (e *Event) checkClose(status EventStatus, winToken token.Token) error {
+	switch {
+	case e.isFinished():
+		return ErrEventFinished
+	case e.isClosing() && (e.Status != status || e.WinToken != winToken):
+		return fmt.Errorf("%w: status: %d, win token: %s", ErrEventClosing, e.Status, e.WinToken)
+	default:
+		return nil
+	}
+}
+
+// apply returns patched deep copy of the event
+func (e *Event) apply(patch *EventPatch) (*Event, error) {
+	patched := *e
+	patched.BetMap = make(map[token.Token]*Bet, len(e.BetMap))
+	for t, b := range e.BetMap {
+		bet := *b
+		patched.BetMap[t] = &bet
+	}
+
+	if patch.Tag != nil {
+		patched.Tag = *patch.Tag
+	}
+	if patch.LogoLink != nil {
+		patched.LogoLink = *patch.LogoLink
+	}
+	if patch.Title != nil {
+		patched.Title = *patch.Title
+	}
+	if patch.OpensAt != nil {
+		patched.OpensAt = *patch.OpensAt
+	}
+	if patch.LocksAt != nil {
+		patched.LocksAt = *patch.LocksAt
+	}
+	if patch.ResolvesAt != nil {
+		patched.ResolvesAt = *patch.ResolvesAt
+	}
+	if patch.Resolver != nil {
+		patched.Resolver = patch.Resolver
+		if patch.Resolver.Kind == "" {
+			patched.Resolver = nil
+		}
+	}
+	if patch.FeePolicy != nil {
+		patched.FeePolicy = patch.FeePolicy
+		if patch.FeePolicy.Kind == "" {
+			patched.FeePolicy = nil
+		}
+	}
+	if patch.OutcomeCap != nil {
+		patched.OutcomeCap = *patch.OutcomeCap
+	}
+	if err := patched.validateSchedule(); err != nil {
+		return nil, err
+	}
+	if err := patched.validateResolver(); err != nil {
+		return nil, err
+	}
+	if err := patched.validateOutcomeCap(); err != nil {
+		return nil, err
+	}
+	if patched.FeePolicy != nil {
+		if err := patched.FeePolicy.validate(); err != nil {
+			return nil, err
+		}
+	}
+	for t, bp := range patch.BetMap {
+		b, ok := patched.BetMap[t]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownOutcome, t)
+		}
+		if bp.Title != nil {
+			b.Title = *bp.Title
+		}
+		if bp.LogoLink != nil {
+			b.LogoLink = *bp.LogoLink
+		}
+	}
+
+	return &patched, nil
+}
+
+func (e *Event) hasOutcome(t token.Token) bool {
+	_, ok := e.BetMap[t]
+	return ok
 }
 
 type betState struct {
 	collateral tlb.Grams
+	// size outstanding shares of the outcome, equals collateral for parimutuel event
+	size       tlb.Grams
 	percentage float64
+	// price of one share for LMSR event, 0 for parimutuel
+	price float64
 }
 
 // betRuntime runtime bet state
@@ -110,24 +378,48 @@ type betRuntime struct {
 	sync.RWMutex
 	token.Token
 	collateral tlb.Grams
+	size       tlb.Grams
+}
+
+func (br *betRuntime) deposit(collateral, size tlb.Grams) {
+	br.Lock()
+	defer br.Unlock()
+	br.collateral += collateral
+	br.size += size
+}
+
+func (br *betRuntime) withdraw(collateral, size tlb.Grams) {
+	br.Lock()
+	defer br.Unlock()
+	br.collateral -= min(collateral, br.collateral)
+	br.size -= min(size, br.size)
 }
 
-func (br *betRuntime) deposit(g tlb.Grams) {
+func (br *betRuntime) set(total stakeTotal) {
 	br.Lock()
 	defer br.Unlock()
-	br.collateral += g
+	br.collateral = total.collateral
+	br.size = total.size
 }
 
 func (br *betRuntime) getState() *betState {
 	br.RLock()
 	defer br.RUnlock()
-	return &betState{br.collateral, 0}
+	return &betState{br.collateral, br.size, 0, 0}
 }
 
 type eventState struct {
 	isActive    bool
 	collateral  tlb.Grams
 	betStateMap map[token.Token]*betState
+	// liquidity LMSR parameter in minimal units, 0 for parimutuel event
+	liquidity tlb.Grams
+	// exposure loss of the house if the outcome with most shares wins, 0 for parimutuel event
+	exposure tlb.Grams
+}
+
+func (es *eventState) isLMSR() bool {
+	return es.liquidity > 0
 }
 
 type eventRuntime struct {
@@ -135,14 +427,97 @@ type eventRuntime struct {
 	isActive      bool
 	eventID       uuid.UUID
 	betRuntimeMap map[token.Token]*betRuntime
+	liquidity     tlb.Grams
+	// buyMu serializes stakes of the event, LMSR price depends on the previous stake
+	buyMu sync.Mutex
+	// bookMu serializes order matching of the event
+	bookMu sync.Mutex
 }
 
 var ErrEventClosed = errors.New("event closed")
 
-func (er *eventRuntime) deposit(t token.Token, g tlb.Grams) {
+func (er *eventRuntime) deposit(t token.Token, collateral, size tlb.Grams) error {
+	er.RLock()
+	defer er.RUnlock()
+
+	br, ok := er.betRuntimeMap[t]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownOutcome, t)
+	}
+	br.deposit(collateral, size)
+	return nil
+}
+
+func (er *eventRuntime) withdraw(t token.Token, collateral, size tlb.Grams) error {
+	er.RLock()
+	defer er.RUnlock()
+
+	br, ok := er.betRuntimeMap[t]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownOutcome, t)
+	}
+	br.withdraw(collateral, size)
+	return nil
+}
+
+func (er *eventRuntime) restore(t token.Token, total stakeTotal) error {
+	er.RLock()
+	defer er.RUnlock()
+
+	br, ok := er.betRuntimeMap[t]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownOutcome, t)
+	}
+	br.set(total)
+	return nil
+}
+
+// shares returns size bought on the outcome for collateral at the current price,
+// size equals collateral for parimutuel event
+func (er *eventRuntime) shares(t token.Token, collateral tlb.Grams) (tlb.Grams, error) {
+	er.RLock()
+	defer er.RUnlock()
+
+	if _, ok := er.betRuntimeMap[t]; !ok {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownOutcome, t)
+	}
+	if er.liquidity == 0 {
+		return collateral, nil
+	}
+
+	q := make([]float64, 0, len(er.betRuntimeMap))
+	i := 0
+	for bt, br := range er.betRuntimeMap {
+		if bt == t {
+			i = len(q)
+		}
+		q = append(q, float64(br.getState().size))
+	}
+	return tlb.Grams(lmsrShares(q, i, float64(collateral), float64(er.liquidity))), nil
+}
+
+// sellValue returns collateral paid for size of the outcome sold back at the current price.
+// Parimutuel stake is withdrawn from the pool, its return at the pool implied odds equals the stake.
+func (er *eventRuntime) sellValue(t token.Token, collateral, size tlb.Grams) (tlb.Grams, error) {
 	er.RLock()
 	defer er.RUnlock()
-	er.betRuntimeMap[t].deposit(g)
+
+	if _, ok := er.betRuntimeMap[t]; !ok {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownOutcome, t)
+	}
+	if er.liquidity == 0 {
+		return collateral, nil
+	}
+
+	q := make([]float64, 0, len(er.betRuntimeMap))
+	i := 0
+	for bt, br := range er.betRuntimeMap {
+		if bt == t {
+			i = len(q)
+		}
+		q = append(q, float64(br.getState().size))
+	}
+	return tlb.Grams(lmsrSellValue(q, i, float64(size), float64(er.liquidity))), nil
 }
 
 func (er *eventRuntime) getState() *eventState {
@@ -152,6 +527,7 @@ func (er *eventRuntime) getState() *eventState {
 	es := &eventState{
 		isActive:    er.isActive,
 		betStateMap: make(map[token.Token]*betState),
+		liquidity:   er.liquidity,
 	}
 
 	for t, br := range er.betRuntimeMap {
@@ -160,6 +536,26 @@ func (er *eventRuntime) getState() *eventState {
 		es.collateral += bs.collateral
 	}
 
+	if es.isLMSR() {
+		tokens := make([]token.Token, 0, len(es.betStateMap))
+		q := make([]float64, 0, len(es.betStateMap))
+		var maxSize tlb.Grams
+		for t, bs := range es.betStateMap {
+			tokens = append(tokens, t)
+			q = append(q, float64(bs.size))
+			maxSize = max(maxSize, bs.size)
+		}
+		for j, price := range lmsrPrices(q, float64(es.liquidity)) {
+			bs := es.betStateMap[tokens[j]]
+			bs.price = price
+			bs.percentage = price * 100
+		}
+		if maxSize > es.collateral {
+			es.exposure = maxSize - es.collateral
+		}
+		return es
+	}
+
 	for _, bs := range es.betStateMap {
 		if bs.collateral == tlb.Grams(0) {
 			bs.percentage = 0
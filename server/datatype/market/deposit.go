@@ -0,0 +1,238 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/TON-Market/tma/server/config"
+	"github.com/TON-Market/tma/server/utils"
+	"github.com/google/uuid"
+	"github.com/tonkeeper/tongo/boc"
+	"github.com/tonkeeper/tongo/tlb"
+	"github.com/tonkeeper/tongo/ton"
+	"github.com/tonkeeper/tongo/wallet"
+	"log"
+)
+
+const (
+	UnderpayDecline = "decline"
+	UnderpayProRata = "pro_rata"
+)
+
+var ErrInvalidUnderpayPolicy = errors.New("invalid underpay policy")
+
+func validateDepositConfig() error {
+	switch config.Config.Deposit.UnderpayPolicy {
+	case UnderpayDecline, UnderpayProRata:
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidUnderpayPolicy, config.Config.Deposit.UnderpayPolicy)
+	}
+}
+
+// depositSettlement how the received transfer is applied to the deal
+type depositSettlement struct {
+	outcome    DepositOutcome
+	received   tlb.Grams
+	collateral tlb.Grams
+	size       tlb.Grams
+	// refund nil if nothing is refunded
+	refund *UserProfit
+}
+
+func (s *depositSettlement) refunded() tlb.Grams {
+	if s.refund == nil {
+		return 0
+	}
+	return s.refund.Grams
+}
+
+// buildSettlement credits at most the deal collateral, surplus is refunded in currency c,
+// underpayment is credited pro rata or refunded as a whole depending on config
+func buildSettlement(d *Deal, received tlb.Grams, c *Currency) *depositSettlement {
+	s := &depositSettlement{
+		received:   received,
+		collateral: d.Collateral,
+		size:       d.Size,
+	}
+
+	var surplus tlb.Grams
+	switch {
+	case received == d.Collateral:
+		s.outcome = DepositExact
+	case received > d.Collateral:
+		s.outcome = DepositOverpaid
+		surplus = received - d.Collateral
+	case config.Config.Deposit.UnderpayPolicy == UnderpayProRata && received > 0:
+		s.outcome = DepositProRata
+		s.collateral = received
+		s.size = tlb.Grams(float64(d.Size) * float64(received) / float64(d.Collateral))
+	default:
+		s.outcome = DepositUnderpaidDeclined
+		s.collateral, s.size = 0, 0
+		surplus = received
+	}
+
+	s.refund = buildDepositRefund(d, surplus, c)
+	return s
+}
+
+// buildLimitSettlement declines the deal breaking stake limits at confirmation, received transfer is refunded
+func buildLimitSettlement(d *Deal, received tlb.Grams, c *Currency) *depositSettlement {
+	return &depositSettlement{
+		outcome:  DepositLimitDeclined,
+		received: received,
+		refund:   buildDepositRefund(d, received, c),
+	}
+}
+
+// buildDepositRefund returns nil if surplus does not cover the refund fee
+func buildDepositRefund(d *Deal, surplus tlb.Grams, c *Currency) *UserProfit {
+	refundFee := c.FromFloat(config.Config.Deposit.RefundFee)
+	if surplus <= refundFee {
+		if surplus > 0 {
+			log.Printf("[WARNING] deposit refund for deal: %s, grams: %v does not cover fee\n\n", d.ID.String(), surplus)
+		}
+		return nil
+	}
+
+	return &UserProfit{
+		ID:             uuid.New(),
+		Kind:           PayoutDepositRefund,
+		UserRawAddress: d.UserRawAddr,
+		Grams:          surplus - refundFee,
+		Jetton:         c.Jetton,
+		Fee:            refundFee,
+		EventID:        d.EventID,
+		Comment:        "deposit refund: " + d.ID.String(),
+		State:          PayoutPending,
+	}
+}
+
+// PaymentMessage message the user sends from the wallet to pay the deal
+type PaymentMessage struct {
+	Address string
+	Amount  tlb.Grams
+	Payload *boc.Cell
+}
+
+// BuildPayment returns TON transfer to the bank with the deal id comment, or jetton transfer
+// to the user jetton wallet forwarding the deal id comment to the bank
+func (m *Market) BuildPayment(ctx context.Context, d *Deal) (*PaymentMessage, error) {
+	eventCopy, err := m.persistor.getCopyByID(ctx, d.EventID)
+	if err != nil {
+		return nil, fmt.Errorf("market build payment failed: %w", err)
+	}
+
+	if eventCopy.Jetton == "" {
+		body := boc.NewCell()
+		if err := tlb.Marshal(body, wallet.TextComment(d.ID.String())); err != nil {
+			return nil, fmt.Errorf("market build payment failed: %w", err)
+		}
+		return &PaymentMessage{m.BankAddress(), d.Collateral, body}, nil
+	}
+
+	userWallet, err := m.jettonWalletOf(ctx, eventCopy.Jetton, d.UserRawAddr)
+	if err != nil {
+		return nil, fmt.Errorf("market build payment failed: %w", err)
+	}
+	owner, err := ton.ParseAccountID(d.UserRawAddr)
+	if err != nil {
+		return nil, fmt.Errorf("market build payment failed: %w", err)
+	}
+
+	body, err := buildJettonTransfer(d.Collateral, m.chain.BankAddress(), owner, d.ID.String())
+	if err != nil {
+		return nil, fmt.Errorf("market build payment failed: %w", err)
+	}
+	return &PaymentMessage{userWallet.ToHuman(true, utils.IsTestnet()), jettonAttachedTon(), body}, nil
+}
+
+// settleDeposit applies bank transfer matched to the deal
+func (m *Market) settleDeposit(ctx context.Context, transfer *BankTransfer) error {
+	if transfer.DealID == nil {
+		return fmt.Errorf("settle deposit lt: %d failed: transfer has no deal", transfer.Lt)
+	}
+
+	deal, err := m.persistor.getDeal(ctx, *transfer.DealID)
+	if err != nil {
+		return fmt.Errorf("settle deposit failed: %w", err)
+	}
+	if deal.DealStatus != Unchecked {
+		return fmt.Errorf("settle deposit failed: %w: %s", ErrDealAlreadyProcessed, deal.ID.String())
+	}
+
+	// stake can't be placed anymore, the transfer is refunded as orphaned
+	es, err := m.runtimer.getEventState(ctx, deal.EventID)
+	if err != nil && !errors.Is(err, ErrRuntimeEventNotExist) {
+		return fmt.Errorf("settle deposit failed: %w", err)
+	}
+	if err != nil || !es.isActive {
+		reason := "event closed before confirmation"
+		if err := m.persistor.orphanTransfer(ctx, transfer, reason); err != nil {
+			return fmt.Errorf("settle deposit failed: %w", err)
+		}
+		log.Printf("[WARNING] deal: %s declined, %s\n\n", deal.ID.String(), reason)
+		return nil
+	}
+
+	c, err := m.currencyOf(transfer.Jetton)
+	if err != nil {
+		return fmt.Errorf("settle deposit failed: %w", err)
+	}
+
+	order, err := m.persistor.getOrderByDeal(ctx, deal.ID)
+	if err != nil {
+		return fmt.Errorf("settle deposit failed: %w", err)
+	}
+	if order != nil {
+		return m.settleOrderDeposit(ctx, transfer, deal, order, c)
+	}
+
+	s := buildSettlement(deal, transfer.Grams, c)
+
+	if s.outcome == DepositUnderpaidDeclined {
+		reason := fmt.Sprintf("underpaid: received %s of %s %s",
+			c.Format(transfer.Grams), c.Format(deal.Collateral), c.Symbol)
+		if err := m.persistor.declineDeal(ctx, deal.ID, reason, s); err != nil {
+			return fmt.Errorf("settle deposit failed: %w", err)
+		}
+		log.Printf("[INFO] deal: %s declined, %s\n\n", deal.ID.String(), reason)
+		return nil
+	}
+
+	eventCopy, err := m.persistor.getCopyByID(ctx, deal.EventID)
+	if err != nil {
+		return fmt.Errorf("settle deposit failed: %w", err)
+	}
+
+	// shares are bought at the price of the settlement, not of the deal creation,
+	// limits are checked again under the buy lock, the pool may have grown since the deal was saved
+	err = m.runtimer.buy(ctx, deal.EventID, deal.Token, s.collateral, func(size tlb.Grams) error {
+		es, err := m.runtimer.getEventState(ctx, deal.EventID)
+		if err != nil {
+			return err
+		}
+		if err := m.checkStakeLimits(ctx, &eventCopy, es, c, deal.UserRawAddr, deal.Token, s.collateral); err != nil {
+			return err
+		}
+		s.size = size
+		deal, err = m.persistor.verifyDealAndGet(ctx, deal.ID, s)
+		return err
+	})
+	if errors.Is(err, ErrStakeLimit) {
+		reason := err.Error()
+		if err := m.persistor.declineDeal(ctx, deal.ID, reason, buildLimitSettlement(deal, transfer.Grams, c)); err != nil {
+			return fmt.Errorf("settle deposit failed: %w", err)
+		}
+		log.Printf("[INFO] deal: %s declined, %s\n\n", deal.ID.String(), reason)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("settle deposit failed: %w", err)
+	}
+	if err = m.sendToSocket(ctx, deal.EventID); err != nil {
+		return fmt.Errorf("settle deposit failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package market
+
+import (
+	"errors"
+	"github.com/TON-Market/tma/server/config"
+	"github.com/google/uuid"
+	"github.com/tonkeeper/tongo/tlb"
+	"testing"
+)
+
+const (
+	testUserAddr  = "0:1111111111111111111111111111111111111111111111111111111111111111"
+	testOtherAddr = "0:2222222222222222222222222222222222222222222222222222222222222222"
+	testJetton    = "0:3333333333333333333333333333333333333333333333333333333333333333"
+)
+
+var testJettonCurrency = &Currency{Symbol: "USDT", Jetton: testJetton, Decimals: 6}
+
+// setDepositConfig sets deposit config for the test only
+func setDepositConfig(t *testing.T, underpayPolicy string, refundFee float64) {
+	t.Helper()
+	saved := config.Config.Deposit
+	t.Cleanup(func() { config.Config.Deposit = saved })
+	config.Config.Deposit.UnderpayPolicy = underpayPolicy
+	config.Config.Deposit.RefundFee = refundFee
+}
+
+func TestBuildSettlement(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		c          *Currency
+		collateral tlb.Grams
+		received   tlb.Grams
+		outcome    DepositOutcome
+		staked     tlb.Grams
+		refund     tlb.Grams
+	}{
+		{"exact", UnderpayDecline, tonCurrency, 1e9, 1e9, DepositExact, 1e9, 0},
+		{"overpaid", UnderpayDecline, tonCurrency, 1e9, 1.5e9, DepositOverpaid, 1e9, 0.49e9},
+		{"overpaid below refund fee", UnderpayDecline, tonCurrency, 1e9, 1.005e9, DepositOverpaid, 1e9, 0},
+		{"overpaid by refund fee", UnderpayDecline, tonCurrency, 1e9, 1.01e9, DepositOverpaid, 1e9, 0},
+		{"underpaid declined", UnderpayDecline, tonCurrency, 1e9, 0.6e9, DepositUnderpaidDeclined, 0, 0.59e9},
+		{"underpaid pro rata", UnderpayProRata, tonCurrency, 1e9, 0.6e9, DepositProRata, 0.6e9, 0},
+		{"nothing received pro rata", UnderpayProRata, tonCurrency, 1e9, 0, DepositUnderpaidDeclined, 0, 0},
+		{"jetton overpaid", UnderpayDecline, testJettonCurrency, 10e6, 10.5e6, DepositOverpaid, 10e6, 0.49e6},
+		{"jetton underpaid declined", UnderpayDecline, testJettonCurrency, 10e6, 5e6, DepositUnderpaidDeclined, 0,
+			4.99e6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setDepositConfig(t, tt.policy, 0.01)
+			d := &Deal{ID: uuid.New(), EventID: uuid.New(), UserRawAddr: testUserAddr, Collateral: tt.collateral,
+				Size: tt.collateral}
+
+			s := buildSettlement(d, tt.received, tt.c)
+
+			if s.outcome != tt.outcome {
+				t.Errorf("outcome = %d, want %d", s.outcome, tt.outcome)
+			}
+			if s.received != tt.received {
+				t.Errorf("received = %d, want %d", s.received, tt.received)
+			}
+			if s.collateral != tt.staked || s.size != tt.staked {
+				t.Errorf("collateral, size = %d, %d, want %d", s.collateral, s.size, tt.staked)
+			}
+			if s.refunded() != tt.refund {
+				t.Errorf("refunded = %d, want %d", s.refunded(), tt.refund)
+			}
+			if s.refund == nil {
+				return
+			}
+			if s.refund.Kind != PayoutDepositRefund || s.refund.Jetton != tt.c.Jetton ||
+				s.refund.UserRawAddress != d.UserRawAddr || s.refund.Fee != tt.c.FromFloat(0.01) {
+				t.Errorf("refund = %+v", s.refund)
+			}
+			// staked, refunded and kept fee add up to the received amount
+			if s.collateral+s.refund.Grams+s.refund.Fee != tt.received {
+				t.Errorf("staked %d + refund %d + fee %d != received %d", s.collateral, s.refund.Grams,
+					s.refund.Fee, tt.received)
+			}
+		})
+	}
+}
+
+func TestBuildLimitSettlement(t *testing.T) {
+	setDepositConfig(t, UnderpayDecline, 0.01)
+	d := &Deal{ID: uuid.New(), UserRawAddr: testUserAddr, Collateral: 1e9, Size: 1e9}
+
+	s := buildLimitSettlement(d, 1e9, tonCurrency)
+
+	if s.outcome != DepositLimitDeclined || s.collateral != 0 || s.size != 0 {
+		t.Fatalf("settlement = %+v", s)
+	}
+	if s.refunded() != 0.99e9 {
+		t.Fatalf("refunded = %d, want %d", s.refunded(), tlb.Grams(0.99e9))
+	}
+}
+
+func TestCheckPayer(t *testing.T) {
+	m := newTestMarket(t, nil, nil)
+	m.currencies.add(testJettonCurrency)
+	deal := &Deal{ID: uuid.New(), UserRawAddr: testUserAddr}
+
+	tests := []struct {
+		name     string
+		jetton   string
+		transfer *BankTransfer
+		err      error
+	}{
+		{"ton", "", &BankTransfer{Sender: testUserAddr}, nil},
+		{"jetton", testJetton, &BankTransfer{Sender: testUserAddr, Jetton: testJetton}, nil},
+		{"other sender", "", &BankTransfer{Sender: testOtherAddr}, ErrTransferMismatch},
+		{"jetton for ton event", "", &BankTransfer{Sender: testUserAddr, Jetton: testJetton}, ErrTransferMismatch},
+		{"ton for jetton event", testJetton, &BankTransfer{Sender: testUserAddr}, ErrTransferMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := m.checkPayer(deal, &Event{Jetton: tt.jetton}, tt.transfer)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/TON-Market/tma/server/config"
+	"github.com/google/uuid"
+	"github.com/tonkeeper/tongo/tlb"
+	"time"
+)
+
+type FeeKind string
+
+const (
+	// FeeFlat fixed amount taken from each winner
+	FeeFlat FeeKind = "flat"
+	// FeeWinPercent percent of each winner's net winnings
+	FeeWinPercent FeeKind = "win_percent"
+	// FeePoolPercent percent of the losing pool taken before it is shared between winners
+	FeePoolPercent FeeKind = "pool_percent"
+)
+
+// FeePolicy house fee taken at event close, amounts are in whole units of the event collateral.
+// Min is a floor for percent kinds: per winner for FeeWinPercent, per event for FeePoolPercent.
+type FeePolicy struct {
+	Kind    FeeKind `json:"kind"`
+	Flat    float64 `json:"flat,omitempty"`
+	Percent float64 `json:"percent,omitempty"`
+	Min     float64 `json:"min,omitempty"`
+}
+
+var ErrInvalidFeePolicy = errors.New("invalid fee policy")
+
+func (p *FeePolicy) validate() error {
+	switch p.Kind {
+	case FeeFlat, FeeWinPercent, FeePoolPercent:
+	default:
+		return fmt.Errorf("%w: unknown kind: %s", ErrInvalidFeePolicy, p.Kind)
+	}
+	if p.Flat < 0 || p.Min < 0 {
+		return fmt.Errorf("%w: negative amount", ErrInvalidFeePolicy)
+	}
+	if p.Percent < 0 || p.Percent > 100 {
+		return fmt.Errorf("%w: percent must be from 0 to 100", ErrInvalidFeePolicy)
+	}
+	return nil
+}
+
+func defaultFeePolicy() *FeePolicy {
+	return &FeePolicy{
+		Kind:    FeeKind(config.Config.Fee.Kind),
+		Flat:    config.Config.Fee.Flat,
+		Percent: config.Config.Fee.Percent,
+		Min:     config.Config.Fee.Min,
+	}
+}
+
+// percentFee returns percent of g, but not less than policy minimum and not more than g
+func (p *FeePolicy) percentFee(g tlb.Grams, c *Currency) tlb.Grams {
+	fee := tlb.Grams(float64(g) * p.Percent / 100)
+	fee = max(fee, c.FromFloat(p.Min))
+	return min(fee, g)
+}
+
+// poolFee fee taken from the losing pool once per event
+func (p *FeePolicy) poolFee(losePool tlb.Grams, c *Currency) tlb.Grams {
+	if p.Kind != FeePoolPercent {
+		return 0
+	}
+	return p.percentFee(losePool, c)
+}
+
+// winnerFee fee taken from the winner with net winnings profit
+func (p *FeePolicy) winnerFee(profit tlb.Grams, c *Currency) tlb.Grams {
+	switch p.Kind {
+	case FeeFlat:
+		return c.FromFloat(p.Flat)
+	case FeeWinPercent:
+		return p.percentFee(profit, c)
+	default:
+		return 0
+	}
+}
+
+// shareFee fee taken from the winner of LMSR event with net winnings profit,
+// there is no losing pool, so pool percent is taken from net winnings of each winner
+func (p *FeePolicy) shareFee(profit tlb.Grams, c *Currency) tlb.Grams {
+	if p.Kind == FeePoolPercent {
+		return p.percentFee(profit, c)
+	}
+	return p.winnerFee(profit, c)
+}
+
+// feePolicyFor picks event policy, then policy of the event tag, then the default one
+func (m *Market) feePolicyFor(ctx context.Context, e *Event) (*FeePolicy, error) {
+	if e.FeePolicy != nil {
+		return e.FeePolicy, nil
+	}
+
+	policy, err := m.persistor.getTagFeePolicy(ctx, e.Tag)
+	if err != nil {
+		return nil, err
+	}
+	if policy != nil {
+		return policy, nil
+	}
+
+	return defaultFeePolicy(), nil
+}
+
+// EventFee house revenue of the finished event,
+// pools of the voided event are not split and LosePool holds all stakes
+type EventFee struct {
+	EventID   uuid.UUID
+	Kind      PayoutKind
+	Policy    *FeePolicy
+	Grams     tlb.Grams
+	Jetton    string
+	WinPool   tlb.Grams
+	LosePool  tlb.Grams
+	CreatedAt time.Time
+}
+
+type EventFeeDTO struct {
+	EventID   string     `json:"eventId"`
+	Kind      PayoutKind `json:"kind"`
+	Policy    *FeePolicy `json:"policy"`
+	Currency  string     `json:"currency"`
+	Fee       string     `json:"fee"`
+	WinPool   string     `json:"winPool"`
+	LosePool  string     `json:"losePool"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// FeePeriod fee revenue of events finished within the period
+type FeePeriod struct {
+	Start  time.Time
+	Jetton string
+	Grams  tlb.Grams
+	Events int
+}
+
+type FeePeriodDTO struct {
+	Start    time.Time `json:"start"`
+	Currency string    `json:"currency"`
+	Fee      string    `json:"fee"`
+	Events   int       `json:"events"`
+}
+
+var (
+	ErrFeeNotExist      = errors.New("event fee does not exist")
+	ErrInvalidFeePeriod = errors.New("invalid fee report period")
+)
+
+// SetTagFeePolicy sets policy for events of the tag, policy with empty kind removes it
+func (m *Market) SetTagFeePolicy(ctx context.Context, tag Tag, policy *FeePolicy) error {
+	if policy.Kind == "" {
+		if err := m.persistor.deleteTagFeePolicy(ctx, tag); err != nil {
+			return fmt.Errorf("market set tag fee policy failed: %w", err)
+		}
+		return nil
+	}
+
+	if err := policy.validate(); err != nil {
+		return fmt.Errorf("market set tag fee policy failed: %w", err)
+	}
+	if err := m.persistor.saveTagFeePolicy(ctx, tag, policy); err != nil {
+		return fmt.Errorf("market set tag fee policy failed: %w", err)
+	}
+	return nil
+}
+
+func (m *Market) GetEventFee(ctx context.Context, id uuid.UUID) (*EventFeeDTO, error) {
+	fee, err := m.persistor.getEventFee(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("market get event fee failed: %w", err)
+	}
+
+	return &EventFeeDTO{
+		EventID:   fee.EventID.String(),
+		Kind:      fee.Kind,
+		Policy:    fee.Policy,
+		Currency:  m.symbolOf(fee.Jetton),
+		Fee:       m.formatOf(fee.Jetton, fee.Grams),
+		WinPool:   m.formatOf(fee.Jetton, fee.WinPool),
+		LosePool:  m.formatOf(fee.Jetton, fee.LosePool),
+		CreatedAt: fee.CreatedAt,
+	}, nil
+}
+
+// GetFeeReport sums fee revenue within [from, to) by period: day, week or month, and by currency.
+// Total is by currency symbol.
+func (m *Market) GetFeeReport(ctx context.Context, from, to time.Time, period string) ([]FeePeriodDTO, map[string]string, error) {
+	switch period {
+	case "day", "week", "month":
+	default:
+		return nil, nil, fmt.Errorf("market get fee report failed: %w: %s", ErrInvalidFeePeriod, period)
+	}
+	if !to.After(from) {
+		return nil, nil, fmt.Errorf("market get fee report failed: %w: to must be after from", ErrInvalidFeePeriod)
+	}
+
+	feePeriodList, err := m.persistor.getFeeReport(ctx, from, to, period)
+	if err != nil {
+		return nil, nil, fmt.Errorf("market get fee report failed: %w", err)
+	}
+
+	totalMap := make(map[string]tlb.Grams)
+	feePeriodDtoList := make([]FeePeriodDTO, 0, len(feePeriodList))
+	for _, fp := range feePeriodList {
+		totalMap[fp.Jetton] += fp.Grams
+		feePeriodDtoList = append(feePeriodDtoList, FeePeriodDTO{
+			Start:    fp.Start,
+			Currency: m.symbolOf(fp.Jetton),
+			Fee:      m.formatOf(fp.Jetton, fp.Grams),
+			Events:   fp.Events,
+		})
+	}
+
+	feeTotalMap := make(map[string]string, len(totalMap))
+	for jetton, total := range totalMap {
+		feeTotalMap[m.symbolOf(jetton)] = m.formatOf(jetton, total)
+	}
+	return feePeriodDtoList, feeTotalMap, nil
+}
@@ -0,0 +1,280 @@
+package market
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/tonkeeper/tongo/tlb"
+	"github.com/tonkeeper/tongo/ton"
+	"log"
+	"slices"
+	"time"
+)
+
+const (
+	bankIndexerName       = "bank"
+	bankIndexerPollPeriod = 5 * time.Second
+	bankIndexerPageSize   = 16
+	// bankIndexerInitialDepth limits the first walk when there is no saved lt
+	bankIndexerInitialDepth = 1000
+	bankTransferBatchSize   = 100
+)
+
+type TransferStatus int
+
+const (
+	TransferPending TransferStatus = iota
+	TransferMatched
+	// TransferUnmatched orphaned transfer waiting for the refund
+	TransferUnmatched
+	TransferRefunded
+	// TransferKept orphaned transfer not covering the refund fee
+	TransferKept
+)
+
+// BankTransfer incoming transfer of the bank wallet
+type BankTransfer struct {
+	Lt     uint64
+	Hash   string
+	Sender string
+	Grams  tlb.Grams
+	// Jetton master raw address of the received jettons, empty for TON
+	Jetton  string
+	Comment string
+	DealID  *uuid.UUID
+	Status  TransferStatus
+	Reason  string
+	Time    time.Time
+	// RefundID payout returning orphaned transfer
+	RefundID *uuid.UUID
+}
+
+func (m *Market) startBankIndexer(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(bankIndexerPollPeriod)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := m.indexBankTransactions(ctx); err != nil {
+				log.Printf("[ERROR] %s\n\n", err.Error())
+				continue
+			}
+			if err := m.matchBankTransfers(ctx); err != nil {
+				log.Printf("[ERROR] %s\n\n", err.Error())
+			}
+		}
+	}()
+}
+
+// indexBankTransactions saves incoming transfers with lt greater than the saved one
+// and moves saved lt to the last bank transaction in the same db transaction
+func (m *Market) indexBankTransactions(ctx context.Context) error {
+	bank := m.chain.BankAddress()
+
+	savedLt, err := m.persistor.getIndexerLt(ctx, bankIndexerName)
+	if err != nil {
+		return fmt.Errorf("index bank transactions failed: %w", err)
+	}
+
+	lastLt, lastHash, err := m.chain.LastTransaction(ctx, bank)
+	if err != nil {
+		return fmt.Errorf("index bank transactions failed: %w", err)
+	}
+	if lastLt <= savedLt {
+		return nil
+	}
+
+	// transactions are returned from the newest, walk back until the saved lt
+	txList := make([]ChainTx, 0)
+	lt, hash := lastLt, lastHash
+walk:
+	for lt != 0 {
+		page, err := m.chain.Transactions(ctx, bank, lt, hash, bankIndexerPageSize)
+		if err != nil {
+			return fmt.Errorf("index bank transactions failed: %w", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, tx := range page {
+			if tx.Lt <= savedLt {
+				break walk
+			}
+			txList = append(txList, tx)
+		}
+		if savedLt == 0 && len(txList) >= bankIndexerInitialDepth {
+			log.Printf("[WARNING] bank indexer started without saved lt, walked %d transactions\n\n", len(txList))
+			break
+		}
+		last := page[len(page)-1]
+		lt, hash = last.PrevLt, last.PrevHash
+	}
+	slices.Reverse(txList)
+
+	transferList := make([]*BankTransfer, 0, len(txList))
+	for _, tx := range txList {
+		transfer, ok := m.parseBankTransfer(tx)
+		if ok {
+			transferList = append(transferList, transfer)
+		}
+	}
+
+	if err := m.persistor.saveBankTransfers(ctx, bankIndexerName, transferList, lastLt); err != nil {
+		return fmt.Errorf("index bank transactions failed: %w", err)
+	}
+
+	if len(transferList) > 0 {
+		log.Printf("[INFO] bank indexer saved %d transfers, lt: %d\n\n", len(transferList), lastLt)
+	}
+	return nil
+}
+
+// parseBankTransfer returns incoming internal transfer of the transaction, bounced messages
+// and jetton excesses are skipped. Jettons are received as notification of the bank jetton wallet.
+func (m *Market) parseBankTransfer(tx ChainTx) (*BankTransfer, bool) {
+	if tx.In == nil || tx.In.Bounced {
+		return nil, false
+	}
+	if op, ok := bodyOp(tx.In.Body); ok && op == jettonExcessesOp {
+		return nil, false
+	}
+
+	// only the bank jetton wallet is trusted, anyone can send a notification
+	if c, ok := m.currencies.byBankWallet(tx.In.Src); ok {
+		notify, ok := parseJettonNotify(tx.In.Body)
+		if !ok {
+			return nil, false
+		}
+		return &BankTransfer{
+			Lt:      tx.Lt,
+			Hash:    hex.EncodeToString(tx.Hash[:]),
+			Sender:  notify.Peer.ToRaw(),
+			Grams:   notify.Amount,
+			Jetton:  c.Jetton,
+			Comment: notify.Comment,
+			Status:  TransferPending,
+			Time:    tx.Time,
+		}, true
+	}
+
+	// a transfer without text comment is still indexed, it can't be matched to a deal
+	return &BankTransfer{
+		Lt:      tx.Lt,
+		Hash:    hex.EncodeToString(tx.Hash[:]),
+		Sender:  tx.In.Src.ToRaw(),
+		Grams:   tx.In.Amount,
+		Comment: tx.In.Comment,
+		Status:  TransferPending,
+		Time:    tx.Time,
+	}, true
+}
+
+func (m *Market) matchBankTransfers(ctx context.Context) error {
+	transferList, err := m.persistor.getTransfers(ctx, TransferPending, bankTransferBatchSize)
+	if err != nil {
+		return fmt.Errorf("match bank transfers failed: %w", err)
+	}
+
+	for _, transfer := range transferList {
+		if err := m.matchTransfer(ctx, transfer); err != nil {
+			log.Printf("[ERROR] match transfer lt: %d failed: %s\n\n", transfer.Lt, err.Error())
+		}
+	}
+	return nil
+}
+
+var ErrTransferMismatch = errors.New("transfer does not match deal")
+
+// checkTransfer verifies that transfer pays the unchecked deal, amount is checked at settlement
+func (m *Market) checkTransfer(ctx context.Context, transfer *BankTransfer) (*Deal, error) {
+	dealID, err := uuid.Parse(transfer.Comment)
+	if err != nil {
+		return nil, fmt.Errorf("%w: comment is not a deal id", ErrTransferMismatch)
+	}
+
+	deal, err := m.persistor.getDeal(ctx, dealID)
+	if err != nil {
+		if errors.Is(err, ErrDealNotExist) {
+			return nil, fmt.Errorf("%w: %w", ErrTransferMismatch, err)
+		}
+		return nil, err
+	}
+	transfer.DealID = &deal.ID
+
+	if deal.DealStatus != Unchecked {
+		return deal, fmt.Errorf("%w: %w", ErrTransferMismatch, ErrDealAlreadyProcessed)
+	}
+
+	eventCopy, err := m.persistor.getCopyByID(ctx, deal.EventID)
+	if err != nil {
+		return deal, fmt.Errorf("%w: %w", ErrTransferMismatch, err)
+	}
+	if err := m.checkPayer(deal, &eventCopy, transfer); err != nil {
+		return deal, err
+	}
+
+	// only the first transfer pays the deal, repeated payments stay unmatched
+	matched, err := m.persistor.getMatchedTransfer(ctx, deal.ID)
+	if err != nil {
+		return deal, err
+	}
+	if matched != nil {
+		return deal, fmt.Errorf("%w: deal is paid by transfer lt: %d", ErrTransferMismatch, matched.Lt)
+	}
+
+	return deal, nil
+}
+
+// checkPayer verifies that transfer is sent by the deal owner in the event collateral
+func (m *Market) checkPayer(deal *Deal, e *Event, transfer *BankTransfer) error {
+	owner, err := ton.ParseAccountID(deal.UserRawAddr)
+	if err != nil {
+		return fmt.Errorf("%w: bad deal address: %w", ErrTransferMismatch, err)
+	}
+	if owner.ToRaw() != transfer.Sender {
+		return fmt.Errorf("%w: sender: %s is not deal owner", ErrTransferMismatch, transfer.Sender)
+	}
+	if e.Jetton != transfer.Jetton {
+		return fmt.Errorf("%w: paid in %s, event collateral is %s", ErrTransferMismatch,
+			m.symbolOf(transfer.Jetton), m.symbolOf(e.Jetton))
+	}
+	return nil
+}
+
+func (m *Market) matchTransfer(ctx context.Context, transfer *BankTransfer) error {
+	limits, err := treasuryConfig()
+	if err != nil {
+		return err
+	}
+	if limits.isRefill(transfer.Sender) {
+		log.Printf("[INFO] bank transfer lt: %d from: %s kept as treasury refill, amount: %s %s\n\n",
+			transfer.Lt, transfer.Sender, m.formatOf(transfer.Jetton, transfer.Grams), m.symbolOf(transfer.Jetton))
+		return m.persistor.setTransferStatus(ctx, transfer, TransferKept, "treasury refill")
+	}
+
+	deal, err := m.checkTransfer(ctx, transfer)
+	if err != nil {
+		if !errors.Is(err, ErrTransferMismatch) {
+			return err
+		}
+		log.Printf("[WARNING] bank transfer lt: %d unmatched: %s\n\n", transfer.Lt, err.Error())
+		return m.persistor.setTransferStatus(ctx, transfer, TransferUnmatched, err.Error())
+	}
+
+	if err := m.persistor.setTransferStatus(ctx, transfer, TransferMatched, ""); err != nil {
+		return err
+	}
+
+	err = m.settleDeposit(ctx, transfer)
+	if err == nil || errors.Is(err, ErrDealAlreadyProcessed) {
+		return nil
+	}
+
+	// deposit job settles matched transfer later
+	if err := m.persistor.enqueueDepositJob(ctx, deal.ID, 0); err != nil {
+		return err
+	}
+	return fmt.Errorf("confirm deal: %s failed: %w", deal.ID.String(), err)
+}
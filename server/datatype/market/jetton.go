@@ -0,0 +1,308 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/TON-Market/tma/server/config"
+	"github.com/TON-Market/tma/server/utils"
+	"github.com/google/uuid"
+	"github.com/tonkeeper/tongo/boc"
+	"github.com/tonkeeper/tongo/tlb"
+	"github.com/tonkeeper/tongo/ton"
+	"github.com/tonkeeper/tongo/wallet"
+	"log"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Currency collateral asset of the event, amounts of the event are in its minimal units
+type Currency struct {
+	Symbol string
+	// Jetton master raw address, empty for TON
+	Jetton   string
+	Decimals int
+	// bankWallet jetton wallet of the bank, zero for TON
+	bankWallet ton.AccountID
+}
+
+var tonCurrency = &Currency{Symbol: "TON", Decimals: 9}
+
+var ErrUnknownCurrency = errors.New("unknown collateral currency")
+
+func (c *Currency) IsJetton() bool {
+	return c.Jetton != ""
+}
+
+// FromFloat converts amount in whole units to minimal units
+func (c *Currency) FromFloat(v float64) tlb.Grams {
+	return tlb.Grams(math.Round(v * math.Pow10(c.Decimals)))
+}
+
+// Format returns amount in whole units rounded to 4 digits
+func (c *Currency) Format(g tlb.Grams) string {
+	v := float64(g) / math.Pow10(c.Decimals)
+	return strconv.FormatFloat(math.Round(v*1e4)/1e4, 'f', 4, 64)
+}
+
+// parseCurrency parses "SYMBOL:master:decimals", master may be raw or user friendly
+func parseCurrency(s string) (*Currency, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) < 3 {
+		return nil, fmt.Errorf("%w: %s: expected SYMBOL:master:decimals", ErrUnknownCurrency, s)
+	}
+	symbol, last := parts[0], len(parts)-1
+
+	master, err := ton.ParseAccountID(strings.Join(parts[1:last], ":"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrUnknownCurrency, s, err)
+	}
+	decimals, err := strconv.Atoi(parts[last])
+	if err != nil || decimals < 0 || decimals > 18 || symbol == "" {
+		return nil, fmt.Errorf("%w: %s: bad symbol or decimals", ErrUnknownCurrency, s)
+	}
+
+	return &Currency{Symbol: symbol, Jetton: master.ToRaw(), Decimals: decimals}, nil
+}
+
+// currencyRegistry accepted jetton collaterals by master raw address
+type currencyRegistry struct {
+	sync.RWMutex
+	jettonMap map[string]*Currency
+}
+
+func (r *currencyRegistry) add(c *Currency) {
+	r.Lock()
+	defer r.Unlock()
+	r.jettonMap[c.Jetton] = c
+}
+
+func (r *currencyRegistry) get(jetton string) (*Currency, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	c, ok := r.jettonMap[jetton]
+	return c, ok
+}
+
+// list returns registered currencies
+func (r *currencyRegistry) list() []*Currency {
+	r.RLock()
+	defer r.RUnlock()
+	currencyList := make([]*Currency, 0, len(r.jettonMap))
+	for _, c := range r.jettonMap {
+		currencyList = append(currencyList, c)
+	}
+	return currencyList
+}
+
+// byBankWallet returns currency of the bank jetton wallet
+func (r *currencyRegistry) byBankWallet(id ton.AccountID) (*Currency, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	for _, c := range r.jettonMap {
+		if c.bankWallet == id {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// loadCurrencies registers configured jettons with jetton wallets of the bank
+func (m *Market) loadCurrencies(ctx context.Context) error {
+	for _, s := range config.Config.Jetton.List {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		c, err := parseCurrency(s)
+		if err != nil {
+			return fmt.Errorf("market load currencies failed: %w", err)
+		}
+		master, _ := ton.ParseAccountID(c.Jetton)
+		c.bankWallet, err = m.chain.JettonWallet(ctx, master, m.chain.BankAddress())
+		if err != nil {
+			return fmt.Errorf("market load currencies failed: %s bank wallet: %w", c.Symbol, err)
+		}
+		m.currencies.add(c)
+		log.Printf("[INFO] jetton: %s, master: %s, bank jetton wallet: %s\n\n",
+			c.Symbol, c.Jetton, c.bankWallet.ToHuman(true, utils.IsTestnet()))
+	}
+	return nil
+}
+
+// currencyOf returns currency of the jetton master, TON for empty jetton
+func (m *Market) currencyOf(jetton string) (*Currency, error) {
+	if jetton == "" {
+		return tonCurrency, nil
+	}
+	c, ok := m.currencies.get(jetton)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCurrency, jetton)
+	}
+	return c, nil
+}
+
+// formatOf formats amount of the jetton, unknown jetton amount is left in minimal units
+func (m *Market) formatOf(jetton string, g tlb.Grams) string {
+	c, err := m.currencyOf(jetton)
+	if err != nil {
+		return utils.GramsToString(g)
+	}
+	return c.Format(g)
+}
+
+// symbolOf returns currency symbol of the jetton, master address if jetton is unknown
+func (m *Market) symbolOf(jetton string) string {
+	c, err := m.currencyOf(jetton)
+	if err != nil {
+		return jetton
+	}
+	return c.Symbol
+}
+
+// EventCurrency returns collateral currency of the event
+func (m *Market) EventCurrency(ctx context.Context, eventID uuid.UUID) (*Currency, error) {
+	eventCopy, err := m.persistor.getCopyByID(ctx, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("market get event currency failed: %w", err)
+	}
+	c, err := m.currencyOf(eventCopy.Jetton)
+	if err != nil {
+		return nil, fmt.Errorf("market get event currency failed: %w", err)
+	}
+	return c, nil
+}
+
+// jettonWalletOf returns jetton wallet of the owner
+func (m *Market) jettonWalletOf(ctx context.Context, jetton, ownerRawAddress string) (ton.AccountID, error) {
+	master, err := ton.ParseAccountID(jetton)
+	if err != nil {
+		return ton.AccountID{}, fmt.Errorf("%w: %s", ErrUnknownCurrency, jetton)
+	}
+	owner, err := ton.ParseAccountID(ownerRawAddress)
+	if err != nil {
+		return ton.AccountID{}, err
+	}
+	return m.chain.JettonWallet(ctx, master, owner)
+}
+
+// jettonAttachedTon TON attached to a jetton transfer, covers fees and forwarded notification
+func jettonAttachedTon() tlb.Grams {
+	return utils.FloatToGrams(config.Config.Jetton.TransferTon + config.Config.Jetton.ForwardTon)
+}
+
+const jettonExcessesOp = 0xd53276db
+
+// jettonTransferBody TEP-74 transfer sent to the jetton wallet of the sender
+type jettonTransferBody struct {
+	Magic               tlb.Magic `tlb:"#0f8a7ea5"`
+	QueryID             uint64
+	Amount              tlb.VarUInteger16
+	Destination         tlb.MsgAddress
+	ResponseDestination tlb.MsgAddress
+	CustomPayload       *tlb.Any `tlb:"maybe^"`
+	ForwardTonAmount    tlb.VarUInteger16
+	ForwardPayload      tlb.EitherRef[tlb.Any]
+}
+
+// jettonNotifyBody TEP-74 transfer notification sent by the jetton wallet to the recipient
+type jettonNotifyBody struct {
+	Magic          tlb.Magic `tlb:"#7362d09c"`
+	QueryID        uint64
+	Amount         tlb.VarUInteger16
+	Sender         tlb.MsgAddress
+	ForwardPayload tlb.EitherRef[tlb.Any]
+}
+
+// jettonTransfer decoded jetton transfer or notification, Peer is the destination of the transfer
+// or the sender of the notification
+type jettonTransfer struct {
+	Amount  tlb.Grams
+	Peer    ton.AccountID
+	Comment string
+}
+
+// buildJettonTransfer returns transfer body with text comment forwarded to the destination,
+// excess TON returns to the response address
+func buildJettonTransfer(amount tlb.Grams, dest, response ton.AccountID, comment string) (*boc.Cell, error) {
+	payload := boc.NewCell()
+	if err := tlb.Marshal(payload, wallet.TextComment(comment)); err != nil {
+		return nil, fmt.Errorf("build jetton transfer failed: %w", err)
+	}
+
+	body := jettonTransferBody{
+		Amount:              tlb.VarUInteger16(*new(big.Int).SetUint64(uint64(amount))),
+		Destination:         dest.ToMsgAddress(),
+		ResponseDestination: response.ToMsgAddress(),
+		ForwardTonAmount:    tlb.VarUInteger16(*big.NewInt(int64(utils.FloatToGrams(config.Config.Jetton.ForwardTon)))),
+		ForwardPayload:      tlb.EitherRef[tlb.Any]{IsRight: true, Value: tlb.Any(*payload)},
+	}
+
+	cell := boc.NewCell()
+	if err := tlb.Marshal(cell, body); err != nil {
+		return nil, fmt.Errorf("build jetton transfer failed: %w", err)
+	}
+	return cell, nil
+}
+
+// parseJettonTransfer decodes jetton transfer body
+func parseJettonTransfer(body *boc.Cell) (*jettonTransfer, bool) {
+	if body == nil {
+		return nil, false
+	}
+	defer body.ResetCounters()
+
+	var t jettonTransferBody
+	if err := tlb.Unmarshal(body, &t); err != nil {
+		return nil, false
+	}
+	return toJettonTransfer(t.Amount, t.Destination, t.ForwardPayload)
+}
+
+// parseJettonNotify decodes transfer notification body
+func parseJettonNotify(body *boc.Cell) (*jettonTransfer, bool) {
+	if body == nil {
+		return nil, false
+	}
+	defer body.ResetCounters()
+
+	var n jettonNotifyBody
+	if err := tlb.Unmarshal(body, &n); err != nil {
+		return nil, false
+	}
+	return toJettonTransfer(n.Amount, n.Sender, n.ForwardPayload)
+}
+
+func toJettonTransfer(amount tlb.VarUInteger16, peer tlb.MsgAddress, payload tlb.EitherRef[tlb.Any]) (*jettonTransfer, bool) {
+	a := big.Int(amount)
+	if !a.IsUint64() {
+		return nil, false
+	}
+	id, err := ton.AccountIDFromTlb(peer)
+	if err != nil || id == nil {
+		return nil, false
+	}
+
+	comment := boc.Cell(payload.Value)
+	return &jettonTransfer{
+		Amount:  tlb.Grams(a.Uint64()),
+		Peer:    *id,
+		Comment: decodeComment(&comment),
+	}, true
+}
+
+// bodyOp returns op code of the message body
+func bodyOp(body *boc.Cell) (uint32, bool) {
+	if body == nil {
+		return 0, false
+	}
+	defer body.ResetCounters()
+
+	op, err := body.ReadUint(32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(op), true
+}
@@ -0,0 +1,120 @@
+package market
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"time"
+)
+
+func (m *Market) UpdateEvent(ctx context.Context, id uuid.UUID, patch *EventPatch) error {
+	eventCopy, err := m.persistor.getCopyByID(ctx, id)
+	if err != nil {
+		return fmt.Errorf("market update event failed: %w", err)
+	}
+	if eventCopy.isFinished() {
+		return fmt.Errorf("market update event failed: %w", ErrEventFinished)
+	}
+	if eventCopy.isClosing() {
+		return fmt.Errorf("market update event failed: %w", ErrEventClosing)
+	}
+
+	patched, err := eventCopy.apply(patch)
+	if err != nil {
+		return fmt.Errorf("market update event failed: %w", err)
+	}
+
+	if err := m.persistor.updateEvent(ctx, patched); err != nil {
+		return fmt.Errorf("market update event failed: %w", err)
+	}
+	if _, _, err := m.refreshBetting(ctx, id, time.Now()); err != nil {
+		return fmt.Errorf("market update event failed: %w", err)
+	}
+
+	m.notifyEvent(ctx, id)
+	return nil
+}
+
+// SuspendEvent stops accepting bets until ResumeEvent is called
+func (m *Market) SuspendEvent(ctx context.Context, id uuid.UUID) error {
+	eventCopy, err := m.persistor.getCopyByID(ctx, id)
+	if err != nil {
+		return fmt.Errorf("market suspend event failed: %w", err)
+	}
+	if eventCopy.Status != EventActive {
+		return fmt.Errorf("market suspend event failed: %w", ErrEventNotActive)
+	}
+
+	if err := m.persistor.setEventStatus(ctx, id, EventSuspended, EventActive); err != nil {
+		return fmt.Errorf("market suspend event failed: %w", err)
+	}
+	if err := m.runtimer.close(ctx, id); err != nil {
+		return fmt.Errorf("market suspend event failed: %w", err)
+	}
+
+	m.notifyEvent(ctx, id)
+	return nil
+}
+
+func (m *Market) ResumeEvent(ctx context.Context, id uuid.UUID) error {
+	eventCopy, err := m.persistor.getCopyByID(ctx, id)
+	if err != nil {
+		return fmt.Errorf("market resume event failed: %w", err)
+	}
+	if eventCopy.isClosing() {
+		return fmt.Errorf("market resume event failed: %w", ErrEventClosing)
+	}
+	if eventCopy.Status != EventSuspended {
+		return fmt.Errorf("market resume event failed: %w", ErrEventNotSuspended)
+	}
+
+	if err := m.persistor.setEventStatus(ctx, id, EventActive, EventSuspended); err != nil {
+		return fmt.Errorf("market resume event failed: %w", err)
+	}
+	// betting is reopened only inside the event window
+	if _, _, err := m.refreshBetting(ctx, id, time.Now()); err != nil {
+		return fmt.Errorf("market resume event failed: %w", err)
+	}
+
+	m.notifyEvent(ctx, id)
+	return nil
+}
+
+// VoidEvent cancels event without a winner and refunds all stakes
+func (m *Market) VoidEvent(ctx context.Context, id uuid.UUID) error {
+	eventCopy, err := m.persistor.getCopyByID(ctx, id)
+	if err != nil {
+		return fmt.Errorf("market void event failed: %w", err)
+	}
+	if eventCopy.isFinished() {
+		return fmt.Errorf("market void event failed: %w", ErrEventFinished)
+	}
+
+	// event stays voiding until refunds are saved, so an interrupted void can be repeated,
+	// resolving event can't be voided
+	if err := m.persistor.beginClose(ctx, id, EventVoiding, ""); err != nil {
+		return fmt.Errorf("market void event failed: %w", err)
+	}
+	if err := m.runtimer.close(ctx, id); err != nil {
+		return fmt.Errorf("market void event failed: %w", err)
+	}
+	time.Sleep(closeDelay)
+	c, err := m.currencyOf(eventCopy.Jetton)
+	if err != nil {
+		return fmt.Errorf("market void event failed: %w", err)
+	}
+	if err := m.cancelEventOrders(ctx, id, c); err != nil {
+		return fmt.Errorf("market void event failed: %w", err)
+	}
+
+	refundList, fee, err := m.buildRefundData(ctx, id, c)
+	if err != nil {
+		return fmt.Errorf("market void event failed: %w", err)
+	}
+	if err := m.persistor.finishClose(ctx, id, "", refundList, fee); err != nil {
+		return fmt.Errorf("market void event failed: %w", err)
+	}
+
+	m.notifyEvent(ctx, id)
+	return nil
+}
@@ -0,0 +1,194 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"github.com/TON-Market/tma/server/datatype/token"
+	"github.com/google/uuid"
+	"testing"
+)
+
+func TestEventCheckClose(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   EventStatus
+		winToken token.Token
+		to       EventStatus
+		toToken  token.Token
+		wantErr  error
+	}{
+		{"resolve active", EventActive, "", EventResolving, token.A, nil},
+		{"void suspended", EventSuspended, "", EventVoiding, "", nil},
+		{"repeat resolve", EventResolving, token.A, EventResolving, token.A, nil},
+		{"repeat void", EventVoiding, "", EventVoiding, "", nil},
+		{"resolve to other token", EventResolving, token.A, EventResolving, token.B, ErrEventClosing},
+		{"void resolving", EventResolving, token.A, EventVoiding, "", ErrEventClosing},
+		{"resolve voiding", EventVoiding, "", EventResolving, token.A, ErrEventClosing},
+		{"resolve resolved", EventResolved, token.A, EventResolving, token.A, ErrEventFinished},
+		{"void voided", EventVoided, "", EventVoiding, "", ErrEventFinished},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Event{Status: tt.status, WinToken: tt.winToken}
+			if err := e.checkClose(tt.to, tt.toToken); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestInterruptedCloseKeepsOutcome repeats the close interrupted before payouts were saved,
+// other outcome, void and resume are rejected and the event is paid out once
+func TestInterruptedCloseKeepsOutcome(t *testing.T) {
+	loadTestConfig(t)
+	pool := testPool(t)
+	chain := newTestChain(t)
+	m := newTestMarket(t, chain, pool)
+	ctx := context.Background()
+
+	e := addTestEvent(t, m)
+	placeTestStake(t, m, chain, testUserAddr, e.ID, token.A, 10)
+	placeTestStake(t, m, chain, testOtherAddr, e.ID, token.B, 5)
+	settleTestTransfers(t, m)
+
+	// close to A crashed after the event became resolving
+	if err := m.persistor.beginClose(ctx, e.ID, EventResolving, token.A); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.CloseEvent(ctx, e.ID, token.B); !errors.Is(err, ErrEventClosing) {
+		t.Fatalf("close to other token err = %v, want %v", err, ErrEventClosing)
+	}
+	if err := m.VoidEvent(ctx, e.ID); !errors.Is(err, ErrEventClosing) {
+		t.Fatalf("void err = %v, want %v", err, ErrEventClosing)
+	}
+	if err := m.ResumeEvent(ctx, e.ID); !errors.Is(err, ErrEventClosing) {
+		t.Fatalf("resume err = %v, want %v", err, ErrEventClosing)
+	}
+
+	if err := m.CloseEvent(ctx, e.ID, token.A); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CloseEvent(ctx, e.ID, token.A); !errors.Is(err, ErrEventFinished) {
+		t.Fatalf("second close err = %v, want %v", err, ErrEventFinished)
+	}
+
+	eventCopy, err := m.persistor.getCopyByID(ctx, e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eventCopy.Status != EventResolved || eventCopy.WinToken != token.A {
+		t.Fatalf("event status, win token = %d, %s, want %d, %s", eventCopy.Status, eventCopy.WinToken,
+			EventResolved, token.A)
+	}
+	payoutList := getTestPayouts(t, pool, e.ID)
+	if len(payoutList) != 1 || payoutList[0].UserRawAddress != testUserAddr || payoutList[0].Kind != PayoutWin {
+		t.Fatalf("payouts = %+v, want one win payout of %s", payoutList, testUserAddr)
+	}
+}
+
+// TestFinishCloseRejectsOtherOutcome saves no payouts when the event moved on while payouts were built
+func TestFinishCloseRejectsOtherOutcome(t *testing.T) {
+	loadTestConfig(t)
+	pool := testPool(t)
+	m := newTestMarket(t, newTestChain(t), pool)
+	ctx := context.Background()
+
+	e := addTestEvent(t, m)
+	if err := m.persistor.beginClose(ctx, e.ID, EventResolving, token.A); err != nil {
+		t.Fatal(err)
+	}
+
+	up := &UserProfit{ID: uuid.New(), Kind: PayoutRefund, UserRawAddress: testUserAddr, Grams: 1e9,
+		EventID: e.ID, Comment: "event voided: " + e.ID.String(), State: PayoutPending}
+	if err := m.persistor.finishClose(ctx, e.ID, "", []*UserProfit{up}, nil); !errors.Is(err,
+		ErrEventStatusConflict) {
+		t.Fatalf("finish void of resolving event err = %v, want %v", err, ErrEventStatusConflict)
+	}
+	if payoutList := getTestPayouts(t, pool, e.ID); len(payoutList) != 0 {
+		t.Fatalf("payouts = %+v, want none", payoutList)
+	}
+}
+
+// TestVoidRacingResolve runs void and resolve of the same event concurrently,
+// only one of them wins and the event is paid out by its payouts only
+func TestVoidRacingResolve(t *testing.T) {
+	loadTestConfig(t)
+	pool := testPool(t)
+	chain := newTestChain(t)
+	m := newTestMarket(t, chain, pool)
+	ctx := context.Background()
+
+	e := addTestEvent(t, m)
+	placeTestStake(t, m, chain, testUserAddr, e.ID, token.A, 10)
+	placeTestStake(t, m, chain, testOtherAddr, e.ID, token.B, 5)
+	settleTestTransfers(t, m)
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- m.CloseEvent(ctx, e.ID, token.A) }()
+	go func() { errCh <- m.VoidEvent(ctx, e.ID) }()
+
+	var failed int
+	for range 2 {
+		err := <-errCh
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrEventClosing) && !errors.Is(err, ErrEventFinished) {
+			t.Fatal(err)
+		}
+		failed++
+	}
+	if failed != 1 {
+		t.Fatalf("failed closes = %d, want 1", failed)
+	}
+
+	eventCopy, err := m.persistor.getCopyByID(ctx, e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantKind, wantPayouts := PayoutWin, 1
+	if eventCopy.Status == EventVoided {
+		wantKind, wantPayouts = PayoutRefund, 2
+	}
+	payoutList := getTestPayouts(t, pool, e.ID)
+	if len(payoutList) != wantPayouts {
+		t.Fatalf("event status: %d, payouts = %d, want %d", eventCopy.Status, len(payoutList), wantPayouts)
+	}
+	for _, p := range payoutList {
+		if p.Kind != wantKind {
+			t.Fatalf("event status: %d, payout kind = %d, want %d", eventCopy.Status, p.Kind, wantKind)
+		}
+	}
+}
+
+// TestInterruptedVoid repeats the void interrupted before refunds were saved, resolve is rejected meanwhile
+func TestInterruptedVoid(t *testing.T) {
+	loadTestConfig(t)
+	pool := testPool(t)
+	chain := newTestChain(t)
+	m := newTestMarket(t, chain, pool)
+	ctx := context.Background()
+
+	e := addTestEvent(t, m)
+	placeTestStake(t, m, chain, testUserAddr, e.ID, token.A, 10)
+	settleTestTransfers(t, m)
+
+	if err := m.persistor.beginClose(ctx, e.ID, EventVoiding, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CloseEvent(ctx, e.ID, token.A); !errors.Is(err, ErrEventClosing) {
+		t.Fatalf("close of voiding event err = %v, want %v", err, ErrEventClosing)
+	}
+	if err := m.VoidEvent(ctx, e.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.VoidEvent(ctx, e.ID); !errors.Is(err, ErrEventFinished) {
+		t.Fatalf("second void err = %v, want %v", err, ErrEventFinished)
+	}
+
+	payoutList := getTestPayouts(t, pool, e.ID)
+	if len(payoutList) != 1 || payoutList[0].Kind != PayoutRefund {
+		t.Fatalf("payouts = %+v, want one refund", payoutList)
+	}
+}
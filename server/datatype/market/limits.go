@@ -0,0 +1,78 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/TON-Market/tma/server/config"
+	"github.com/TON-Market/tma/server/datatype/token"
+	"github.com/tonkeeper/tongo/tlb"
+	"math"
+)
+
+var (
+	// ErrStakeLimit is wrapped by every limit error, deals breaking limits at confirmation are refunded
+	ErrStakeLimit        = errors.New("stake limit")
+	ErrStakeTooSmall     = fmt.Errorf("%w: stake is below minimum", ErrStakeLimit)
+	ErrStakeTooLarge     = fmt.Errorf("%w: stake is above maximum", ErrStakeLimit)
+	ErrExposureLimit     = fmt.Errorf("%w: user exposure on the event is above maximum", ErrStakeLimit)
+	ErrOutcomeCapReached = fmt.Errorf("%w: outcome pool cap reached", ErrStakeLimit)
+	ErrInvalidOutcomeCap = errors.New("invalid outcome cap")
+)
+
+func (e *Event) validateOutcomeCap() error {
+	if e.OutcomeCap < 0 || math.IsInf(e.OutcomeCap, 0) || math.IsNaN(e.OutcomeCap) {
+		return fmt.Errorf("%w: %v", ErrInvalidOutcomeCap, e.OutcomeCap)
+	}
+	return nil
+}
+
+// formatOutcomeCap returns empty string if the event is not capped
+func (m *Market) formatOutcomeCap(e Event) string {
+	if e.OutcomeCap == 0 {
+		return ""
+	}
+	c, err := m.currencyOf(e.Jetton)
+	if err != nil {
+		return ""
+	}
+	return c.Format(c.FromFloat(e.OutcomeCap))
+}
+
+// checkStakeLimits checks collateral staked by addr on outcome t against min and max stake,
+// max exposure of the user on the event and the outcome pool cap
+func (m *Market) checkStakeLimits(ctx context.Context, e *Event, es *eventState, c *Currency, addr string,
+	t token.Token, collateral tlb.Grams) error {
+	if minStake := c.FromFloat(config.Config.Stake.Min); collateral == 0 || collateral < minStake {
+		return fmt.Errorf("%w: %s of min %s %s", ErrStakeTooSmall, c.Format(collateral), c.Format(minStake), c.Symbol)
+	}
+	if config.Config.Stake.Max > 0 {
+		if maxStake := c.FromFloat(config.Config.Stake.Max); collateral > maxStake {
+			return fmt.Errorf("%w: %s of max %s %s", ErrStakeTooLarge, c.Format(collateral), c.Format(maxStake),
+				c.Symbol)
+		}
+	}
+
+	if e.OutcomeCap > 0 {
+		var pool tlb.Grams
+		if bs, ok := es.betStateMap[t]; ok {
+			pool = bs.collateral
+		}
+		if outcomeCap := c.FromFloat(e.OutcomeCap); pool+collateral > outcomeCap {
+			return fmt.Errorf("%w: token: %s, pool: %s, stake: %s of cap %s %s", ErrOutcomeCapReached, t,
+				c.Format(pool), c.Format(collateral), c.Format(outcomeCap), c.Symbol)
+		}
+	}
+
+	if config.Config.Stake.MaxUserExposure > 0 {
+		exposure, err := m.persistor.getUserExposure(ctx, addr, e.ID)
+		if err != nil {
+			return err
+		}
+		if maxExposure := c.FromFloat(config.Config.Stake.MaxUserExposure); exposure+collateral > maxExposure {
+			return fmt.Errorf("%w: staked: %s, stake: %s of max %s %s", ErrExposureLimit, c.Format(exposure),
+				c.Format(collateral), c.Format(maxExposure), c.Symbol)
+		}
+	}
+	return nil
+}
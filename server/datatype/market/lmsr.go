@@ -0,0 +1,132 @@
+package market
+
+import (
+	"errors"
+	"fmt"
+	"github.com/TON-Market/tma/server/config"
+	"github.com/tonkeeper/tongo/tlb"
+	"math"
+)
+
+type PricingKind string
+
+const (
+	// PricingParimutuel winners share the losing pool, stake size equals collateral
+	PricingParimutuel PricingKind = "parimutuel"
+	// PricingLMSR stakes buy outcome shares from the house market maker, each winning share pays one unit
+	PricingLMSR PricingKind = "lmsr"
+)
+
+// PricingSpec pricing mode of the event, parimutuel when not set.
+// Liquidity is the LMSR parameter b in whole units of the event collateral, default is taken from config.
+// The house can lose at most b * ln(outcomes) on the event.
+type PricingSpec struct {
+	Kind      PricingKind `json:"kind"`
+	Liquidity float64     `json:"liquidity,omitempty"`
+}
+
+var ErrInvalidPricing = errors.New("invalid event pricing")
+
+func (p *PricingSpec) validate() error {
+	switch p.Kind {
+	case PricingParimutuel:
+		if p.Liquidity != 0 {
+			return fmt.Errorf("%w: liquidity is set for parimutuel event", ErrInvalidPricing)
+		}
+	case PricingLMSR:
+		if p.Liquidity <= 0 || math.IsInf(p.Liquidity, 0) || math.IsNaN(p.Liquidity) {
+			return fmt.Errorf("%w: liquidity must be positive", ErrInvalidPricing)
+		}
+	default:
+		return fmt.Errorf("%w: unknown kind: %s", ErrInvalidPricing, p.Kind)
+	}
+	return nil
+}
+
+// normalizePricing drops parimutuel spec and fills default liquidity of LMSR
+func (e *Event) normalizePricing() error {
+	if e.Pricing == nil {
+		return nil
+	}
+	if e.Pricing.Kind == PricingLMSR && e.Pricing.Liquidity == 0 {
+		e.Pricing.Liquidity = config.Config.Pricing.LmsrLiquidity
+	}
+	if err := e.Pricing.validate(); err != nil {
+		return err
+	}
+	if e.Pricing.Kind == PricingParimutuel {
+		e.Pricing = nil
+	}
+	return nil
+}
+
+func (e *Event) isLMSR() bool {
+	return e.Pricing != nil && e.Pricing.Kind == PricingLMSR
+}
+
+// eventLiquidity returns LMSR parameter in minimal units of the collateral, 0 for parimutuel event
+func (m *Market) eventLiquidity(e *Event) (tlb.Grams, error) {
+	if !e.isLMSR() {
+		return 0, nil
+	}
+	c, err := m.currencyOf(e.Jetton)
+	if err != nil {
+		return 0, err
+	}
+	return c.FromFloat(e.Pricing.Liquidity), nil
+}
+
+// lmsrShares returns shares of outcome i bought for cost with outstanding shares q and liquidity b.
+// Cost of the market maker is C(q) = b * ln(sum(exp(q_j / b))), the buy solves C(q + x * e_i) - C(q) = cost
+// for x. Exponents are shifted by max q, so large pools don't overflow.
+func lmsrShares(q []float64, i int, cost, b float64) float64 {
+	if cost <= 0 {
+		return 0
+	}
+	maxQ := q[0]
+	for _, qj := range q[1:] {
+		maxQ = max(maxQ, qj)
+	}
+
+	var sum float64
+	for _, qj := range q {
+		sum += math.Exp((qj - maxQ) / b)
+	}
+
+	// ln(sum * (exp(cost / b) - 1)) without computing exp(cost / b)
+	logGrowth := math.Log(sum) + cost/b + math.Log1p(-math.Exp(-cost/b))
+	logOwn := (q[i] - maxQ) / b
+	hi, lo := max(logGrowth, logOwn), min(logGrowth, logOwn)
+	logX := hi + math.Log1p(math.Exp(lo-hi))
+
+	return maxQ + b*logX - q[i]
+}
+
+// lmsrSellValue returns collateral paid for x shares of outcome i sold back, C(q) - C(q - x * e_i),
+// which is -b * ln(1 - p_i * (1 - exp(-x / b))) for the current price p_i
+func lmsrSellValue(q []float64, i int, x, b float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	p := lmsrPrices(q, b)[i]
+	return -b * math.Log1p(p*math.Expm1(-x/b))
+}
+
+// lmsrPrices returns instant prices of outcomes, prices sum to 1
+func lmsrPrices(q []float64, b float64) []float64 {
+	maxQ := q[0]
+	for _, qj := range q[1:] {
+		maxQ = max(maxQ, qj)
+	}
+
+	prices := make([]float64, len(q))
+	var sum float64
+	for j, qj := range q {
+		prices[j] = math.Exp((qj - maxQ) / b)
+		sum += prices[j]
+	}
+	for j := range prices {
+		prices[j] /= sum
+	}
+	return prices
+}
@@ -0,0 +1,147 @@
+package market
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// lmsrCost is the market maker cost C(q) = b * ln(sum(exp(q_j / b)))
+func lmsrCost(q []float64, b float64) float64 {
+	maxQ := q[0]
+	for _, qj := range q[1:] {
+		maxQ = max(maxQ, qj)
+	}
+	var sum float64
+	for _, qj := range q {
+		sum += math.Exp((qj - maxQ) / b)
+	}
+	return maxQ + b*math.Log(sum)
+}
+
+// almostEqual compares with tolerance relative to the larger value, at least 1e-9 absolute
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*max(1, math.Abs(a), math.Abs(b))
+}
+
+var lmsrTests = []struct {
+	name string
+	q    []float64
+	b    float64
+}{
+	{"empty two outcomes", []float64{0, 0}, 100},
+	{"empty five outcomes", []float64{0, 0, 0, 0, 0}, 100},
+	{"skewed", []float64{250, 10, 0}, 100},
+	{"small liquidity", []float64{3, 1}, 0.5},
+	{"nano units", []float64{40e9, 25e9, 5e9}, 100e9},
+	{"large pool", []float64{1e6, 2e6}, 1e3},
+}
+
+func TestLmsrPricesSumToOne(t *testing.T) {
+	for _, tt := range lmsrTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sum float64
+			for j, p := range lmsrPrices(tt.q, tt.b) {
+				if p < 0 || p > 1 || math.IsNaN(p) {
+					t.Fatalf("price %d = %v", j, p)
+				}
+				sum += p
+			}
+			if !almostEqual(sum, 1) {
+				t.Fatalf("prices sum = %v, want 1", sum)
+			}
+		})
+	}
+}
+
+func TestLmsrSharesInverseOfCost(t *testing.T) {
+	for _, tt := range lmsrTests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := range tt.q {
+				for _, cost := range []float64{tt.b / 1e3, tt.b / 10, tt.b, 5 * tt.b} {
+					x := lmsrShares(tt.q, i, cost, tt.b)
+					if x <= 0 {
+						t.Fatalf("shares of %d for %v = %v", i, cost, x)
+					}
+
+					after := append([]float64(nil), tt.q...)
+					after[i] += x
+					if delta := lmsrCost(after, tt.b) - lmsrCost(tt.q, tt.b); !almostEqual(delta, cost) {
+						t.Fatalf("outcome %d: C(q + x) - C(q) = %v, want %v", i, delta, cost)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLmsrBuySellRoundTrip(t *testing.T) {
+	for _, tt := range lmsrTests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := range tt.q {
+				cost := tt.b / 3
+				x := lmsrShares(tt.q, i, cost, tt.b)
+
+				after := append([]float64(nil), tt.q...)
+				after[i] += x
+				if value := lmsrSellValue(after, i, x, tt.b); !almostEqual(value, cost) {
+					t.Fatalf("outcome %d: sell of %v shares = %v, want %v", i, x, value, cost)
+				}
+			}
+		})
+	}
+}
+
+func TestLmsrZeroAmounts(t *testing.T) {
+	q := []float64{10, 0}
+	if x := lmsrShares(q, 0, 0, 100); x != 0 {
+		t.Fatalf("shares for 0 = %v, want 0", x)
+	}
+	if v := lmsrSellValue(q, 0, 0, 100); v != 0 {
+		t.Fatalf("sell value of 0 = %v, want 0", v)
+	}
+}
+
+// TestLmsrWorstCaseLoss buys random outcomes from the empty market, whichever outcome wins
+// the house pays no more than b * ln(n) above the collected collateral
+func TestLmsrWorstCaseLoss(t *testing.T) {
+	const b = 100.0
+	rnd := rand.New(rand.NewSource(1))
+
+	for _, n := range []int{2, 3, 5, 26} {
+		bound := b * math.Log(float64(n))
+		q := make([]float64, n)
+		var collected float64
+
+		for k := 0; k < 1000; k++ {
+			i := rnd.Intn(n)
+			cost := rnd.Float64() * b
+			q[i] += lmsrShares(q, i, cost, b)
+			collected += cost
+
+			for j, qj := range q {
+				if loss := qj - collected; loss > bound*(1+1e-9) {
+					t.Fatalf("n: %d, outcome %d wins: loss = %v above b * ln(n) = %v", n, j, loss, bound)
+				}
+			}
+		}
+	}
+}
+
+// TestLmsrWorstCaseLossTight buys only one outcome, the house loss approaches b * ln(n) when it wins
+func TestLmsrWorstCaseLossTight(t *testing.T) {
+	const b = 100.0
+	for _, n := range []int{2, 3, 5, 26} {
+		bound := b * math.Log(float64(n))
+		q := make([]float64, n)
+		var collected float64
+		for k := 0; k < 100; k++ {
+			q[0] += lmsrShares(q, 0, b, b)
+			collected += b
+		}
+
+		if loss := q[0] - collected; loss > bound*(1+1e-9) || loss < 0.99*bound {
+			t.Fatalf("n: %d, loss = %v, want close to b * ln(n) = %v", n, loss, bound)
+		}
+	}
+}
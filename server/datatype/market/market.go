@@ -2,13 +2,13 @@ package market
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"github.com/TON-Market/tma/server/datatype/token"
+	"github.com/TON-Market/tma/server/config"
 	"github.com/TON-Market/tma/server/db"
 	"github.com/TON-Market/tma/server/utils"
 	"github.com/google/uuid"
-	"github.com/tonkeeper/tongo/boc"
-	"github.com/tonkeeper/tongo/liteapi"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/tonkeeper/tongo/tlb"
 	"github.com/tonkeeper/tongo/ton"
 	"github.com/tonkeeper/tongo/wallet"
@@ -20,25 +20,47 @@ import (
 type DepositReq struct {
 	ID            uuid.UUID
 	DepositStatus DepositStatus
-	Time          time.Time
 }
 
 type Market struct {
-	wallet       wallet.Wallet
-	WsCh         chan *EventDTO
-	depositReqCh chan *DepositReq
-	profitCh     chan *UserProfit
-	client       *liteapi.Client
-	snapshot     *snapshot
-	persistor    *persistor
-	runtimer     *runtimer
+	chain      Chain
+	WsCh       chan *EventDTO
+	BookCh     chan *OrderBookDTO
+	snapshot   *snapshot
+	persistor  *persistor
+	runtimer   *runtimer
+	currencies *currencyRegistry
 }
 
 func (m *Market) SaveDealUnchecked(ctx context.Context, d *Deal) error {
-	es := m.runtimer.getEventState(ctx, d.EventID)
+	eventCopy, err := m.persistor.getCopyByID(ctx, d.EventID)
+	if err != nil {
+		return fmt.Errorf("market save deal unchecked failed: %w", err)
+	}
+	if err := eventCopy.checkWindow(time.Now()); err != nil {
+		return fmt.Errorf("market save deal unchecked failed: %w", err)
+	}
+	es, err := m.runtimer.getEventState(ctx, d.EventID)
+	if err != nil {
+		return fmt.Errorf("market save deal unchecked failed: %w", err)
+	}
 	if !es.isActive {
 		return ErrEventClosed
 	}
+	if _, ok := es.betStateMap[d.Token]; !ok {
+		return fmt.Errorf("market save deal unchecked failed: %w: %s", ErrUnknownOutcome, d.Token)
+	}
+	c, err := m.currencyOf(eventCopy.Jetton)
+	if err != nil {
+		return fmt.Errorf("market save deal unchecked failed: %w", err)
+	}
+	if err := m.checkStakeLimits(ctx, &eventCopy, es, c, d.UserRawAddr, d.Token, d.Collateral); err != nil {
+		return fmt.Errorf("market save deal unchecked failed: %w", err)
+	}
+	// size of LMSR deal is indicative, shares are priced again when the deposit is settled
+	if d.Size, err = m.runtimer.shares(ctx, d.EventID, d.Token, d.Collateral); err != nil {
+		return fmt.Errorf("market save deal unchecked failed: %w", err)
+	}
 	d.DealStatus = Unchecked
 	d.Attempts = 0
 	if err := m.persistor.saveDeal(ctx, d); err != nil {
@@ -48,169 +70,210 @@ func (m *Market) SaveDealUnchecked(ctx context.Context, d *Deal) error {
 }
 
 func (m *Market) AddEvent(ctx context.Context, e *Event) error {
+	if err := e.validateOutcomes(); err != nil {
+		return fmt.Errorf("market add event failed: %w", err)
+	}
+	if err := e.validateSchedule(); err != nil {
+		return fmt.Errorf("market add event failed: %w", err)
+	}
+	if err := e.validateResolver(); err != nil {
+		return fmt.Errorf("market add event failed: %w", err)
+	}
+	if e.FeePolicy != nil {
+		if err := e.FeePolicy.validate(); err != nil {
+			return fmt.Errorf("market add event failed: %w", err)
+		}
+	}
+	if err := e.normalizePricing(); err != nil {
+		return fmt.Errorf("market add event failed: %w", err)
+	}
+	if err := e.validateOutcomeCap(); err != nil {
+		return fmt.Errorf("market add event failed: %w", err)
+	}
+	if e.Jetton != "" {
+		master, err := ton.ParseAccountID(e.Jetton)
+		if err != nil {
+			return fmt.Errorf("market add event failed: %w: %s", ErrUnknownCurrency, e.Jetton)
+		}
+		e.Jetton = master.ToRaw()
+		if _, err := m.currencyOf(e.Jetton); err != nil {
+			return fmt.Errorf("market add event failed: %w", err)
+		}
+	}
+	liquidity, err := m.eventLiquidity(e)
+	if err != nil {
+		return fmt.Errorf("market add event failed: %w", err)
+	}
 	e.ID = uuid.New()
-	for _, b := range e.BetMap {
+	e.Status = EventActive
+	for t, b := range e.BetMap {
 		b.EventID = e.ID
+		b.Token = t
 	}
 	if err := m.persistor.saveEvent(ctx, e); err != nil {
 		return fmt.Errorf("market add event failed: %w", err)
 	}
-	if err := m.runtimer.saveEvent(ctx, e); err != nil {
+	if err := m.runtimer.saveEvent(ctx, e, liquidity); err != nil {
 		return fmt.Errorf("market add event failed: %w", err)
 	}
 	return nil
 }
 
-func (m *Market) GetUserAssets(ctx context.Context, addr string) ([]*AssetDTO, string, error) {
+// EventsCount returns number of known events
+func (m *Market) EventsCount() int {
+	return m.persistor.count()
+}
+
+// loadEvents fills event storage and runtimer from the db
+func (m *Market) loadEvents(ctx context.Context) error {
+	eventList, err := m.persistor.loadEvents(ctx)
+	if err != nil {
+		return fmt.Errorf("market load events failed: %w", err)
+	}
+
+	for _, e := range eventList {
+		// jetton of the event must stay in config until all its payouts are delivered
+		liquidity, err := m.eventLiquidity(e)
+		if err != nil {
+			return fmt.Errorf("market load events failed: event: %s: %w", e.ID.String(), err)
+		}
+		if err := m.persistor.eventStorage.saveEvent(ctx, e); err != nil {
+			return fmt.Errorf("market load events failed: %w", err)
+		}
+		if err := m.runtimer.saveEvent(ctx, e, liquidity); err != nil {
+			return fmt.Errorf("market load events failed: %w", err)
+		}
+	}
+
+	log.Printf("[INFO] %d events loaded\n\n", len(eventList))
+	return nil
+}
+
+// GetUserAssets returns user assets and total staked by currency symbol, TON total is always set
+func (m *Market) GetUserAssets(ctx context.Context, addr string) ([]*AssetDTO, map[string]string, error) {
 	assetList, err := m.persistor.getUserAssets(ctx, addr)
 	if err != nil {
-		return nil, "", fmt.Errorf("market get user assets failed: %w", err)
+		return nil, nil, fmt.Errorf("market get user assets failed: %w", err)
 	}
 
 	assetDtoList := make([]*AssetDTO, 0, len(assetList))
-	totalInMarket := tlb.Grams(0)
+	totalMap := map[string]tlb.Grams{"": 0}
 
 	for _, asset := range assetList {
-		totalInMarket += asset.CollateralStaked
-
 		eventCopy, err := m.persistor.getCopyByID(ctx, asset.EventID)
 		if err != nil {
-			return nil, "", fmt.Errorf("market get user assets failed: %w", err)
+			return nil, nil, fmt.Errorf("market get user assets failed: %w", err)
 		}
+		totalMap[eventCopy.Jetton] += asset.CollateralStaked
 
 		assetDto := &AssetDTO{
 			EventTitle:       eventCopy.Title,
 			BetTitle:         eventCopy.BetMap[asset.Token].Title,
-			CollateralStaked: utils.GramsToStringInFloat(asset.CollateralStaked),
-			Size:             utils.GramsToStringInFloat(asset.Size),
+			CollateralStaked: m.formatOf(eventCopy.Jetton, asset.CollateralStaked),
+			Size:             m.formatOf(eventCopy.Jetton, asset.Size),
+			Currency:         m.symbolOf(eventCopy.Jetton),
 		}
 
 		assetDtoList = append(assetDtoList, assetDto)
 	}
-	return assetDtoList, utils.GramsToStringInFloat(totalInMarket), nil
+
+	totalInMarketMap := make(map[string]string, len(totalMap))
+	for jetton, total := range totalMap {
+		totalInMarketMap[m.symbolOf(jetton)] = m.formatOf(jetton, total)
+	}
+	return assetDtoList, totalInMarketMap, nil
 }
 
-func (m *Market) Deposit(_ context.Context, dr *DepositReq) error {
-	dr.Time = time.Now()
-	m.depositReqCh <- dr
+const (
+	depositCheckDelay    = 20 * time.Second
+	depositCheckLease    = 2 * time.Minute
+	depositPollPeriod    = time.Second
+	depositBatchSize     = 10
+	depositMaxAttempts   = 6
+	depositWorkersNumber = 1
+)
+
+func (m *Market) Deposit(ctx context.Context, dr *DepositReq) error {
+	if dr.DepositStatus == ERROR {
+		if err := m.persistor.declineDeal(ctx, dr.ID, "declined by client", nil); err != nil {
+			return fmt.Errorf("market deposit failed: %w", err)
+		}
+		log.Printf("[INFO] deposit request declined, id: %s\n\n", dr.ID.String())
+		return nil
+	}
+	if err := m.persistor.enqueueDepositJob(ctx, dr.ID, depositCheckDelay); err != nil {
+		return fmt.Errorf("market deposit failed: %w", err)
+	}
 	log.Printf("[INFO] deposit request registered, id: %s\n\n", dr.ID.String())
 	return nil
 }
 
+// resumeDepositJobs enqueues unchecked deals which lost their deposit request
+func (m *Market) resumeDepositJobs(ctx context.Context) error {
+	dealList, err := m.persistor.getPendingDeals(ctx)
+	if err != nil {
+		return fmt.Errorf("market resume deposit jobs failed: %w", err)
+	}
+	for _, d := range dealList {
+		if err := m.persistor.enqueueDepositJob(ctx, d.ID, 0); err != nil {
+			return fmt.Errorf("market resume deposit jobs failed: %w", err)
+		}
+	}
+	return nil
+}
+
 func (m *Market) checkIncomeTransactions(ctx context.Context) {
 	go func() {
-		for depositReq := range m.depositReqCh {
-			if depositReq.DepositStatus == ERROR {
-				if err := m.persistor.declineDeal(ctx, depositReq.ID); err != nil {
-					log.Printf("[ERROR] check income transaction failed, deal_id: %s, %s\n\n",
-						depositReq.ID.String(), err.Error())
-					m.depositReqCh <- depositReq
-				}
-				continue
-			}
-
-			if depositReq.Time.Add(20 * time.Second).After(time.Now()) {
-				m.depositReqCh <- depositReq
-				continue
-			}
-
-			isDepositDelivered, _ := m.tryCheckIfDepositDelivered(ctx, depositReq)
-			if isDepositDelivered {
-				if err := m.confirmSuccessTransaction(ctx, depositReq); err != nil {
-					log.Printf("[ERROR] confirm success transaction failed: %s\n\n", err.Error())
-				}
-				continue
-			}
+		ticker := time.NewTicker(depositPollPeriod)
+		defer ticker.Stop()
 
-			attempts, err := m.persistor.attemptDeal(ctx, depositReq.ID)
+		for range ticker.C {
+			jobList, err := m.persistor.claimDepositJobs(ctx, depositBatchSize, depositCheckLease)
 			if err != nil {
-				m.depositReqCh <- depositReq
+				log.Printf("[ERROR] claim deposit jobs failed: %s\n\n", err.Error())
 				continue
 			}
-
-			if attempts > 5 {
-				log.Printf("[ERROR] deal %v out of attempts\n\n", attempts)
-				continue
+			for _, job := range jobList {
+				m.processDepositJob(ctx, job)
 			}
-
-			m.depositReqCh <- depositReq
 		}
 	}()
 }
 
-func (m *Market) tryCheckIfDepositDelivered(ctx context.Context, depositReq *DepositReq) (bool, error) {
-	depositReq.Time = depositReq.Time.Add(20 * time.Second)
-	userRawAddress, err := m.persistor.getUserAddressByUncheckedDealID(ctx, depositReq.ID)
-	if err != nil {
-		return false, err
+func (m *Market) processDepositJob(ctx context.Context, job *depositJob) {
+	transfer, err := m.persistor.getMatchedTransfer(ctx, job.dealID)
+	if transfer != nil {
+		err = m.settleDeposit(ctx, transfer)
+		if err == nil || errors.Is(err, ErrDealAlreadyProcessed) {
+			return
+		}
+		log.Printf("[ERROR] %s\n\n", err.Error())
 	}
 
-	trxList, err := m.getLastTransactions(ctx, userRawAddress)
+	reason := "deposit not found"
 	if err != nil {
-		return false, err
+		reason = err.Error()
 	}
 
-	for _, trx := range trxList {
-		isDepositTransaction, err := m.isDepositTransaction(ctx, trx, depositReq)
-		if err != nil {
-			continue
-		}
-		if isDepositTransaction {
-			return true, nil
+	if job.attempts >= depositMaxAttempts {
+		log.Printf("[ERROR] deal %s out of attempts: %v\n\n", job.dealID.String(), job.attempts)
+		// received transfer is refunded as orphaned, the deal is declined with nothing received otherwise
+		if transfer != nil {
+			if err := m.persistor.orphanTransfer(ctx, transfer, "out of attempts: "+reason); err != nil {
+				log.Printf("[ERROR] orphan transfer lt: %d of deal %s failed: %s\n\n", transfer.Lt,
+					job.dealID.String(), err.Error())
+			}
+			return
 		}
-	}
-
-	return false, nil
-}
-
-func (m *Market) isDepositTransaction(_ context.Context, trx ton.Transaction, depositReq *DepositReq) (bool, error) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Println("[ALARM] Recovered in isDepositTransaction", r)
+		if err := m.persistor.declineDeal(ctx, job.dealID, "out of attempts: "+reason, nil); err != nil {
+			log.Printf("[ERROR] decline deal %s failed: %s\n\n", job.dealID.String(), err.Error())
 		}
-	}()
-	var t wallet.TextComment
-	if err := tlb.Unmarshal((*boc.Cell)(&trx.Msgs.OutMsgs.Values()[0].Value.Body.Value), &t); err != nil {
-		return false, err
+		return
 	}
 
-	comment := wallet.TextComment(depositReq.ID.String())
-
-	if t == comment {
-		return true, nil
-	}
-
-	return false, nil
-}
-
-func (m *Market) confirmSuccessTransaction(ctx context.Context, depositReq *DepositReq) error {
-	deal, err := m.persistor.verifyDealAndGet(ctx, depositReq.ID)
-	if err != nil {
-		return err
-	}
-	if err = m.runtimer.deposit(ctx, deal); err != nil {
-		return err
-	}
-	if err = m.sendToSocket(ctx, deal.EventID); err != nil {
-		return err
-	}
-	return nil
-}
-
-func (m *Market) getLastTransactions(ctx context.Context, userRawAddress string) ([]ton.Transaction, error) {
-	accountID, err := ton.ParseAccountID(userRawAddress)
-	if err != nil {
-		return nil, fmt.Errorf("failed get last transactions: %w", err)
-	}
-	for i := 0; i < 10; i++ {
-		l, err := m.client.GetLastTransactions(ctx, accountID, 10)
-		if err != nil {
-			time.Sleep(10 * time.Second)
-			continue
-		}
-		return l, nil
+	if err := m.persistor.retryDepositJob(ctx, job.dealID, time.Duration(job.attempts)*depositCheckDelay, reason); err != nil {
+		log.Printf("[ERROR] retry deposit job failed: %s\n\n", err.Error())
 	}
-	return nil, fmt.Errorf("failed get last transactions: tryied 10 times")
 }
 
 func (m *Market) sendToSocket(ctx context.Context, id uuid.UUID) error {
@@ -219,33 +282,28 @@ func (m *Market) sendToSocket(ctx context.Context, id uuid.UUID) error {
 		return fmt.Errorf("send to socket failed: %w", err)
 	}
 
-	eventState := m.runtimer.getEventState(ctx, id)
-
-	eventDTO := &EventDTO{
-		ID:              eventCopy.ID,
-		Tag:             eventCopy.Tag,
-		LogoLink:        eventCopy.LogoLink,
-		Title:           eventCopy.Title,
-		Collateral:      utils.GramsToStringInFloat(eventState.collateral),
-		CollateralGrams: eventState.collateral,
-		Bets: []*BetDTO{
-			{
-				Token:      token.A,
-				Title:      eventCopy.BetMap[token.A].Title,
-				Percentage: utils.FloatToString(eventState.betStateMap[token.A].percentage),
-			},
-			{
-				Token:      token.B,
-				Title:      eventCopy.BetMap[token.B].Title,
-				Percentage: utils.FloatToString(eventState.betStateMap[token.B].percentage),
-			},
-		},
+	eventState, err := m.runtimer.getEventState(ctx, id)
+	if err != nil {
+		return fmt.Errorf("send to socket failed: %w", err)
 	}
 
-	m.WsCh <- eventDTO
+	eventDTO := m.buildEventDTO(ctx, eventCopy, eventState)
+
+	select {
+	case m.WsCh <- &eventDTO:
+	default:
+		log.Printf("[WARNING] socket channel is full, event: %s update skipped\n\n", id.String())
+	}
 	return nil
 }
 
+// notifyEvent pushes event update to the socket, clients also get it with the next snapshot
+func (m *Market) notifyEvent(ctx context.Context, id uuid.UUID) {
+	if err := m.sendToSocket(ctx, id); err != nil {
+		log.Printf("[ERROR] %s\n\n", err.Error())
+	}
+}
+
 var (
 	once      sync.Once
 	singleton *Market
@@ -253,11 +311,11 @@ var (
 
 func GetMarket() *Market {
 	once.Do(func() {
-		client, err := liteapi.NewClientWithDefaultMainnet()
+		client, err := utils.NewLiteClient(config.Config.Network)
 		if err != nil {
 			log.Fatalln(err)
 		}
-		pk, err := wallet.SeedToPrivateKey(SEED)
+		pk, err := wallet.SeedToPrivateKey(config.Config.Secret.Seed)
 		if err != nil {
 			log.Fatalln(err)
 		}
@@ -267,36 +325,93 @@ func GetMarket() *Market {
 			log.Fatalln(err)
 		}
 
-		singleton = &Market{
-			w,
-			make(chan *EventDTO),
-			make(chan *DepositReq, 10000),
-			make(chan *UserProfit, 10000),
-			client,
-			&snapshot{
-				sync.RWMutex{},
-				make([]EventDTO, 0),
-			},
-			&persistor{
-				&eventStorage{
-					sync.RWMutex{},
-					make(map[uuid.UUID]*Event),
-				},
-				db.Get(),
-			},
-			&runtimer{
-				sync.RWMutex{},
-				make(map[uuid.UUID]*eventRuntime),
-			},
-		}
+		singleton = NewMarket(NewLiteChain(client, &w, payoutMessageLifetime), db.Get())
 	})
 	return singleton
 }
 
-func (m *Market) Start(ctx context.Context) {
+// NewMarket creates market on top of the chain, GetMarket is used by the server
+func NewMarket(chain Chain, pool *pgxpool.Pool) *Market {
+	return &Market{
+		chain,
+		make(chan *EventDTO, 100),
+		make(chan *OrderBookDTO, 100),
+		&snapshot{
+			sync.RWMutex{},
+			make([]EventDTO, 0),
+		},
+		&persistor{
+			&eventStorage{
+				sync.RWMutex{},
+				make(map[uuid.UUID]*Event),
+			},
+			pool,
+		},
+		&runtimer{
+			sync.RWMutex{},
+			make(map[uuid.UUID]*eventRuntime),
+		},
+		&currencyRegistry{
+			sync.RWMutex{},
+			make(map[string]*Currency),
+		},
+	}
+}
+
+// BankAddress returns address of the bank wallet in the configured network
+func (m *Market) BankAddress() string {
+	return m.chain.BankAddress().ToHuman(true, utils.IsTestnet())
+}
+
+var ErrBankAddressMismatch = errors.New("bank wallet is not BANK_ADDR")
+
+// checkBankAddress verifies that the bank wallet derived from the configured key is BANK_ADDR
+func (m *Market) checkBankAddress() error {
+	bank, err := ton.ParseAccountID(config.Config.Secret.BankAddress)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBankAddressMismatch, err)
+	}
+	if bank != m.chain.BankAddress() {
+		return fmt.Errorf("%w: bank wallet: %s, BANK_ADDR: %s", ErrBankAddressMismatch,
+			m.BankAddress(), config.Config.Secret.BankAddress)
+	}
+	return nil
+}
+
+func (m *Market) Start(ctx context.Context) error {
+	log.Printf("[INFO] network: %s, bank wallet: %s\n\n", config.Config.Network, m.BankAddress())
+	if err := m.checkBankAddress(); err != nil {
+		return err
+	}
+	if err := defaultFeePolicy().validate(); err != nil {
+		return fmt.Errorf("default fee config: %w", err)
+	}
+	if err := validateDepositConfig(); err != nil {
+		return fmt.Errorf("deposit config: %w", err)
+	}
+	if err := m.validateTreasuryConfig(); err != nil {
+		return fmt.Errorf("treasury config: %w", err)
+	}
+	if err := m.loadCurrencies(ctx); err != nil {
+		return err
+	}
+	if err := m.loadEvents(ctx); err != nil {
+		return err
+	}
+	if err := m.restoreRuntime(ctx); err != nil {
+		return err
+	}
+	if err := m.makeSnapshot(ctx); err != nil {
+		return err
+	}
+
 	ticker := time.NewTicker(5 * time.Second)
 
-	for i := 0; i < 1; i++ {
+	if err := m.resumeDepositJobs(ctx); err != nil {
+		return err
+	}
+
+	for i := 0; i < depositWorkersNumber; i++ {
 		m.checkIncomeTransactions(ctx)
 	}
 
@@ -309,5 +424,13 @@ func (m *Market) Start(ctx context.Context) {
 		defer ticker.Stop()
 	}()
 
+	m.startBankIndexer(ctx)
+	m.startReconciliation(ctx)
 	m.startResendProcess(ctx)
+	m.startTreasury(ctx)
+	m.startConsistencyCheck(ctx)
+	m.startSolvencyCheck(ctx)
+	m.startScheduler(ctx)
+	m.startResolutionWorker(ctx)
+	return nil
 }
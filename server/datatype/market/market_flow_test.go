@@ -0,0 +1,349 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"github.com/TON-Market/tma/server/datatype/token"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/tonkeeper/tongo/tlb"
+	"testing"
+	"time"
+)
+
+const testWalletFunds = 100e9
+
+// placeTestStake saves the deal and pays it from the funded user wallet like a wallet app does
+func placeTestStake(t *testing.T, m *Market, chain *FakeChain, addr string, eventID uuid.UUID, tk token.Token,
+	collateral float64) *Deal {
+	t.Helper()
+	ctx := context.Background()
+
+	addTestUser(t, m.persistor.pool, addr)
+	user := mustAccountID(t, addr)
+	chain.Fund(user, testWalletFunds)
+
+	grams := tonCurrency.FromFloat(collateral)
+	d := &Deal{ID: uuid.New(), EventID: eventID, Token: tk, Collateral: grams, UserRawAddr: addr, Size: grams}
+	if err := m.SaveDealUnchecked(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	payment, err := m.BuildPayment(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.Transfer(user, chain.BankAddress(), payment.Amount, d.ID.String()); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func assertDeal(t *testing.T, m *Market, id uuid.UUID, status DealStatus, outcome DepositOutcome) *Deal {
+	t.Helper()
+	d, err := m.persistor.getDeal(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.DealStatus != status || d.DepositOutcome != outcome {
+		t.Fatalf("deal: %s status, outcome = %d, %d, want %d, %d", id, d.DealStatus, d.DepositOutcome, status,
+			outcome)
+	}
+	return d
+}
+
+type testPayout struct {
+	UserProfit
+	state  PayoutState
+	txHash string
+}
+
+func getTestPayouts(t *testing.T, pool *pgxpool.Pool, eventID uuid.UUID) []*testPayout {
+	t.Helper()
+	q := `SELECT id, user_raw_addr, kind, grams, fee, comment, state, tx_hash FROM payouts WHERE event_id = $1
+          ORDER BY created_at`
+
+	rows, err := pool.Query(context.Background(), q, eventID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	payoutList := make([]*testPayout, 0)
+	for rows.Next() {
+		p := &testPayout{}
+		if err := rows.Scan(&p.ID, &p.UserRawAddress, &p.Kind, &p.Grams, &p.Fee, &p.Comment, &p.state,
+			&p.txHash); err != nil {
+			t.Fatal(err)
+		}
+		payoutList = append(payoutList, p)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return payoutList
+}
+
+// TestPayDepositClosePayout runs a parimutuel event end to end on the fake chain:
+// stakes are paid, indexed and settled, the event is closed and the winner payout is sent and confirmed
+func TestPayDepositClosePayout(t *testing.T) {
+	loadTestConfig(t)
+	pool := testPool(t)
+	chain := newTestChain(t)
+	m := newTestMarket(t, chain, pool)
+	ctx := context.Background()
+
+	e := addTestEvent(t, m)
+	winner := placeTestStake(t, m, chain, testUserAddr, e.ID, token.A, 10)
+	loser := placeTestStake(t, m, chain, testOtherAddr, e.ID, token.B, 5)
+
+	// deals wait for the bank transfer
+	assertDeal(t, m, winner.ID, Unchecked, DepositAwaiting)
+	assertDeal(t, m, loser.ID, Unchecked, DepositAwaiting)
+
+	if err := m.indexBankTransactions(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.matchBankTransfers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	assertDeal(t, m, winner.ID, Verified, DepositExact)
+	assertDeal(t, m, loser.ID, Verified, DepositExact)
+
+	es, err := m.runtimer.getEventState(ctx, e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if es.collateral != 15e9 {
+		t.Fatalf("pool collateral = %d, want %d", es.collateral, tlb.Grams(15e9))
+	}
+
+	if err := m.CloseEvent(ctx, e.ID, token.A); err != nil {
+		t.Fatal(err)
+	}
+	eventCopy, err := m.persistor.getCopyByID(ctx, e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eventCopy.Status != EventResolved {
+		t.Fatalf("event status = %d, want %d", eventCopy.Status, EventResolved)
+	}
+
+	payoutList := getTestPayouts(t, pool, e.ID)
+	if len(payoutList) != 1 {
+		t.Fatalf("payouts = %d, want 1", len(payoutList))
+	}
+	payout := payoutList[0]
+	if payout.UserRawAddress != testUserAddr || payout.Kind != PayoutWin || payout.state != PayoutPending {
+		t.Fatalf("payout = %+v", payout)
+	}
+
+	var eventFee tlb.Grams
+	if err := pool.QueryRow(ctx, `SELECT grams FROM event_fees WHERE event_id = $1`, e.ID).Scan(&eventFee); err != nil {
+		t.Fatal(err)
+	}
+	// both stakes are paid out or kept as fee, rounding loses at most a gram per payout
+	if total := payout.Grams + eventFee; total > 15e9 || total < 15e9-1 {
+		t.Fatalf("payout %d + fee %d = %d, want %d", payout.Grams, eventFee, total, tlb.Grams(15e9))
+	}
+
+	scan, err := m.scanBankPayouts(ctx, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery, err := m.checkPayoutDelivery(&payout.UserProfit, scan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivery != payoutNotEmitted {
+		t.Fatal("payout is delivered before it is sent")
+	}
+
+	claimed, err := m.persistor.claimPayouts(ctx, payoutBatchSize, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.processPayouts(ctx, claimed)
+
+	if payout = getTestPayouts(t, pool, e.ID)[0]; payout.state != PayoutSent {
+		t.Fatalf("payout state = %d, want %d", payout.state, PayoutSent)
+	}
+	if scan, err = m.scanBankPayouts(ctx, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	delivery, err = m.checkPayoutDelivery(&payout.UserProfit, scan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivery != payoutEmitted {
+		t.Fatal("sent payout is not delivered")
+	}
+
+	// the next claim confirms the delivered payout
+	claimed, err = m.persistor.claimPayouts(ctx, payoutBatchSize, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.processPayouts(ctx, claimed)
+
+	if payout = getTestPayouts(t, pool, e.ID)[0]; payout.state != PayoutConfirmed || payout.txHash == "" {
+		t.Fatalf("payout state, tx hash = %d, %q, want %d and hash", payout.state, payout.txHash, PayoutConfirmed)
+	}
+
+	balance, err := chain.Balance(ctx, mustAccountID(t, testUserAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testWalletFunds - winner.Collateral + payout.Grams; balance != want {
+		t.Fatalf("winner balance = %d, want %d", balance, want)
+	}
+}
+
+// TestDepositJobOutOfAttempts gives up on the deal whose matched transfer can't be settled,
+// the transfer is orphaned for refund instead of the deal being declined with nothing received
+func TestDepositJobOutOfAttempts(t *testing.T) {
+	loadTestConfig(t)
+	pool := testPool(t)
+	m := newTestMarket(t, newTestChain(t), pool)
+	ctx := context.Background()
+
+	e := addTestEvent(t, m)
+	addTestUser(t, pool, testUserAddr)
+	d := &Deal{ID: uuid.New(), EventID: e.ID, Token: token.A, Collateral: 1e9, UserRawAddr: testUserAddr, Size: 1e9}
+	if err := m.SaveDealUnchecked(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+
+	// jetton of the transfer is not configured, so settlement keeps failing
+	q := `INSERT INTO bank_transfers (lt, hash, sender, grams, jetton, comment, deal_id, status, tx_time)
+          VALUES (1, '', $1, $2, $3, $4, $5, $6, now())`
+	if _, err := pool.Exec(ctx, q, testUserAddr, d.Collateral, testJetton, d.ID.String(), d.ID,
+		TransferMatched); err != nil {
+		t.Fatal(err)
+	}
+
+	m.processDepositJob(ctx, &depositJob{dealID: d.ID, attempts: depositMaxAttempts})
+
+	got := assertDeal(t, m, d.ID, Declined, DepositOrphaned)
+	if got.Received != d.Collateral {
+		t.Fatalf("deal received = %d, want %d", got.Received, d.Collateral)
+	}
+	var status TransferStatus
+	if err := pool.QueryRow(ctx, `SELECT status FROM bank_transfers WHERE lt = 1`).Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status != TransferUnmatched {
+		t.Fatalf("transfer status = %d, want %d", status, TransferUnmatched)
+	}
+}
+
+// TestCheckPayoutDeliveryByBank decides every payout of the batch by the bank transactions:
+// emitted, bounced back or skipped in the action phase. The payout of the other user with the same comment
+// is not confirmed by the emitted one.
+func TestCheckPayoutDeliveryByBank(t *testing.T) {
+	loadTestConfig(t)
+	chain := newTestChain(t)
+	m := newTestMarket(t, chain, nil)
+	ctx := context.Background()
+	chain.Fund(chain.BankAddress(), testWalletFunds)
+	chain.SetBouncing(mustAccountID(t, testOtherAddr))
+	chain.SetSkipped(mustAccountID(t, testColdAddr))
+
+	lastTry := time.Now()
+	payout := &UserProfit{UserRawAddress: testUserAddr, Grams: 1e9, Comment: "event closed: test", LastTry: lastTry}
+	bounced := &UserProfit{UserRawAddress: testOtherAddr, Grams: 1e9, Comment: payout.Comment, LastTry: lastTry}
+	skipped := &UserProfit{UserRawAddress: testColdAddr, Grams: 1e9, Comment: payout.Comment, LastTry: lastTry}
+
+	transferList := make([]ChainTransfer, 0, 3)
+	for _, up := range []*UserProfit{payout, bounced, skipped} {
+		transfer, err := m.buildPayoutTransfer(up)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transferList = append(transferList, transfer)
+	}
+	bankLt, _, _ := chain.LastTransaction(ctx, chain.BankAddress())
+	if _, err := chain.Send(ctx, transferList...); err != nil {
+		t.Fatal(err)
+	}
+
+	scan, err := m.scanBankPayouts(ctx, lastTry.Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		up   *UserProfit
+		want payoutDelivery
+	}{
+		{"emitted", payout, payoutEmitted},
+		{"bounced", bounced, payoutBounced},
+		{"skipped", skipped, payoutNotEmitted},
+	}
+	for _, tt := range tests {
+		delivery, err := m.checkPayoutDelivery(tt.up, scan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if delivery != tt.want {
+			t.Fatalf("%s payout delivery = %d, want %d", tt.name, delivery, tt.want)
+		}
+	}
+	if payout.TxLt <= bankLt {
+		t.Fatalf("payout tx lt = %d, want the bank transaction after %d", payout.TxLt, bankLt)
+	}
+
+	// the bank is not scanned back to the last try, the payout can't be resent
+	if scan, err = m.scanBankPayouts(ctx, lastTry.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.checkPayoutDelivery(skipped, scan); !errors.Is(err, ErrPayoutNotScanned) {
+		t.Fatalf("err = %v, want %v", err, ErrPayoutNotScanned)
+	}
+}
+
+// TestProcessPayoutsBouncedAndSkipped fails the bounced payout and sends again only the one
+// the bank skipped in the action phase of the processed batch
+func TestProcessPayoutsBouncedAndSkipped(t *testing.T) {
+	loadTestConfig(t)
+	pool := testPool(t)
+	chain := newTestChain(t)
+	m := newTestMarket(t, chain, pool)
+	ctx := context.Background()
+
+	e := addTestEvent(t, m)
+	placeTestStake(t, m, chain, testUserAddr, e.ID, token.A, 10)
+	placeTestStake(t, m, chain, testOtherAddr, e.ID, token.B, 5)
+	settleTestTransfers(t, m)
+	if err := m.VoidEvent(ctx, e.ID); err != nil {
+		t.Fatal(err)
+	}
+	chain.SetBouncing(mustAccountID(t, testUserAddr))
+	chain.SetSkipped(mustAccountID(t, testOtherAddr))
+
+	for range 2 {
+		claimed, err := m.persistor.claimPayouts(ctx, payoutBatchSize, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.processPayouts(ctx, claimed)
+	}
+
+	wantMap := map[string]struct {
+		state    PayoutState
+		attempts int
+	}{
+		testUserAddr:  {PayoutFailed, 1},
+		testOtherAddr: {PayoutSent, 2},
+	}
+	for _, payout := range getTestPayouts(t, pool, e.ID) {
+		var attempts int
+		if err := pool.QueryRow(ctx, `SELECT attempts FROM payouts WHERE id = $1`, payout.ID).Scan(&attempts); err != nil {
+			t.Fatal(err)
+		}
+		want := wantMap[payout.UserRawAddress]
+		if payout.state != want.state || attempts != want.attempts {
+			t.Fatalf("payout of %s state, attempts = %d, %d, want %d, %d", payout.UserRawAddress, payout.state,
+				attempts, want.state, want.attempts)
+		}
+	}
+}
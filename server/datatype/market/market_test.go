@@ -0,0 +1,153 @@
+package market
+
+import (
+	"context"
+	"fmt"
+	"github.com/TON-Market/tma/server/config"
+	"github.com/TON-Market/tma/server/datatype/token"
+	"github.com/TON-Market/tma/server/db"
+	"github.com/caarlos0/env/v6"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/tonkeeper/tongo/ton"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testBankAddr = "0:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+
+// loadTestConfig fills config with its defaults, required values are set to the test bank
+func loadTestConfig(t *testing.T) {
+	t.Helper()
+	saved := config.Config
+	t.Cleanup(func() { config.Config = saved })
+	t.Setenv("BANK_ADDR", testBankAddr)
+	t.Setenv("TONPROOF_PAYLOAD_SIGNATURE_KEY", "test")
+	if err := env.Parse(&config.Config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testPool connects to TEST_DB_URL and empties all tables, the test is skipped without it, see make test-db.
+// The database is wiped, never point it to a database with data you need.
+func testPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("TEST_DB_URL")
+	if url == "" {
+		t.Skip("TEST_DB_URL is not set, run make test-db")
+	}
+	ctx := context.Background()
+
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+
+	if err := db.Migrate(ctx, pool); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := pool.Query(ctx, `SELECT tablename FROM pg_tables WHERE schemaname = current_schema()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tableList := make([]string, 0)
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			t.Fatal(err)
+		}
+		tableList = append(tableList, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pool.Exec(ctx, fmt.Sprintf("TRUNCATE %s CASCADE", strings.Join(tableList, ", "))); err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// newTestMarket returns market on the chain, events of market without pool live in memory only
+func newTestMarket(t *testing.T, chain Chain, pool *pgxpool.Pool) *Market {
+	t.Helper()
+	saved := closeDelay
+	closeDelay = 0
+	t.Cleanup(func() { closeDelay = saved })
+	return NewMarket(chain, pool)
+}
+
+// newTestChain returns fake chain of the test bank
+func newTestChain(t *testing.T) *FakeChain {
+	t.Helper()
+	return NewFakeChain(mustAccountID(t, testBankAddr))
+}
+
+func mustAccountID(t *testing.T, addr string) ton.AccountID {
+	t.Helper()
+	id, err := ton.ParseAccountID(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// addTestUser saves the user deals are referencing
+func addTestUser(t *testing.T, pool *pgxpool.Pool, addr string) {
+	t.Helper()
+	if _, err := pool.Exec(context.Background(), `INSERT INTO users (raw_addr) VALUES ($1)`, addr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addTestEvent adds active TON event with outcomes A and B, opts are applied before the event is added
+func addTestEvent(t *testing.T, m *Market, opts ...func(e *Event)) *Event {
+	t.Helper()
+	ctx := context.Background()
+
+	e := &Event{
+		Title: "test event",
+		BetMap: map[token.Token]*Bet{
+			token.A: {Title: "A"},
+			token.B: {Title: "B"},
+		},
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	if m.persistor.pool != nil {
+		if err := m.AddEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	if err := e.validateOutcomes(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.normalizePricing(); err != nil {
+		t.Fatal(err)
+	}
+	liquidity, err := m.eventLiquidity(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.ID = uuid.New()
+	e.Status = EventActive
+	for tk, b := range e.BetMap {
+		b.EventID = e.ID
+		b.Token = tk
+	}
+	if err := m.persistor.eventStorage.saveEvent(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.runtimer.saveEvent(ctx, e, liquidity); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
@@ -0,0 +1,486 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/TON-Market/tma/server/datatype/token"
+	"github.com/google/uuid"
+	"github.com/tonkeeper/tongo/tlb"
+	"log"
+	"math"
+	"time"
+)
+
+type OrderSide string
+
+const (
+	OrderBuy  OrderSide = "buy"
+	OrderSell OrderSide = "sell"
+)
+
+type OrderState int
+
+const (
+	// OrderFunding buy order waits for the deposit of its deal
+	OrderFunding OrderState = iota
+	OrderOpen
+	OrderFilled
+	OrderCancelled
+	// OrderDeclined funding deal of the buy order was declined
+	OrderDeclined
+)
+
+const (
+	// orderMatchLimit resting orders matched against one order at once
+	orderMatchLimit = 100
+	// userOrdersLimit orders listed to the user
+	userOrdersLimit = 100
+)
+
+var (
+	ErrInvalidOrder  = errors.New("invalid order")
+	ErrOrderNotExist = errors.New("order not exist")
+	ErrOrderNotOpen  = errors.New("order is not open")
+)
+
+// Order limit order on outcome shares, Price is collateral per unit of size.
+// Buy order is funded by the deal paid like a stake, sell order holds shares taken off the asset.
+type Order struct {
+	ID          uuid.UUID
+	EventID     uuid.UUID
+	UserRawAddr string
+	token.Token
+	Side   OrderSide
+	Price  float64
+	Size   tlb.Grams
+	Filled tlb.Grams
+	// Locked collateral of buy order not spent on fills yet
+	Locked tlb.Grams
+	// Escrow collateral staked for the shares of sell order not filled yet
+	Escrow tlb.Grams
+	// DealID funding deal of buy order, nil for sell order
+	DealID    *uuid.UUID
+	State     OrderState
+	CreatedAt time.Time
+}
+
+func (o *Order) remaining() tlb.Grams {
+	return o.Size - o.Filled
+}
+
+func (o *Order) validate() error {
+	if o.Side != OrderBuy && o.Side != OrderSell {
+		return fmt.Errorf("%w: unknown side: %s", ErrInvalidOrder, o.Side)
+	}
+	if o.Price <= 0 || math.IsInf(o.Price, 0) || math.IsNaN(o.Price) {
+		return fmt.Errorf("%w: price must be positive", ErrInvalidOrder)
+	}
+	if o.Size == 0 {
+		return fmt.Errorf("%w: size must be positive", ErrInvalidOrder)
+	}
+	return nil
+}
+
+// OrderFill trade of two orders at the resting order price
+type OrderFill struct {
+	ID          int64
+	EventID     uuid.UUID
+	Token       token.Token
+	BuyOrderID  uuid.UUID
+	SellOrderID uuid.UUID
+	Price       float64
+	Size        tlb.Grams
+	// Grams paid by the buyer to the seller
+	Grams tlb.Grams
+	// collateral staked for the size, moved from the seller escrow to the buyer asset
+	collateral tlb.Grams
+}
+
+// fillOrders trades the common remaining size at price, shares keep their staked collateral
+// so outcome pools don't change
+func fillOrders(buy, sell *Order, price float64) *OrderFill {
+	size := min(buy.remaining(), sell.remaining())
+	grams := min(tlb.Grams(float64(size)*price), buy.Locked)
+	collateral := sell.Escrow
+	if size < sell.remaining() {
+		collateral = tlb.Grams(float64(sell.Escrow) * float64(size) / float64(sell.remaining()))
+	}
+
+	buy.Filled += size
+	buy.Locked -= grams
+	sell.Filled += size
+	sell.Escrow -= collateral
+
+	return &OrderFill{
+		EventID:     buy.EventID,
+		Token:       buy.Token,
+		BuyOrderID:  buy.ID,
+		SellOrderID: sell.ID,
+		Price:       price,
+		Size:        size,
+		Grams:       grams,
+		collateral:  collateral,
+	}
+}
+
+// orderFillPayout pays the seller for the fill
+func orderFillPayout(sell *Order, fill *OrderFill, jetton string) *UserProfit {
+	return &UserProfit{
+		ID:             uuid.New(),
+		Kind:           PayoutOrderFill,
+		UserRawAddress: sell.UserRawAddr,
+		Grams:          fill.Grams,
+		Jetton:         jetton,
+		EventID:        sell.EventID,
+		Comment:        fmt.Sprintf("order fill: %d", fill.ID),
+		State:          PayoutPending,
+	}
+}
+
+// orderRefund returns collateral of buy order left after fills or cancellation
+func orderRefund(buy *Order, jetton string) *UserProfit {
+	return &UserProfit{
+		ID:             uuid.New(),
+		Kind:           PayoutOrderRefund,
+		UserRawAddress: buy.UserRawAddr,
+		Grams:          buy.Locked,
+		Jetton:         jetton,
+		EventID:        buy.EventID,
+		Comment:        "order refund: " + buy.ID.String(),
+		State:          PayoutPending,
+	}
+}
+
+// PlaceOrder saves the limit order. Buy order waits for the payment of the returned message,
+// its deal is settled by the deposit flow of stakes. Sell order takes the shares off the asset
+// and is matched at once, the returned message is nil.
+func (m *Market) PlaceOrder(ctx context.Context, o *Order) (*PaymentMessage, error) {
+	if err := o.validate(); err != nil {
+		return nil, fmt.Errorf("market place order failed: %w", err)
+	}
+	eventCopy, err := m.persistor.getCopyByID(ctx, o.EventID)
+	if err != nil {
+		return nil, fmt.Errorf("market place order failed: %w", err)
+	}
+	if err := eventCopy.checkWindow(time.Now()); err != nil {
+		return nil, fmt.Errorf("market place order failed: %w", err)
+	}
+	es, err := m.runtimer.getEventState(ctx, o.EventID)
+	if err != nil {
+		return nil, fmt.Errorf("market place order failed: %w", err)
+	}
+	if !es.isActive {
+		return nil, fmt.Errorf("market place order failed: %w", ErrEventClosed)
+	}
+	if _, ok := es.betStateMap[o.Token]; !ok {
+		return nil, fmt.Errorf("market place order failed: %w: %s", ErrUnknownOutcome, o.Token)
+	}
+	c, err := m.currencyOf(eventCopy.Jetton)
+	if err != nil {
+		return nil, fmt.Errorf("market place order failed: %w", err)
+	}
+
+	o.ID = uuid.New()
+	o.Filled = 0
+
+	if o.Side == OrderBuy {
+		deal := &Deal{
+			ID:          uuid.New(),
+			EventID:     o.EventID,
+			UserRawAddr: o.UserRawAddr,
+			Token:       o.Token,
+			Collateral:  tlb.Grams(math.Ceil(float64(o.Size) * o.Price)),
+			Size:        o.Size,
+			DealStatus:  Unchecked,
+		}
+		if err := m.checkStakeLimits(ctx, &eventCopy, es, c, o.UserRawAddr, o.Token, deal.Collateral); err != nil {
+			return nil, fmt.Errorf("market place order failed: %w", err)
+		}
+		o.DealID, o.State = &deal.ID, OrderFunding
+		if err := m.persistor.createBuyOrder(ctx, o, deal); err != nil {
+			return nil, fmt.Errorf("market place order failed: %w", err)
+		}
+		payment, err := m.BuildPayment(ctx, deal)
+		if err != nil {
+			return nil, fmt.Errorf("market place order failed: %w", err)
+		}
+		return payment, nil
+	}
+
+	asset, err := m.persistor.getAsset(ctx, o.UserRawAddr, o.EventID, o.Token)
+	if err != nil {
+		return nil, fmt.Errorf("market place order failed: %w", err)
+	}
+	if o.Size > asset.Size {
+		return nil, fmt.Errorf("market place order failed: %w: %s of %s", ErrInsufficientPosition,
+			c.Format(o.Size), c.Format(asset.Size))
+	}
+	o.Escrow = asset.CollateralStaked
+	if o.Size < asset.Size {
+		o.Escrow = tlb.Grams(float64(asset.CollateralStaked) * float64(o.Size) / float64(asset.Size))
+	}
+	o.State = OrderOpen
+
+	err = m.runtimer.withBook(ctx, o.EventID, func() error {
+		if err := m.persistor.createSellOrder(ctx, o); err != nil {
+			return err
+		}
+		return m.matchOrder(ctx, o.ID, c)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("market place order failed: %w", err)
+	}
+
+	m.notifyBook(ctx, o.EventID, o.Token)
+	return nil, nil
+}
+
+// matchOrder fills the order against the book, must be called within the event book lock
+func (m *Market) matchOrder(ctx context.Context, id uuid.UUID, c *Currency) error {
+	fillList, err := m.persistor.matchOrder(ctx, id, c.Jetton, orderMatchLimit)
+	if err != nil {
+		return err
+	}
+	for _, fill := range fillList {
+		log.Printf("[INFO] order fill: %d, buy: %s, sell: %s, size: %s at %v for %s %s\n\n", fill.ID,
+			fill.BuyOrderID.String(), fill.SellOrderID.String(), c.Format(fill.Size), fill.Price,
+			c.Format(fill.Grams), c.Symbol)
+	}
+	return nil
+}
+
+// settleOrderDeposit opens the buy order funded by the transfer and matches it,
+// the transfer of cancelled order is refunded as orphaned, the deal breaking limits is declined and refunded
+func (m *Market) settleOrderDeposit(ctx context.Context, transfer *BankTransfer, deal *Deal, order *Order,
+	c *Currency) error {
+	orphan := func() error {
+		reason := "order cancelled before funding"
+		if err := m.persistor.orphanTransfer(ctx, transfer, reason); err != nil {
+			return fmt.Errorf("settle order deposit failed: %w", err)
+		}
+		log.Printf("[WARNING] deal: %s of order: %s declined, %s\n\n", deal.ID.String(), order.ID.String(), reason)
+		return nil
+	}
+	if order.State != OrderFunding {
+		return orphan()
+	}
+
+	s := buildSettlement(deal, transfer.Grams, c)
+	if s.outcome == DepositUnderpaidDeclined {
+		reason := fmt.Sprintf("underpaid: received %s of %s %s",
+			c.Format(transfer.Grams), c.Format(deal.Collateral), c.Symbol)
+		if err := m.persistor.declineDeal(ctx, deal.ID, reason, s); err != nil {
+			return fmt.Errorf("settle order deposit failed: %w", err)
+		}
+		log.Printf("[INFO] deal: %s of order: %s declined, %s\n\n", deal.ID.String(), order.ID.String(), reason)
+		return nil
+	}
+
+	eventCopy, err := m.persistor.getCopyByID(ctx, order.EventID)
+	if err != nil {
+		return fmt.Errorf("settle order deposit failed: %w", err)
+	}
+
+	// limits are checked again under the book lock, other orders of the user may have been funded since
+	err = m.runtimer.withBook(ctx, order.EventID, func() error {
+		es, err := m.runtimer.getEventState(ctx, order.EventID)
+		if err != nil {
+			return err
+		}
+		if err := m.checkStakeLimits(ctx, &eventCopy, es, c, deal.UserRawAddr, deal.Token, s.collateral); err != nil {
+			return err
+		}
+		if err := m.persistor.fundOrder(ctx, deal.ID, s); err != nil {
+			return err
+		}
+		return m.matchOrder(ctx, order.ID, c)
+	})
+	if errors.Is(err, ErrOrderNotOpen) {
+		return orphan()
+	}
+	if errors.Is(err, ErrStakeLimit) {
+		reason := err.Error()
+		if err := m.persistor.declineDeal(ctx, deal.ID, reason, buildLimitSettlement(deal, transfer.Grams, c)); err != nil {
+			return fmt.Errorf("settle order deposit failed: %w", err)
+		}
+		log.Printf("[INFO] deal: %s of order: %s declined, %s\n\n", deal.ID.String(), order.ID.String(), reason)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("settle order deposit failed: %w", err)
+	}
+
+	m.notifyBook(ctx, order.EventID, order.Token)
+	return nil
+}
+
+// CancelOrder cancels funding or open order of the user, the rest of buy order collateral is refunded,
+// the rest of sell order shares returns to the asset
+func (m *Market) CancelOrder(ctx context.Context, addr string, id uuid.UUID) error {
+	order, err := m.persistor.getOrder(ctx, id)
+	if err != nil {
+		return fmt.Errorf("market cancel order failed: %w", err)
+	}
+	if order.UserRawAddr != addr {
+		return fmt.Errorf("market cancel order failed: %w: %s", ErrOrderNotExist, id.String())
+	}
+	eventCopy, err := m.persistor.getCopyByID(ctx, order.EventID)
+	if err != nil {
+		return fmt.Errorf("market cancel order failed: %w", err)
+	}
+	c, err := m.currencyOf(eventCopy.Jetton)
+	if err != nil {
+		return fmt.Errorf("market cancel order failed: %w", err)
+	}
+
+	err = m.runtimer.withBook(ctx, order.EventID, func() error {
+		return m.persistor.cancelOrder(ctx, id, c.Jetton)
+	})
+	if err != nil {
+		return fmt.Errorf("market cancel order failed: %w", err)
+	}
+
+	m.notifyBook(ctx, order.EventID, order.Token)
+	return nil
+}
+
+// cancelEventOrders cancels all orders of the closed event, so its assets are final
+func (m *Market) cancelEventOrders(ctx context.Context, eventID uuid.UUID, c *Currency) error {
+	idList, err := m.persistor.getActiveOrderIDs(ctx, eventID)
+	if err != nil {
+		return fmt.Errorf("cancel event: %s orders failed: %w", eventID.String(), err)
+	}
+
+	for _, id := range idList {
+		err := m.runtimer.withBook(ctx, eventID, func() error {
+			return m.persistor.cancelOrder(ctx, id, c.Jetton)
+		})
+		if err != nil && !errors.Is(err, ErrOrderNotOpen) {
+			return fmt.Errorf("cancel event: %s orders failed: %w", eventID.String(), err)
+		}
+	}
+	if len(idList) > 0 {
+		log.Printf("[INFO] %d orders of event: %s cancelled\n\n", len(idList), eventID.String())
+	}
+	return nil
+}
+
+type OrderDTO struct {
+	ID        uuid.UUID   `json:"id"`
+	EventID   uuid.UUID   `json:"eventId"`
+	Token     token.Token `json:"token"`
+	Side      OrderSide   `json:"side"`
+	Price     float64     `json:"price"`
+	Size      string      `json:"size"`
+	Filled    string      `json:"filled"`
+	Currency  string      `json:"currency"`
+	State     OrderState  `json:"state"`
+	DepositID *uuid.UUID  `json:"depositId,omitempty"`
+	CreatedAt time.Time   `json:"createdAt"`
+}
+
+func (m *Market) buildOrderDTO(o *Order, jetton string) *OrderDTO {
+	return &OrderDTO{
+		ID:        o.ID,
+		EventID:   o.EventID,
+		Token:     o.Token,
+		Side:      o.Side,
+		Price:     o.Price,
+		Size:      m.formatOf(jetton, o.Size),
+		Filled:    m.formatOf(jetton, o.Filled),
+		Currency:  m.symbolOf(jetton),
+		State:     o.State,
+		DepositID: o.DealID,
+		CreatedAt: o.CreatedAt,
+	}
+}
+
+// GetUserOrders returns last orders of the user
+func (m *Market) GetUserOrders(ctx context.Context, addr string) ([]*OrderDTO, error) {
+	orderList, err := m.persistor.getUserOrders(ctx, addr, userOrdersLimit)
+	if err != nil {
+		return nil, fmt.Errorf("market get user orders failed: %w", err)
+	}
+
+	orderDTOList := make([]*OrderDTO, 0, len(orderList))
+	for _, o := range orderList {
+		eventCopy, err := m.persistor.getCopyByID(ctx, o.EventID)
+		if err != nil {
+			return nil, fmt.Errorf("market get user orders failed: %w", err)
+		}
+		orderDTOList = append(orderDTOList, m.buildOrderDTO(o, eventCopy.Jetton))
+	}
+	return orderDTOList, nil
+}
+
+// bookLevel open orders of one side at one price
+type bookLevel struct {
+	side   OrderSide
+	price  float64
+	size   tlb.Grams
+	orders int
+}
+
+type BookLevelDTO struct {
+	Price  float64 `json:"price"`
+	Size   string  `json:"size"`
+	Orders int     `json:"orders"`
+}
+
+// OrderBookDTO open orders of the outcome, bids by price descending, asks by price ascending
+type OrderBookDTO struct {
+	EventID  uuid.UUID       `json:"eventId"`
+	Token    token.Token     `json:"token"`
+	Currency string          `json:"currency"`
+	Bids     []*BookLevelDTO `json:"bids"`
+	Asks     []*BookLevelDTO `json:"asks"`
+	Time     time.Time       `json:"time"`
+}
+
+func (m *Market) GetOrderBook(ctx context.Context, eventID uuid.UUID, t token.Token) (*OrderBookDTO, error) {
+	eventCopy, err := m.persistor.getCopyByID(ctx, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("market get order book failed: %w", err)
+	}
+	if !eventCopy.hasOutcome(t) {
+		return nil, fmt.Errorf("market get order book failed: %w: %s", ErrUnknownOutcome, t)
+	}
+	levelList, err := m.persistor.getBookLevels(ctx, eventID, t)
+	if err != nil {
+		return nil, fmt.Errorf("market get order book failed: %w", err)
+	}
+
+	book := &OrderBookDTO{
+		EventID:  eventID,
+		Token:    t,
+		Currency: m.symbolOf(eventCopy.Jetton),
+		Bids:     make([]*BookLevelDTO, 0),
+		Asks:     make([]*BookLevelDTO, 0),
+		Time:     time.Now(),
+	}
+	for _, l := range levelList {
+		levelDTO := &BookLevelDTO{Price: l.price, Size: m.formatOf(eventCopy.Jetton, l.size), Orders: l.orders}
+		if l.side == OrderBuy {
+			book.Bids = append(book.Bids, levelDTO)
+			continue
+		}
+		book.Asks = append(book.Asks, levelDTO)
+	}
+	return book, nil
+}
+
+// notifyBook pushes the outcome book to the book socket
+func (m *Market) notifyBook(ctx context.Context, eventID uuid.UUID, t token.Token) {
+	book, err := m.GetOrderBook(ctx, eventID, t)
+	if err != nil {
+		log.Printf("[ERROR] %s\n\n", err.Error())
+		return
+	}
+
+	select {
+	case m.BookCh <- book:
+	default:
+		log.Printf("[WARNING] book channel is full, event: %s book update skipped\n\n", eventID.String())
+	}
+}
@@ -0,0 +1,330 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"github.com/TON-Market/tma/server/config"
+	"github.com/TON-Market/tma/server/datatype/token"
+	"github.com/google/uuid"
+	"github.com/tonkeeper/tongo/tlb"
+	"testing"
+)
+
+func TestFillOrders(t *testing.T) {
+	tests := []struct {
+		name           string
+		buy            Order
+		sell           Order
+		price          float64
+		wantSize       tlb.Grams
+		wantGrams      tlb.Grams
+		wantCollateral tlb.Grams
+	}{
+		{"both filled", Order{Size: 10e9, Locked: 8e9}, Order{Size: 10e9, Escrow: 10e9}, 0.6, 10e9, 6e9, 10e9},
+		{"sell partially filled", Order{Size: 4e9, Locked: 3.2e9}, Order{Size: 10e9, Escrow: 10e9}, 0.6,
+			4e9, 2.4e9, 4e9},
+		{"buy partially filled takes the whole escrow", Order{Size: 10e9, Locked: 8e9},
+			Order{Size: 4e9, Escrow: 3e9}, 0.6, 4e9, 2.4e9, 3e9},
+		{"sell filled before", Order{Size: 4e9, Locked: 4e9}, Order{Size: 10e9, Filled: 2e9, Escrow: 4e9}, 0.5,
+			4e9, 2e9, 2e9},
+		{"grams capped by locked", Order{Size: 10e9, Locked: 5e9}, Order{Size: 10e9, Escrow: 10e9}, 0.6,
+			10e9, 5e9, 10e9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buy, sell := tt.buy, tt.sell
+			fill := fillOrders(&buy, &sell, tt.price)
+
+			if fill.Price != tt.price || fill.Size != tt.wantSize || fill.Grams != tt.wantGrams ||
+				fill.collateral != tt.wantCollateral {
+				t.Fatalf("fill = %+v, want price: %v, size: %d, grams: %d, collateral: %d", fill, tt.price,
+					tt.wantSize, tt.wantGrams, tt.wantCollateral)
+			}
+			if buy.Locked+fill.Grams != tt.buy.Locked || sell.Escrow+fill.collateral != tt.sell.Escrow {
+				t.Fatalf("locked, escrow = %d, %d not conserved by fill: %+v", buy.Locked, sell.Escrow, fill)
+			}
+			if buy.Filled != tt.buy.Filled+fill.Size || sell.Filled != tt.sell.Filled+fill.Size {
+				t.Fatalf("filled = %d, %d, want +%d", buy.Filled, sell.Filled, fill.Size)
+			}
+		})
+	}
+}
+
+// settleTestTransfers indexes and settles transfers paid to the bank
+func settleTestTransfers(t *testing.T, m *Market) {
+	t.Helper()
+	ctx := context.Background()
+	if err := m.indexBankTransactions(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.matchBankTransfers(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// placeTestOrder places the order of the funded user, buy order is paid when pay is set
+func placeTestOrder(t *testing.T, m *Market, chain *FakeChain, addr string, eventID uuid.UUID, side OrderSide,
+	price float64, size tlb.Grams, pay bool) *Order {
+	t.Helper()
+	o := &Order{EventID: eventID, UserRawAddr: addr, Token: token.A, Side: side, Price: price, Size: size}
+	payment, err := m.PlaceOrder(context.Background(), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if side == OrderBuy && pay {
+		if _, err := chain.Transfer(mustAccountID(t, addr), chain.BankAddress(), payment.Amount,
+			o.DealID.String()); err != nil {
+			t.Fatal(err)
+		}
+		settleTestTransfers(t, m)
+	}
+	return o
+}
+
+func assertOrder(t *testing.T, m *Market, id uuid.UUID, state OrderState, filled, locked, escrow tlb.Grams) {
+	t.Helper()
+	o, err := m.persistor.getOrder(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.State != state || o.Filled != filled || o.Locked != locked || o.Escrow != escrow {
+		t.Fatalf("order: %s state, filled, locked, escrow = %d, %d, %d, %d, want %d, %d, %d, %d", id, o.State,
+			o.Filled, o.Locked, o.Escrow, state, filled, locked, escrow)
+	}
+}
+
+func assertAsset(t *testing.T, m *Market, addr string, eventID uuid.UUID, collateral, size tlb.Grams) {
+	t.Helper()
+	a, err := m.persistor.getAsset(context.Background(), addr, eventID, token.A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.CollateralStaked != collateral || a.Size != size {
+		t.Fatalf("asset of: %s collateral, size = %d, %d, want %d, %d", addr, a.CollateralStaked, a.Size,
+			collateral, size)
+	}
+}
+
+// payoutTotal sums payouts of the kind to the user
+func payoutTotal(t *testing.T, m *Market, eventID uuid.UUID, addr string, kind PayoutKind) tlb.Grams {
+	t.Helper()
+	var total tlb.Grams
+	for _, p := range getTestPayouts(t, m.persistor.pool, eventID) {
+		if p.UserRawAddress == addr && p.Kind == kind {
+			total += p.Grams
+		}
+	}
+	return total
+}
+
+// assertOrderConservation checks that orders neither create nor lose collateral:
+// staked collateral is in assets or sell escrow, funded buy collateral is locked or paid out
+func assertOrderConservation(t *testing.T, m *Market, eventID uuid.UUID, staked, funded tlb.Grams) {
+	t.Helper()
+	ctx := context.Background()
+	pool := m.persistor.pool
+
+	var assets, escrow, locked, paid tlb.Grams
+	if err := pool.QueryRow(ctx, `SELECT COALESCE(SUM(collateral_staked), 0)::bigint FROM assets WHERE event_id = $1`,
+		eventID).Scan(&assets); err != nil {
+		t.Fatal(err)
+	}
+	q := `SELECT COALESCE(SUM(escrow), 0)::bigint, COALESCE(SUM(locked), 0)::bigint FROM orders WHERE event_id = $1`
+	if err := pool.QueryRow(ctx, q, eventID).Scan(&escrow, &locked); err != nil {
+		t.Fatal(err)
+	}
+	q = `SELECT COALESCE(SUM(grams), 0)::bigint FROM payouts WHERE event_id = $1 AND kind IN ($2, $3)`
+	if err := pool.QueryRow(ctx, q, eventID, PayoutOrderFill, PayoutOrderRefund).Scan(&paid); err != nil {
+		t.Fatal(err)
+	}
+
+	if assets+escrow != staked {
+		t.Fatalf("assets: %d + escrow: %d = %d, want staked %d", assets, escrow, assets+escrow, staked)
+	}
+	if locked+paid != funded {
+		t.Fatalf("locked: %d + paid out: %d = %d, want funded %d", locked, paid, locked+paid, funded)
+	}
+}
+
+// TestOrderFillAtRestingPrice crosses a bid above the resting ask, the fill is at the ask price
+// and the rest of the bid collateral is refunded
+func TestOrderFillAtRestingPrice(t *testing.T) {
+	loadTestConfig(t)
+	pool := testPool(t)
+	chain := newTestChain(t)
+	m := newTestMarket(t, chain, pool)
+	ctx := context.Background()
+
+	e := addTestEvent(t, m)
+	placeTestStake(t, m, chain, testUserAddr, e.ID, token.A, 10)
+	settleTestTransfers(t, m)
+
+	addTestUser(t, pool, testOtherAddr)
+	chain.Fund(mustAccountID(t, testOtherAddr), testWalletFunds)
+
+	sell := placeTestOrder(t, m, chain, testUserAddr, e.ID, OrderSell, 0.6, 4e9, false)
+	assertOrder(t, m, sell.ID, OrderOpen, 0, 0, 4e9)
+	assertAsset(t, m, testUserAddr, e.ID, 6e9, 6e9)
+	assertOrderConservation(t, m, e.ID, 10e9, 0)
+
+	buy := placeTestOrder(t, m, chain, testOtherAddr, e.ID, OrderBuy, 0.8, 4e9, true)
+	assertOrder(t, m, buy.ID, OrderFilled, 4e9, 0, 0)
+	assertOrder(t, m, sell.ID, OrderFilled, 4e9, 0, 0)
+	assertAsset(t, m, testOtherAddr, e.ID, 4e9, 4e9)
+
+	var price float64
+	var size, grams tlb.Grams
+	q := `SELECT price, size, grams FROM order_fills WHERE buy_order_id = $1 AND sell_order_id = $2`
+	if err := pool.QueryRow(ctx, q, buy.ID, sell.ID).Scan(&price, &size, &grams); err != nil {
+		t.Fatal(err)
+	}
+	if price != 0.6 || size != 4e9 || grams != 2.4e9 {
+		t.Fatalf("fill price, size, grams = %v, %d, %d, want 0.6, %d, %d", price, size, grams, tlb.Grams(4e9),
+			tlb.Grams(2.4e9))
+	}
+
+	if got := payoutTotal(t, m, e.ID, testUserAddr, PayoutOrderFill); got != 2.4e9 {
+		t.Fatalf("seller paid = %d, want %d", got, tlb.Grams(2.4e9))
+	}
+	if got := payoutTotal(t, m, e.ID, testOtherAddr, PayoutOrderRefund); got != 0.8e9 {
+		t.Fatalf("buyer refunded = %d, want %d", got, tlb.Grams(0.8e9))
+	}
+	assertOrderConservation(t, m, e.ID, 10e9, 3.2e9)
+}
+
+// TestCancelOrderRefundsRemainder cancels partially filled bid and resting ask,
+// the bid refunds exactly its locked rest and the ask returns its shares to the asset
+func TestCancelOrderRefundsRemainder(t *testing.T) {
+	loadTestConfig(t)
+	pool := testPool(t)
+	chain := newTestChain(t)
+	m := newTestMarket(t, chain, pool)
+	ctx := context.Background()
+
+	e := addTestEvent(t, m)
+	placeTestStake(t, m, chain, testUserAddr, e.ID, token.A, 10)
+	settleTestTransfers(t, m)
+
+	addTestUser(t, pool, testOtherAddr)
+	chain.Fund(mustAccountID(t, testOtherAddr), testWalletFunds)
+
+	placeTestOrder(t, m, chain, testUserAddr, e.ID, OrderSell, 0.6, 4e9, false)
+	buy := placeTestOrder(t, m, chain, testOtherAddr, e.ID, OrderBuy, 0.8, 10e9, true)
+	assertOrder(t, m, buy.ID, OrderOpen, 4e9, 5.6e9, 0)
+
+	ask := placeTestOrder(t, m, chain, testUserAddr, e.ID, OrderSell, 0.9, 3e9, false)
+	assertOrder(t, m, ask.ID, OrderOpen, 0, 0, 3e9)
+	assertAsset(t, m, testUserAddr, e.ID, 3e9, 3e9)
+	assertOrderConservation(t, m, e.ID, 10e9, 8e9)
+
+	if err := m.CancelOrder(ctx, testUserAddr, buy.ID); !errors.Is(err, ErrOrderNotExist) {
+		t.Fatalf("cancel order of other user err = %v, want %v", err, ErrOrderNotExist)
+	}
+
+	if err := m.CancelOrder(ctx, testOtherAddr, buy.ID); err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, m, buy.ID, OrderCancelled, 4e9, 0, 0)
+	if got := payoutTotal(t, m, e.ID, testOtherAddr, PayoutOrderRefund); got != 5.6e9 {
+		t.Fatalf("buyer refunded = %d, want %d", got, tlb.Grams(5.6e9))
+	}
+
+	if err := m.CancelOrder(ctx, testUserAddr, ask.ID); err != nil {
+		t.Fatal(err)
+	}
+	assertOrder(t, m, ask.ID, OrderCancelled, 0, 0, 0)
+	assertAsset(t, m, testUserAddr, e.ID, 6e9, 6e9)
+	assertOrderConservation(t, m, e.ID, 10e9, 8e9)
+
+	if err := m.CancelOrder(ctx, testOtherAddr, buy.ID); !errors.Is(err, ErrOrderNotOpen) {
+		t.Fatalf("cancel cancelled order err = %v, want %v", err, ErrOrderNotOpen)
+	}
+}
+
+// TestCloseEventCancelsOrders closes the event with resting orders, they are cancelled
+// before payouts, so the seller wins with the shares of the ask and the bid is refunded
+func TestCloseEventCancelsOrders(t *testing.T) {
+	loadTestConfig(t)
+	pool := testPool(t)
+	chain := newTestChain(t)
+	m := newTestMarket(t, chain, pool)
+	ctx := context.Background()
+
+	e := addTestEvent(t, m)
+	placeTestStake(t, m, chain, testUserAddr, e.ID, token.A, 10)
+	settleTestTransfers(t, m)
+
+	addTestUser(t, pool, testOtherAddr)
+	chain.Fund(mustAccountID(t, testOtherAddr), testWalletFunds)
+
+	ask := placeTestOrder(t, m, chain, testUserAddr, e.ID, OrderSell, 0.9, 4e9, false)
+	bid := placeTestOrder(t, m, chain, testOtherAddr, e.ID, OrderBuy, 0.5, 2e9, true)
+	unpaid := placeTestOrder(t, m, chain, testOtherAddr, e.ID, OrderBuy, 0.5, 2e9, false)
+	assertOrder(t, m, bid.ID, OrderOpen, 0, 1e9, 0)
+	assertOrder(t, m, unpaid.ID, OrderFunding, 0, 0, 0)
+
+	if err := m.CloseEvent(ctx, e.ID, token.A); err != nil {
+		t.Fatal(err)
+	}
+
+	idList, err := m.persistor.getActiveOrderIDs(ctx, e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idList) != 0 {
+		t.Fatalf("active orders after close = %v", idList)
+	}
+	assertOrder(t, m, ask.ID, OrderCancelled, 0, 0, 0)
+	assertOrder(t, m, bid.ID, OrderCancelled, 0, 0, 0)
+	assertOrder(t, m, unpaid.ID, OrderCancelled, 0, 0, 0)
+	assertAsset(t, m, testUserAddr, e.ID, 10e9, 10e9)
+
+	if got := payoutTotal(t, m, e.ID, testOtherAddr, PayoutOrderRefund); got != 1e9 {
+		t.Fatalf("bid refunded = %d, want %d", got, tlb.Grams(1e9))
+	}
+	if got := payoutTotal(t, m, e.ID, testUserAddr, PayoutWin); got == 0 {
+		t.Fatal("seller has no win payout for the shares of the cancelled ask")
+	}
+	assertOrderConservation(t, m, e.ID, 10e9, 1e9)
+}
+
+// TestBuyOrderStakeLimits rejects the bid below min stake and declines the funding that breaks
+// the user exposure, its transfer is refunded
+func TestBuyOrderStakeLimits(t *testing.T) {
+	loadTestConfig(t)
+	config.Config.Stake.Min = 1
+	config.Config.Stake.MaxUserExposure = 5
+	pool := testPool(t)
+	chain := newTestChain(t)
+	m := newTestMarket(t, chain, pool)
+	ctx := context.Background()
+
+	e := addTestEvent(t, m)
+	addTestUser(t, pool, testOtherAddr)
+	chain.Fund(mustAccountID(t, testOtherAddr), testWalletFunds)
+
+	small := &Order{EventID: e.ID, UserRawAddr: testOtherAddr, Token: token.A, Side: OrderBuy, Price: 0.5, Size: 1e9}
+	if _, err := m.PlaceOrder(ctx, small); !errors.Is(err, ErrStakeTooSmall) {
+		t.Fatalf("place order err = %v, want %v", err, ErrStakeTooSmall)
+	}
+
+	// both bids pass while funding, the second breaks the exposure once the first is open
+	first := placeTestOrder(t, m, chain, testOtherAddr, e.ID, OrderBuy, 0.5, 8e9, false)
+	second := placeTestOrder(t, m, chain, testOtherAddr, e.ID, OrderBuy, 0.5, 8e9, false)
+	for _, o := range []*Order{first, second} {
+		if _, err := chain.Transfer(mustAccountID(t, testOtherAddr), chain.BankAddress(), 4e9,
+			o.DealID.String()); err != nil {
+			t.Fatal(err)
+		}
+		settleTestTransfers(t, m)
+	}
+
+	assertOrder(t, m, first.ID, OrderOpen, 0, 4e9, 0)
+	assertOrder(t, m, second.ID, OrderDeclined, 0, 0, 0)
+	assertDeal(t, m, *second.DealID, Declined, DepositLimitDeclined)
+
+	refundFee := tonCurrency.FromFloat(config.Config.Deposit.RefundFee)
+	if got := payoutTotal(t, m, e.ID, testOtherAddr, PayoutDepositRefund); got != 4e9-refundFee {
+		t.Fatalf("declined funding refunded = %d, want %d", got, 4e9-refundFee)
+	}
+}
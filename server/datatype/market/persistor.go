@@ -4,12 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/TON-Market/tma/server/datatype/token"
 	"github.com/TON-Market/tma/server/db"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/tonkeeper/tongo/tlb"
 	"strconv"
 	"sync"
+	"time"
 )
 
 type eventStorage struct {
@@ -25,8 +28,8 @@ var (
 var ErrSaveEvent = errors.New("save event failed")
 
 func (es *eventStorage) saveEvent(_ context.Context, e *Event) error {
-	es.RLock()
-	defer es.RUnlock()
+	es.Lock()
+	defer es.Unlock()
 
 	if _, ok := es.m[e.ID]; ok {
 		return fmt.Errorf("%w: %w: %s", ErrSaveEvent, ErrEventAlreadyExist, e.ID.String())
@@ -63,11 +66,313 @@ func (es *eventStorage) getCopyByID(_ context.Context, id uuid.UUID) (Event, err
 	return *v, nil
 }
 
+// replaceEvent swaps stored event, copies handed out before stay untouched
+func (es *eventStorage) replaceEvent(_ context.Context, e *Event) error {
+	es.Lock()
+	defer es.Unlock()
+
+	if _, ok := es.m[e.ID]; !ok {
+		return fmt.Errorf("replace event failed: %w: %s", ErrEventNotExist, e.ID.String())
+	}
+
+	es.m[e.ID] = e
+	return nil
+}
+
+func (es *eventStorage) setStatus(_ context.Context, id uuid.UUID, status EventStatus) error {
+	es.Lock()
+	defer es.Unlock()
+
+	e, ok := es.m[id]
+	if !ok {
+		return fmt.Errorf("set event status failed: %w: %s", ErrEventNotExist, id.String())
+	}
+
+	updated := *e
+	updated.Status = status
+	es.m[id] = &updated
+	return nil
+}
+
+func (es *eventStorage) setClose(_ context.Context, id uuid.UUID, status EventStatus, winToken token.Token) error {
+	es.Lock()
+	defer es.Unlock()
+
+	e, ok := es.m[id]
+	if !ok {
+		return fmt.Errorf("set event close failed: %w: %s", ErrEventNotExist, id.String())
+	}
+
+	updated := *e
+	updated.Status, updated.WinToken = status, winToken
+	es.m[id] = &updated
+	return nil
+}
+
+func (es *eventStorage) getAll(_ context.Context) []Event {
+	es.RLock()
+	defer es.RUnlock()
+
+	eventList := make([]Event, 0, len(es.m))
+	for _, e := range es.m {
+		eventList = append(eventList, *e)
+	}
+	return eventList
+}
+
+func (es *eventStorage) count() int {
+	es.RLock()
+	defer es.RUnlock()
+	return len(es.m)
+}
+
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func fromNullTime(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
 type persistor struct {
 	*eventStorage
 	pool *pgxpool.Pool
 }
 
+func (p *persistor) saveEvent(ctx context.Context, e *Event) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrSaveEvent, db.ErrOpenTransaction, err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	eq := `INSERT INTO events (id, tag, logo_link, title, status, opens_at, locks_at, resolves_at, resolver, fee_policy,
+           jetton, pricing, outcome_cap)
+           VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
+
+	bq := `INSERT INTO bets (event_id, token, title, logo_link)
+           VALUES ($1, $2, $3, $4)`
+
+	if _, err := tx.Exec(ctx, eq, e.ID, e.Tag, e.LogoLink, e.Title, e.Status,
+		nullTime(e.OpensAt), nullTime(e.LocksAt), nullTime(e.ResolvesAt), e.Resolver, e.FeePolicy, e.Jetton,
+		e.Pricing, e.OutcomeCap); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrSaveEvent, db.ErrTransactionFailed, err)
+	}
+
+	for _, t := range e.Tokens() {
+		b := e.BetMap[t]
+		if _, err := tx.Exec(ctx, bq, e.ID, t, b.Title, b.LogoLink); err != nil {
+			return fmt.Errorf("%w: %w: %w", ErrSaveEvent, db.ErrTransactionFailed, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrSaveEvent, db.ErrCommitTransaction, err)
+	}
+
+	return p.eventStorage.saveEvent(ctx, e)
+}
+
+var (
+	ErrUpdateEvent         = errors.New("update event failed")
+	ErrEventStatusConflict = errors.New("event status changed concurrently")
+)
+
+func (p *persistor) updateEvent(ctx context.Context, e *Event) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrUpdateEvent, db.ErrOpenTransaction, err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	eq := `UPDATE events SET tag = $1, logo_link = $2, title = $3, opens_at = $4, locks_at = $5, resolves_at = $6,
+           resolver = $7, fee_policy = $8, outcome_cap = $9
+           WHERE id = $10`
+
+	bq := `UPDATE bets SET title = $1, logo_link = $2 WHERE event_id = $3 AND token = $4`
+
+	if _, err := tx.Exec(ctx, eq, e.Tag, e.LogoLink, e.Title,
+		nullTime(e.OpensAt), nullTime(e.LocksAt), nullTime(e.ResolvesAt), e.Resolver, e.FeePolicy, e.OutcomeCap,
+		e.ID); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrUpdateEvent, db.ErrTransactionFailed, err)
+	}
+
+	for _, t := range e.Tokens() {
+		b := e.BetMap[t]
+		if _, err := tx.Exec(ctx, bq, b.Title, b.LogoLink, e.ID, t); err != nil {
+			return fmt.Errorf("%w: %w: %w", ErrUpdateEvent, db.ErrTransactionFailed, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrUpdateEvent, db.ErrCommitTransaction, err)
+	}
+
+	return p.eventStorage.replaceEvent(ctx, e)
+}
+
+// setEventStatus moves event to status only if its current status is one of from
+func (p *persistor) setEventStatus(ctx context.Context, id uuid.UUID, status EventStatus, from ...EventStatus) error {
+	q := `UPDATE events SET status = $1 WHERE id = $2 AND status = ANY($3)`
+
+	tag, err := p.pool.Exec(ctx, q, status, id, from)
+	if err != nil {
+		return fmt.Errorf("set event: %s status failed: %w", id.String(), err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("set event: %s status failed: %w", id.String(), ErrEventStatusConflict)
+	}
+
+	return p.eventStorage.setStatus(ctx, id, status)
+}
+
+// lockEventStatus reads the event status and win token within tx, the event row stays locked until tx ends
+func lockEventStatus(ctx context.Context, tx pgx.Tx, id uuid.UUID) (*Event, error) {
+	q := `SELECT status, win_token FROM events WHERE id = $1 FOR UPDATE`
+
+	e := &Event{ID: id}
+	if err := tx.QueryRow(ctx, q, id).Scan(&e.Status, &e.WinToken); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("%w: %s", ErrEventNotExist, id.String())
+		}
+		return nil, err
+	}
+	return e, nil
+}
+
+// beginClose moves the event to resolving with the win token or to voiding, betting can't be reopened after it
+func (p *persistor) beginClose(ctx context.Context, id uuid.UUID, status EventStatus, winToken token.Token) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin close event: %s failed: %w: %w", id.String(), db.ErrOpenTransaction, err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	q := `UPDATE events SET status = $1, win_token = $2 WHERE id = $3`
+
+	e, err := lockEventStatus(ctx, tx, id)
+	if err != nil {
+		return fmt.Errorf("begin close event: %s failed: %w", id.String(), err)
+	}
+	if err := e.checkClose(status, winToken); err != nil {
+		return fmt.Errorf("begin close event: %s failed: %w", id.String(), err)
+	}
+	if _, err := tx.Exec(ctx, q, status, winToken, id); err != nil {
+		return fmt.Errorf("begin close event: %s failed: %w: %w", id.String(), db.ErrTransactionFailed, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("begin close event: %s failed: %w: %w", id.String(), db.ErrCommitTransaction, err)
+	}
+	return p.eventStorage.setClose(ctx, id, status, winToken)
+}
+
+// finishClose saves payouts of the closing event and moves it to the final status in one transaction,
+// the event must still be closing with the same status and win token
+func (p *persistor) finishClose(ctx context.Context, id uuid.UUID, winToken token.Token, userProfitList []*UserProfit,
+	fee *EventFee) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("finish close event: %s failed: %w: %w", id.String(), db.ErrOpenTransaction, err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	q := `UPDATE events SET status = $1 WHERE id = $2`
+
+	from, status := EventResolving, EventResolved
+	if winToken == "" {
+		from, status = EventVoiding, EventVoided
+	}
+
+	e, err := lockEventStatus(ctx, tx, id)
+	if err != nil {
+		return fmt.Errorf("finish close event: %s failed: %w", id.String(), err)
+	}
+	if e.isFinished() {
+		return fmt.Errorf("finish close event: %s failed: %w", id.String(), ErrEventFinished)
+	}
+	if e.Status != from || e.WinToken != winToken {
+		return fmt.Errorf("finish close event: %s failed: %w", id.String(), ErrEventStatusConflict)
+	}
+	if err := insertEventPayouts(ctx, tx, userProfitList, fee); err != nil {
+		return fmt.Errorf("finish close event: %s failed: %w", id.String(), err)
+	}
+	if _, err := tx.Exec(ctx, q, status, id); err != nil {
+		return fmt.Errorf("finish close event: %s failed: %w: %w", id.String(), db.ErrTransactionFailed, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("finish close event: %s failed: %w: %w", id.String(), db.ErrCommitTransaction, err)
+	}
+	return p.eventStorage.setStatus(ctx, id, status)
+}
+
+var ErrLoadEvents = errors.New("load events failed")
+
+func (p *persistor) loadEvents(ctx context.Context) ([]*Event, error) {
+	eq := `SELECT id, tag, logo_link, title, status, win_token, opens_at, locks_at, resolves_at, resolver, fee_policy,
+           jetton, pricing, outcome_cap
+           FROM events ORDER BY created_at`
+
+	bq := `SELECT event_id, token, title, logo_link FROM bets`
+
+	eventList := make([]*Event, 0)
+	eventMap := make(map[uuid.UUID]*Event)
+
+	rows, err := p.pool.Query(ctx, eq)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrLoadEvents, err)
+	}
+
+	for rows.Next() {
+		e := &Event{BetMap: make(map[token.Token]*Bet)}
+		var opensAt, locksAt, resolvesAt *time.Time
+		if err = rows.Scan(&e.ID, &e.Tag, &e.LogoLink, &e.Title, &e.Status, &e.WinToken, &opensAt, &locksAt, &resolvesAt,
+			&e.Resolver, &e.FeePolicy, &e.Jetton, &e.Pricing, &e.OutcomeCap); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("%w: %w", ErrLoadEvents, err)
+		}
+		e.OpensAt, e.LocksAt, e.ResolvesAt = fromNullTime(opensAt), fromNullTime(locksAt), fromNullTime(resolvesAt)
+		eventList = append(eventList, e)
+		eventMap[e.ID] = e
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrLoadEvents, err)
+	}
+
+	rows, err = p.pool.Query(ctx, bq)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrLoadEvents, err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		b := &Bet{}
+		if err = rows.Scan(&b.EventID, &b.Token, &b.Title, &b.LogoLink); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrLoadEvents, err)
+		}
+		e, ok := eventMap[b.EventID]
+		if !ok {
+			continue
+		}
+		e.BetMap[b.Token] = b
+	}
+
+	return eventList, rows.Err()
+}
+
 var (
 	ErrPersistDeal = errors.New("persist deal failed")
 )
@@ -86,7 +391,7 @@ func (p *persistor) getPendingDeals(ctx context.Context) ([]*Deal, error) {
 
 	for rows.Next() {
 		var deal Deal
-		if err = rows.Scan(&deal.ID, &deal.EventID, &deal.Collateral, &deal.Size, &deal.UserRawAddr, &deal.DealStatus); err != nil {
+		if err = rows.Scan(&deal.ID, &deal.EventID, &deal.Token, &deal.Collateral, &deal.Size, &deal.UserRawAddr, &deal.DealStatus); err != nil {
 			return nil, fmt.Errorf("get pending deals failed: %w", err)
 		}
 
@@ -127,9 +432,13 @@ func (p *persistor) saveDeal(ctx context.Context, d *Deal) error {
 	return nil
 }
 
-var ErrVerifyDealAndGet = errors.New("verify deal and get failed")
+var (
+	ErrVerifyDealAndGet     = errors.New("verify deal and get failed")
+	ErrDealAlreadyProcessed = errors.New("deal already processed")
+)
 
-func (p *persistor) verifyDealAndGet(ctx context.Context, id uuid.UUID) (*Deal, error) {
+// verifyDealAndGet credits settled collateral to the user asset and saves surplus refund
+func (p *persistor) verifyDealAndGet(ctx context.Context, id uuid.UUID, s *depositSettlement) (*Deal, error) {
 	tx, err := p.pool.Begin(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("%w: %w: %w", ErrVerifyDealAndGet, db.ErrOpenTransaction, err)
@@ -146,17 +455,36 @@ func (p *persistor) verifyDealAndGet(ctx context.Context, id uuid.UUID) (*Deal,
 	qag := `SELECT user_raw_address, event_id, collateral_staked, token, size
             FROM assets WHERE user_raw_address = $1 AND event_id = $2 AND token = $3`
 
-	qu := `UPDATE public.deals SET deal_status = $1 WHERE id = $2`
+	qu := `UPDATE public.deals SET deal_status = $1, collateral = $2, size = $3, received = $4, refunded = $5,
+           deposit_outcome = $6
+           WHERE id = $7 AND deal_status = $8`
 
-	qg := `SELECT id, event_id, token, collateral, size, user_raw_addr, deal_status
+	qg := `SELECT id, event_id, token, collateral, size, user_raw_addr, deal_status, received, refunded, deposit_outcome
            FROM deals WHERE id = $1`
 
-	if _, err := tx.Exec(ctx, qu, Verified, id); err != nil {
+	qj := `UPDATE deposit_jobs SET done = true WHERE deal_id = $1`
+
+	tag, err := tx.Exec(ctx, qu, Verified, s.collateral, s.size, s.received, s.refunded(), s.outcome, id, Unchecked)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w: %w", ErrVerifyDealAndGet, db.ErrTransactionFailed, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, fmt.Errorf("%w: %w: %s", ErrVerifyDealAndGet, ErrDealAlreadyProcessed, id.String())
+	}
+
+	if _, err := tx.Exec(ctx, qj, id); err != nil {
 		return nil, fmt.Errorf("%w: %w: %w", ErrVerifyDealAndGet, db.ErrTransactionFailed, err)
 	}
 
+	if s.refund != nil {
+		if err := insertPayout(ctx, tx, s.refund); err != nil {
+			return nil, fmt.Errorf("%w: %w: %w", ErrVerifyDealAndGet, db.ErrTransactionFailed, err)
+		}
+	}
+
 	var deal Deal
-	if err := tx.QueryRow(ctx, qg, id).Scan(&deal.ID, &deal.EventID, &deal.Token, &deal.Collateral, &deal.Size, &deal.UserRawAddr, &deal.DealStatus); err != nil {
+	if err := tx.QueryRow(ctx, qg, id).Scan(&deal.ID, &deal.EventID, &deal.Token, &deal.Collateral, &deal.Size,
+		&deal.UserRawAddr, &deal.DealStatus, &deal.Received, &deal.Refunded, &deal.DepositOutcome); err != nil {
 		return nil, fmt.Errorf("%w: %w: %w", ErrVerifyDealAndGet, db.ErrTransactionFailed, err)
 	}
 
@@ -192,11 +520,53 @@ func (p *persistor) verifyDealAndGet(ctx context.Context, id uuid.UUID) (*Deal,
 	return &deal, nil
 }
 
-func (p *persistor) declineDeal(ctx context.Context, id uuid.UUID) error {
-	q := `UPDATE deals SET deal_status = $1 WHERE id = $2`
+// declineDeal declines unchecked deal, s is nil if nothing was received for the deal
+func (p *persistor) declineDeal(ctx context.Context, id uuid.UUID, reason string, s *depositSettlement) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("decline deal failed: %w: %w", db.ErrOpenTransaction, err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	q := `UPDATE deals SET deal_status = $1 WHERE id = $2 AND deal_status = $3`
+
+	qs := `UPDATE deals SET deal_status = $1, received = $2, refunded = $3, deposit_outcome = $4
+           WHERE id = $5 AND deal_status = $6`
+
+	qj := `UPDATE deposit_jobs SET done = true, last_error = $1 WHERE deal_id = $2`
+
+	qo := `UPDATE orders SET state = $1 WHERE deal_id = $2 AND state = $3`
+
+	if s == nil {
+		if _, err := tx.Exec(ctx, q, Declined, id, Unchecked); err != nil {
+			return fmt.Errorf("decline deal failed: %w: %w", db.ErrTransactionFailed, err)
+		}
+	} else {
+		tag, err := tx.Exec(ctx, qs, Declined, s.received, s.refunded(), s.outcome, id, Unchecked)
+		if err != nil {
+			return fmt.Errorf("decline deal failed: %w: %w", db.ErrTransactionFailed, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return fmt.Errorf("decline deal failed: %w: %s", ErrDealAlreadyProcessed, id.String())
+		}
+		if s.refund != nil {
+			if err := insertPayout(ctx, tx, s.refund); err != nil {
+				return fmt.Errorf("decline deal failed: %w: %w", db.ErrTransactionFailed, err)
+			}
+		}
+	}
+
+	if _, err := tx.Exec(ctx, qj, reason, id); err != nil {
+		return fmt.Errorf("decline deal failed: %w: %w", db.ErrTransactionFailed, err)
+	}
+
+	if _, err := tx.Exec(ctx, qo, OrderDeclined, id, OrderFunding); err != nil {
+		return fmt.Errorf("decline deal failed: %w: %w", db.ErrTransactionFailed, err)
+	}
 
-	if _, err := p.pool.Exec(ctx, q, Declined, id); err != nil {
-		return fmt.Errorf("decline deal failed: %w", err)
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("decline deal failed: %w: %w", db.ErrCommitTransaction, err)
 	}
 	return nil
 }
@@ -211,18 +581,6 @@ func (p *persistor) deleteDeal(ctx context.Context, id uuid.UUID) error {
 	return nil
 }
 
-func (p *persistor) getUserAddressByUncheckedDealID(ctx context.Context, id uuid.UUID) (string, error) {
-	q := `SELECT user_raw_addr FROM deals WHERE id = $1`
-
-	var userRawAddr string
-
-	if err := p.pool.QueryRow(ctx, q, id).Scan(&userRawAddr); err != nil {
-		return "", fmt.Errorf("select user_raw_address with deal id: %s falied: %w", id.String(), err)
-	}
-
-	return userRawAddr, nil
-}
-
 func (p *persistor) getUserAssets(ctx context.Context, addr string) ([]*Asset, error) {
 	q := `SELECT user_raw_address, event_id, collateral_staked, token, size
           FROM assets WHERE user_raw_address = $1`
@@ -249,6 +607,20 @@ func (p *persistor) getUserAssets(ctx context.Context, addr string) ([]*Asset, e
 	return assetList, nil
 }
 
+// getUserExposure sums collateral of the user staked on the event, open orders included
+func (p *persistor) getUserExposure(ctx context.Context, addr string, eventID uuid.UUID) (tlb.Grams, error) {
+	q := `SELECT COALESCE(SUM(collateral), 0)::bigint
+          FROM (SELECT collateral_staked AS collateral FROM assets WHERE user_raw_address = $1 AND event_id = $2
+                UNION ALL
+                SELECT locked + escrow FROM orders WHERE user_raw_addr = $1 AND event_id = $2 AND state = $3) s`
+
+	var exposure tlb.Grams
+	if err := p.pool.QueryRow(ctx, q, addr, eventID, OrderOpen).Scan(&exposure); err != nil {
+		return 0, fmt.Errorf("get user exposure from db failed: %w", err)
+	}
+	return exposure, nil
+}
+
 func (p *persistor) getEventAssets(ctx context.Context, id uuid.UUID) ([]*Asset, error) {
 	q := `SELECT user_raw_address, event_id, collateral_staked, token, size
         FROM assets WHERE event_id = $1`
@@ -274,6 +646,60 @@ func (p *persistor) getEventAssets(ctx context.Context, id uuid.UUID) ([]*Asset,
 	return assetList, nil
 }
 
+// stakeTotal verified collateral and size of an outcome
+type stakeTotal struct {
+	collateral tlb.Grams
+	size       tlb.Grams
+}
+
+// getStakedTotals sums verified stakes per event and outcome, shares held by open sell orders included
+func (p *persistor) getStakedTotals(ctx context.Context) (map[uuid.UUID]map[token.Token]stakeTotal, error) {
+	q := `SELECT event_id, token, SUM(collateral)::bigint, SUM(size)::bigint
+          FROM (SELECT event_id, token, collateral_staked AS collateral, size FROM assets
+                UNION ALL
+                SELECT event_id, token, escrow, size - filled FROM orders WHERE side = $1 AND state = $2) s
+          GROUP BY event_id, token`
+
+	totals := make(map[uuid.UUID]map[token.Token]stakeTotal)
+
+	rows, err := p.pool.Query(ctx, q, OrderSell, OrderOpen)
+	if err != nil {
+		return nil, fmt.Errorf("get staked totals failed: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var eventID uuid.UUID
+		var t token.Token
+		var total stakeTotal
+		if err = rows.Scan(&eventID, &t, &total.collateral, &total.size); err != nil {
+			return nil, fmt.Errorf("get staked totals failed: %w", err)
+		}
+		if _, ok := totals[eventID]; !ok {
+			totals[eventID] = make(map[token.Token]stakeTotal)
+		}
+		totals[eventID][t] = total
+	}
+
+	return totals, rows.Err()
+}
+
+func (p *persistor) saveResolution(ctx context.Context, eventID uuid.UUID, kind string, t token.Token,
+	evidence *Evidence, resolveErr error) error {
+	q := `INSERT INTO resolutions (event_id, kind, token, evidence, error) VALUES ($1, $2, $3, $4, $5)`
+
+	errStr := ""
+	if resolveErr != nil {
+		errStr = resolveErr.Error()
+	}
+
+	if _, err := p.pool.Exec(ctx, q, eventID, kind, t, evidence, errStr); err != nil {
+		return fmt.Errorf("save resolution of event: %s failed: %w", eventID.String(), err)
+	}
+	return nil
+}
+
 func (p *persistor) deleteAssets(ctx context.Context, id uuid.UUID) error {
 	q := `DELETE FROM assets WHERE event_id = $1`
 
@@ -284,28 +710,95 @@ func (p *persistor) deleteAssets(ctx context.Context, id uuid.UUID) error {
 	return nil
 }
 
-func (p *persistor) attemptDeal(ctx context.Context, dealID uuid.UUID) (int, error) {
+type depositJob struct {
+	dealID   uuid.UUID
+	attempts int
+}
+
+var ErrDepositJob = errors.New("deposit job failed")
+
+// enqueueDepositJob registers deal for the deposit check, repeated calls are no-op
+func (p *persistor) enqueueDepositJob(ctx context.Context, dealID uuid.UUID, delay time.Duration) error {
+	q := `INSERT INTO deposit_jobs (deal_id, next_attempt_at)
+          VALUES ($1, now() + $2::interval)
+          ON CONFLICT (deal_id) DO NOTHING`
+
+	if _, err := p.pool.Exec(ctx, q, dealID, delay); err != nil {
+		return fmt.Errorf("%w: enqueue deal: %s: %w", ErrDepositJob, dealID.String(), err)
+	}
+	return nil
+}
+
+// claimDepositJobs takes due jobs and hides them from other workers for lease duration,
+// so a job of a crashed worker is picked up again once the lease is over
+func (p *persistor) claimDepositJobs(ctx context.Context, limit int, lease time.Duration) ([]*depositJob, error) {
 	tx, err := p.pool.Begin(ctx)
 	if err != nil {
-		return -1, err
+		return nil, fmt.Errorf("%w: %w: %w", ErrDepositJob, db.ErrOpenTransaction, err)
 	}
 
-	qg := `SELECT deal_status FROM deals WHERE id = $1`
-	qu := `UPDATE deals SET attempts = $1`
+	defer tx.Rollback(ctx)
+
+	qs := `SELECT deal_id FROM deposit_jobs
+           WHERE NOT done AND next_attempt_at <= now()
+           ORDER BY next_attempt_at
+           LIMIT $1
+           FOR UPDATE SKIP LOCKED`
+
+	qu := `UPDATE deposit_jobs SET attempts = attempts + 1, next_attempt_at = now() + $1::interval
+           WHERE deal_id = ANY($2)
+           RETURNING deal_id, attempts`
 
-	var attempts int
-	err = tx.QueryRow(ctx, qg, dealID).Scan(&attempts)
+	rows, err := tx.Query(ctx, qs, limit)
 	if err != nil {
-		return -1, err
+		return nil, fmt.Errorf("%w: %w: %w", ErrDepositJob, db.ErrTransactionFailed, err)
 	}
 
-	attempts++
-	if _, err := tx.Exec(ctx, qu, attempts); err != nil {
-		return -1, err
+	idList := make([]uuid.UUID, 0, limit)
+	for rows.Next() {
+		var id uuid.UUID
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("%w: %w: %w", ErrDepositJob, db.ErrTransactionFailed, err)
+		}
+		idList = append(idList, id)
 	}
+	rows.Close()
+
+	if len(idList) == 0 {
+		return nil, nil
+	}
+
+	rows, err = tx.Query(ctx, qu, lease, idList)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w: %w", ErrDepositJob, db.ErrTransactionFailed, err)
+	}
+
+	jobList := make([]*depositJob, 0, len(idList))
+	for rows.Next() {
+		var job depositJob
+		if err = rows.Scan(&job.dealID, &job.attempts); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("%w: %w: %w", ErrDepositJob, db.ErrTransactionFailed, err)
+		}
+		jobList = append(jobList, &job)
+	}
+	rows.Close()
 
 	if err := tx.Commit(ctx); err != nil {
-		return -1, err
+		return nil, fmt.Errorf("%w: %w: %w", ErrDepositJob, db.ErrCommitTransaction, err)
 	}
-	return attempts, nil
+
+	return jobList, nil
+}
+
+// retryDepositJob schedules next attempt of the claimed job
+func (p *persistor) retryDepositJob(ctx context.Context, dealID uuid.UUID, delay time.Duration, reason string) error {
+	q := `UPDATE deposit_jobs SET next_attempt_at = now() + $1::interval, last_error = $2
+          WHERE deal_id = $3`
+
+	if _, err := p.pool.Exec(ctx, q, delay, reason, dealID); err != nil {
+		return fmt.Errorf("%w: retry deal: %s: %w", ErrDepositJob, dealID.String(), err)
+	}
+	return nil
 }
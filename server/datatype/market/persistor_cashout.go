@@ -0,0 +1,127 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/TON-Market/tma/server/datatype/token"
+	"github.com/TON-Market/tma/server/db"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/tonkeeper/tongo/tlb"
+)
+
+var ErrPersistCashOut = errors.New("persist cash out failed")
+
+func (p *persistor) getAsset(ctx context.Context, addr string, eventID uuid.UUID, t token.Token) (*Asset, error) {
+	q := `SELECT user_raw_address, event_id, collateral_staked, token, size
+          FROM assets WHERE user_raw_address = $1 AND event_id = $2 AND token = $3`
+
+	var asset Asset
+	err := p.pool.QueryRow(ctx, q, addr, eventID, t).
+		Scan(&asset.UserRawAddress, &asset.EventID, &asset.CollateralStaked, &asset.Token, &asset.Size)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w: event: %s, token: %s", ErrNoPosition, eventID.String(), t)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: get asset: %w", ErrPersistCashOut, err)
+	}
+	return &asset, nil
+}
+
+// cashOut takes collateral and size of the deal off the asset, saves the deal and the payout of the value.
+// The asset is checked again in the transaction, the position may be sold concurrently.
+func (p *persistor) cashOut(ctx context.Context, d *Deal, up *UserProfit) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistCashOut, db.ErrOpenTransaction, err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	qd := `INSERT INTO deals (id, event_id, token, collateral, size, user_raw_addr, deal_status, refunded)
+           VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	qud := `INSERT INTO user_deals (user_raw_addr, deal_id) VALUES ($1, $2)`
+
+	err = takeAsset(ctx, tx, &Asset{d.UserRawAddr, d.EventID, d.Collateral, d.Token, d.Size})
+	if errors.Is(err, ErrInsufficientPosition) {
+		return fmt.Errorf("%w: %w", ErrPersistCashOut, err)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistCashOut, db.ErrTransactionFailed, err)
+	}
+
+	if _, err := tx.Exec(ctx, qd, d.ID, d.EventID, d.Token, d.Collateral, d.Size, d.UserRawAddr, d.DealStatus,
+		d.Refunded); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistCashOut, db.ErrTransactionFailed, err)
+	}
+	if _, err := tx.Exec(ctx, qud, d.UserRawAddr, d.ID); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistCashOut, db.ErrTransactionFailed, err)
+	}
+
+	if err := insertPayout(ctx, tx, up); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistCashOut, db.ErrTransactionFailed, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistCashOut, db.ErrCommitTransaction, err)
+	}
+	return nil
+}
+
+// takeAsset takes collateral and size off the user asset, the asset is removed when its size is taken whole
+func takeAsset(ctx context.Context, tx pgx.Tx, a *Asset) error {
+	qa := `UPDATE assets SET collateral_staked = collateral_staked - $1, size = size - $2
+           WHERE user_raw_address = $3 AND event_id = $4 AND token = $5
+             AND collateral_staked >= $1 AND size >= $2`
+
+	qad := `DELETE FROM assets WHERE user_raw_address = $1 AND event_id = $2 AND token = $3 AND size = 0`
+
+	tag, err := tx.Exec(ctx, qa, a.CollateralStaked, a.Size, a.UserRawAddress, a.EventID, a.Token)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInsufficientPosition
+	}
+	_, err = tx.Exec(ctx, qad, a.UserRawAddress, a.EventID, a.Token)
+	return err
+}
+
+// addAsset adds collateral and size to the user asset, the asset is created if the user has none
+func addAsset(ctx context.Context, tx pgx.Tx, a *Asset) error {
+	q := `INSERT INTO assets (user_raw_address, event_id, collateral_staked, token, size)
+          VALUES ($1, $2, $3, $4, $5)
+          ON CONFLICT (user_raw_address, event_id, token) DO UPDATE
+          SET collateral_staked = assets.collateral_staked + excluded.collateral_staked,
+              size = assets.size + excluded.size`
+
+	_, err := tx.Exec(ctx, q, a.UserRawAddress, a.EventID, a.CollateralStaked, a.Token, a.Size)
+	return err
+}
+
+// cashOutTotal positions of the event sold before resolution
+type cashOutTotal struct {
+	// collateral taken off the assets
+	collateral tlb.Grams
+	// value paid to the users, fee included
+	value tlb.Grams
+	fee   tlb.Grams
+}
+
+func (p *persistor) getCashOutTotal(ctx context.Context, eventID uuid.UUID) (*cashOutTotal, error) {
+	qd := `SELECT COALESCE(SUM(collateral), 0)::bigint, COALESCE(SUM(refunded), 0)::bigint
+           FROM deals WHERE event_id = $1 AND deal_status = $2`
+
+	qf := `SELECT COALESCE(SUM(fee), 0)::bigint FROM payouts WHERE event_id = $1 AND kind = $2`
+
+	var total cashOutTotal
+	if err := p.pool.QueryRow(ctx, qd, eventID, CashedOut).Scan(&total.collateral, &total.value); err != nil {
+		return nil, fmt.Errorf("%w: get cash out total: %w", ErrPersistCashOut, err)
+	}
+	if err := p.pool.QueryRow(ctx, qf, eventID, PayoutCashOut).Scan(&total.fee); err != nil {
+		return nil, fmt.Errorf("%w: get cash out total: %w", ErrPersistCashOut, err)
+	}
+	return &total, nil
+}
@@ -0,0 +1,90 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+var ErrPersistFee = errors.New("persist fee failed")
+
+// getTagFeePolicy returns nil if tag has no policy
+func (p *persistor) getTagFeePolicy(ctx context.Context, tag Tag) (*FeePolicy, error) {
+	q := `SELECT policy FROM fee_policies WHERE tag = $1`
+
+	var policy FeePolicy
+	if err := p.pool.QueryRow(ctx, q, tag).Scan(&policy); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: get tag: %d policy: %w", ErrPersistFee, tag, err)
+	}
+	return &policy, nil
+}
+
+func (p *persistor) saveTagFeePolicy(ctx context.Context, tag Tag, policy *FeePolicy) error {
+	q := `INSERT INTO fee_policies (tag, policy) VALUES ($1, $2)
+          ON CONFLICT (tag) DO UPDATE SET policy = excluded.policy, updated_at = now()`
+
+	if _, err := p.pool.Exec(ctx, q, tag, policy); err != nil {
+		return fmt.Errorf("%w: save tag: %d policy: %w", ErrPersistFee, tag, err)
+	}
+	return nil
+}
+
+func (p *persistor) deleteTagFeePolicy(ctx context.Context, tag Tag) error {
+	q := `DELETE FROM fee_policies WHERE tag = $1`
+
+	if _, err := p.pool.Exec(ctx, q, tag); err != nil {
+		return fmt.Errorf("%w: delete tag: %d policy: %w", ErrPersistFee, tag, err)
+	}
+	return nil
+}
+
+func (p *persistor) getEventFee(ctx context.Context, id uuid.UUID) (*EventFee, error) {
+	q := `SELECT event_id, kind, policy, grams, jetton, win_pool, lose_pool, created_at
+          FROM event_fees WHERE event_id = $1`
+
+	var fee EventFee
+	if err := p.pool.QueryRow(ctx, q, id).Scan(&fee.EventID, &fee.Kind, &fee.Policy, &fee.Grams,
+		&fee.Jetton, &fee.WinPool, &fee.LosePool, &fee.CreatedAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("%w: %s", ErrFeeNotExist, id.String())
+		}
+		return nil, fmt.Errorf("%w: get event: %s fee: %w", ErrPersistFee, id.String(), err)
+	}
+	return &fee, nil
+}
+
+// getFeeReport groups fees by period and collateral, period must be a valid date_trunc field
+func (p *persistor) getFeeReport(ctx context.Context, from, to time.Time, period string) ([]*FeePeriod, error) {
+	q := `SELECT date_trunc($1, created_at) AS start, jetton, SUM(grams)::bigint, COUNT(*)
+          FROM event_fees
+          WHERE created_at >= $2 AND created_at < $3
+          GROUP BY start, jetton
+          ORDER BY start, jetton`
+
+	rows, err := p.pool.Query(ctx, q, period, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("%w: get fee report: %w", ErrPersistFee, err)
+	}
+
+	defer rows.Close()
+
+	feePeriodList := make([]*FeePeriod, 0)
+	for rows.Next() {
+		var fp FeePeriod
+		if err = rows.Scan(&fp.Start, &fp.Jetton, &fp.Grams, &fp.Events); err != nil {
+			return nil, fmt.Errorf("%w: get fee report: %w", ErrPersistFee, err)
+		}
+		feePeriodList = append(feePeriodList, &fp)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: get fee report: %w", ErrPersistFee, err)
+	}
+
+	return feePeriodList, nil
+}
@@ -0,0 +1,407 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/TON-Market/tma/server/datatype/token"
+	"github.com/TON-Market/tma/server/db"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrPersistOrder = errors.New("persist order failed")
+
+func scanOrder(row pgx.Row, o *Order) error {
+	return row.Scan(&o.ID, &o.EventID, &o.Token, &o.UserRawAddr, &o.Side, &o.Price, &o.Size, &o.Filled,
+		&o.Locked, &o.Escrow, &o.DealID, &o.State, &o.CreatedAt)
+}
+
+func insertOrder(ctx context.Context, tx pgx.Tx, o *Order) error {
+	q := `INSERT INTO orders (id, event_id, token, user_raw_addr, side, price, size, locked, escrow, deal_id, state)
+          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+          RETURNING created_at`
+
+	return tx.QueryRow(ctx, q, o.ID, o.EventID, o.Token, o.UserRawAddr, o.Side, o.Price, o.Size, o.Locked,
+		o.Escrow, o.DealID, o.State).Scan(&o.CreatedAt)
+}
+
+func updateOrder(ctx context.Context, tx pgx.Tx, o *Order) error {
+	q := `UPDATE orders SET filled = $1, locked = $2, escrow = $3, state = $4 WHERE id = $5`
+
+	_, err := tx.Exec(ctx, q, o.Filled, o.Locked, o.Escrow, o.State, o.ID)
+	return err
+}
+
+// createBuyOrder saves the buy order with its unchecked funding deal
+func (p *persistor) createBuyOrder(ctx context.Context, o *Order, d *Deal) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrOpenTransaction, err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	dq := `INSERT INTO deals (id, event_id, token, collateral, size, user_raw_addr, deal_status, attempts)
+           VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	udq := `INSERT INTO user_deals (user_raw_addr, deal_id) VALUES ($1, $2)`
+
+	if _, err := tx.Exec(ctx, dq, d.ID, d.EventID, d.Token, d.Collateral, d.Size, d.UserRawAddr, d.DealStatus,
+		d.Attempts); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+	}
+	if _, err := tx.Exec(ctx, udq, d.UserRawAddr, d.ID); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+	}
+	if err := insertOrder(ctx, tx, o); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrCommitTransaction, err)
+	}
+	return nil
+}
+
+// createSellOrder saves the sell order with its shares taken off the asset
+func (p *persistor) createSellOrder(ctx context.Context, o *Order) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrOpenTransaction, err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	err = takeAsset(ctx, tx, &Asset{o.UserRawAddr, o.EventID, o.Escrow, o.Token, o.Size})
+	if errors.Is(err, ErrInsufficientPosition) {
+		return fmt.Errorf("%w: %w", ErrPersistOrder, err)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+	}
+	if err := insertOrder(ctx, tx, o); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrCommitTransaction, err)
+	}
+	return nil
+}
+
+// fundOrder verifies the funding deal by the settlement and opens its order with the credited collateral,
+// size of pro rata credited order is reduced the same way
+func (p *persistor) fundOrder(ctx context.Context, dealID uuid.UUID, s *depositSettlement) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrOpenTransaction, err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	qu := `UPDATE deals SET deal_status = $1, collateral = $2, size = $3, received = $4, refunded = $5,
+           deposit_outcome = $6
+           WHERE id = $7 AND deal_status = $8`
+
+	qj := `UPDATE deposit_jobs SET done = true WHERE deal_id = $1`
+
+	qo := `UPDATE orders SET state = $1, locked = $2, size = $3 WHERE deal_id = $4 AND state = $5`
+
+	tag, err := tx.Exec(ctx, qo, OrderOpen, s.collateral, s.size, dealID, OrderFunding)
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %w: deal: %s", ErrPersistOrder, ErrOrderNotOpen, dealID.String())
+	}
+
+	tag, err = tx.Exec(ctx, qu, Verified, s.collateral, s.size, s.received, s.refunded(), s.outcome, dealID, Unchecked)
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %w: %s", ErrPersistOrder, ErrDealAlreadyProcessed, dealID.String())
+	}
+	if _, err := tx.Exec(ctx, qj, dealID); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+	}
+	if s.refund != nil {
+		if err := insertPayout(ctx, tx, s.refund); err != nil {
+			return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrCommitTransaction, err)
+	}
+	return nil
+}
+
+// matchOrder fills the open order against resting orders of the other side by price, then by time.
+// Orders of the same user are skipped. The buyer gets the shares, the seller gets a payout,
+// filled buy order refunds the rest of its collateral.
+func (p *persistor) matchOrder(ctx context.Context, id uuid.UUID, jetton string, limit int) ([]*OrderFill, error) {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrOpenTransaction, err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	qo := `SELECT id, event_id, token, user_raw_addr, side, price, size, filled, locked, escrow, deal_id, state, created_at
+           FROM orders WHERE id = $1 FOR UPDATE`
+
+	qasks := `SELECT id, event_id, token, user_raw_addr, side, price, size, filled, locked, escrow, deal_id, state,
+                     created_at
+              FROM orders
+              WHERE event_id = $1 AND token = $2 AND side = $3 AND state = $4 AND user_raw_addr <> $5
+                AND price <= $6
+              ORDER BY price, created_at
+              LIMIT $7
+              FOR UPDATE`
+
+	qbids := `SELECT id, event_id, token, user_raw_addr, side, price, size, filled, locked, escrow, deal_id, state,
+                     created_at
+              FROM orders
+              WHERE event_id = $1 AND token = $2 AND side = $3 AND state = $4 AND user_raw_addr <> $5
+                AND price >= $6
+              ORDER BY price DESC, created_at
+              LIMIT $7
+              FOR UPDATE`
+
+	qf := `INSERT INTO order_fills (event_id, token, buy_order_id, sell_order_id, price, size, grams)
+           VALUES ($1, $2, $3, $4, $5, $6, $7)
+           RETURNING id`
+
+	var taker Order
+	if err := scanOrder(tx.QueryRow(ctx, qo, id), &taker); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("%w: %w: %s", ErrPersistOrder, ErrOrderNotExist, id.String())
+		}
+		return nil, fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+	}
+	if taker.State != OrderOpen {
+		return nil, nil
+	}
+
+	q, makerSide := qasks, OrderSell
+	if taker.Side == OrderSell {
+		q, makerSide = qbids, OrderBuy
+	}
+	rows, err := tx.Query(ctx, q, taker.EventID, taker.Token, makerSide, OrderOpen, taker.UserRawAddr, taker.Price, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+	}
+	makerList := make([]*Order, 0)
+	for rows.Next() {
+		var maker Order
+		if err := scanOrder(rows, &maker); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+		}
+		makerList = append(makerList, &maker)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+	}
+
+	fillList := make([]*OrderFill, 0)
+	for _, maker := range makerList {
+		if taker.remaining() == 0 {
+			break
+		}
+
+		buy, sell := &taker, maker
+		if taker.Side == OrderSell {
+			buy, sell = maker, &taker
+		}
+		fill := fillOrders(buy, sell, maker.Price)
+
+		if err := addAsset(ctx, tx, &Asset{buy.UserRawAddr, buy.EventID, fill.collateral, buy.Token, fill.Size}); err != nil {
+			return nil, fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+		}
+		if err := tx.QueryRow(ctx, qf, fill.EventID, fill.Token, fill.BuyOrderID, fill.SellOrderID, fill.Price,
+			fill.Size, fill.Grams).Scan(&fill.ID); err != nil {
+			return nil, fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+		}
+		if fill.Grams > 0 {
+			if err := insertPayout(ctx, tx, orderFillPayout(sell, fill, jetton)); err != nil {
+				return nil, fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+			}
+		}
+
+		for _, o := range []*Order{buy, sell} {
+			if o.remaining() > 0 {
+				continue
+			}
+			o.State = OrderFilled
+			if o.Side == OrderBuy && o.Locked > 0 {
+				if err := insertPayout(ctx, tx, orderRefund(o, jetton)); err != nil {
+					return nil, fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+				}
+				o.Locked = 0
+			}
+		}
+		if err := updateOrder(ctx, tx, maker); err != nil {
+			return nil, fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+		}
+		fillList = append(fillList, fill)
+	}
+
+	if err := updateOrder(ctx, tx, &taker); err != nil {
+		return nil, fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrCommitTransaction, err)
+	}
+	return fillList, nil
+}
+
+// cancelOrder cancels funding or open order, open buy order refunds the rest of its collateral,
+// open sell order returns the rest of its shares to the asset
+func (p *persistor) cancelOrder(ctx context.Context, id uuid.UUID, jetton string) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrOpenTransaction, err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	qo := `SELECT id, event_id, token, user_raw_addr, side, price, size, filled, locked, escrow, deal_id, state, created_at
+           FROM orders WHERE id = $1 FOR UPDATE`
+
+	var o Order
+	if err := scanOrder(tx.QueryRow(ctx, qo, id), &o); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("%w: %w: %s", ErrPersistOrder, ErrOrderNotExist, id.String())
+		}
+		return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+	}
+	if o.State != OrderFunding && o.State != OrderOpen {
+		return fmt.Errorf("%w: %w: %s", ErrPersistOrder, ErrOrderNotOpen, id.String())
+	}
+
+	if o.State == OrderOpen && o.Side == OrderBuy && o.Locked > 0 {
+		if err := insertPayout(ctx, tx, orderRefund(&o, jetton)); err != nil {
+			return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+		}
+	}
+	if o.State == OrderOpen && o.Side == OrderSell && o.remaining() > 0 {
+		if err := addAsset(ctx, tx, &Asset{o.UserRawAddr, o.EventID, o.Escrow, o.Token, o.remaining()}); err != nil {
+			return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+		}
+	}
+
+	o.State, o.Locked, o.Escrow = OrderCancelled, 0, 0
+	if err := updateOrder(ctx, tx, &o); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrTransactionFailed, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistOrder, db.ErrCommitTransaction, err)
+	}
+	return nil
+}
+
+func (p *persistor) getOrder(ctx context.Context, id uuid.UUID) (*Order, error) {
+	q := `SELECT id, event_id, token, user_raw_addr, side, price, size, filled, locked, escrow, deal_id, state, created_at
+          FROM orders WHERE id = $1`
+
+	var o Order
+	if err := scanOrder(p.pool.QueryRow(ctx, q, id), &o); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("%w: %s", ErrOrderNotExist, id.String())
+		}
+		return nil, fmt.Errorf("%w: get order: %w", ErrPersistOrder, err)
+	}
+	return &o, nil
+}
+
+// getOrderByDeal returns order funded by the deal, nil if the deal is a stake
+func (p *persistor) getOrderByDeal(ctx context.Context, dealID uuid.UUID) (*Order, error) {
+	q := `SELECT id, event_id, token, user_raw_addr, side, price, size, filled, locked, escrow, deal_id, state, created_at
+          FROM orders WHERE deal_id = $1`
+
+	var o Order
+	if err := scanOrder(p.pool.QueryRow(ctx, q, dealID), &o); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: get order by deal: %w", ErrPersistOrder, err)
+	}
+	return &o, nil
+}
+
+// getActiveOrderIDs returns funding and open orders of the event
+func (p *persistor) getActiveOrderIDs(ctx context.Context, eventID uuid.UUID) ([]uuid.UUID, error) {
+	q := `SELECT id FROM orders WHERE event_id = $1 AND state IN ($2, $3) ORDER BY created_at`
+
+	rows, err := p.pool.Query(ctx, q, eventID, OrderFunding, OrderOpen)
+	if err != nil {
+		return nil, fmt.Errorf("%w: get active orders: %w", ErrPersistOrder, err)
+	}
+	defer rows.Close()
+
+	idList := make([]uuid.UUID, 0)
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("%w: get active orders: %w", ErrPersistOrder, err)
+		}
+		idList = append(idList, id)
+	}
+	return idList, rows.Err()
+}
+
+func (p *persistor) getUserOrders(ctx context.Context, addr string, limit int) ([]*Order, error) {
+	q := `SELECT id, event_id, token, user_raw_addr, side, price, size, filled, locked, escrow, deal_id, state, created_at
+          FROM orders WHERE user_raw_addr = $1
+          ORDER BY created_at DESC
+          LIMIT $2`
+
+	rows, err := p.pool.Query(ctx, q, addr, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%w: get user orders: %w", ErrPersistOrder, err)
+	}
+
+	defer rows.Close()
+
+	orderList := make([]*Order, 0)
+	for rows.Next() {
+		var o Order
+		if err := scanOrder(rows, &o); err != nil {
+			return nil, fmt.Errorf("%w: get user orders: %w", ErrPersistOrder, err)
+		}
+		orderList = append(orderList, &o)
+	}
+	return orderList, rows.Err()
+}
+
+// getBookLevels sums open orders of the outcome by side and price, bids first by price descending,
+// then asks by price ascending
+func (p *persistor) getBookLevels(ctx context.Context, eventID uuid.UUID, t token.Token) ([]*bookLevel, error) {
+	q := `SELECT side, price, SUM(size - filled)::bigint, COUNT(*)
+          FROM orders WHERE event_id = $1 AND token = $2 AND state = $3
+          GROUP BY side, price
+          ORDER BY side, CASE WHEN side = $4 THEN -price ELSE price END`
+
+	rows, err := p.pool.Query(ctx, q, eventID, t, OrderOpen, OrderBuy)
+	if err != nil {
+		return nil, fmt.Errorf("%w: get book levels: %w", ErrPersistOrder, err)
+	}
+
+	defer rows.Close()
+
+	levelList := make([]*bookLevel, 0)
+	for rows.Next() {
+		var l bookLevel
+		if err := rows.Scan(&l.side, &l.price, &l.size, &l.orders); err != nil {
+			return nil, fmt.Errorf("%w: get book levels: %w", ErrPersistOrder, err)
+		}
+		levelList = append(levelList, &l)
+	}
+	return levelList, rows.Err()
+}
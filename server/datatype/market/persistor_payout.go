@@ -0,0 +1,304 @@
+package market
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/TON-Market/tma/server/db"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/tonkeeper/tongo/tlb"
+	"time"
+)
+
+var ErrPersistPayout = errors.New("persist payout failed")
+
+// insertEventPayouts saves payouts of the closed event as pending together with the event fee within tx,
+// payouts already known by user and comment and already known event fee are skipped
+func insertEventPayouts(ctx context.Context, tx pgx.Tx, userProfitList []*UserProfit, fee *EventFee) error {
+	qf := `INSERT INTO event_fees (event_id, kind, policy, grams, jetton, win_pool, lose_pool)
+           VALUES ($1, $2, $3, $4, $5, $6, $7)
+           ON CONFLICT (event_id) DO NOTHING`
+
+	for _, up := range userProfitList {
+		if err := insertPayout(ctx, tx, up); err != nil {
+			return fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrTransactionFailed, err)
+		}
+	}
+
+	if fee != nil {
+		if _, err := tx.Exec(ctx, qf, fee.EventID, fee.Kind, fee.Policy, fee.Grams, fee.Jetton, fee.WinPool, fee.LosePool); err != nil {
+			return fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrTransactionFailed, err)
+		}
+	}
+	return nil
+}
+
+// insertPayout saves pending payout within tx, payout already known by user and comment is skipped
+func insertPayout(ctx context.Context, tx pgx.Tx, up *UserProfit) error {
+	q := `INSERT INTO payouts (id, event_id, user_raw_addr, kind, grams, jetton, fee, comment, state)
+          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+          ON CONFLICT (user_raw_addr, comment) DO NOTHING`
+
+	_, err := tx.Exec(ctx, q, up.ID, up.EventID, up.UserRawAddress, up.Kind, up.Grams, up.Jetton, up.Fee, up.Comment,
+		PayoutPending)
+	return err
+}
+
+// claimPayouts takes pending payouts and sent payouts without confirmation for resendAfter
+// together with their last batch. Claimed payouts are hidden from other workers for lease duration.
+func (p *persistor) claimPayouts(ctx context.Context, limit int, resendAfter, lease time.Duration) ([]*UserProfit, error) {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrOpenTransaction, err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	qs := `SELECT p.id, p.event_id, p.user_raw_addr, p.kind, p.grams, p.jetton, p.comment, p.state, p.attempts,
+                  p.last_try, b.id, b.query_id, b.msg_hash, b.state, b.valid_until
+           FROM payouts p
+           LEFT JOIN payout_batches b ON b.id = p.batch_id
+           WHERE p.locked_until <= now()
+             AND (p.state = $1 OR (p.state = $2 AND p.last_try <= now() - $3::interval))
+           ORDER BY p.created_at
+           LIMIT $4
+           FOR UPDATE OF p SKIP LOCKED`
+
+	ql := `UPDATE payouts SET locked_until = now() + $1::interval WHERE id = ANY($2)`
+
+	rows, err := tx.Query(ctx, qs, PayoutPending, PayoutSent, resendAfter, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrTransactionFailed, err)
+	}
+
+	userProfitList := make([]*UserProfit, 0, limit)
+	idList := make([]uuid.UUID, 0, limit)
+	for rows.Next() {
+		var up UserProfit
+		var lastTry, validUntil *time.Time
+		var batchID, queryID *int64
+		var msgHash *string
+		var batchState *BatchState
+		if err = rows.Scan(&up.ID, &up.EventID, &up.UserRawAddress, &up.Kind, &up.Grams, &up.Jetton, &up.Comment,
+			&up.State, &up.Attempts, &lastTry, &batchID, &queryID, &msgHash, &batchState, &validUntil); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrTransactionFailed, err)
+		}
+		if lastTry != nil {
+			up.LastTry = *lastTry
+		}
+		if batchID != nil {
+			up.Batch = &PayoutBatch{ID: *batchID, QueryID: uint64(*queryID), MsgHash: *msgHash, State: *batchState}
+			if validUntil != nil {
+				up.Batch.ValidUntil = *validUntil
+			}
+		}
+		userProfitList = append(userProfitList, &up)
+		idList = append(idList, up.ID)
+	}
+	rows.Close()
+
+	if len(idList) == 0 {
+		return nil, nil
+	}
+
+	if _, err := tx.Exec(ctx, ql, lease, idList); err != nil {
+		return nil, fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrTransactionFailed, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrCommitTransaction, err)
+	}
+
+	return userProfitList, nil
+}
+
+// createPayoutBatch saves the batch and marks its payouts sent in it. It must be committed
+// before the batch is sent, so a crash after sending never leaves payouts in pending state.
+func (p *persistor) createPayoutBatch(ctx context.Context, upList []*UserProfit) (*PayoutBatch, error) {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrOpenTransaction, err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	qb := `INSERT INTO payout_batches (state, size) VALUES ($1, $2) RETURNING id`
+
+	qp := `UPDATE payouts SET state = $1, attempts = attempts + 1, last_try = now(), batch_id = $2
+           WHERE id = $3 AND state IN ($4, $1)
+           RETURNING attempts, last_try`
+
+	batch := &PayoutBatch{State: BatchSending}
+	if err := tx.QueryRow(ctx, qb, BatchSending, len(upList)).Scan(&batch.ID); err != nil {
+		return nil, fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrTransactionFailed, err)
+	}
+
+	for _, up := range upList {
+		if err := tx.QueryRow(ctx, qp, PayoutSent, batch.ID, up.ID, PayoutPending).Scan(&up.Attempts, &up.LastTry); err != nil {
+			return nil, fmt.Errorf("%w: mark payout: %s sent: %w", ErrPersistPayout, up.ID.String(), err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrCommitTransaction, err)
+	}
+
+	for _, up := range upList {
+		up.State = PayoutSent
+		up.Batch = batch
+	}
+	return batch, nil
+}
+
+// savePayoutBatch records the sent wallet message and an attempt of every payout of the batch.
+// The batch stays sent if the message was built, it may be accepted despite the send error.
+func (p *persistor) savePayoutBatch(ctx context.Context, batch *PayoutBatch, chainBatch ChainBatch,
+	upList []*UserProfit, sendErr error) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrOpenTransaction, err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	qb := `UPDATE payout_batches SET query_id = $1, msg_hash = $2, state = $3, valid_until = $4, error = $5
+           WHERE id = $6`
+
+	qa := `INSERT INTO payout_attempts (payout_id, state, msg_hash, error) VALUES ($1, $2, $3, $4)`
+
+	state, msgHash, errStr := BatchSent, "", ""
+	if chainBatch.QueryID == 0 {
+		state = BatchFailed
+	} else {
+		msgHash = hex.EncodeToString(chainBatch.MsgHash[:])
+	}
+	if sendErr != nil {
+		errStr = sendErr.Error()
+	}
+
+	var validUntil *time.Time
+	if !chainBatch.ValidUntil.IsZero() {
+		validUntil = &chainBatch.ValidUntil
+	}
+
+	if _, err := tx.Exec(ctx, qb, int64(chainBatch.QueryID), msgHash, state, validUntil, errStr, batch.ID); err != nil {
+		return fmt.Errorf("%w: save payout batch: %d: %w", ErrPersistPayout, batch.ID, err)
+	}
+
+	for _, up := range upList {
+		if _, err := tx.Exec(ctx, qa, up.ID, up.State, msgHash, errStr); err != nil {
+			return fmt.Errorf("%w: save attempt of payout: %s: %w", ErrPersistPayout, up.ID.String(), err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrCommitTransaction, err)
+	}
+
+	batch.QueryID, batch.MsgHash, batch.State, batch.ValidUntil = chainBatch.QueryID, msgHash, state, chainBatch.ValidUntil
+	return nil
+}
+
+func (p *persistor) setPayoutBatchState(ctx context.Context, batch *PayoutBatch) error {
+	q := `UPDATE payout_batches SET state = $1 WHERE id = $2`
+
+	if _, err := p.pool.Exec(ctx, q, batch.State, batch.ID); err != nil {
+		return fmt.Errorf("%w: set payout batch: %d state: %w", ErrPersistPayout, batch.ID, err)
+	}
+	return nil
+}
+
+func (p *persistor) markPayoutConfirmed(ctx context.Context, up *UserProfit) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrOpenTransaction, err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	q := `UPDATE payouts SET state = $1, tx_hash = $2, tx_lt = $3 WHERE id = $4`
+
+	qa := `INSERT INTO payout_attempts (payout_id, state, msg_hash) VALUES ($1, $2, $3)`
+
+	if _, err := tx.Exec(ctx, q, PayoutConfirmed, up.TxHash, up.TxLt, up.ID); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrTransactionFailed, err)
+	}
+
+	if _, err := tx.Exec(ctx, qa, up.ID, PayoutConfirmed, up.TxHash); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrTransactionFailed, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrCommitTransaction, err)
+	}
+
+	up.State = PayoutConfirmed
+	return nil
+}
+
+func (p *persistor) markPayoutFailed(ctx context.Context, up *UserProfit, reason string) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrOpenTransaction, err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	q := `UPDATE payouts SET state = $1 WHERE id = $2`
+
+	qa := `INSERT INTO payout_attempts (payout_id, state, error) VALUES ($1, $2, $3)`
+
+	if _, err := tx.Exec(ctx, q, PayoutFailed, up.ID); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrTransactionFailed, err)
+	}
+
+	if _, err := tx.Exec(ctx, qa, up.ID, PayoutFailed, reason); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrTransactionFailed, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistPayout, db.ErrCommitTransaction, err)
+	}
+
+	up.State = PayoutFailed
+	return nil
+}
+
+// PayoutTotal sum of not confirmed payouts in one currency
+type PayoutTotal struct {
+	Jetton string
+	Grams  tlb.Grams
+	Count  int
+}
+
+// getPendingPayoutTotals sums pending and sent payouts by jetton
+func (p *persistor) getPendingPayoutTotals(ctx context.Context) ([]PayoutTotal, error) {
+	q := `SELECT jetton, coalesce(sum(grams), 0), count(*)
+          FROM payouts
+          WHERE state IN ($1, $2)
+          GROUP BY jetton`
+
+	rows, err := p.pool.Query(ctx, q, PayoutPending, PayoutSent)
+	if err != nil {
+		return nil, fmt.Errorf("%w: get pending payout totals: %w", ErrPersistPayout, err)
+	}
+
+	defer rows.Close()
+
+	totalList := make([]PayoutTotal, 0)
+	for rows.Next() {
+		var t PayoutTotal
+		if err = rows.Scan(&t.Jetton, &t.Grams, &t.Count); err != nil {
+			return nil, fmt.Errorf("%w: get pending payout totals: %w", ErrPersistPayout, err)
+		}
+		totalList = append(totalList, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: get pending payout totals: %w", ErrPersistPayout, err)
+	}
+
+	return totalList, nil
+}
@@ -0,0 +1,128 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tonkeeper/tongo/tlb"
+)
+
+var ErrPersistSolvency = errors.New("persist solvency failed")
+
+// getOpenStakeTotals sums stakes of not finished events by jetton,
+// collateral held by open orders included
+func (p *persistor) getOpenStakeTotals(ctx context.Context) (map[string]tlb.Grams, error) {
+	q := `SELECT e.jetton, coalesce(sum(a.collateral), 0)::bigint
+          FROM (SELECT event_id, collateral_staked AS collateral FROM assets
+                UNION ALL
+                SELECT event_id, locked + escrow FROM orders WHERE state = $3) a
+          JOIN events e ON e.id = a.event_id
+          WHERE e.status NOT IN ($1, $2)
+          GROUP BY e.jetton`
+
+	return p.sumByJetton(ctx, q, EventResolved, EventVoided, OrderOpen)
+}
+
+// getUnpaidPayoutTotals sums not confirmed payouts by jetton, failed payouts are still owed
+func (p *persistor) getUnpaidPayoutTotals(ctx context.Context) (map[string]tlb.Grams, error) {
+	q := `SELECT jetton, coalesce(sum(grams), 0)::bigint
+          FROM payouts
+          WHERE state <> $1
+          GROUP BY jetton`
+
+	return p.sumByJetton(ctx, q, PayoutConfirmed)
+}
+
+// getUnsettledTransferTotals sums received transfers neither staked nor refunded yet by jetton
+func (p *persistor) getUnsettledTransferTotals(ctx context.Context) (map[string]tlb.Grams, error) {
+	q := `SELECT jetton, coalesce(sum(grams), 0)::bigint
+          FROM bank_transfers
+          WHERE status IN ($1, $2)
+          GROUP BY jetton`
+
+	return p.sumByJetton(ctx, q, TransferPending, TransferUnmatched)
+}
+
+func (p *persistor) sumByJetton(ctx context.Context, q string, args ...any) (map[string]tlb.Grams, error) {
+	rows, err := p.pool.Query(ctx, q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPersistSolvency, err)
+	}
+
+	defer rows.Close()
+
+	totals := make(map[string]tlb.Grams)
+	for rows.Next() {
+		var jetton string
+		var g tlb.Grams
+		if err = rows.Scan(&jetton, &g); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrPersistSolvency, err)
+		}
+		totals[jetton] = g
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPersistSolvency, err)
+	}
+
+	return totals, nil
+}
+
+// getDiscrepancies returns up to limit records of each kind that don't add up with the chain
+func (p *persistor) getDiscrepancies(ctx context.Context, limit int) ([]*Discrepancy, error) {
+	// verified deal must be paid by a matched bank transfer
+	qv := `SELECT d.id::text, d.user_raw_addr, d.collateral, e.jetton
+           FROM deals d
+           JOIN events e ON e.id = d.event_id
+           WHERE d.deal_status = $1
+             AND NOT EXISTS (SELECT 1 FROM bank_transfers t WHERE t.deal_id = d.id AND t.status = $2)
+           LIMIT $3`
+
+	// matched transfer of unchecked deal must have a deposit job settling it
+	qm := `SELECT t.lt::text, t.sender, t.grams, t.jetton
+           FROM bank_transfers t
+           JOIN deals d ON d.id = t.deal_id
+           LEFT JOIN deposit_jobs j ON j.deal_id = d.id
+           WHERE t.status = $1 AND d.deal_status = $2 AND (j.deal_id IS NULL OR j.done)
+           LIMIT $3`
+
+	qf := `SELECT id::text, user_raw_addr, grams, jetton
+           FROM payouts
+           WHERE state = $1
+           LIMIT $2`
+
+	queryList := []struct {
+		kind DiscrepancyKind
+		q    string
+		args []any
+	}{
+		{DiscrepancyUnpaidDeal, qv, []any{Verified, TransferMatched, limit}},
+		{DiscrepancyUnsettledTransfer, qm, []any{TransferMatched, Unchecked, limit}},
+		{DiscrepancyFailedPayout, qf, []any{PayoutFailed, limit}},
+	}
+
+	discrepancyList := make([]*Discrepancy, 0)
+	for _, dq := range queryList {
+		rows, err := p.pool.Query(ctx, dq.q, dq.args...)
+		if err != nil {
+			return nil, fmt.Errorf("%w: get discrepancies: %w", ErrPersistSolvency, err)
+		}
+		for rows.Next() {
+			d := Discrepancy{Kind: dq.kind}
+			var user *string
+			if err = rows.Scan(&d.Ref, &user, &d.Grams, &d.Jetton); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("%w: get discrepancies: %w", ErrPersistSolvency, err)
+			}
+			if user != nil {
+				d.UserRawAddress = *user
+			}
+			discrepancyList = append(discrepancyList, &d)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, fmt.Errorf("%w: get discrepancies: %w", ErrPersistSolvency, err)
+		}
+	}
+
+	return discrepancyList, nil
+}
@@ -0,0 +1,256 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/TON-Market/tma/server/db"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrPersistTransfer = errors.New("persist bank transfer failed")
+	ErrDealNotExist    = errors.New("deal does not exist")
+)
+
+// getIndexerLt returns last processed lt of the indexer, 0 if it never ran
+func (p *persistor) getIndexerLt(ctx context.Context, name string) (uint64, error) {
+	q := `SELECT last_lt FROM indexer_state WHERE name = $1`
+
+	var lt uint64
+	if err := p.pool.QueryRow(ctx, q, name).Scan(&lt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("%w: get indexer: %s lt: %w", ErrPersistTransfer, name, err)
+	}
+	return lt, nil
+}
+
+// saveBankTransfers stores transfers and moves indexer lt in one transaction
+func (p *persistor) saveBankTransfers(ctx context.Context, name string, transferList []*BankTransfer, lt uint64) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistTransfer, db.ErrOpenTransaction, err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	q := `INSERT INTO bank_transfers (lt, hash, sender, grams, jetton, comment, status, tx_time)
+          VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+          ON CONFLICT (lt) DO NOTHING`
+
+	qs := `INSERT INTO indexer_state (name, last_lt) VALUES ($1, $2)
+           ON CONFLICT (name) DO UPDATE SET last_lt = excluded.last_lt, updated_at = now()`
+
+	for _, t := range transferList {
+		if _, err := tx.Exec(ctx, q, t.Lt, t.Hash, t.Sender, t.Grams, t.Jetton, t.Comment, t.Status, t.Time); err != nil {
+			return fmt.Errorf("%w: %w: %w", ErrPersistTransfer, db.ErrTransactionFailed, err)
+		}
+	}
+
+	if _, err := tx.Exec(ctx, qs, name, lt); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistTransfer, db.ErrTransactionFailed, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistTransfer, db.ErrCommitTransaction, err)
+	}
+	return nil
+}
+
+// getTransfers returns transfers with status, oldest first
+func (p *persistor) getTransfers(ctx context.Context, status TransferStatus, limit int) ([]*BankTransfer, error) {
+	q := `SELECT lt, hash, sender, grams, jetton, comment, deal_id, status, tx_time
+          FROM bank_transfers WHERE status = $1
+          ORDER BY lt
+          LIMIT $2`
+
+	rows, err := p.pool.Query(ctx, q, status, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%w: get transfers: %w", ErrPersistTransfer, err)
+	}
+
+	defer rows.Close()
+
+	transferList := make([]*BankTransfer, 0)
+	for rows.Next() {
+		var t BankTransfer
+		if err = rows.Scan(&t.Lt, &t.Hash, &t.Sender, &t.Grams, &t.Jetton, &t.Comment, &t.DealID, &t.Status, &t.Time); err != nil {
+			return nil, fmt.Errorf("%w: get transfers: %w", ErrPersistTransfer, err)
+		}
+		transferList = append(transferList, &t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: get transfers: %w", ErrPersistTransfer, err)
+	}
+
+	return transferList, nil
+}
+
+// setTransferStatus moves pending transfer to the status with deal it was matched to
+func (p *persistor) setTransferStatus(ctx context.Context, t *BankTransfer, status TransferStatus, reason string) error {
+	q := `UPDATE bank_transfers SET status = $1, deal_id = $2, reason = $3
+          WHERE lt = $4 AND status = $5`
+
+	if _, err := p.pool.Exec(ctx, q, status, t.DealID, reason, t.Lt, TransferPending); err != nil {
+		return fmt.Errorf("%w: set transfer lt: %d status: %w", ErrPersistTransfer, t.Lt, err)
+	}
+	t.Status, t.Reason = status, reason
+	return nil
+}
+
+// getMatchedTransfer returns bank transfer the indexer matched to the deal, nil if there is none
+func (p *persistor) getMatchedTransfer(ctx context.Context, dealID uuid.UUID) (*BankTransfer, error) {
+	q := `SELECT lt, hash, sender, grams, jetton, comment, deal_id, status, tx_time
+          FROM bank_transfers WHERE deal_id = $1 AND status = $2
+          ORDER BY lt
+          LIMIT 1`
+
+	var t BankTransfer
+	if err := p.pool.QueryRow(ctx, q, dealID, TransferMatched).Scan(&t.Lt, &t.Hash, &t.Sender, &t.Grams,
+		&t.Jetton, &t.Comment, &t.DealID, &t.Status, &t.Time); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: get deal: %s transfer: %w", ErrPersistTransfer, dealID.String(), err)
+	}
+	return &t, nil
+}
+
+func (p *persistor) getDeal(ctx context.Context, id uuid.UUID) (*Deal, error) {
+	q := `SELECT id, event_id, token, collateral, size, user_raw_addr, deal_status, received, refunded, deposit_outcome
+          FROM deals WHERE id = $1`
+
+	var deal Deal
+	if err := p.pool.QueryRow(ctx, q, id).Scan(&deal.ID, &deal.EventID, &deal.Token, &deal.Collateral,
+		&deal.Size, &deal.UserRawAddr, &deal.DealStatus, &deal.Received, &deal.Refunded, &deal.DepositOutcome); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("%w: %s", ErrDealNotExist, id.String())
+		}
+		return nil, fmt.Errorf("%w: get deal: %s: %w", ErrPersistDeal, id.String(), err)
+	}
+	return &deal, nil
+}
+
+// orphanTransfer declines the deal of matched transfer and leaves the transfer for refund
+func (p *persistor) orphanTransfer(ctx context.Context, t *BankTransfer, reason string) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistTransfer, db.ErrOpenTransaction, err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	qt := `UPDATE bank_transfers SET status = $1, reason = $2 WHERE lt = $3 AND status = $4`
+
+	qd := `UPDATE deals SET deal_status = $1, received = $2, deposit_outcome = $3
+           WHERE id = $4 AND deal_status = $5`
+
+	qj := `UPDATE deposit_jobs SET done = true, last_error = $1 WHERE deal_id = $2`
+
+	qo := `UPDATE orders SET state = $1 WHERE deal_id = $2 AND state = $3`
+
+	tag, err := tx.Exec(ctx, qd, Declined, t.Grams, DepositOrphaned, t.DealID, Unchecked)
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistTransfer, db.ErrTransactionFailed, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: %w", ErrPersistTransfer, ErrDealAlreadyProcessed)
+	}
+
+	if _, err := tx.Exec(ctx, qt, TransferUnmatched, reason, t.Lt, TransferMatched); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistTransfer, db.ErrTransactionFailed, err)
+	}
+
+	if _, err := tx.Exec(ctx, qj, reason, t.DealID); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistTransfer, db.ErrTransactionFailed, err)
+	}
+
+	if _, err := tx.Exec(ctx, qo, OrderDeclined, t.DealID, OrderFunding); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistTransfer, db.ErrTransactionFailed, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistTransfer, db.ErrCommitTransaction, err)
+	}
+
+	t.Status, t.Reason = TransferUnmatched, reason
+	return nil
+}
+
+// refundTransfer saves refund payout of unmatched transfer, up is nil if the transfer is kept
+func (p *persistor) refundTransfer(ctx context.Context, t *BankTransfer, up *UserProfit) error {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistTransfer, db.ErrOpenTransaction, err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	q := `UPDATE bank_transfers SET status = $1, refund_payout_id = $2 WHERE lt = $3 AND status = $4`
+
+	status := TransferKept
+	var refundID *uuid.UUID
+	if up != nil {
+		status, refundID = TransferRefunded, &up.ID
+	}
+
+	tag, err := tx.Exec(ctx, q, status, refundID, t.Lt, TransferUnmatched)
+	if err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistTransfer, db.ErrTransactionFailed, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil
+	}
+
+	if up != nil {
+		if err := insertPayout(ctx, tx, up); err != nil {
+			return fmt.Errorf("%w: %w: %w", ErrPersistTransfer, db.ErrTransactionFailed, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%w: %w: %w", ErrPersistTransfer, db.ErrCommitTransaction, err)
+	}
+
+	t.Status, t.RefundID = status, refundID
+	return nil
+}
+
+// getOrphanTransfers returns transfers with one of statuses, newest first, with state of the refund payout
+func (p *persistor) getOrphanTransfers(ctx context.Context, statusList []TransferStatus, limit, offset int) ([]*BankTransfer, []*PayoutState, error) {
+	q := `SELECT t.lt, t.hash, t.sender, t.grams, t.jetton, t.comment, t.deal_id, t.status, t.reason, t.tx_time,
+                 t.refund_payout_id, p.state
+          FROM bank_transfers t
+          LEFT JOIN payouts p ON p.id = t.refund_payout_id
+          WHERE t.status = ANY($1)
+          ORDER BY t.lt DESC
+          LIMIT $2 OFFSET $3`
+
+	rows, err := p.pool.Query(ctx, q, statusList, limit, offset)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: get orphan transfers: %w", ErrPersistTransfer, err)
+	}
+
+	defer rows.Close()
+
+	transferList := make([]*BankTransfer, 0)
+	stateList := make([]*PayoutState, 0)
+	for rows.Next() {
+		var t BankTransfer
+		var state *PayoutState
+		if err = rows.Scan(&t.Lt, &t.Hash, &t.Sender, &t.Grams, &t.Jetton, &t.Comment, &t.DealID, &t.Status, &t.Reason,
+			&t.Time, &t.RefundID, &state); err != nil {
+			return nil, nil, fmt.Errorf("%w: get orphan transfers: %w", ErrPersistTransfer, err)
+		}
+		transferList = append(transferList, &t)
+		stateList = append(stateList, state)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("%w: get orphan transfers: %w", ErrPersistTransfer, err)
+	}
+
+	return transferList, stateList, nil
+}
@@ -0,0 +1,106 @@
+package market
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrPersistTreasury = errors.New("persist treasury failed")
+
+// createSweep saves the sweep before its transfer is sent
+func (p *persistor) createSweep(ctx context.Context, s *Sweep) error {
+	q := `INSERT INTO treasury_sweeps (to_addr, grams, hot_balance, pending, state)
+          VALUES ($1, $2, $3, $4, $5)
+          RETURNING id, created_at`
+
+	if err := p.pool.QueryRow(ctx, q, s.To, s.Grams, s.HotBalance, s.Pending, s.State).Scan(&s.ID, &s.CreatedAt); err != nil {
+		return fmt.Errorf("%w: create sweep: %w", ErrPersistTreasury, err)
+	}
+	return nil
+}
+
+// saveSweep records the sent wallet message of the sweep,
+// the sweep stays sent if the message was built, it may be accepted despite the send error
+func (p *persistor) saveSweep(ctx context.Context, s *Sweep, chainBatch ChainBatch, sendErr error) error {
+	q := `UPDATE treasury_sweeps SET state = $1, query_id = $2, msg_hash = $3, valid_until = $4, error = $5
+          WHERE id = $6`
+
+	state, msgHash, errStr := SweepSent, "", ""
+	if chainBatch.QueryID == 0 {
+		state = SweepFailed
+	} else {
+		msgHash = hex.EncodeToString(chainBatch.MsgHash[:])
+	}
+	if sendErr != nil {
+		errStr = sendErr.Error()
+	}
+
+	var validUntil *time.Time
+	if !chainBatch.ValidUntil.IsZero() {
+		validUntil = &chainBatch.ValidUntil
+	}
+
+	if _, err := p.pool.Exec(ctx, q, state, int64(chainBatch.QueryID), msgHash, validUntil, errStr, s.ID); err != nil {
+		return fmt.Errorf("%w: save sweep: %d: %w", ErrPersistTreasury, s.ID, err)
+	}
+
+	s.State, s.QueryID, s.MsgHash, s.ValidUntil, s.Error = state, chainBatch.QueryID, msgHash, chainBatch.ValidUntil, errStr
+	return nil
+}
+
+func (p *persistor) setSweepState(ctx context.Context, s *Sweep) error {
+	q := `UPDATE treasury_sweeps SET state = $1, error = $2 WHERE id = $3`
+
+	if _, err := p.pool.Exec(ctx, q, s.State, s.Error, s.ID); err != nil {
+		return fmt.Errorf("%w: set sweep: %d state: %w", ErrPersistTreasury, s.ID, err)
+	}
+	return nil
+}
+
+// getLastSweep returns the newest sweep, nil if there is none
+func (p *persistor) getLastSweep(ctx context.Context) (*Sweep, error) {
+	sweepList, err := p.getSweeps(ctx, 1)
+	if err != nil || len(sweepList) == 0 {
+		return nil, err
+	}
+	return sweepList[0], nil
+}
+
+// getSweeps returns up to limit sweeps, newest first
+func (p *persistor) getSweeps(ctx context.Context, limit int) ([]*Sweep, error) {
+	q := `SELECT id, to_addr, grams, hot_balance, pending, state, query_id, msg_hash, valid_until, error, created_at
+          FROM treasury_sweeps
+          ORDER BY id DESC
+          LIMIT $1`
+
+	rows, err := p.pool.Query(ctx, q, limit)
+	if err != nil {
+		return nil, fmt.Errorf("%w: get sweeps: %w", ErrPersistTreasury, err)
+	}
+
+	defer rows.Close()
+
+	sweepList := make([]*Sweep, 0)
+	for rows.Next() {
+		var s Sweep
+		var queryID int64
+		var validUntil *time.Time
+		if err = rows.Scan(&s.ID, &s.To, &s.Grams, &s.HotBalance, &s.Pending, &s.State, &queryID, &s.MsgHash,
+			&validUntil, &s.Error, &s.CreatedAt); err != nil {
+			return nil, fmt.Errorf("%w: get sweeps: %w", ErrPersistTreasury, err)
+		}
+		s.QueryID = uint64(queryID)
+		if validUntil != nil {
+			s.ValidUntil = *validUntil
+		}
+		sweepList = append(sweepList, &s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: get sweeps: %w", ErrPersistTreasury, err)
+	}
+
+	return sweepList, nil
+}
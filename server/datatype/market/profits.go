@@ -2,7 +2,10 @@ package market
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/TON-Market/tma/server/config"
 	"github.com/TON-Market/tma/server/datatype/token"
 	"github.com/google/uuid"
 	"github.com/tonkeeper/tongo/boc"
@@ -10,14 +13,73 @@ import (
 	"github.com/tonkeeper/tongo/ton"
 	"github.com/tonkeeper/tongo/wallet"
 	"log"
+	"slices"
 	"time"
 )
 
+type PayoutState int
+
+const (
+	PayoutPending PayoutState = iota
+	PayoutSent
+	PayoutConfirmed
+	PayoutFailed
+)
+
+type BatchState int
+
+const (
+	// BatchSending batch is saved, the wallet message is not sent yet
+	BatchSending BatchState = iota
+	BatchSent
+	BatchProcessed
+	BatchExpired
+	// BatchFailed wallet message was not sent
+	BatchFailed
+)
+
+// PayoutBatch wallet message carrying several payouts, tracked by query id of the highload wallet
+type PayoutBatch struct {
+	ID         int64
+	QueryID    uint64
+	MsgHash    string
+	State      BatchState
+	ValidUntil time.Time
+}
+
+type PayoutKind int
+
+const (
+	PayoutWin PayoutKind = iota
+	PayoutRefund
+	PayoutDepositRefund
+	PayoutTransferRefund
+	PayoutCashOut
+	// PayoutOrderFill pays the seller of the order fill
+	PayoutOrderFill
+	// PayoutOrderRefund returns collateral of buy order left after fills or cancellation
+	PayoutOrderRefund
+)
+
+// UserProfit persist payout to the user
 type UserProfit struct {
+	ID             uuid.UUID
+	Kind           PayoutKind
 	UserRawAddress string
 	Grams          tlb.Grams
-	LastTry        time.Time
-	EventID        string
+	// Jetton master raw address of the paid jettons, empty for TON
+	Jetton   string
+	LastTry  time.Time
+	EventID  uuid.UUID
+	Comment  string
+	State    PayoutState
+	Attempts int
+	TxHash   string
+	TxLt     uint64
+	// Batch last batch the payout was sent in, nil if it was never sent
+	Batch *PayoutBatch
+	// Fee taken by the house from this payout
+	Fee tlb.Grams
 }
 
 type TokenDeposits struct {
@@ -25,30 +87,93 @@ type TokenDeposits struct {
 	LoseCollateral tlb.Grams
 }
 
+// closeDelay lets deposits already confirmed on chain settle after betting is closed, before stakes are summed
+var closeDelay = 20 * time.Second
+
 func (m *Market) CloseEvent(ctx context.Context, eventID uuid.UUID, winToken token.Token) error {
+	eventCopy, err := m.persistor.getCopyByID(ctx, eventID)
+	if err != nil {
+		return fmt.Errorf("close event failed: %w", err)
+	}
+	if eventCopy.isFinished() {
+		return fmt.Errorf("close event failed: %w", ErrEventFinished)
+	}
+	if !eventCopy.hasOutcome(winToken) {
+		return fmt.Errorf("close event failed: %w: %s", ErrUnknownOutcome, winToken)
+	}
+	// event stays resolving with the win token until payouts are saved,
+	// so an interrupted close can be repeated with the same token only
+	if err := m.persistor.beginClose(ctx, eventID, EventResolving, winToken); err != nil {
+		return fmt.Errorf("close event failed: %w", err)
+	}
 	if err := m.runtimer.close(ctx, eventID); err != nil {
 		return fmt.Errorf("close event failed: %w", err)
 	}
-	//time.Sleep(5 * time.Minute)
-	time.Sleep(20 * time.Second)
-	userProfitList, err := m.buildUserProfitData(ctx, eventID, winToken)
+	time.Sleep(closeDelay)
+	policy, err := m.feePolicyFor(ctx, &eventCopy)
+	if err != nil {
+		return fmt.Errorf("close event failed: %w", err)
+	}
+	c, err := m.currencyOf(eventCopy.Jetton)
 	if err != nil {
 		return fmt.Errorf("close event failed: %w", err)
 	}
+	if err := m.cancelEventOrders(ctx, eventID, c); err != nil {
+		return fmt.Errorf("close event failed: %w", err)
+	}
 
-	m.broadcastUsersProfit(ctx, userProfitList)
-	m.writeToChannel(ctx, userProfitList)
+	buildProfitData := m.buildUserProfitData
+	if eventCopy.isLMSR() {
+		buildProfitData = m.buildShareProfitData
+	}
+	userProfitList, fee, err := buildProfitData(ctx, eventID, winToken, policy, c)
+	if err != nil {
+		return fmt.Errorf("close event failed: %w", err)
+	}
+
+	if err := m.persistor.finishClose(ctx, eventID, winToken, userProfitList, fee); err != nil {
+		return fmt.Errorf("close event failed: %w", err)
+	}
+
+	m.notifyEvent(ctx, eventID)
 	return nil
 }
 
-func (m *Market) buildUserProfitData(ctx context.Context, eventID uuid.UUID, winToken token.Token) ([]*UserProfit, error) {
+func (m *Market) buildUserProfitData(ctx context.Context, eventID uuid.UUID, winToken token.Token,
+	policy *FeePolicy, c *Currency) ([]*UserProfit, *EventFee, error) {
 	assetList, err := m.persistor.getEventAssets(ctx, eventID)
 	if err != nil {
-		return nil, fmt.Errorf("calc user profit failed: %w", err)
+		return nil, nil, fmt.Errorf("calc user profit failed: %w", err)
+	}
+
+	cashOut, err := m.persistor.getCashOutTotal(ctx, eventID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("calc user profit failed: %w", err)
 	}
 
 	tokenDeposits := m.getTokenDeposits(assetList, winToken)
 
+	// cashed out stakes left the pools, their fees are the house revenue of the event
+	fee := &EventFee{
+		EventID:  eventID,
+		Kind:     PayoutWin,
+		Policy:   policy,
+		Grams:    cashOut.fee,
+		Jetton:   c.Jetton,
+		WinPool:  tokenDeposits.WinCollateral,
+		LosePool: tokenDeposits.LoseCollateral,
+	}
+
+	// nobody won, the losing pool stays with the house
+	if tokenDeposits.WinCollateral == 0 {
+		fee.Grams += tokenDeposits.LoseCollateral
+		return nil, fee, nil
+	}
+
+	poolFee := policy.poolFee(tokenDeposits.LoseCollateral, c)
+	tokenDeposits.LoseCollateral -= poolFee
+	fee.Grams += poolFee
+
 	userProfitList := make([]*UserProfit, 0)
 
 	for _, asset := range assetList {
@@ -56,21 +181,148 @@ func (m *Market) buildUserProfitData(ctx context.Context, eventID uuid.UUID, win
 			continue
 		}
 
-		profit := m.calcUserProfit(ctx, asset, tokenDeposits)
-		if profit < 0 {
+		payout, userFee := m.winnerReturn(ctx, asset, tokenDeposits, policy, c)
+		fee.Grams += userFee
+		if payout == 0 {
+			log.Printf("[WARNING] profit for user: %s, grams: %v does not cover fee\n\n", asset.UserRawAddress, userFee)
 			continue
 		}
 
 		userProfit := &UserProfit{
+			ID:             uuid.New(),
+			Kind:           PayoutWin,
 			UserRawAddress: asset.UserRawAddress,
-			Grams:          profit,
-			EventID:        eventID.String(),
+			Grams:          payout,
+			Jetton:         c.Jetton,
+			Fee:            userFee,
+			EventID:        eventID,
+			Comment:        "event closed: " + eventID.String(),
+			State:          PayoutPending,
 		}
 
 		userProfitList = append(userProfitList, userProfit)
 	}
 
-	return userProfitList, nil
+	return userProfitList, fee, nil
+}
+
+// buildShareProfitData pays each winning share of LMSR event one unit of the collateral minus fee,
+// the house keeps the rest of collected collateral or covers the shortfall
+func (m *Market) buildShareProfitData(ctx context.Context, eventID uuid.UUID, winToken token.Token,
+	policy *FeePolicy, c *Currency) ([]*UserProfit, *EventFee, error) {
+	assetList, err := m.persistor.getEventAssets(ctx, eventID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("calc share profit failed: %w", err)
+	}
+	cashOut, err := m.persistor.getCashOutTotal(ctx, eventID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("calc share profit failed: %w", err)
+	}
+
+	tokenDeposits := m.getTokenDeposits(assetList, winToken)
+	// collateral of sold shares stays in the bank, the cash-out payouts left it
+	collected := int64(tokenDeposits.WinCollateral+tokenDeposits.LoseCollateral+cashOut.collateral+cashOut.fee) -
+		int64(cashOut.value)
+
+	fee := &EventFee{
+		EventID:  eventID,
+		Kind:     PayoutWin,
+		Policy:   policy,
+		Jetton:   c.Jetton,
+		WinPool:  tokenDeposits.WinCollateral,
+		LosePool: tokenDeposits.LoseCollateral,
+	}
+
+	userProfitList := make([]*UserProfit, 0)
+	var paid tlb.Grams
+
+	for _, asset := range assetList {
+		if asset.Token != winToken {
+			continue
+		}
+
+		payout, userFee := m.shareReturn(ctx, asset, policy, c)
+		paid += payout
+		if payout == 0 {
+			log.Printf("[WARNING] shares of user: %s, grams: %v do not cover fee\n\n", asset.UserRawAddress, userFee)
+			continue
+		}
+
+		userProfitList = append(userProfitList, &UserProfit{
+			ID:             uuid.New(),
+			Kind:           PayoutWin,
+			UserRawAddress: asset.UserRawAddress,
+			Grams:          payout,
+			Jetton:         c.Jetton,
+			Fee:            userFee,
+			EventID:        eventID,
+			Comment:        "event closed: " + eventID.String(),
+			State:          PayoutPending,
+		})
+	}
+
+	if loss := int64(paid) - collected; loss > 0 {
+		log.Printf("[WARNING] event: %s pays %s %s over collected collateral, the house covers the loss\n\n",
+			eventID.String(), c.Format(tlb.Grams(loss)), c.Symbol)
+		return userProfitList, fee, nil
+	}
+	fee.Grams = tlb.Grams(collected - int64(paid))
+
+	return userProfitList, fee, nil
+}
+
+// buildRefundData returns stakes of the voided event minus refund fee
+func (m *Market) buildRefundData(ctx context.Context, eventID uuid.UUID, c *Currency) ([]*UserProfit, *EventFee, error) {
+	assetList, err := m.persistor.getEventAssets(ctx, eventID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("build refund data failed: %w", err)
+	}
+
+	cashOut, err := m.persistor.getCashOutTotal(ctx, eventID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("build refund data failed: %w", err)
+	}
+
+	refundFee := c.FromFloat(config.Config.Payout.VoidRefundFee)
+
+	// one refund per user, comment must be unique per user
+	refundMap := make(map[string]tlb.Grams)
+	for _, asset := range assetList {
+		refundMap[asset.UserRawAddress] += asset.CollateralStaked
+	}
+
+	fee := &EventFee{
+		EventID: eventID,
+		Kind:    PayoutRefund,
+		Grams:   cashOut.fee,
+		Jetton:  c.Jetton,
+	}
+
+	userProfitList := make([]*UserProfit, 0, len(refundMap))
+
+	for userRawAddress, staked := range refundMap {
+		fee.LosePool += staked
+		if staked <= refundFee {
+			log.Printf("[WARNING] refund for user: %s, grams: %v does not cover fee\n\n", userRawAddress, staked)
+			fee.Grams += staked
+			continue
+		}
+		fee.Grams += refundFee
+
+		userProfitList = append(userProfitList, &UserProfit{
+			ID:             uuid.New(),
+			Kind:           PayoutRefund,
+			UserRawAddress: userRawAddress,
+			Grams:          staked - refundFee,
+			Jetton:         c.Jetton,
+			Fee:            refundFee,
+			EventID:        eventID,
+			Comment:        "event voided: " + eventID.String(),
+			State:          PayoutPending,
+		})
+	}
+
+	return userProfitList, fee, nil
 }
 
 func (m *Market) getTokenDeposits(assetList []*Asset, winToken token.Token) *TokenDeposits {
@@ -91,115 +343,428 @@ func (m *Market) getTokenDeposits(assetList []*Asset, winToken token.Token) *Tok
 	}
 }
 
-var baseFee = tlb.Grams(7000000)
+// winnerReturn returns payout of the winning asset, stake included, and the winner fee kept from it.
+// Pool fee must be already taken from the losing pool, return not covering the fee is kept whole.
+func (m *Market) winnerReturn(ctx context.Context, asset *Asset, tokenDeposits *TokenDeposits, policy *FeePolicy,
+	c *Currency) (tlb.Grams, tlb.Grams) {
+	profit := m.calcUserProfit(ctx, asset, tokenDeposits)
+	userFee := policy.winnerFee(profit, c)
+	userReturn := asset.CollateralStaked + profit
+	if userReturn <= userFee {
+		return 0, userReturn
+	}
+	return userReturn - userFee, userFee
+}
+
+// shareReturn returns payout of the winning LMSR asset, one unit per share, and the fee kept from it
+func (m *Market) shareReturn(_ context.Context, asset *Asset, policy *FeePolicy, c *Currency) (tlb.Grams, tlb.Grams) {
+	var profit tlb.Grams
+	if asset.Size > asset.CollateralStaked {
+		profit = asset.Size - asset.CollateralStaked
+	}
+	userFee := policy.shareFee(profit, c)
+	if asset.Size <= userFee {
+		return 0, asset.Size
+	}
+	return asset.Size - userFee, userFee
+}
 
+// calcUserProfit returns net winnings of the asset, share of the losing pool
 func (m *Market) calcUserProfit(_ context.Context, asset *Asset, tokenDeposits *TokenDeposits) tlb.Grams {
 	rest := float64(asset.CollateralStaked) / float64(tokenDeposits.WinCollateral)
 	profit := rest * float64(tokenDeposits.LoseCollateral)
-	userTotalReturn := profit + float64(asset.CollateralStaked)
-	returnGrams := tlb.Grams(userTotalReturn) - baseFee
-	return returnGrams
+	return tlb.Grams(profit)
 }
 
-func (m *Market) broadcastUsersProfit(ctx context.Context, userProfitList []*UserProfit) {
-	for _, userProfit := range userProfitList {
-		if err := m.trySendProfit(ctx, userProfit); err != nil {
-			log.Printf("[ERROR] try send profit for user: %s, grams: %v failed: %s\n\n",
-				userProfit.UserRawAddress, userProfit.Grams, err.Error())
-			continue
-		}
-	}
+const (
+	payoutPollPeriod  = 10 * time.Second
+	payoutResendAfter = 3 * time.Minute
+	payoutLease       = 5 * time.Minute
+	// payoutBatchSize payouts claimed at once, fits one wallet message
+	payoutBatchSize   = chainBatchLimit
+	payoutMaxAttempts = 5
+	// payoutMessageLifetime must be less than payoutResendAfter,
+	// an expired message can't be accepted by the wallet anymore
+	payoutMessageLifetime = time.Minute
+	// payoutScanDepth limits the walk over the bank transactions looking for sent payouts
+	payoutScanDepth = 1000
+	// payoutScanSlack covers the clock difference of the db and the chain
+	payoutScanSlack = time.Minute
+)
+
+// ErrPayoutNotScanned bank transactions are not walked back to the last try of the payout, it can't be resent
+var ErrPayoutNotScanned = errors.New("bank transactions are not scanned back to the payout")
+
+// payoutCheck state shared by the checks of the claimed payouts
+type payoutCheck struct {
+	inFlightMap map[int64]bool
+	// since last try of the earliest sent payout
+	since   time.Time
+	scan    *bankPayoutScan
+	scanErr error
 }
 
-func (m *Market) writeToChannel(_ context.Context, userProfitList []*UserProfit) {
-	for _, userProfit := range userProfitList {
-		m.profitCh <- userProfit
+// bankPayouts scans the bank once for all checks
+func (m *Market) bankPayouts(ctx context.Context, check *payoutCheck) (*bankPayoutScan, error) {
+	if check.scan == nil && check.scanErr == nil {
+		check.scan, check.scanErr = m.scanBankPayouts(ctx, check.since.Add(-payoutScanSlack))
 	}
+	return check.scan, check.scanErr
 }
 
 func (m *Market) startResendProcess(ctx context.Context) {
 	go func() {
-		for userProfit := range m.profitCh {
-			if userProfit.LastTry.Add(3 * time.Minute).After(time.Now()) {
-				m.profitCh <- userProfit
-				continue
-			}
+		ticker := time.NewTicker(payoutPollPeriod)
+		defer ticker.Stop()
 
-			isProfitDelivered, err := m.checkIfProfitDelivered(ctx, userProfit)
+		for range ticker.C {
+			userProfitList, err := m.persistor.claimPayouts(ctx, payoutBatchSize, payoutResendAfter, payoutLease)
 			if err != nil {
-				log.Printf("[ERROR] check profit delivered failed: %s\n\n", err.Error())
+				log.Printf("[ERROR] claim payouts failed: %s\n\n", err.Error())
 				continue
 			}
+			m.processPayouts(ctx, userProfitList)
+		}
+	}()
+}
 
-			if !isProfitDelivered {
-				log.Printf("[WARNING] profit for user: %s, grams: %v still pending\n\n",
-					userProfit.UserRawAddress, userProfit.Grams)
+// processPayouts confirms delivered payouts and sends the rest in batches,
+// payouts of a batch the wallet can still process are left until the next claim
+func (m *Market) processPayouts(ctx context.Context, userProfitList []*UserProfit) {
+	check := &payoutCheck{inFlightMap: make(map[int64]bool)}
+	for _, userProfit := range userProfitList {
+		if userProfit.State == PayoutSent && (check.since.IsZero() || userProfit.LastTry.Before(check.since)) {
+			check.since = userProfit.LastTry
+		}
+	}
 
-				if err = m.trySendProfit(ctx, userProfit); err != nil {
-					log.Printf("[ERROR] try send profit for user: %s, grams: %v failed: %s\n\n",
-						userProfit.UserRawAddress, userProfit.Grams, err.Error())
-				}
-				m.profitCh <- userProfit
+	sendList := make([]*UserProfit, 0, len(userProfitList))
+	for _, userProfit := range userProfitList {
+		if userProfit.State == PayoutSent && !m.checkPayout(ctx, userProfit, check) {
+			continue
+		}
+		sendList = append(sendList, userProfit)
+	}
+
+	for batchList := range slices.Chunk(sendList, chainBatchLimit) {
+		m.sendPayoutBatch(ctx, batchList)
+	}
+}
+
+// checkPayout confirms or fails the sent payout by the bank transactions, returns true if it must be sent again.
+// Payout is never sent again once the bank has emitted its message.
+func (m *Market) checkPayout(ctx context.Context, userProfit *UserProfit, check *payoutCheck) bool {
+	if batch := userProfit.Batch; batch != nil {
+		inFlight, ok := check.inFlightMap[batch.ID]
+		if !ok {
+			var err error
+			if inFlight, err = m.checkPayoutBatch(ctx, batch); err != nil {
+				log.Printf("[ERROR] %s\n\n", err.Error())
+				return false
 			}
-			log.Printf("[SUCCESS] profit for user: %s, grams: %v delivered\n\n",
-				userProfit.UserRawAddress, userProfit.Grams)
+			check.inFlightMap[batch.ID] = inFlight
 		}
-	}()
+		if inFlight {
+			return false
+		}
+	}
+
+	scan, err := m.bankPayouts(ctx, check)
+	if err != nil {
+		log.Printf("[ERROR] %s\n\n", err.Error())
+		return false
+	}
+	delivery, err := m.checkPayoutDelivery(userProfit, scan)
+	if err != nil {
+		log.Printf("[ERROR] check profit delivered failed: %s\n\n", err.Error())
+		return false
+	}
+
+	switch delivery {
+	case payoutEmitted:
+		if err := m.persistor.markPayoutConfirmed(ctx, userProfit); err != nil {
+			log.Printf("[ERROR] confirm payout failed: %s\n\n", err.Error())
+			return false
+		}
+		log.Printf("[SUCCESS] profit for user: %s, grams: %v delivered\n\n",
+			userProfit.UserRawAddress, userProfit.Grams)
+		return false
+	case payoutBounced:
+		log.Printf("[ALARM] profit for user: %s, grams: %v bounced back to the bank\n\n",
+			userProfit.UserRawAddress, userProfit.Grams)
+		if err := m.persistor.markPayoutFailed(ctx, userProfit, "bounced"); err != nil {
+			log.Printf("[ERROR] fail payout failed: %s\n\n", err.Error())
+		}
+		return false
+	}
+
+	// the wallet won't process the batch anymore and has not emitted the message:
+	// the action phase skipped it, or the batch expired or was forgotten unprocessed
+
+	if userProfit.Attempts >= payoutMaxAttempts {
+		log.Printf("[ALARM] profit for user: %s, grams: %v out of attempts\n\n",
+			userProfit.UserRawAddress, userProfit.Grams)
+		if err := m.persistor.markPayoutFailed(ctx, userProfit, "out of attempts"); err != nil {
+			log.Printf("[ERROR] fail payout failed: %s\n\n", err.Error())
+		}
+		return false
+	}
+
+	log.Printf("[WARNING] profit for user: %s, grams: %v not sent by the bank\n\n",
+		userProfit.UserRawAddress, userProfit.Grams)
+	return true
 }
 
-func (m *Market) checkIfProfitDelivered(ctx context.Context, userProfit *UserProfit) (bool, error) {
-	trxList, err := m.getLastTransactions(ctx, userProfit.UserRawAddress)
+// checkPayoutBatch moves the sent batch to processed or expired, returns true while the wallet can still process it.
+// Processed batch may be forgotten by the wallet unprocessed, its payouts are decided by the bank transactions.
+func (m *Market) checkPayoutBatch(ctx context.Context, batch *PayoutBatch) (bool, error) {
+	if batch.State != BatchSent {
+		return false, nil
+	}
+
+	processed, err := m.chain.IsProcessed(ctx, batch.QueryID)
 	if err != nil {
-		return false, fmt.Errorf("check if profit delivered failed: %w", err)
+		return false, fmt.Errorf("check payout batch: %d failed: %w", batch.ID, err)
+	}
+	switch {
+	case processed:
+		batch.State = BatchProcessed
+	case time.Now().After(batch.ValidUntil):
+		batch.State = BatchExpired
+		log.Printf("[WARNING] payout batch: %d, query id: %d expired\n\n", batch.ID, batch.QueryID)
+	default:
+		return true, nil
 	}
 
-	for _, trx := range trxList {
-		isProfitTransaction, err := m.isProfitTransaction(ctx, trx, userProfit)
+	if err := m.persistor.setPayoutBatchState(ctx, batch); err != nil {
+		return false, fmt.Errorf("check payout batch: %d failed: %w", batch.ID, err)
+	}
+	return false, nil
+}
+
+// sendPayoutBatch sends payouts in one wallet message,
+// payouts are marked sent in the batch before the message is sent
+func (m *Market) sendPayoutBatch(ctx context.Context, userProfitList []*UserProfit) {
+	transferList := make([]ChainTransfer, 0, len(userProfitList))
+	sendList := make([]*UserProfit, 0, len(userProfitList))
+	for _, userProfit := range userProfitList {
+		transfer, err := m.buildPayoutTransfer(userProfit)
 		if err != nil {
+			log.Printf("[ALARM] build profit for user: %s, grams: %v failed: %s\n\n",
+				userProfit.UserRawAddress, userProfit.Grams, err.Error())
+			if err := m.persistor.markPayoutFailed(ctx, userProfit, err.Error()); err != nil {
+				log.Printf("[ERROR] fail payout failed: %s\n\n", err.Error())
+			}
 			continue
 		}
-		if isProfitTransaction {
-			return true, nil
+		transferList = append(transferList, transfer)
+		sendList = append(sendList, userProfit)
+	}
+	if len(sendList) == 0 {
+		return
+	}
+
+	batch, err := m.persistor.createPayoutBatch(ctx, sendList)
+	if err != nil {
+		log.Printf("[ERROR] %s\n\n", err.Error())
+		return
+	}
+
+	chainBatch, sendErr := m.chain.Send(ctx, transferList...)
+	if sendErr != nil {
+		log.Printf("[ERROR] send payout batch: %d of %d payouts failed: %s\n\n", batch.ID, len(sendList), sendErr.Error())
+	}
+
+	if err := m.persistor.savePayoutBatch(ctx, batch, chainBatch, sendList, sendErr); err != nil {
+		log.Printf("[ERROR] %s\n\n", err.Error())
+		return
+	}
+	if sendErr == nil {
+		log.Printf("[INFO] payout batch: %d of %d payouts sent, query id: %d\n\n", batch.ID, len(sendList), batch.QueryID)
+	}
+}
+
+type payoutDelivery int
+
+const (
+	payoutNotEmitted payoutDelivery = iota
+	payoutEmitted
+	// payoutBounced the message is emitted and bounced back to the bank
+	payoutBounced
+)
+
+// checkPayoutDelivery looks for the payout message among the bank transactions and its bounce after it,
+// tx hash and lt of the payout are set to the emitting bank transaction.
+// Bounce is back long before the payout is checked, payoutResendAfter is well over the message lifetime.
+func (m *Market) checkPayoutDelivery(userProfit *UserProfit, scan *bankPayoutScan) (payoutDelivery, error) {
+	transfer, err := m.buildPayoutTransfer(userProfit)
+	if err != nil {
+		return payoutNotEmitted, fmt.Errorf("check payout delivery failed: %w", err)
+	}
+
+	key := newPayoutMsgKey(transfer.To, transfer.Amount, transfer.Comment, transfer.Body)
+	tx, ok := scan.txMap[key]
+	if !ok {
+		if !scan.from.IsZero() && scan.from.After(userProfit.LastTry.Add(-payoutScanSlack)) {
+			return payoutNotEmitted, fmt.Errorf("check payout delivery failed: %w", ErrPayoutNotScanned)
 		}
+		return payoutNotEmitted, nil
 	}
-	return false, nil
+	userProfit.TxHash = hex.EncodeToString(tx.Hash[:])
+	userProfit.TxLt = tx.Lt
+
+	body, err := transferBody(transfer)
+	if err != nil {
+		return payoutNotEmitted, fmt.Errorf("check payout delivery failed: %w", err)
+	}
+	for _, bounce := range scan.bounceMap[transfer.To] {
+		if bounce.Lt > tx.Lt && isBouncedBody(bounce.In.Body, body) {
+			return payoutBounced, nil
+		}
+	}
+	return payoutEmitted, nil
+}
+
+// transferBody returns body of the transfer message, the comment is sent as text comment body
+func transferBody(transfer ChainTransfer) (*boc.Cell, error) {
+	if transfer.Body != nil {
+		return transfer.Body, nil
+	}
+	body := boc.NewCell()
+	if err := tlb.Marshal(body, wallet.TextComment(transfer.Comment)); err != nil {
+		return nil, err
+	}
+	return body, nil
 }
 
-func (m *Market) isProfitTransaction(_ context.Context, trx ton.Transaction, userProfit *UserProfit) (bool, error) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Println("[ALARM] Recovered in isProfitTransaction", r)
+// bouncedPrefix opens the body of the bounced message, the first 256 bits of the original body follow it
+const bouncedPrefix = 0xffffffff
+
+// isBouncedBody reports whether the bounced message carries the start of the body
+func isBouncedBody(bounced, body *boc.Cell) bool {
+	if bounced == nil || body == nil {
+		return false
+	}
+	defer bounced.ResetCounters()
+	defer body.ResetCounters()
+
+	if prefix, err := bounced.ReadUint(32); err != nil || prefix != bouncedPrefix {
+		return false
+	}
+	for range min(bounced.BitsAvailableForRead(), body.BitsAvailableForRead(), 256) {
+		a, errA := bounced.ReadBit()
+		b, errB := body.ReadBit()
+		if errA != nil || errB != nil || a != b {
+			return false
 		}
-	}()
-	var t wallet.TextComment
-	if err := tlb.Unmarshal((*boc.Cell)(&trx.Msgs.InMsg.Value.Value.Body.Value), &t); err != nil {
-		return false, fmt.Errorf("unmarshal transaction failed: %w", err)
 	}
+	return true
+}
 
-	comment := wallet.TextComment("event closed: " + userProfit.EventID)
+// payoutMsgKey identifies the payout message of the bank, jetton payout by the transfer to the bank jetton wallet
+type payoutMsgKey struct {
+	to      ton.AccountID
+	peer    ton.AccountID
+	amount  tlb.Grams
+	comment string
+}
 
-	if t == comment {
-		return true, nil
+func newPayoutMsgKey(to ton.AccountID, amount tlb.Grams, comment string, body *boc.Cell) payoutMsgKey {
+	if jt, ok := parseJettonTransfer(body); ok {
+		return payoutMsgKey{to: to, peer: jt.Peer, amount: jt.Amount, comment: jt.Comment}
 	}
+	return payoutMsgKey{to: to, amount: amount, comment: comment}
+}
 
-	return false, nil
+// bankPayoutScan outgoing messages of the bank transactions and bounced messages returned to the bank
+type bankPayoutScan struct {
+	// from time of the oldest scanned transaction, zero if the whole history is scanned
+	from  time.Time
+	txMap map[payoutMsgKey]ChainTx
+	// bounceMap transactions of bounced messages by the bouncing account
+	bounceMap map[ton.AccountID][]ChainTx
+}
+
+// scanBankPayouts walks the bank transactions by lt back to since, up to payoutScanDepth transactions
+func (m *Market) scanBankPayouts(ctx context.Context, since time.Time) (*bankPayoutScan, error) {
+	bank := m.chain.BankAddress()
+	scan := &bankPayoutScan{txMap: make(map[payoutMsgKey]ChainTx), bounceMap: make(map[ton.AccountID][]ChainTx)}
+
+	lt, hash, err := m.chain.LastTransaction(ctx, bank)
+	if err != nil {
+		return nil, fmt.Errorf("scan bank payouts failed: %w", err)
+	}
+
+	n := 0
+	for lt != 0 {
+		page, err := m.chain.Transactions(ctx, bank, lt, hash, bankIndexerPageSize)
+		if err != nil {
+			return nil, fmt.Errorf("scan bank payouts failed: %w", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, tx := range page {
+			if tx.Time.Before(since) {
+				scan.from = since
+				return scan, nil
+			}
+			if tx.In != nil && tx.In.Bounced {
+				scan.bounceMap[tx.In.Src] = append(scan.bounceMap[tx.In.Src], tx)
+			}
+			for _, out := range tx.Out {
+				key := newPayoutMsgKey(out.Dest, out.Amount, out.Comment, out.Body)
+				if _, ok := scan.txMap[key]; !ok {
+					scan.txMap[key] = tx
+				}
+			}
+			if n++; n >= payoutScanDepth {
+				log.Printf("[WARNING] bank payout scan stopped after %d transactions\n\n", n)
+				scan.from = tx.Time
+				return scan, nil
+			}
+		}
+		last := page[len(page)-1]
+		lt, hash = last.PrevLt, last.PrevHash
+	}
+	return scan, nil
 }
 
-func (m *Market) trySendProfit(ctx context.Context, userProfit *UserProfit) error {
-	recipient := ton.MustParseAccountID(userProfit.UserRawAddress)
+// buildPayoutTransfer returns transfer of the payout from the bank wallet
+func (m *Market) buildPayoutTransfer(userProfit *UserProfit) (ChainTransfer, error) {
+	recipient, err := ton.ParseAccountID(userProfit.UserRawAddress)
+	if err != nil {
+		return ChainTransfer{}, err
+	}
 
-	message := wallet.SimpleTransfer{
+	if userProfit.Jetton != "" {
+		return m.buildJettonPayout(userProfit, recipient)
+	}
+
+	return ChainTransfer{
+		To:         recipient,
 		Amount:     userProfit.Grams,
-		Address:    recipient,
-		Comment:    "event closed: " + userProfit.EventID,
+		Comment:    userProfit.Comment,
 		Bounceable: true,
-	}
+	}, nil
+}
 
-	userProfit.LastTry = time.Now()
+// buildJettonPayout returns transfer to the bank jetton wallet, excess TON returns to the bank
+func (m *Market) buildJettonPayout(userProfit *UserProfit, recipient ton.AccountID) (ChainTransfer, error) {
+	c, err := m.currencyOf(userProfit.Jetton)
+	if err != nil {
+		return ChainTransfer{}, err
+	}
 
-	if err := m.wallet.Send(ctx, message); err != nil {
-		return err
+	body, err := buildJettonTransfer(userProfit.Grams, recipient, m.chain.BankAddress(), userProfit.Comment)
+	if err != nil {
+		return ChainTransfer{}, err
 	}
 
-	return nil
+	return ChainTransfer{
+		To:         c.bankWallet,
+		Amount:     jettonAttachedTon(),
+		Body:       body,
+		Bounceable: true,
+	}, nil
 }
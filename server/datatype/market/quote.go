@@ -0,0 +1,200 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/TON-Market/tma/server/datatype/token"
+	"github.com/google/uuid"
+	"github.com/tonkeeper/tongo/tlb"
+	"math"
+)
+
+var ErrInvalidAmount = errors.New("stake amount must be positive")
+
+// quoteSensitivitySteps relative growth of a pool in the sensitivity scenarios
+var quoteSensitivitySteps = []float64{0.1, 0.25, 0.5, 1}
+
+// QuoteScenarioDTO payout of the stake if the pools change, pools include the stake
+type QuoteScenarioDTO struct {
+	// Pool "win" or "lose" pool grown by Change
+	Pool     string  `json:"pool"`
+	Change   float64 `json:"change"`
+	WinPool  string  `json:"winPool"`
+	LosePool string  `json:"losePool"`
+	Payout   string  `json:"payout"`
+	Odds     float64 `json:"odds"`
+}
+
+// QuoteDTO projected result of the stake if the outcome wins and no further bets arrive,
+// amounts in event collateral units
+type QuoteDTO struct {
+	EventID  uuid.UUID   `json:"eventId"`
+	Token    token.Token `json:"token"`
+	Currency string      `json:"currency"`
+	Stake    string      `json:"stake"`
+	// Payout returned to the user, stake included, fee deducted
+	Payout string `json:"payout"`
+	Profit string `json:"profit"`
+	// Fee winner fee plus the stake share of the pool fee
+	Fee string `json:"fee"`
+	// Odds decimal odds, payout per unit of the stake
+	Odds float64 `json:"odds"`
+	// ImpliedProbability share of the outcome in the event collateral after the stake,
+	// outcome price after the stake for LMSR event
+	ImpliedProbability float64 `json:"impliedProbability"`
+	// Shares bought by the stake on LMSR event, each pays one unit if the outcome wins
+	Shares   string `json:"shares,omitempty"`
+	WinPool  string `json:"winPool"`
+	LosePool string `json:"losePool"`
+	// Sensitivity is empty for LMSR event, price of bought shares doesn't depend on later bets
+	Sensitivity []*QuoteScenarioDTO `json:"sensitivity"`
+}
+
+// quote payout and fee of the stake against the pools, pools include the stake
+type quote struct {
+	payout tlb.Grams
+	fee    tlb.Grams
+}
+
+// quoteStake settles the stake the way buildUserProfitData settles the winners
+func (m *Market) quoteStake(ctx context.Context, stake, winPool, losePool tlb.Grams, policy *FeePolicy,
+	c *Currency) quote {
+	tokenDeposits := &TokenDeposits{WinCollateral: winPool, LoseCollateral: losePool}
+
+	poolFee := policy.poolFee(tokenDeposits.LoseCollateral, c)
+	tokenDeposits.LoseCollateral -= poolFee
+
+	payout, userFee := m.winnerReturn(ctx, &Asset{CollateralStaked: stake}, tokenDeposits, policy, c)
+	poolFeeShare := tlb.Grams(float64(poolFee) * float64(stake) / float64(winPool))
+	return quote{payout: payout, fee: userFee + poolFeeShare}
+}
+
+// quoteShares buys shares of LMSR event the way runtimer buy does, returns shares and outcome price after the buy
+func quoteShares(es *eventState, t token.Token, stake tlb.Grams) (tlb.Grams, float64) {
+	q := make([]float64, 0, len(es.betStateMap))
+	i := 0
+	for bt, bs := range es.betStateMap {
+		if bt == t {
+			i = len(q)
+		}
+		q = append(q, float64(bs.size))
+	}
+
+	shares := lmsrShares(q, i, float64(stake), float64(es.liquidity))
+	q[i] += shares
+	return tlb.Grams(shares), lmsrPrices(q, float64(es.liquidity))[i]
+}
+
+func quoteOdds(q quote, stake tlb.Grams) float64 {
+	return math.Round(float64(q.payout)/float64(stake)*1e4) / 1e4
+}
+
+// GetQuote returns projected payout of the stake on the outcome against the current event pools
+func (m *Market) GetQuote(ctx context.Context, eventID uuid.UUID, t token.Token, stake tlb.Grams) (*QuoteDTO, error) {
+	if stake == 0 {
+		return nil, fmt.Errorf("market get quote failed: %w", ErrInvalidAmount)
+	}
+
+	eventCopy, err := m.persistor.getCopyByID(ctx, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("market get quote failed: %w", err)
+	}
+	es, err := m.runtimer.getEventState(ctx, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("market get quote failed: %w", err)
+	}
+	if !es.isActive {
+		return nil, fmt.Errorf("market get quote failed: %w", ErrEventClosed)
+	}
+	bs, ok := es.betStateMap[t]
+	if !ok {
+		return nil, fmt.Errorf("market get quote failed: %w: %s", ErrUnknownOutcome, t)
+	}
+
+	policy, err := m.feePolicyFor(ctx, &eventCopy)
+	if err != nil {
+		return nil, fmt.Errorf("market get quote failed: %w", err)
+	}
+	c, err := m.currencyOf(eventCopy.Jetton)
+	if err != nil {
+		return nil, fmt.Errorf("market get quote failed: %w", err)
+	}
+
+	winPool := bs.collateral + stake
+	losePool := es.collateral - bs.collateral
+
+	if es.isLMSR() {
+		shares, price := quoteShares(es, t, stake)
+		payout, fee := m.shareReturn(ctx, &Asset{CollateralStaked: stake, Size: shares}, policy, c)
+		q := quote{payout: payout, fee: fee}
+		var profit tlb.Grams
+		if q.payout > stake {
+			profit = q.payout - stake
+		}
+		return &QuoteDTO{
+			EventID:            eventID,
+			Token:              t,
+			Currency:           c.Symbol,
+			Stake:              c.Format(stake),
+			Payout:             c.Format(q.payout),
+			Profit:             c.Format(profit),
+			Fee:                c.Format(q.fee),
+			Odds:               quoteOdds(q, stake),
+			ImpliedProbability: math.Round(price*1e4) / 1e4,
+			Shares:             c.Format(shares),
+			WinPool:            c.Format(winPool),
+			LosePool:           c.Format(losePool),
+			Sensitivity:        make([]*QuoteScenarioDTO, 0),
+		}, nil
+	}
+
+	q := m.quoteStake(ctx, stake, winPool, losePool, policy, c)
+
+	var profit tlb.Grams
+	if q.payout > stake {
+		profit = q.payout - stake
+	}
+
+	quoteDto := &QuoteDTO{
+		EventID:            eventID,
+		Token:              t,
+		Currency:           c.Symbol,
+		Stake:              c.Format(stake),
+		Payout:             c.Format(q.payout),
+		Profit:             c.Format(profit),
+		Fee:                c.Format(q.fee),
+		Odds:               quoteOdds(q, stake),
+		ImpliedProbability: math.Round(float64(winPool)/float64(winPool+losePool)*1e4) / 1e4,
+		WinPool:            c.Format(winPool),
+		LosePool:           c.Format(losePool),
+		Sensitivity:        make([]*QuoteScenarioDTO, 0, 2*len(quoteSensitivitySteps)),
+	}
+
+	for _, step := range quoteSensitivitySteps {
+		// other bettors join the outcome, the stake share of the losing pool shrinks
+		grownWin := winPool + tlb.Grams(float64(winPool)*step)
+		sq := m.quoteStake(ctx, stake, grownWin, losePool, policy, c)
+		quoteDto.Sensitivity = append(quoteDto.Sensitivity, &QuoteScenarioDTO{
+			Pool:     "win",
+			Change:   step,
+			WinPool:  c.Format(grownWin),
+			LosePool: c.Format(losePool),
+			Payout:   c.Format(sq.payout),
+			Odds:     quoteOdds(sq, stake),
+		})
+
+		grownLose := losePool + tlb.Grams(float64(losePool)*step)
+		sq = m.quoteStake(ctx, stake, winPool, grownLose, policy, c)
+		quoteDto.Sensitivity = append(quoteDto.Sensitivity, &QuoteScenarioDTO{
+			Pool:     "lose",
+			Change:   step,
+			WinPool:  c.Format(winPool),
+			LosePool: c.Format(grownLose),
+			Payout:   c.Format(sq.payout),
+			Odds:     quoteOdds(sq, stake),
+		})
+	}
+
+	return quoteDto, nil
+}
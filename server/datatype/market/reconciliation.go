@@ -0,0 +1,148 @@
+package market
+
+import (
+	"context"
+	"fmt"
+	"github.com/TON-Market/tma/server/config"
+	"github.com/google/uuid"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	reconciliationPollPeriod = 30 * time.Second
+	reconciliationBatchSize  = 50
+)
+
+// startReconciliation refunds orphaned bank transfers: unknown comment, declined deal,
+// wrong sender, repeated payment or event closed before confirmation
+func (m *Market) startReconciliation(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(reconciliationPollPeriod)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := m.refundOrphanTransfers(ctx); err != nil {
+				log.Printf("[ERROR] %s\n\n", err.Error())
+			}
+		}
+	}()
+}
+
+func (m *Market) refundOrphanTransfers(ctx context.Context) error {
+	transferList, err := m.persistor.getTransfers(ctx, TransferUnmatched, reconciliationBatchSize)
+	if err != nil {
+		return fmt.Errorf("refund orphan transfers failed: %w", err)
+	}
+
+	limits, err := treasuryConfig()
+	if err != nil {
+		return fmt.Errorf("refund orphan transfers failed: %w", err)
+	}
+
+	for _, transfer := range transferList {
+		// refills unmatched before the sender was configured are kept, not sent back
+		if limits.isRefill(transfer.Sender) {
+			if err := m.persistor.refundTransfer(ctx, transfer, nil); err != nil {
+				log.Printf("[ERROR] keep transfer lt: %d failed: %s\n\n", transfer.Lt, err.Error())
+				continue
+			}
+			log.Printf("[INFO] orphan transfer lt: %d from: %s kept as treasury refill\n\n", transfer.Lt, transfer.Sender)
+			continue
+		}
+
+		refund, err := m.buildTransferRefund(ctx, transfer)
+		if err != nil {
+			log.Printf("[ERROR] refund transfer lt: %d failed: %s\n\n", transfer.Lt, err.Error())
+			continue
+		}
+		if err := m.persistor.refundTransfer(ctx, transfer, refund); err != nil {
+			log.Printf("[ERROR] refund transfer lt: %d failed: %s\n\n", transfer.Lt, err.Error())
+			continue
+		}
+		if refund == nil {
+			log.Printf("[WARNING] orphan transfer lt: %d, amount: %s %s does not cover fee, kept\n\n",
+				transfer.Lt, m.formatOf(transfer.Jetton, transfer.Grams), m.symbolOf(transfer.Jetton))
+			continue
+		}
+		log.Printf("[INFO] orphan transfer lt: %d refunded to: %s, amount: %s %s\n\n",
+			transfer.Lt, transfer.Sender, m.formatOf(refund.Jetton, refund.Grams), m.symbolOf(refund.Jetton))
+	}
+	return nil
+}
+
+// buildTransferRefund returns transfer to the sender minus refund fee, nil if it doesn't cover the fee
+func (m *Market) buildTransferRefund(ctx context.Context, transfer *BankTransfer) (*UserProfit, error) {
+	c, err := m.currencyOf(transfer.Jetton)
+	if err != nil {
+		return nil, err
+	}
+	refundFee := c.FromFloat(config.Config.Deposit.RefundFee)
+	if transfer.Grams <= refundFee {
+		return nil, nil
+	}
+
+	eventID := uuid.Nil
+	if transfer.DealID != nil {
+		if deal, err := m.persistor.getDeal(ctx, *transfer.DealID); err == nil {
+			eventID = deal.EventID
+		}
+	}
+
+	return &UserProfit{
+		ID:             uuid.New(),
+		Kind:           PayoutTransferRefund,
+		UserRawAddress: transfer.Sender,
+		Grams:          transfer.Grams - refundFee,
+		Jetton:         transfer.Jetton,
+		Fee:            refundFee,
+		EventID:        eventID,
+		Comment:        "transfer refund: " + strconv.FormatUint(transfer.Lt, 10),
+		State:          PayoutPending,
+	}, nil
+}
+
+type OrphanTransferDTO struct {
+	Lt          uint64         `json:"lt"`
+	Hash        string         `json:"hash"`
+	Sender      string         `json:"sender"`
+	Amount      string         `json:"amount"`
+	Currency    string         `json:"currency"`
+	Comment     string         `json:"comment"`
+	DealID      *uuid.UUID     `json:"dealId,omitempty"`
+	Status      TransferStatus `json:"status"`
+	Reason      string         `json:"reason"`
+	Time        time.Time      `json:"time"`
+	RefundID    *uuid.UUID     `json:"refundId,omitempty"`
+	RefundState *PayoutState   `json:"refundState,omitempty"`
+}
+
+// GetOrphanTransfers lists orphaned transfers: waiting for refund, refunded and kept
+func (m *Market) GetOrphanTransfers(ctx context.Context, limit, offset int) ([]*OrphanTransferDTO, error) {
+	statusList := []TransferStatus{TransferUnmatched, TransferRefunded, TransferKept}
+
+	transferList, stateList, err := m.persistor.getOrphanTransfers(ctx, statusList, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("market get orphan transfers failed: %w", err)
+	}
+
+	orphanDtoList := make([]*OrphanTransferDTO, 0, len(transferList))
+	for i, t := range transferList {
+		orphanDtoList = append(orphanDtoList, &OrphanTransferDTO{
+			Lt:          t.Lt,
+			Hash:        t.Hash,
+			Sender:      t.Sender,
+			Amount:      m.formatOf(t.Jetton, t.Grams),
+			Currency:    m.symbolOf(t.Jetton),
+			Comment:     t.Comment,
+			DealID:      t.DealID,
+			Status:      t.Status,
+			Reason:      t.Reason,
+			Time:        t.Time,
+			RefundID:    t.RefundID,
+			RefundState: stateList[i],
+		})
+	}
+	return orphanDtoList, nil
+}
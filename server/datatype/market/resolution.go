@@ -0,0 +1,153 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/TON-Market/tma/server/datatype/token"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	resolutionPollPeriod = 30 * time.Second
+	// resolutionMaxBackoff between attempts of the failing resolver
+	resolutionMaxBackoff = time.Hour
+)
+
+// resolutionWorker settles due events bound to a resolver
+type resolutionWorker struct {
+	sync.Mutex
+	inProgress map[string]bool
+	// retries of events the resolver failed on
+	retries map[string]*resolutionRetry
+}
+
+// resolutionRetry failed resolution, halted event is never retried and waits to be closed by the admin
+type resolutionRetry struct {
+	attempts int
+	next     time.Time
+	halted   bool
+}
+
+func newResolutionWorker() *resolutionWorker {
+	return &resolutionWorker{inProgress: make(map[string]bool), retries: make(map[string]*resolutionRetry)}
+}
+
+// resolutionBackoff doubles the poll period with each failed attempt up to max backoff
+func resolutionBackoff(attempts int) time.Duration {
+	return min(resolutionPollPeriod<<min(attempts, 10), resolutionMaxBackoff)
+}
+
+// isTerminalResolution reports whether retrying the resolution can't help
+func isTerminalResolution(err error) bool {
+	return errors.Is(err, ErrStaleEvidence) || errors.Is(err, ErrUnknownResolver) ||
+		errors.Is(err, ErrInvalidResolver) || errors.Is(err, ErrUnknownOutcome) || errors.Is(err, ErrEventClosing) ||
+		errors.Is(err, ErrEventFinished)
+}
+
+// isDue reports whether the event may be resolved at now, must be called holding the worker lock
+func (w *resolutionWorker) isDue(id string, now time.Time) bool {
+	if w.inProgress[id] {
+		return false
+	}
+	r, ok := w.retries[id]
+	return !ok || !r.halted && !now.Before(r.next)
+}
+
+// done records the resolution result, failed resolution is retried with backoff or halted
+func (w *resolutionWorker) done(id string, err error, now time.Time) {
+	w.Lock()
+	defer w.Unlock()
+
+	delete(w.inProgress, id)
+	if err == nil {
+		delete(w.retries, id)
+		return
+	}
+
+	r, ok := w.retries[id]
+	if !ok {
+		r = &resolutionRetry{}
+		w.retries[id] = r
+	}
+	r.attempts++
+	r.next = now.Add(resolutionBackoff(r.attempts))
+	r.halted = isTerminalResolution(err)
+}
+
+func (m *Market) startResolutionWorker(ctx context.Context) {
+	ticker := time.NewTicker(resolutionPollPeriod)
+	w := newResolutionWorker()
+
+	go func() {
+		defer ticker.Stop()
+		for now := range ticker.C {
+			m.resolveDueEvents(ctx, w, now)
+		}
+	}()
+}
+
+// resolveDueEvents starts resolution of every due event, an event is never resolved twice concurrently.
+// Suspended event waits for the admin, resolving one is the interrupted close and is repeated.
+func (m *Market) resolveDueEvents(ctx context.Context, w *resolutionWorker, now time.Time) {
+	for _, e := range m.persistor.getAll(ctx) {
+		if e.Status != EventActive && e.Status != EventResolving {
+			continue
+		}
+		if e.Resolver == nil || e.ResolvesAt.IsZero() || now.Before(e.ResolvesAt) {
+			continue
+		}
+
+		id := e.ID.String()
+		w.Lock()
+		if !w.isDue(id, now) {
+			w.Unlock()
+			continue
+		}
+		w.inProgress[id] = true
+		w.Unlock()
+
+		go func(e Event) {
+			err := m.ResolveByOracle(ctx, e)
+			w.done(id, err, time.Now())
+			switch {
+			case err == nil:
+			case isTerminalResolution(err):
+				log.Printf("[ALARM] %s, resolver stopped, close or void the event manually\n\n", err.Error())
+			default:
+				log.Printf("[ERROR] %s\n\n", err.Error())
+			}
+		}(e)
+	}
+}
+
+// ResolveByOracle computes winning outcome with the bound resolver,
+// records the evidence and closes the event
+func (m *Market) ResolveByOracle(ctx context.Context, e Event) error {
+	if e.Resolver == nil {
+		return fmt.Errorf("resolve event: %s by oracle failed: resolver is not bound", e.ID.String())
+	}
+
+	var winToken token.Token
+	var evidence *Evidence
+
+	r, err := buildResolver(e.Resolver)
+	if err == nil {
+		winToken, evidence, err = r.Resolve(ctx, e)
+	}
+	if err == nil && !e.hasOutcome(winToken) {
+		err = fmt.Errorf("%w: %s", ErrUnknownOutcome, winToken)
+	}
+
+	if saveErr := m.persistor.saveResolution(ctx, e.ID, e.Resolver.Kind, winToken, evidence, err); saveErr != nil {
+		return fmt.Errorf("resolve event: %s by oracle failed: %w", e.ID.String(), saveErr)
+	}
+	if err != nil {
+		return fmt.Errorf("resolve event: %s by oracle failed: %w", e.ID.String(), err)
+	}
+
+	log.Printf("[INFO] event: %s resolved by %s to %s\n\n", e.ID.String(), e.Resolver.Kind, winToken)
+	return m.CloseEvent(ctx, e.ID, winToken)
+}
@@ -0,0 +1,355 @@
+package market
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TON-Market/tma/server/datatype/token"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Evidence data a resolution was based on
+type Evidence struct {
+	Source     string          `json:"source"`
+	ObservedAt time.Time       `json:"observedAt"`
+	Value      string          `json:"value"`
+	Raw        json.RawMessage `json:"raw,omitempty"`
+}
+
+// Resolver computes winning outcome of the event
+type Resolver interface {
+	Resolve(ctx context.Context, e Event) (token.Token, *Evidence, error)
+}
+
+// ResolverSpec binds event to a resolver kind with its config
+type ResolverSpec struct {
+	Kind   string          `json:"kind"`
+	Config json.RawMessage `json:"config"`
+}
+
+// ResolverFactory builds resolver from the spec config
+type ResolverFactory func(config json.RawMessage) (Resolver, error)
+
+var (
+	ErrUnknownResolver = errors.New("unknown resolver kind")
+	ErrInvalidResolver = errors.New("invalid resolver config")
+	ErrResultNotReady  = errors.New("resolution result is not ready")
+	ErrStaleEvidence   = errors.New("evidence is observed too late")
+)
+
+const (
+	PriceAboveResolverKind  = "price_above"
+	JSONOutcomeResolverKind = "json_outcome"
+)
+
+var (
+	resolverMu        sync.RWMutex
+	resolverFactories = map[string]ResolverFactory{
+		PriceAboveResolverKind:  newPriceAboveResolver,
+		JSONOutcomeResolverKind: newJSONOutcomeResolver,
+	}
+)
+
+// RegisterResolver adds resolver kind, existing kind is replaced
+func RegisterResolver(kind string, factory ResolverFactory) {
+	resolverMu.Lock()
+	defer resolverMu.Unlock()
+	resolverFactories[kind] = factory
+}
+
+func buildResolver(spec *ResolverSpec) (Resolver, error) {
+	resolverMu.RLock()
+	factory, ok := resolverFactories[spec.Kind]
+	resolverMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownResolver, spec.Kind)
+	}
+
+	r, err := factory(spec.Config)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidResolver, spec.Kind, err)
+	}
+	return r, nil
+}
+
+// validateResolver checks that bound resolver can be built and returns only event outcomes
+func (e *Event) validateResolver() error {
+	if e.Resolver == nil {
+		return nil
+	}
+	if e.ResolvesAt.IsZero() {
+		return fmt.Errorf("%w: resolves at must be set", ErrInvalidResolver)
+	}
+	// betting must be locked before the result is known
+	if e.LocksAt.IsZero() || e.ResolvesAt.Before(e.LocksAt) {
+		return fmt.Errorf("%w: locks at must be set and not after resolves at", ErrInvalidResolver)
+	}
+
+	r, err := buildResolver(e.Resolver)
+	if err != nil {
+		return err
+	}
+
+	if op, ok := r.(interface{ outcomes() []token.Token }); ok {
+		for _, t := range op.outcomes() {
+			if !e.hasOutcome(t) {
+				return fmt.Errorf("%w: %w: %s", ErrInvalidResolver, ErrUnknownOutcome, t)
+			}
+		}
+	}
+	return nil
+}
+
+// PriceSource provides asset price at the moment, evidence ObservedAt tells when the price was actually observed
+type PriceSource interface {
+	Price(ctx context.Context, at time.Time) (float64, *Evidence, error)
+}
+
+// StaticPriceSource always returns the same price, used for local runs
+type StaticPriceSource float64
+
+func (s StaticPriceSource) Price(_ context.Context, at time.Time) (float64, *Evidence, error) {
+	v := float64(s)
+	return v, &Evidence{
+		Source:     "static",
+		ObservedAt: at,
+		Value:      strconv.FormatFloat(v, 'f', -1, 64),
+	}, nil
+}
+
+var resolverHttpClient = &http.Client{Timeout: 10 * time.Second}
+
+// priceAtPlaceholder in the price url is replaced with unix seconds of the requested moment
+const priceAtPlaceholder = "{at}"
+
+// JSONPriceSource reads price by dot separated path from the JSON endpoint,
+// e.g. "the-open-network.usd" for coingecko simple price.
+// URL with {at} is a historical endpoint and returns the price at the moment, otherwise the current price.
+type JSONPriceSource struct {
+	URL  string
+	Path string
+}
+
+func (s *JSONPriceSource) Price(ctx context.Context, at time.Time) (float64, *Evidence, error) {
+	url := strings.ReplaceAll(s.URL, priceAtPlaceholder, strconv.FormatInt(at.Unix(), 10))
+	v, evidence, err := fetchJSONValue(ctx, url, s.Path)
+	if err != nil {
+		return 0, nil, err
+	}
+	if url != s.URL {
+		evidence.ObservedAt = at
+	}
+
+	var price float64
+	switch pv := v.(type) {
+	case float64:
+		price = pv
+	case string:
+		price, err = strconv.ParseFloat(pv, 64)
+		if err != nil {
+			return 0, nil, fmt.Errorf("parse price failed: %w", err)
+		}
+	default:
+		return 0, nil, fmt.Errorf("price at %s is not a number", s.Path)
+	}
+
+	return price, evidence, nil
+}
+
+// defaultPriceMaxLag of the price observed after the event resolves at
+const defaultPriceMaxLag = 5 * time.Minute
+
+// PriceAboveResolver settles "price is above threshold" events by the price at the event resolves at,
+// price observed before it or later than MaxLag after it is not accepted
+type PriceAboveResolver struct {
+	Source    PriceSource
+	Threshold float64
+	Above     token.Token
+	Below     token.Token
+	MaxLag    time.Duration
+}
+
+type priceAboveConfig struct {
+	URL       string      `json:"url"`
+	Path      string      `json:"path"`
+	Price     *float64    `json:"price"`
+	Threshold float64     `json:"threshold"`
+	Above     token.Token `json:"above"`
+	Below     token.Token `json:"below"`
+	// MaxLagSec 0 means default
+	MaxLagSec int64 `json:"maxLagSec"`
+}
+
+// newPriceAboveResolver builds resolver from config, a fixed "price" replaces the url source
+func newPriceAboveResolver(config json.RawMessage) (Resolver, error) {
+	var c priceAboveConfig
+	if err := json.Unmarshal(config, &c); err != nil {
+		return nil, err
+	}
+	if c.Above == "" || c.Below == "" || c.Above == c.Below {
+		return nil, errors.New("above and below outcomes must be set and differ")
+	}
+	if c.MaxLagSec < 0 {
+		return nil, errors.New("max lag must not be negative")
+	}
+	maxLag := defaultPriceMaxLag
+	if c.MaxLagSec > 0 {
+		maxLag = time.Duration(c.MaxLagSec) * time.Second
+	}
+
+	var source PriceSource
+	switch {
+	case c.Price != nil:
+		source = StaticPriceSource(*c.Price)
+	case c.URL != "" && c.Path != "":
+		source = &JSONPriceSource{URL: c.URL, Path: c.Path}
+	default:
+		return nil, errors.New("url and path or price must be set")
+	}
+
+	return &PriceAboveResolver{
+		Source:    source,
+		Threshold: c.Threshold,
+		Above:     c.Above,
+		Below:     c.Below,
+		MaxLag:    maxLag,
+	}, nil
+}
+
+func (r *PriceAboveResolver) Resolve(ctx context.Context, e Event) (token.Token, *Evidence, error) {
+	if e.ResolvesAt.IsZero() || time.Now().Before(e.ResolvesAt) {
+		return "", nil, fmt.Errorf("%w: resolves at: %s", ErrResultNotReady, e.ResolvesAt)
+	}
+
+	price, evidence, err := r.Source.Price(ctx, e.ResolvesAt)
+	if err != nil {
+		return "", nil, err
+	}
+	switch lag := evidence.ObservedAt.Sub(e.ResolvesAt); {
+	case lag < 0:
+		return "", evidence, fmt.Errorf("%w: price observed at: %s before resolves at: %s", ErrResultNotReady,
+			evidence.ObservedAt, e.ResolvesAt)
+	case lag > r.MaxLag:
+		return "", evidence, fmt.Errorf("%w: price observed at: %s, %s after resolves at, close the event manually",
+			ErrStaleEvidence, evidence.ObservedAt, lag)
+	}
+
+	if price > r.Threshold {
+		return r.Above, evidence, nil
+	}
+	return r.Below, evidence, nil
+}
+
+func (r *PriceAboveResolver) outcomes() []token.Token {
+	return []token.Token{r.Above, r.Below}
+}
+
+// JSONOutcomeResolver maps value from the JSON endpoint to the outcome,
+// unmapped value means the result is not published yet
+type JSONOutcomeResolver struct {
+	URL      string                 `json:"url"`
+	Path     string                 `json:"path"`
+	Outcomes map[string]token.Token `json:"outcomes"`
+}
+
+func newJSONOutcomeResolver(config json.RawMessage) (Resolver, error) {
+	var r JSONOutcomeResolver
+	if err := json.Unmarshal(config, &r); err != nil {
+		return nil, err
+	}
+	if r.URL == "" || r.Path == "" || len(r.Outcomes) == 0 {
+		return nil, errors.New("url, path and outcomes must be set")
+	}
+	return &r, nil
+}
+
+func (r *JSONOutcomeResolver) Resolve(ctx context.Context, _ Event) (token.Token, *Evidence, error) {
+	_, evidence, err := fetchJSONValue(ctx, r.URL, r.Path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	t, ok := r.Outcomes[evidence.Value]
+	if !ok {
+		return "", evidence, fmt.Errorf("%w: value: %s", ErrResultNotReady, evidence.Value)
+	}
+	return t, evidence, nil
+}
+
+func (r *JSONOutcomeResolver) outcomes() []token.Token {
+	tokens := make([]token.Token, 0, len(r.Outcomes))
+	for _, t := range r.Outcomes {
+		tokens = append(tokens, t)
+	}
+	return tokens
+}
+
+func fetchJSONValue(ctx context.Context, url, path string) (any, *Evidence, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetch %s failed: %w", url, err)
+	}
+
+	resp, err := resolverHttpClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetch %s failed: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetch %s failed: %w", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("fetch %s failed: status: %d", url, resp.StatusCode)
+	}
+
+	var doc any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, nil, fmt.Errorf("fetch %s failed: %w", url, err)
+	}
+
+	v, err := lookupJSONPath(doc, path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetch %s failed: %w", url, err)
+	}
+
+	evidence := &Evidence{
+		Source:     url,
+		ObservedAt: time.Now(),
+		Value:      fmt.Sprint(v),
+		Raw:        body,
+	}
+	return v, evidence, nil
+}
+
+// lookupJSONPath walks dot separated path, numeric parts index arrays
+func lookupJSONPath(doc any, path string) (any, error) {
+	v := doc
+	for _, part := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			next, ok := node[part]
+			if !ok {
+				return nil, fmt.Errorf("path %s: key %s not found", path, part)
+			}
+			v = next
+		case []any:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, fmt.Errorf("path %s: bad index %s", path, part)
+			}
+			v = node[i]
+		default:
+			return nil, fmt.Errorf("path %s: %s is not an object", path, part)
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,343 @@
+package market
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TON-Market/tma/server/datatype/token"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// stubPriceSource returns the price observed lag after the requested moment and remembers the moment
+type stubPriceSource struct {
+	price float64
+	lag   time.Duration
+	at    time.Time
+}
+
+func (s *stubPriceSource) Price(_ context.Context, at time.Time) (float64, *Evidence, error) {
+	s.at = at
+	return s.price, &Evidence{
+		Source:     "stub",
+		ObservedAt: at.Add(s.lag),
+		Value:      strconv.FormatFloat(s.price, 'f', -1, 64),
+	}, nil
+}
+
+func TestPriceAboveResolver(t *testing.T) {
+	resolvesAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name       string
+		price      float64
+		lag        time.Duration
+		resolvesAt time.Time
+		want       token.Token
+		wantErr    error
+	}{
+		{"above", 2.5, 0, resolvesAt, token.A, nil},
+		{"below", 1.5, time.Minute, resolvesAt, token.B, nil},
+		{"equal is below", 2, 0, resolvesAt, token.B, nil},
+		{"within max lag", 2.5, defaultPriceMaxLag, resolvesAt, token.A, nil},
+		{"observed before resolves at", 2.5, -time.Second, resolvesAt, "", ErrResultNotReady},
+		{"observed too late", 2.5, defaultPriceMaxLag + time.Second, resolvesAt, "", ErrStaleEvidence},
+		{"resolves at is ahead", 2.5, 0, time.Now().Add(time.Hour), "", ErrResultNotReady},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &stubPriceSource{price: tt.price, lag: tt.lag}
+			r := &PriceAboveResolver{Source: source, Threshold: 2, Above: token.A, Below: token.B,
+				MaxLag: defaultPriceMaxLag}
+
+			got, _, err := r.Resolve(context.Background(), Event{ResolvesAt: tt.resolvesAt})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("outcome = %s, want %s", got, tt.want)
+			}
+			if tt.wantErr == nil && !source.at.Equal(tt.resolvesAt) {
+				t.Fatalf("price requested at: %s, want %s", source.at, tt.resolvesAt)
+			}
+		})
+	}
+}
+
+func TestNewPriceAboveResolver(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantLag time.Duration
+		wantErr bool
+	}{
+		{"default lag", `{"price": 2, "threshold": 1, "above": "A", "below": "B"}`, defaultPriceMaxLag, false},
+		{"lag", `{"price": 2, "threshold": 1, "above": "A", "below": "B", "maxLagSec": 60}`, time.Minute, false},
+		{"negative lag", `{"price": 2, "threshold": 1, "above": "A", "below": "B", "maxLagSec": -1}`, 0, true},
+		{"same outcomes", `{"price": 2, "threshold": 1, "above": "A", "below": "A"}`, 0, true},
+		{"no source", `{"threshold": 1, "above": "A", "below": "B"}`, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newPriceAboveResolver(json.RawMessage(tt.config))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if lag := r.(*PriceAboveResolver).MaxLag; lag != tt.wantLag {
+				t.Fatalf("max lag = %s, want %s", lag, tt.wantLag)
+			}
+		})
+	}
+}
+
+func TestJSONPriceSourceAt(t *testing.T) {
+	at := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("at") != strconv.FormatInt(at.Unix(), 10) {
+			http.Error(w, "bad at", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"ton": {"usd": "2.5"}}`)
+	}))
+	defer srv.Close()
+
+	s := &JSONPriceSource{URL: srv.URL + "?at=" + priceAtPlaceholder, Path: "ton.usd"}
+	price, evidence, err := s.Price(context.Background(), at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if price != 2.5 || !evidence.ObservedAt.Equal(at) {
+		t.Fatalf("price, observed at = %v, %s, want 2.5, %s", price, evidence.ObservedAt, at)
+	}
+
+	// current price endpoint is observed now and is rejected long after the event resolves at
+	s = &JSONPriceSource{URL: srv.URL + "?at=" + strconv.FormatInt(at.Unix(), 10), Path: "ton.usd"}
+	r := &PriceAboveResolver{Source: s, Threshold: 2, Above: token.A, Below: token.B, MaxLag: defaultPriceMaxLag}
+	if _, _, err := r.Resolve(context.Background(), Event{ResolvesAt: at}); !errors.Is(err, ErrStaleEvidence) {
+		t.Fatalf("err = %v, want %v", err, ErrStaleEvidence)
+	}
+}
+
+const testPriceResolverKind = "test_price"
+
+// registerTestPriceResolver binds resolver kind to the stub source
+func registerTestPriceResolver(source *stubPriceSource) {
+	RegisterResolver(testPriceResolverKind, func(_ json.RawMessage) (Resolver, error) {
+		return &PriceAboveResolver{Source: source, Threshold: 2, Above: token.A, Below: token.B,
+			MaxLag: defaultPriceMaxLag}, nil
+	})
+}
+
+// waitResolutions waits until the worker has no event in progress
+func waitResolutions(t *testing.T, w *resolutionWorker) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w.Lock()
+		n := len(w.inProgress)
+		w.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("resolution is not finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestResolveDueEvents settles the due event by the price at its resolves at and leaves the rest alone
+func TestResolveDueEvents(t *testing.T) {
+	loadTestConfig(t)
+	pool := testPool(t)
+	m := newTestMarket(t, newTestChain(t), pool)
+	ctx := context.Background()
+
+	source := &stubPriceSource{price: 2.5}
+	registerTestPriceResolver(source)
+
+	now := time.Now()
+	spec := &ResolverSpec{Kind: testPriceResolverKind, Config: json.RawMessage(`{}`)}
+	due := addTestEvent(t, m, func(e *Event) {
+		e.ResolvesAt, e.Resolver = now.Add(-time.Minute).Truncate(time.Second), spec
+		e.LocksAt = e.ResolvesAt
+	})
+	notDue := addTestEvent(t, m, func(e *Event) {
+		e.ResolvesAt, e.Resolver = now.Add(time.Hour), spec
+		e.LocksAt = e.ResolvesAt
+	})
+
+	w := newResolutionWorker()
+	m.resolveDueEvents(ctx, w, now)
+	waitResolutions(t, w)
+
+	dueCopy, err := m.persistor.getCopyByID(ctx, due.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dueCopy.Status != EventResolved || !source.at.Equal(due.ResolvesAt) {
+		t.Fatalf("due event status = %d, price at: %s, want %d, %s", dueCopy.Status, source.at, EventResolved,
+			due.ResolvesAt)
+	}
+	notDueCopy, err := m.persistor.getCopyByID(ctx, notDue.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notDueCopy.Status != EventActive {
+		t.Fatalf("not due event status = %d, want %d", notDueCopy.Status, EventActive)
+	}
+
+	var winToken token.Token
+	var resolveErr string
+	q := `SELECT token, error FROM resolutions WHERE event_id = $1`
+	if err := pool.QueryRow(ctx, q, due.ID).Scan(&winToken, &resolveErr); err != nil {
+		t.Fatal(err)
+	}
+	if winToken != token.A || resolveErr != "" {
+		t.Fatalf("resolution = %s, %q, want %s", winToken, resolveErr, token.A)
+	}
+}
+
+// TestResolveDueEventsStale keeps the event active when the price is observed too late after resolves at
+func TestResolveDueEventsStale(t *testing.T) {
+	loadTestConfig(t)
+	pool := testPool(t)
+	m := newTestMarket(t, newTestChain(t), pool)
+	ctx := context.Background()
+
+	registerTestPriceResolver(&stubPriceSource{price: 2.5, lag: time.Hour})
+
+	now := time.Now()
+	e := addTestEvent(t, m, func(e *Event) {
+		e.ResolvesAt, e.LocksAt = now.Add(-time.Minute), now.Add(-time.Minute)
+		e.Resolver = &ResolverSpec{Kind: testPriceResolverKind, Config: json.RawMessage(`{}`)}
+	})
+
+	w := newResolutionWorker()
+	m.resolveDueEvents(ctx, w, now)
+	waitResolutions(t, w)
+	// stale evidence won't get fresher, the resolver is stopped
+	m.resolveDueEvents(ctx, w, now.Add(resolutionMaxBackoff))
+	waitResolutions(t, w)
+
+	eventCopy, err := m.persistor.getCopyByID(ctx, e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eventCopy.Status != EventActive {
+		t.Fatalf("event status = %d, want %d", eventCopy.Status, EventActive)
+	}
+
+	var resolveErr string
+	var n int
+	q := `SELECT max(error), count(*) FROM resolutions WHERE event_id = $1`
+	if err := pool.QueryRow(ctx, q, e.ID).Scan(&resolveErr, &n); err != nil {
+		t.Fatal(err)
+	}
+	if resolveErr == "" || n != 1 {
+		t.Fatalf("resolutions = %d, error %q, want 1 with error", n, resolveErr)
+	}
+}
+
+// TestResolveDueEventsSuspended leaves the event suspended by the admin alone
+func TestResolveDueEventsSuspended(t *testing.T) {
+	loadTestConfig(t)
+	pool := testPool(t)
+	m := newTestMarket(t, newTestChain(t), pool)
+	ctx := context.Background()
+
+	registerTestPriceResolver(&stubPriceSource{price: 2.5})
+
+	now := time.Now()
+	e := addTestEvent(t, m, func(e *Event) {
+		e.ResolvesAt, e.LocksAt = now.Add(-time.Minute), now.Add(-time.Minute)
+		e.Resolver = &ResolverSpec{Kind: testPriceResolverKind, Config: json.RawMessage(`{}`)}
+	})
+	if err := m.SuspendEvent(ctx, e.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newResolutionWorker()
+	m.resolveDueEvents(ctx, w, now)
+	waitResolutions(t, w)
+
+	eventCopy, err := m.persistor.getCopyByID(ctx, e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eventCopy.Status != EventSuspended {
+		t.Fatalf("event status = %d, want %d", eventCopy.Status, EventSuspended)
+	}
+	var n int
+	if err := pool.QueryRow(ctx, `SELECT count(*) FROM resolutions WHERE event_id = $1`, e.ID).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("resolutions = %d, want 0", n)
+	}
+}
+
+func TestResolutionWorkerRetries(t *testing.T) {
+	now := time.Now()
+	w := newResolutionWorker()
+
+	w.inProgress["e"] = true
+	w.done("e", ErrResultNotReady, now)
+	if w.isDue("e", now) || w.isDue("e", now.Add(resolutionPollPeriod)) {
+		t.Fatal("failed event is retried before backoff")
+	}
+	if !w.isDue("e", now.Add(resolutionBackoff(1))) {
+		t.Fatal("failed event is not retried after backoff")
+	}
+
+	w.done("e", nil, now)
+	if !w.isDue("e", now) {
+		t.Fatal("resolved event keeps backoff")
+	}
+
+	w.done("e", fmt.Errorf("resolve: %w", ErrStaleEvidence), now)
+	if w.isDue("e", now.Add(resolutionMaxBackoff)) {
+		t.Fatal("event is retried after terminal error")
+	}
+
+	if b := resolutionBackoff(100); b != resolutionMaxBackoff {
+		t.Fatalf("backoff = %s, want %s", b, resolutionMaxBackoff)
+	}
+}
+
+func TestValidateResolverLocksAt(t *testing.T) {
+	registerTestPriceResolver(&stubPriceSource{price: 2.5})
+	resolvesAt := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		locksAt time.Time
+		wantErr bool
+	}{
+		{"before resolves at", resolvesAt.Add(-time.Minute), false},
+		{"at resolves at", resolvesAt, false},
+		{"after resolves at", resolvesAt.Add(time.Minute), true},
+		{"not set", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Event{
+				BetMap:     map[token.Token]*Bet{token.A: {}, token.B: {}},
+				LocksAt:    tt.locksAt,
+				ResolvesAt: resolvesAt,
+				Resolver:   &ResolverSpec{Kind: testPriceResolverKind, Config: json.RawMessage(`{}`)},
+			}
+			if err := e.validateResolver(); (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/tonkeeper/tongo/tlb"
 	"sync"
+	"time"
 )
 
 type runtimer struct {
@@ -20,7 +21,8 @@ var (
 	ErrRuntimeEventNotExist      = errors.New("err runtime event not exist")
 )
 
-func (r *runtimer) saveEvent(_ context.Context, e *Event) error {
+// saveEvent adds runtime of the event, liquidity is LMSR parameter in minimal units, 0 for parimutuel event
+func (r *runtimer) saveEvent(_ context.Context, e *Event, liquidity tlb.Grams) error {
 	r.Lock()
 	defer r.Unlock()
 
@@ -29,16 +31,18 @@ func (r *runtimer) saveEvent(_ context.Context, e *Event) error {
 	}
 
 	er := &eventRuntime{
-		isActive:      true,
+		isActive:      e.isBettingOpen(time.Now()),
 		eventID:       e.ID,
 		betRuntimeMap: make(map[token.Token]*betRuntime),
+		liquidity:     liquidity,
 	}
 
-	for t := range e.BetMap {
+	for _, t := range e.Tokens() {
 		er.betRuntimeMap[t] = &betRuntime{
 			sync.RWMutex{},
 			t,
 			tlb.Grams(0),
+			tlb.Grams(0),
 		}
 	}
 
@@ -47,19 +51,93 @@ func (r *runtimer) saveEvent(_ context.Context, e *Event) error {
 	return nil
 }
 
-func (r *runtimer) deposit(_ context.Context, d *Deal) error {
+func (r *runtimer) getEventRuntime(id uuid.UUID) (*eventRuntime, bool) {
 	r.RLock()
 	defer r.RUnlock()
 
-	if _, ok := r.eventRuntimeMap[d.EventID]; !ok {
-		return fmt.Errorf("runtimer deposit failed: %v: id: %s", ErrRuntimeEventNotExist, d.EventID.String())
+	er, ok := r.eventRuntimeMap[id]
+	return er, ok
+}
+
+// buy prices the stake of collateral on the outcome and applies it once persist succeeds.
+// Stakes of the event are serialized, so the next one is priced after the previous is applied.
+func (r *runtimer) buy(_ context.Context, eventID uuid.UUID, t token.Token, collateral tlb.Grams,
+	persist func(size tlb.Grams) error) error {
+	er, ok := r.getEventRuntime(eventID)
+	if !ok {
+		return fmt.Errorf("runtimer buy failed: %v: id: %s", ErrRuntimeEventNotExist, eventID.String())
 	}
 
-	r.eventRuntimeMap[d.EventID].deposit(d.Token, d.Collateral)
+	er.buyMu.Lock()
+	defer er.buyMu.Unlock()
+
+	size, err := er.shares(t, collateral)
+	if err != nil {
+		return fmt.Errorf("runtimer buy failed: %w", err)
+	}
+	if err := persist(size); err != nil {
+		return fmt.Errorf("runtimer buy failed: %w", err)
+	}
+	if err := er.deposit(t, collateral, size); err != nil {
+		return fmt.Errorf("runtimer buy failed: %w", err)
+	}
 
 	return nil
 }
 
+// sell prices size of the outcome sold back and takes it with collateral off the runtime once persist succeeds,
+// sells are serialized with buys of the event
+func (r *runtimer) sell(_ context.Context, eventID uuid.UUID, t token.Token, collateral, size tlb.Grams,
+	persist func(value tlb.Grams) error) error {
+	er, ok := r.getEventRuntime(eventID)
+	if !ok {
+		return fmt.Errorf("runtimer sell failed: %v: id: %s", ErrRuntimeEventNotExist, eventID.String())
+	}
+
+	er.buyMu.Lock()
+	defer er.buyMu.Unlock()
+
+	value, err := er.sellValue(t, collateral, size)
+	if err != nil {
+		return fmt.Errorf("runtimer sell failed: %w", err)
+	}
+	if err := persist(value); err != nil {
+		return fmt.Errorf("runtimer sell failed: %w", err)
+	}
+	if err := er.withdraw(t, collateral, size); err != nil {
+		return fmt.Errorf("runtimer sell failed: %w", err)
+	}
+
+	return nil
+}
+
+// withBook runs fn holding the order book lock of the event
+func (r *runtimer) withBook(_ context.Context, eventID uuid.UUID, fn func() error) error {
+	er, ok := r.getEventRuntime(eventID)
+	if !ok {
+		return fmt.Errorf("runtimer book failed: %v: id: %s", ErrRuntimeEventNotExist, eventID.String())
+	}
+
+	er.bookMu.Lock()
+	defer er.bookMu.Unlock()
+
+	return fn()
+}
+
+// shares returns size the collateral buys on the outcome at the current price
+func (r *runtimer) shares(_ context.Context, eventID uuid.UUID, t token.Token, collateral tlb.Grams) (tlb.Grams, error) {
+	er, ok := r.getEventRuntime(eventID)
+	if !ok {
+		return 0, fmt.Errorf("runtimer shares failed: %v: id: %s", ErrRuntimeEventNotExist, eventID.String())
+	}
+
+	size, err := er.shares(t, collateral)
+	if err != nil {
+		return 0, fmt.Errorf("runtimer shares failed: %w", err)
+	}
+	return size, nil
+}
+
 func (r *runtimer) snapshot(_ context.Context) map[uuid.UUID]*eventState {
 	r.RLock()
 	defer r.RUnlock()
@@ -73,11 +151,16 @@ func (r *runtimer) snapshot(_ context.Context) map[uuid.UUID]*eventState {
 	return m
 }
 
-func (r *runtimer) getEventState(_ context.Context, id uuid.UUID) *eventState {
+func (r *runtimer) getEventState(_ context.Context, id uuid.UUID) (*eventState, error) {
 	r.RLock()
 	defer r.RUnlock()
-	s := r.eventRuntimeMap[id].getState()
-	return s
+
+	er, ok := r.eventRuntimeMap[id]
+	if !ok {
+		return nil, fmt.Errorf("runtimer get event: %s state failed: %w", id.String(), ErrRuntimeEventNotExist)
+	}
+
+	return er.getState(), nil
 }
 
 func (r *runtimer) close(_ context.Context, id uuid.UUID) error {
@@ -92,3 +175,47 @@ func (r *runtimer) close(_ context.Context, id uuid.UUID) error {
 	er.close()
 	return nil
 }
+
+// setActive flips event betting state to isOpen, reports whether it was changed.
+// isOpen is called under the event runtime lock, so it sees status changes made before a concurrent close.
+func (r *runtimer) setActive(_ context.Context, id uuid.UUID, isOpen func() bool) (bool, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	er, ok := r.eventRuntimeMap[id]
+	if !ok {
+		return false, fmt.Errorf("runtimer set event: %s active failed: %w", id.String(), ErrRuntimeEventNotExist)
+	}
+
+	er.Lock()
+	defer er.Unlock()
+
+	isActive := isOpen()
+	changed := er.isActive != isActive
+	er.isActive = isActive
+	return changed, nil
+}
+
+// restore overwrites event runtime collateral and size with totals loaded from the db
+func (r *runtimer) restore(_ context.Context, id uuid.UUID, totals map[token.Token]stakeTotal) error {
+	r.RLock()
+	defer r.RUnlock()
+
+	er, ok := r.eventRuntimeMap[id]
+	if !ok {
+		return fmt.Errorf("runtimer restore failed: %w: id: %s", ErrRuntimeEventNotExist, id.String())
+	}
+
+	// known outcomes are restored even if some assets are of an outcome the event no longer has
+	var errList []error
+	for t, total := range totals {
+		if err := er.restore(t, total); err != nil {
+			errList = append(errList, err)
+		}
+	}
+	if err := errors.Join(errList...); err != nil {
+		return fmt.Errorf("runtimer restore event: %s failed: %w", id.String(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package market
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"log"
+	"time"
+)
+
+const schedulePeriod = time.Second
+
+// startScheduler opens and locks betting by event windows
+func (m *Market) startScheduler(ctx context.Context) {
+	ticker := time.NewTicker(schedulePeriod)
+
+	go func() {
+		defer ticker.Stop()
+		for now := range ticker.C {
+			m.applySchedule(ctx, now)
+		}
+	}()
+}
+
+func (m *Market) applySchedule(ctx context.Context, now time.Time) {
+	for _, e := range m.persistor.getAll(ctx) {
+		// suspended event is closed by the runtimer, finished one is never reopened
+		if e.Status != EventActive {
+			continue
+		}
+
+		isActive, changed, err := m.refreshBetting(ctx, e.ID, now)
+		if err != nil {
+			log.Printf("[ERROR] apply schedule failed: %s\n\n", err.Error())
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		if isActive {
+			log.Printf("[INFO] betting opened, event: %s\n\n", e.ID.String())
+		} else {
+			log.Printf("[INFO] betting locked, event: %s\n\n", e.ID.String())
+		}
+		m.notifyEvent(ctx, e.ID)
+	}
+}
+
+// refreshBetting opens or locks betting by the current status and window of the event.
+// Status is read again under the runtime lock, copies taken before a concurrent suspend, close or void
+// would reopen betting otherwise. Reports the new betting state and whether it was changed.
+func (m *Market) refreshBetting(ctx context.Context, id uuid.UUID, now time.Time) (bool, bool, error) {
+	var isActive bool
+	changed, err := m.runtimer.setActive(ctx, id, func() bool {
+		e, err := m.persistor.getCopyByID(ctx, id)
+		isActive = err == nil && e.isBettingOpen(now)
+		return isActive
+	})
+	return isActive, changed, err
+}
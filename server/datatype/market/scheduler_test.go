@@ -0,0 +1,67 @@
+package market
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestApplyScheduleSkipsSuspendedEvent(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMarket(t, nil, nil)
+	now := time.Now()
+	e := addTestEvent(t, m, func(e *Event) {
+		e.OpensAt = now.Add(-time.Hour)
+		e.LocksAt = now.Add(time.Hour)
+	})
+
+	// suspend lands between the scheduler reading events and opening betting
+	if err := m.persistor.eventStorage.setStatus(ctx, e.ID, EventSuspended); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.runtimer.close(ctx, e.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.refreshBetting(ctx, e.ID, now); err != nil {
+		t.Fatal(err)
+	}
+	m.applySchedule(ctx, now)
+
+	es, err := m.runtimer.getEventState(ctx, e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if es.isActive {
+		t.Fatal("betting reopened on suspended event")
+	}
+}
+
+func TestApplyScheduleLocksEvent(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMarket(t, nil, nil)
+	now := time.Now()
+	e := addTestEvent(t, m, func(e *Event) {
+		e.LocksAt = now.Add(time.Minute)
+	})
+
+	m.applySchedule(ctx, now)
+	if es, _ := m.runtimer.getEventState(ctx, e.ID); !es.isActive {
+		t.Fatal("betting is locked before LocksAt")
+	}
+
+	m.applySchedule(ctx, now.Add(2*time.Minute))
+	if es, _ := m.runtimer.getEventState(ctx, e.ID); es.isActive {
+		t.Fatal("betting is open after LocksAt")
+	}
+}
+
+func TestCheckWindowLocksAtResolvesAt(t *testing.T) {
+	now := time.Now()
+	e := &Event{ResolvesAt: now.Add(time.Minute)}
+	if err := e.checkWindow(now); err != nil {
+		t.Fatalf("err = %v before resolves at", err)
+	}
+	if err := e.checkWindow(now.Add(time.Minute)); err != ErrBettingLocked {
+		t.Fatalf("err = %v at resolves at, want %v", err, ErrBettingLocked)
+	}
+}
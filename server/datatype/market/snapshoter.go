@@ -58,21 +58,7 @@ func (m *Market) makeSnapshot(ctx context.Context) error {
 			continue
 		}
 
-		betDTOList := m.snapshotBets(ctx, eventCopy, state)
-
-		collateral := utils.GramsToStringInFloat(state.collateral)
-
-		eventDTO := EventDTO{
-			ID:              eventID,
-			Tag:             eventCopy.Tag,
-			LogoLink:        eventCopy.LogoLink,
-			Title:           eventCopy.Title,
-			Collateral:      collateral,
-			CollateralGrams: state.collateral,
-			Bets:            betDTOList,
-		}
-
-		list = append(list, eventDTO)
+		list = append(list, m.buildEventDTO(ctx, eventCopy, state))
 	}
 
 	m.snapshot.Lock()
@@ -86,14 +72,39 @@ func (m *Market) makeSnapshot(ctx context.Context) error {
 	return nil
 }
 
+func (m *Market) buildEventDTO(ctx context.Context, e Event, state *eventState) EventDTO {
+	return EventDTO{
+		ID:              e.ID,
+		Tag:             e.Tag,
+		Status:          e.Status,
+		IsActive:        state.isActive,
+		OpensAt:         nullTime(e.OpensAt),
+		LocksAt:         nullTime(e.LocksAt),
+		ResolvesAt:      nullTime(e.ResolvesAt),
+		LogoLink:        e.LogoLink,
+		Title:           e.Title,
+		Collateral:      m.formatOf(e.Jetton, state.collateral),
+		Currency:        m.symbolOf(e.Jetton),
+		Jetton:          e.Jetton,
+		Pricing:         e.Pricing,
+		OutcomeCap:      m.formatOutcomeCap(e),
+		CollateralGrams: state.collateral,
+		Bets:            m.snapshotBets(ctx, e, state),
+	}
+}
+
 func (m *Market) snapshotBets(_ context.Context, e Event, state *eventState) []*BetDTO {
 	betDTOList := make([]*BetDTO, 0, len(e.BetMap))
 
-	for t, b := range e.BetMap {
+	for _, t := range e.Tokens() {
+		b := e.BetMap[t]
 		bDTO := &BetDTO{
-			Token:      t,
-			Title:      b.Title,
-			Percentage: utils.FloatToString(state.betStateMap[t].percentage),
+			Token:    t,
+			Title:    b.Title,
+			LogoLink: b.LogoLink,
+		}
+		if bs, ok := state.betStateMap[t]; ok {
+			bDTO.Percentage = utils.FloatToString(bs.percentage)
 		}
 		betDTOList = append(betDTOList, bDTO)
 	}
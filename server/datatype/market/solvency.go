@@ -0,0 +1,245 @@
+package market
+
+import (
+	"context"
+	"fmt"
+	"github.com/tonkeeper/tongo/tlb"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	solvencyCheckPeriod = 10 * time.Minute
+	// solvencyDiscrepancyLimit discrepancies of each kind in the report
+	solvencyDiscrepancyLimit = 100
+)
+
+type DiscrepancyKind string
+
+const (
+	// DiscrepancyUnpaidDeal verified deal without matched bank transfer
+	DiscrepancyUnpaidDeal DiscrepancyKind = "verified_deal_without_deposit"
+	// DiscrepancyUnsettledTransfer matched transfer of unchecked deal without deposit job
+	DiscrepancyUnsettledTransfer DiscrepancyKind = "matched_transfer_not_settled"
+	// DiscrepancyFailedPayout payout out of attempts, still owed to the user
+	DiscrepancyFailedPayout DiscrepancyKind = "failed_payout"
+	// DiscrepancyUnknownCurrency market owes a currency which is not configured
+	DiscrepancyUnknownCurrency DiscrepancyKind = "unknown_currency"
+)
+
+// Discrepancy record that doesn't add up with the chain, Ref is deal id, transfer lt or payout id
+type Discrepancy struct {
+	Kind           DiscrepancyKind
+	Ref            string
+	UserRawAddress string
+	Grams          tlb.Grams
+	Jetton         string
+}
+
+// solvencyLine bank balance of one currency against what the market owes
+type solvencyLine struct {
+	currency  *Currency
+	balance   tlb.Grams
+	staked    tlb.Grams
+	payouts   tlb.Grams
+	transfers tlb.Grams
+	// exposure worst case loss of the house on open LMSR events
+	exposure tlb.Grams
+}
+
+func (l *solvencyLine) liabilities() tlb.Grams {
+	return l.staked + l.payouts + l.transfers + l.exposure
+}
+
+func (l *solvencyLine) solvent() bool {
+	return l.balance >= l.liabilities()
+}
+
+// surplus formats balance minus liabilities, negative on deficit
+func (l *solvencyLine) surplus() string {
+	if l.solvent() {
+		return l.currency.Format(l.balance - l.liabilities())
+	}
+	return "-" + l.currency.Format(l.liabilities()-l.balance)
+}
+
+func (m *Market) startSolvencyCheck(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(solvencyCheckPeriod)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			report, err := m.GetSolvencyReport(ctx)
+			if err != nil {
+				log.Printf("[ERROR] solvency check failed: %s\n\n", err.Error())
+				continue
+			}
+			for _, line := range report.Lines {
+				if !line.Solvent {
+					log.Printf("[ALARM] bank is insolvent in %s: balance: %s, owes: %s, deficit: %s\n\n",
+						line.Currency, line.Balance, line.Liabilities, line.Surplus)
+					continue
+				}
+				log.Printf("[INFO] solvency %s: balance: %s, owes: %s, surplus: %s\n\n",
+					line.Currency, line.Balance, line.Liabilities, line.Surplus)
+			}
+			if len(report.Discrepancies) > 0 {
+				log.Printf("[WARNING] solvency check found %d discrepancies\n\n", len(report.Discrepancies))
+			}
+		}
+	}()
+}
+
+// solvencyLines returns line of TON and of every configured jetton, liabilities in unknown
+// jettons are returned as discrepancies
+func (m *Market) solvencyLines(ctx context.Context) ([]*solvencyLine, []*Discrepancy, error) {
+	staked, err := m.persistor.getOpenStakeTotals(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	payouts, err := m.persistor.getUnpaidPayoutTotals(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	transfers, err := m.persistor.getUnsettledTransferTotals(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	exposure := m.openExposure(ctx)
+
+	currencyList := append([]*Currency{tonCurrency}, m.currencies.list()...)
+	slices.SortFunc(currencyList[1:], func(a, b *Currency) int {
+		return strings.Compare(a.Symbol, b.Symbol)
+	})
+
+	lineList := make([]*solvencyLine, 0, len(currencyList))
+	for _, c := range currencyList {
+		line := &solvencyLine{
+			currency:  c,
+			staked:    staked[c.Jetton],
+			payouts:   payouts[c.Jetton],
+			transfers: transfers[c.Jetton],
+			exposure:  exposure[c.Jetton],
+		}
+		if c.IsJetton() {
+			line.balance, err = m.chain.JettonBalance(ctx, c.bankWallet)
+		} else {
+			line.balance, err = m.chain.Balance(ctx, m.chain.BankAddress())
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		lineList = append(lineList, line)
+	}
+
+	discrepancyList := make([]*Discrepancy, 0)
+	for _, totals := range []map[string]tlb.Grams{staked, payouts, transfers} {
+		for jetton, g := range totals {
+			if _, err := m.currencyOf(jetton); err != nil && g > 0 {
+				discrepancyList = append(discrepancyList, &Discrepancy{
+					Kind:   DiscrepancyUnknownCurrency,
+					Ref:    jetton,
+					Grams:  g,
+					Jetton: jetton,
+				})
+			}
+		}
+	}
+	return lineList, discrepancyList, nil
+}
+
+// openExposure sums house exposure of LMSR events in the runtime by jetton
+func (m *Market) openExposure(ctx context.Context) map[string]tlb.Grams {
+	exposure := make(map[string]tlb.Grams)
+	for eventID, state := range m.runtimer.snapshot(ctx) {
+		if state.exposure == 0 {
+			continue
+		}
+		eventCopy, err := m.persistor.getCopyByID(ctx, eventID)
+		if err != nil || eventCopy.isFinished() {
+			continue
+		}
+		exposure[eventCopy.Jetton] += state.exposure
+	}
+	return exposure
+}
+
+// SolvencyLineDTO amounts in currency units
+type SolvencyLineDTO struct {
+	Currency string `json:"currency"`
+	Balance  string `json:"balance"`
+	// Staked collateral of events not resolved or voided
+	Staked string `json:"staked"`
+	// Payouts not confirmed on chain
+	Payouts string `json:"payouts"`
+	// Transfers received but neither staked nor refunded
+	Transfers string `json:"transfers"`
+	// Exposure max loss of the house on open LMSR events
+	Exposure    string `json:"exposure"`
+	Liabilities string `json:"liabilities"`
+	Surplus     string `json:"surplus"`
+	Solvent     bool   `json:"solvent"`
+}
+
+type DiscrepancyDTO struct {
+	Kind     DiscrepancyKind `json:"kind"`
+	Ref      string          `json:"ref"`
+	User     string          `json:"user,omitempty"`
+	Amount   string          `json:"amount"`
+	Currency string          `json:"currency"`
+}
+
+type SolvencyReportDTO struct {
+	Time          time.Time          `json:"time"`
+	Solvent       bool               `json:"solvent"`
+	Lines         []*SolvencyLineDTO `json:"lines"`
+	Discrepancies []*DiscrepancyDTO  `json:"discrepancies"`
+}
+
+// GetSolvencyReport compares bank balances with open stakes, unpaid payouts and unsettled transfers
+func (m *Market) GetSolvencyReport(ctx context.Context) (*SolvencyReportDTO, error) {
+	lineList, discrepancyList, err := m.solvencyLines(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("market get solvency report failed: %w", err)
+	}
+	dbDiscrepancyList, err := m.persistor.getDiscrepancies(ctx, solvencyDiscrepancyLimit)
+	if err != nil {
+		return nil, fmt.Errorf("market get solvency report failed: %w", err)
+	}
+	discrepancyList = append(discrepancyList, dbDiscrepancyList...)
+
+	report := &SolvencyReportDTO{
+		Time:          time.Now(),
+		Solvent:       true,
+		Lines:         make([]*SolvencyLineDTO, 0, len(lineList)),
+		Discrepancies: make([]*DiscrepancyDTO, 0, len(discrepancyList)),
+	}
+	for _, line := range lineList {
+		c := line.currency
+		report.Solvent = report.Solvent && line.solvent()
+		report.Lines = append(report.Lines, &SolvencyLineDTO{
+			Currency:    c.Symbol,
+			Balance:     c.Format(line.balance),
+			Staked:      c.Format(line.staked),
+			Payouts:     c.Format(line.payouts),
+			Transfers:   c.Format(line.transfers),
+			Exposure:    c.Format(line.exposure),
+			Liabilities: c.Format(line.liabilities()),
+			Surplus:     line.surplus(),
+			Solvent:     line.solvent(),
+		})
+	}
+	for _, d := range discrepancyList {
+		report.Discrepancies = append(report.Discrepancies, &DiscrepancyDTO{
+			Kind:     d.Kind,
+			Ref:      d.Ref,
+			User:     d.UserRawAddress,
+			Amount:   m.formatOf(d.Jetton, d.Grams),
+			Currency: m.symbolOf(d.Jetton),
+		})
+	}
+	return report, nil
+}
@@ -0,0 +1,367 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/TON-Market/tma/server/config"
+	"github.com/TON-Market/tma/server/utils"
+	"github.com/tonkeeper/tongo/tlb"
+	"github.com/tonkeeper/tongo/ton"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	treasuryPollPeriod = time.Minute
+	// treasurySweepsLimit sweeps listed in the treasury report
+	treasurySweepsLimit = 20
+)
+
+var ErrInvalidTreasury = errors.New("invalid treasury config")
+
+type SweepState int
+
+const (
+	// SweepSending sweep is saved, the wallet message is not sent yet
+	SweepSending SweepState = iota
+	SweepSent
+	SweepConfirmed
+	SweepFailed
+)
+
+// Sweep transfer of the hot wallet excess to the cold address
+type Sweep struct {
+	ID    int64
+	To    string
+	Grams tlb.Grams
+	// HotBalance and Pending payouts at the moment of the sweep
+	HotBalance tlb.Grams
+	Pending    tlb.Grams
+	State      SweepState
+	QueryID    uint64
+	MsgHash    string
+	ValidUntil time.Time
+	Error      string
+	CreatedAt  time.Time
+}
+
+// treasuryLimits thresholds of the hot wallet in nanoTON, cold is nil if sweeps are disabled
+type treasuryLimits struct {
+	cold *ton.AccountID
+	// refill operator wallets that top up the hot wallet besides cold
+	refill   []ton.AccountID
+	minHot   tlb.Grams
+	maxHot   tlb.Grams
+	minSweep tlb.Grams
+}
+
+func treasuryConfig() (*treasuryLimits, error) {
+	c := config.Config.Treasury
+	if c.MinHot < 0 || c.MinSweep < 0 || c.MaxHot < c.MinHot {
+		return nil, fmt.Errorf("%w: thresholds must be 0 <= min <= max", ErrInvalidTreasury)
+	}
+
+	limits := &treasuryLimits{
+		minHot:   utils.FloatToGrams(c.MinHot),
+		maxHot:   utils.FloatToGrams(c.MaxHot),
+		minSweep: utils.FloatToGrams(c.MinSweep),
+	}
+	if c.ColdAddress != "" {
+		cold, err := ton.ParseAccountID(c.ColdAddress)
+		if err != nil {
+			return nil, fmt.Errorf("%w: cold address: %w", ErrInvalidTreasury, err)
+		}
+		limits.cold = &cold
+	}
+	for _, addr := range c.RefillAddresses {
+		refill, err := ton.ParseAccountID(addr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: refill address: %s: %w", ErrInvalidTreasury, addr, err)
+		}
+		limits.refill = append(limits.refill, refill)
+	}
+	return limits, nil
+}
+
+// isRefill reports whether the transfer sender is the cold or a refill wallet
+func (l *treasuryLimits) isRefill(sender string) bool {
+	id, err := ton.ParseAccountID(sender)
+	if err != nil {
+		return false
+	}
+	if l.cold != nil && *l.cold == id {
+		return true
+	}
+	for _, refill := range l.refill {
+		if refill == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Market) validateTreasuryConfig() error {
+	limits, err := treasuryConfig()
+	if err != nil {
+		return err
+	}
+	if limits.cold != nil && *limits.cold == m.chain.BankAddress() {
+		return fmt.Errorf("%w: cold address is the bank wallet", ErrInvalidTreasury)
+	}
+	for _, refill := range limits.refill {
+		if refill == m.chain.BankAddress() {
+			return fmt.Errorf("%w: refill address is the bank wallet", ErrInvalidTreasury)
+		}
+	}
+	return nil
+}
+
+// startTreasury keeps the hot wallet balance between min and max thresholds
+func (m *Market) startTreasury(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(treasuryPollPeriod)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := m.balanceTreasury(ctx); err != nil {
+				log.Printf("[ERROR] %s\n\n", err.Error())
+			}
+		}
+	}()
+}
+
+// hotRequired returns TON needed by not confirmed payouts, jetton payouts need the attached TON only
+func (m *Market) hotRequired(ctx context.Context) (tlb.Grams, error) {
+	totalList, err := m.persistor.getPendingPayoutTotals(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var required tlb.Grams
+	for _, t := range totalList {
+		if t.Jetton == "" {
+			required += t.Grams
+			continue
+		}
+		required += tlb.Grams(t.Count) * jettonAttachedTon()
+	}
+	return required, nil
+}
+
+// balanceTreasury raises alerts on low hot balance and sweeps the excess above max to the cold address,
+// the sweep never leaves less than pending payouts plus min in the hot wallet
+func (m *Market) balanceTreasury(ctx context.Context) error {
+	limits, err := treasuryConfig()
+	if err != nil {
+		return fmt.Errorf("balance treasury failed: %w", err)
+	}
+
+	hot, err := m.chain.Balance(ctx, m.chain.BankAddress())
+	if err != nil {
+		return fmt.Errorf("balance treasury failed: %w", err)
+	}
+	required, err := m.hotRequired(ctx)
+	if err != nil {
+		return fmt.Errorf("balance treasury failed: %w", err)
+	}
+
+	switch {
+	case hot < required:
+		log.Printf("[ALARM] hot wallet: %s TON can't cover pending payouts: %s TON\n\n",
+			tonCurrency.Format(hot), tonCurrency.Format(required))
+	case hot < limits.minHot:
+		log.Printf("[ALARM] hot wallet: %s TON is below min: %s TON, refill from cold\n\n",
+			tonCurrency.Format(hot), tonCurrency.Format(limits.minHot))
+	}
+
+	if limits.cold == nil {
+		return nil
+	}
+
+	inFlight, err := m.checkLastSweep(ctx)
+	if err != nil {
+		return fmt.Errorf("balance treasury failed: %w", err)
+	}
+	if inFlight || hot <= limits.maxHot {
+		return nil
+	}
+
+	amount := hot - limits.maxHot
+	if reserve := required + limits.minHot; hot-amount < reserve {
+		if hot <= reserve {
+			return nil
+		}
+		amount = hot - reserve
+	}
+	if amount < limits.minSweep {
+		return nil
+	}
+
+	return m.sweep(ctx, *limits.cold, amount, hot, required)
+}
+
+// checkLastSweep moves the sent sweep to confirmed or failed, returns true while the wallet can still process it.
+// A new sweep waits for the last one, the hot balance does not reflect it yet.
+func (m *Market) checkLastSweep(ctx context.Context) (bool, error) {
+	sweep, err := m.persistor.getLastSweep(ctx)
+	if err != nil || sweep == nil || sweep.State != SweepSent {
+		return false, err
+	}
+
+	processed, err := m.chain.IsProcessed(ctx, sweep.QueryID)
+	if err != nil {
+		return false, fmt.Errorf("check sweep: %d failed: %w", sweep.ID, err)
+	}
+	switch {
+	case processed:
+		// forgotten query is reported processed too, the sweep is confirmed by the message the bank emitted
+		emitted, err := m.isSweepEmitted(ctx, sweep)
+		if err != nil {
+			return false, fmt.Errorf("check sweep: %d failed: %w", sweep.ID, err)
+		}
+		if !emitted {
+			sweep.State, sweep.Error = SweepFailed, "not sent by the bank"
+			log.Printf("[WARNING] sweep: %d, query id: %d not sent by the bank\n\n", sweep.ID, sweep.QueryID)
+			break
+		}
+		sweep.State = SweepConfirmed
+		log.Printf("[SUCCESS] sweep: %d of %s TON to cold confirmed\n\n", sweep.ID, tonCurrency.Format(sweep.Grams))
+	case time.Now().After(sweep.ValidUntil):
+		sweep.State, sweep.Error = SweepFailed, "expired"
+		log.Printf("[WARNING] sweep: %d, query id: %d expired\n\n", sweep.ID, sweep.QueryID)
+	default:
+		return true, nil
+	}
+
+	if err := m.persistor.setSweepState(ctx, sweep); err != nil {
+		return false, fmt.Errorf("check sweep: %d failed: %w", sweep.ID, err)
+	}
+	return false, nil
+}
+
+// isSweepEmitted looks for the sweep message among the bank transactions since the sweep was created
+func (m *Market) isSweepEmitted(ctx context.Context, sweep *Sweep) (bool, error) {
+	cold, err := ton.ParseAccountID(sweep.To)
+	if err != nil {
+		return false, err
+	}
+	scan, err := m.scanBankPayouts(ctx, sweep.CreatedAt.Add(-payoutScanSlack))
+	if err != nil {
+		return false, err
+	}
+	if _, ok := scan.txMap[newPayoutMsgKey(cold, sweep.Grams, sweepComment(sweep.ID), nil)]; ok {
+		return true, nil
+	}
+	if !scan.from.IsZero() && scan.from.After(sweep.CreatedAt.Add(-payoutScanSlack)) {
+		return false, ErrPayoutNotScanned
+	}
+	return false, nil
+}
+
+func sweepComment(id int64) string {
+	return "treasury sweep: " + strconv.FormatInt(id, 10)
+}
+
+// sweep records the sweep before sending, so every transfer to cold is in the db
+func (m *Market) sweep(ctx context.Context, cold ton.AccountID, amount, hot, required tlb.Grams) error {
+	sweep := &Sweep{
+		To:         cold.ToRaw(),
+		Grams:      amount,
+		HotBalance: hot,
+		Pending:    required,
+		State:      SweepSending,
+	}
+	if err := m.persistor.createSweep(ctx, sweep); err != nil {
+		return fmt.Errorf("sweep failed: %w", err)
+	}
+
+	chainBatch, sendErr := m.chain.Send(ctx, ChainTransfer{
+		To:         cold,
+		Amount:     amount,
+		Comment:    sweepComment(sweep.ID),
+		Bounceable: true,
+	})
+	if err := m.persistor.saveSweep(ctx, sweep, chainBatch, sendErr); err != nil {
+		return fmt.Errorf("sweep failed: %w", err)
+	}
+	if sendErr != nil {
+		return fmt.Errorf("sweep: %d failed: %w", sweep.ID, sendErr)
+	}
+
+	log.Printf("[INFO] sweep: %d of %s TON to cold sent, hot: %s TON, pending: %s TON\n\n", sweep.ID,
+		tonCurrency.Format(amount), tonCurrency.Format(hot), tonCurrency.Format(required))
+	return nil
+}
+
+type SweepDTO struct {
+	ID        int64      `json:"id"`
+	To        string     `json:"to"`
+	Amount    string     `json:"amount"`
+	HotBefore string     `json:"hotBefore"`
+	Pending   string     `json:"pending"`
+	State     SweepState `json:"state"`
+	MsgHash   string     `json:"msgHash"`
+	Error     string     `json:"error,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// TreasuryDTO hot wallet state, amounts in TON
+type TreasuryDTO struct {
+	HotAddress  string      `json:"hotAddress"`
+	ColdAddress string      `json:"coldAddress"`
+	HotBalance  string      `json:"hotBalance"`
+	Pending     string      `json:"pending"`
+	MinHot      string      `json:"minHot"`
+	MaxHot      string      `json:"maxHot"`
+	Covered     bool        `json:"covered"`
+	Sweeps      []*SweepDTO `json:"sweeps"`
+}
+
+// GetTreasury returns hot wallet balance against thresholds and last sweeps
+func (m *Market) GetTreasury(ctx context.Context) (*TreasuryDTO, error) {
+	limits, err := treasuryConfig()
+	if err != nil {
+		return nil, fmt.Errorf("market get treasury failed: %w", err)
+	}
+	hot, err := m.chain.Balance(ctx, m.chain.BankAddress())
+	if err != nil {
+		return nil, fmt.Errorf("market get treasury failed: %w", err)
+	}
+	required, err := m.hotRequired(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("market get treasury failed: %w", err)
+	}
+	sweepList, err := m.persistor.getSweeps(ctx, treasurySweepsLimit)
+	if err != nil {
+		return nil, fmt.Errorf("market get treasury failed: %w", err)
+	}
+
+	treasuryDto := &TreasuryDTO{
+		HotAddress: m.BankAddress(),
+		HotBalance: tonCurrency.Format(hot),
+		Pending:    tonCurrency.Format(required),
+		MinHot:     tonCurrency.Format(limits.minHot),
+		MaxHot:     tonCurrency.Format(limits.maxHot),
+		Covered:    hot >= required,
+		Sweeps:     make([]*SweepDTO, 0, len(sweepList)),
+	}
+	if limits.cold != nil {
+		treasuryDto.ColdAddress = limits.cold.ToHuman(true, utils.IsTestnet())
+	}
+	for _, s := range sweepList {
+		treasuryDto.Sweeps = append(treasuryDto.Sweeps, &SweepDTO{
+			ID:        s.ID,
+			To:        s.To,
+			Amount:    tonCurrency.Format(s.Grams),
+			HotBefore: tonCurrency.Format(s.HotBalance),
+			Pending:   tonCurrency.Format(s.Pending),
+			State:     s.State,
+			MsgHash:   s.MsgHash,
+			Error:     s.Error,
+			CreatedAt: s.CreatedAt,
+		})
+	}
+	return treasuryDto, nil
+}
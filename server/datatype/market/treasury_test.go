@@ -0,0 +1,135 @@
+package market
+
+import (
+	"context"
+	"errors"
+	"github.com/TON-Market/tma/server/config"
+	"github.com/tonkeeper/tongo/tlb"
+	"testing"
+)
+
+const (
+	testColdAddr   = "0:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"
+	testRefillAddr = "0:dddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddd"
+)
+
+func TestTreasuryIsRefill(t *testing.T) {
+	loadTestConfig(t)
+
+	tests := []struct {
+		name   string
+		cold   string
+		refill []string
+		sender string
+		want   bool
+	}{
+		{"cold", testColdAddr, nil, testColdAddr, true},
+		{"refill", testColdAddr, []string{testRefillAddr}, testRefillAddr, true},
+		{"refill without cold", "", []string{testRefillAddr}, testRefillAddr, true},
+		{"user", testColdAddr, []string{testRefillAddr}, testUserAddr, false},
+		{"nothing configured", "", nil, testColdAddr, false},
+		{"invalid sender", testColdAddr, nil, "cold", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.Treasury.ColdAddress = tt.cold
+			config.Config.Treasury.RefillAddresses = tt.refill
+
+			limits, err := treasuryConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := limits.isRefill(tt.sender); got != tt.want {
+				t.Fatalf("isRefill(%s) = %v, want %v", tt.sender, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTreasuryConfigInvalidRefill(t *testing.T) {
+	loadTestConfig(t)
+	config.Config.Treasury.RefillAddresses = []string{testRefillAddr, "refill"}
+
+	if _, err := treasuryConfig(); !errors.Is(err, ErrInvalidTreasury) {
+		t.Fatalf("err = %v, want %v", err, ErrInvalidTreasury)
+	}
+
+	config.Config.Treasury.RefillAddresses = []string{testBankAddr}
+	m := newTestMarket(t, newTestChain(t), nil)
+	if err := m.validateTreasuryConfig(); !errors.Is(err, ErrInvalidTreasury) {
+		t.Fatalf("err = %v, want %v", err, ErrInvalidTreasury)
+	}
+}
+
+// TestRefillTransferKept refills the hot wallet from cold and from an operator wallet with no deal in the comment,
+// both are kept while an unknown user transfer is refunded
+func TestRefillTransferKept(t *testing.T) {
+	loadTestConfig(t)
+	config.Config.Treasury.ColdAddress = testColdAddr
+	config.Config.Treasury.RefillAddresses = []string{testRefillAddr}
+	pool := testPool(t)
+	chain := newTestChain(t)
+	m := newTestMarket(t, chain, pool)
+	ctx := context.Background()
+
+	senderList := []string{testColdAddr, testRefillAddr, testUserAddr}
+	for _, addr := range senderList {
+		id := mustAccountID(t, addr)
+		chain.Fund(id, testWalletFunds)
+		if _, err := chain.Transfer(id, chain.BankAddress(), 50e9, "refill"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := m.indexBankTransactions(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.matchBankTransfers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.refundOrphanTransfers(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]TransferStatus{
+		testColdAddr:   TransferKept,
+		testRefillAddr: TransferKept,
+		testUserAddr:   TransferRefunded,
+	}
+	rows, err := pool.Query(ctx, `SELECT sender, status FROM bank_transfers`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	got := make(map[string]TransferStatus)
+	for rows.Next() {
+		var sender string
+		var status TransferStatus
+		if err := rows.Scan(&sender, &status); err != nil {
+			t.Fatal(err)
+		}
+		got[sender] = status
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("transfers = %v, want %v", got, want)
+	}
+	for sender, status := range want {
+		if got[sender] != status {
+			t.Fatalf("transfer from: %s status = %d, want %d", sender, got[sender], status)
+		}
+	}
+
+	var refunds int
+	var refunded tlb.Grams
+	q := `SELECT count(*), coalesce(sum(grams), 0) FROM payouts WHERE user_raw_addr <> $1`
+	if err := pool.QueryRow(ctx, q, testUserAddr).Scan(&refunds, &refunded); err != nil {
+		t.Fatal(err)
+	}
+	if refunds != 0 {
+		t.Fatalf("refill refunds = %d, amount: %d, want none", refunds, refunded)
+	}
+}
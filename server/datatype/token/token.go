@@ -1,7 +1,17 @@
 package token
 
+import (
+	"errors"
+	"fmt"
+)
+
 const Collateral = "Collateral"
 
+// MaxCount number of outcome tokens, TokenA to TokenZ
+const MaxCount = 'Z' - 'A' + 1
+
+var ErrIndexOutOfRange = errors.New("token index out of range")
+
 type Token string
 
 const (
@@ -9,9 +19,10 @@ const (
 	B Token = "TokenB"
 )
 
-func (t Token) Complement() Token {
-	if t == A {
-		return B
+// FromIndex returns token of the i-th event outcome: 0 -> TokenA, 1 -> TokenB, ...
+func FromIndex(i int) (Token, error) {
+	if i < 0 || i >= MaxCount {
+		return "", fmt.Errorf("%w: %d of %d", ErrIndexOutOfRange, i, MaxCount)
 	}
-	return A
+	return Token(fmt.Sprintf("Token%c", 'A'+i)), nil
 }
@@ -0,0 +1,30 @@
+package token
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFromIndex(t *testing.T) {
+	tests := []struct {
+		i    int
+		want Token
+		err  error
+	}{
+		{0, A, nil},
+		{1, B, nil},
+		{MaxCount - 1, "TokenZ", nil},
+		{MaxCount, "", ErrIndexOutOfRange},
+		{-1, "", ErrIndexOutOfRange},
+	}
+
+	for _, tt := range tests {
+		got, err := FromIndex(tt.i)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("FromIndex(%d) error = %v, want %v", tt.i, err, tt.err)
+		}
+		if got != tt.want {
+			t.Errorf("FromIndex(%d) = %s, want %s", tt.i, got, tt.want)
+		}
+	}
+}
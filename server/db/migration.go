@@ -30,7 +30,267 @@ create table if not exists deals
             references users
             on delete cascade,
     deal_status   integer default 0 not null,
-	attempts integer default 0
+	attempts integer default 0,
+    received        bigint  default 0 not null,
+    refunded        bigint  default 0 not null,
+    deposit_outcome integer default 0 not null
+);
+
+-- columns added after the table was first released, create table doesn't add them to existing databases
+alter table deals add column if not exists received bigint default 0 not null;
+alter table deals add column if not exists refunded bigint default 0 not null;
+alter table deals add column if not exists deposit_outcome integer default 0 not null;
+
+create table if not exists deposit_jobs
+(
+    deal_id         uuid                                   not null
+        primary key
+        references deals
+            on delete cascade,
+    attempts        integer                  default 0     not null,
+    next_attempt_at timestamp with time zone default now() not null,
+    done            boolean                  default false not null,
+    last_error      text                     default ''    not null,
+    created_at      timestamp with time zone default now() not null
+);
+
+create index if not exists deposit_jobs_next_attempt_at_idx
+    on deposit_jobs (next_attempt_at)
+    where not done;
+
+create table if not exists orders
+(
+    id            uuid                                   not null
+        primary key,
+    event_id      uuid                                   not null,
+    token         varchar(10)                            not null,
+    user_raw_addr varchar(255)                           not null,
+    side          varchar(10)                            not null,
+    price         double precision                       not null,
+    size          bigint                                 not null,
+    filled        bigint                   default 0     not null,
+    locked        bigint                   default 0     not null,
+    escrow        bigint                   default 0     not null,
+    deal_id       uuid
+        references deals,
+    state         integer                  default 0     not null,
+    created_at    timestamp with time zone default now() not null
+);
+
+create index if not exists orders_book_idx
+    on orders (event_id, token, side, price)
+    where state = 1;
+
+create index if not exists orders_deal_id_idx
+    on orders (deal_id);
+
+create table if not exists order_fills
+(
+    id            bigserial
+        primary key,
+    event_id      uuid                                   not null,
+    token         varchar(10)                            not null,
+    buy_order_id  uuid                                   not null
+        references orders,
+    sell_order_id uuid                                   not null
+        references orders,
+    price         double precision                       not null,
+    size          bigint                                 not null,
+    grams         bigint                                 not null,
+    created_at    timestamp with time zone default now() not null
+);
+
+create table if not exists bank_transfers
+(
+    lt               bigint                                 not null
+        primary key,
+    hash             varchar(64)                            not null,
+    sender           varchar(255)                           not null,
+    grams            bigint                                 not null,
+    jetton           varchar(255)             default ''    not null,
+    comment          text                     default ''    not null,
+    deal_id          uuid,
+    status           integer                  default 0     not null,
+    reason           text                     default ''    not null,
+    tx_time          timestamp with time zone               not null,
+    refund_payout_id uuid,
+    created_at       timestamp with time zone default now() not null
+);
+
+alter table bank_transfers add column if not exists refund_payout_id uuid;
+alter table bank_transfers add column if not exists jetton varchar(255) default '' not null;
+
+create index if not exists bank_transfers_deal_id_idx
+    on bank_transfers (deal_id);
+
+create index if not exists bank_transfers_status_idx
+    on bank_transfers (status)
+    where status in (0, 2);
+
+create table if not exists indexer_state
+(
+    name       varchar(50)                            not null
+        primary key,
+    last_lt    bigint                                 not null,
+    updated_at timestamp with time zone default now() not null
+);
+
+create table if not exists payout_batches
+(
+    id          bigserial
+        primary key,
+    query_id    bigint                   default 0     not null,
+    msg_hash    varchar(64)              default ''    not null,
+    state       integer                  default 0     not null,
+    size        integer                                not null,
+    valid_until timestamp with time zone,
+    error       text                     default ''    not null,
+    created_at  timestamp with time zone default now() not null
+);
+
+create table if not exists payouts
+(
+    id            uuid                                   not null
+        primary key,
+    event_id      uuid                                   not null,
+    user_raw_addr varchar(255)                           not null,
+    kind          integer                  default 0     not null,
+    grams         bigint                                 not null,
+    jetton        varchar(255)             default ''    not null,
+    fee           bigint                   default 0     not null,
+    comment       text                                   not null,
+    state         integer                  default 0     not null,
+    attempts      integer                  default 0     not null,
+    tx_hash       varchar(64)              default ''    not null,
+    tx_lt         bigint                   default 0     not null,
+    batch_id      bigint
+        references payout_batches,
+    last_try      timestamp with time zone,
+    locked_until  timestamp with time zone default now() not null,
+    created_at    timestamp with time zone default now() not null,
+    unique (user_raw_addr, comment)
+);
+
+alter table payouts add column if not exists kind integer default 0 not null;
+alter table payouts add column if not exists fee bigint default 0 not null;
+alter table payouts add column if not exists jetton varchar(255) default '' not null;
+alter table payouts add column if not exists batch_id bigint references payout_batches;
+
+create index if not exists payouts_state_idx
+    on payouts (state)
+    where state < 2;
+
+create table if not exists payout_attempts
+(
+    id         bigserial
+        primary key,
+    payout_id  uuid                                   not null
+        references payouts
+            on delete cascade,
+    state      integer                                not null,
+    msg_hash   varchar(64)              default ''    not null,
+    error      text                     default ''    not null,
+    created_at timestamp with time zone default now() not null
+);
+
+create table if not exists treasury_sweeps
+(
+    id          bigserial
+        primary key,
+    to_addr     varchar(255)                           not null,
+    grams       bigint                                 not null,
+    hot_balance bigint                                 not null,
+    pending     bigint                                 not null,
+    state       integer                  default 0     not null,
+    query_id    bigint                   default 0     not null,
+    msg_hash    varchar(64)              default ''    not null,
+    valid_until timestamp with time zone,
+    error       text                     default ''    not null,
+    created_at  timestamp with time zone default now() not null
+);
+
+create table if not exists events
+(
+    id          uuid                                   not null
+        primary key,
+    tag         integer                                not null,
+    logo_link   text                     default ''    not null,
+    title       text                                   not null,
+    status      integer                  default 0     not null,
+    win_token   varchar(255)             default ''    not null,
+    opens_at    timestamp with time zone,
+    locks_at    timestamp with time zone,
+    resolves_at timestamp with time zone,
+    resolver    jsonb,
+    fee_policy  jsonb,
+    jetton      varchar(255)             default ''    not null,
+    pricing     jsonb,
+    outcome_cap double precision         default 0     not null,
+    created_at  timestamp with time zone default now() not null
+);
+
+alter table events add column if not exists status integer default 0 not null;
+alter table events add column if not exists opens_at timestamp with time zone;
+alter table events add column if not exists locks_at timestamp with time zone;
+alter table events add column if not exists resolves_at timestamp with time zone;
+alter table events add column if not exists resolver jsonb;
+alter table events add column if not exists fee_policy jsonb;
+alter table events add column if not exists jetton varchar(255) default '' not null;
+alter table events add column if not exists pricing jsonb;
+alter table events add column if not exists outcome_cap double precision default 0 not null;
+alter table events add column if not exists win_token varchar(255) default '' not null;
+
+create table if not exists fee_policies
+(
+    tag        integer                                not null
+        primary key,
+    policy     jsonb                                  not null,
+    updated_at timestamp with time zone default now() not null
+);
+
+create table if not exists event_fees
+(
+    event_id   uuid                                   not null
+        primary key
+        references events
+            on delete cascade,
+    kind       integer                                not null,
+    policy     jsonb,
+    grams      bigint                                 not null,
+    jetton     varchar(255)             default ''    not null,
+    win_pool   bigint                   default 0     not null,
+    lose_pool  bigint                   default 0     not null,
+    created_at timestamp with time zone default now() not null
+);
+
+alter table event_fees add column if not exists jetton varchar(255) default '' not null;
+
+create index if not exists event_fees_created_at_idx
+    on event_fees (created_at);
+
+create table if not exists resolutions
+(
+    id         bigserial
+        primary key,
+    event_id   uuid                                   not null
+        references events
+            on delete cascade,
+    kind       varchar(50)                            not null,
+    token      varchar(10)              default ''    not null,
+    evidence   jsonb,
+    error      text                     default ''    not null,
+    created_at timestamp with time zone default now() not null
+);
+
+create table if not exists bets
+(
+    event_id  uuid                  not null
+        references events
+            on delete cascade,
+    token     varchar(10)           not null,
+    title     text                  not null,
+    logo_link text     default ''   not null,
+    primary key (event_id, token)
 );
 
 create table if not exists user_deals
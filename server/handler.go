@@ -25,13 +25,14 @@ type jwtCustomClaims struct {
 	jwt.StandardClaims
 }
 
+// handler serves the configured network only, tonConnect checks proofs of it
 type handler struct {
-	tonConnectMainNet *tonconnect.Server
+	tonConnect *tonconnect.Server
 }
 
-func newHandler(tonConnectMainNet *tonconnect.Server) *handler {
+func newHandler(tonConnect *tonconnect.Server) *handler {
 	h := handler{
-		tonConnectMainNet: tonConnectMainNet,
+		tonConnect: tonConnect,
 	}
 	return &h
 }
@@ -49,7 +50,10 @@ func (h *handler) ProofHandler(c echo.Context) error {
 		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
 	}
 
-	tonConnect := h.tonConnectMainNet
+	net, ok := networks[tp.Network]
+	if !ok {
+		return c.JSON(HttpResErrorWithLog(fmt.Sprintf("network: %s is not supported", tp.Network), http.StatusBadRequest, lg))
+	}
 
 	proof := tonconnect.Proof{
 		Address: tp.Address,
@@ -61,8 +65,8 @@ func (h *handler) ProofHandler(c echo.Context) error {
 			StateInit: tp.Proof.StateInit,
 		},
 	}
-	verified, _, err := tonConnect.CheckProof(context.Background(), &proof,
-		h.tonConnectMainNet.CheckPayload, func(string) (bool, error) {
+	verified, _, err := h.tonConnect.CheckProof(context.Background(), &proof,
+		h.tonConnect.CheckPayload, func(string) (bool, error) {
 			return true, nil
 		})
 	if err != nil || !verified {
@@ -80,14 +84,14 @@ func (h *handler) ProofHandler(c echo.Context) error {
 	}
 
 	jwtTkn := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signedToken, err := jwtTkn.SignedString([]byte(h.tonConnectMainNet.GetSecret()))
+	signedToken, err := jwtTkn.SignedString([]byte(h.tonConnect.GetSecret()))
 	if err != nil {
 		return err
 	}
 
 	ctx := context.TODO()
 
-	info, err := getAccountInfo(ctx, tp.Address, networks["-239"])
+	info, err := getAccountInfo(ctx, tp.Address, net)
 	if err != nil {
 		return c.JSON(HttpResErrorWithLog(fmt.Errorf("get account info failed: %s", err.Error()).Error(), http.StatusInternalServerError, lg))
 	}
@@ -124,7 +128,7 @@ func (h *handler) ProofHandler(c echo.Context) error {
 func (h *handler) PayloadHandler(c echo.Context) error {
 	lg := log.WithContext(c.Request().Context()).WithField("prefix", "PayloadHandler")
 
-	payload, err := h.tonConnectMainNet.GeneratePayload()
+	payload, err := h.tonConnect.GeneratePayload()
 	if err != nil {
 		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
 	}
@@ -152,7 +156,7 @@ func (h *handler) Disconnect(c echo.Context) error {
 func (h *handler) validateUser(auth string, c echo.Context) (bool, error) {
 	lg := log.WithContext(context.Background()).WithField("prefix", "auth request")
 	jwtTkn, err := jwt.ParseWithClaims(auth, &jwtCustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(h.tonConnectMainNet.GetSecret()), nil
+		return []byte(h.tonConnect.GetSecret()), nil
 	})
 	if err != nil {
 		return false, c.JSON(HttpResErrorWithLog("jwtTkn has expired", http.StatusUnauthorized, lg))
@@ -239,8 +243,10 @@ func (h *handler) GetTags(c echo.Context) error {
 }
 
 type GetAssetsResp struct {
-	AssetList     []*market.AssetDTO `json:"assetList"`
-	TotalInMarket string             `json:"totalInMarket"`
+	AssetList []*market.AssetDTO `json:"assetList"`
+	// TotalInMarket total staked in TON, Totals total staked by currency
+	TotalInMarket string            `json:"totalInMarket"`
+	Totals        map[string]string `json:"totals"`
 }
 
 func (h *handler) GetAssets(c echo.Context) error {
@@ -249,14 +255,15 @@ func (h *handler) GetAssets(c echo.Context) error {
 
 	addr := c.Get("address").(string)
 
-	assetDtoList, totalInMarket, err := market.GetMarket().GetUserAssets(ctx, addr)
+	assetDtoList, totalMap, err := market.GetMarket().GetUserAssets(ctx, addr)
 	if err != nil {
 		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusInternalServerError, lg))
 	}
 
 	resp := &GetAssetsResp{
 		AssetList:     assetDtoList,
-		TotalInMarket: totalInMarket,
+		TotalInMarket: totalMap["TON"],
+		Totals:        totalMap,
 	}
 
 	return c.JSON(http.StatusOK, resp)
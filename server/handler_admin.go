@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TON-Market/tma/server/config"
+	"github.com/TON-Market/tma/server/datatype/market"
+	"github.com/TON-Market/tma/server/datatype/token"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// validateAdmin accepts any of the configured admin keys, so keys can be rotated by config
+func (h *handler) validateAdmin(key string, _ echo.Context) (bool, error) {
+	ok := false
+	for _, adminKey := range config.Config.Secret.AdminKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) == 1 {
+			ok = true
+		}
+	}
+	return ok, nil
+}
+
+func adminErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, market.ErrEventNotExist), errors.Is(err, market.ErrFeeNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, market.ErrInvalidOutcomes), errors.Is(err, market.ErrUnknownOutcome),
+		errors.Is(err, market.ErrInvalidSchedule), errors.Is(err, market.ErrUnknownResolver),
+		errors.Is(err, market.ErrInvalidResolver), errors.Is(err, market.ErrInvalidFeePolicy),
+		errors.Is(err, market.ErrInvalidFeePeriod), errors.Is(err, market.ErrUnknownCurrency),
+		errors.Is(err, market.ErrInvalidPricing), errors.Is(err, market.ErrInvalidOutcomeCap):
+		return http.StatusBadRequest
+	case errors.Is(err, market.ErrEventNotActive), errors.Is(err, market.ErrEventNotSuspended),
+		errors.Is(err, market.ErrEventFinished), errors.Is(err, market.ErrEventStatusConflict),
+		errors.Is(err, market.ErrEventClosing):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type CreateBetReq struct {
+	Title    string `json:"title"`
+	LogoLink string `json:"logoLink"`
+}
+
+type CreateEventReq struct {
+	Tag        market.Tag           `json:"tag"`
+	LogoLink   string               `json:"logoLink"`
+	Title      string               `json:"title"`
+	Bets       []*CreateBetReq      `json:"bets"`
+	OpensAt    time.Time            `json:"opensAt"`
+	LocksAt    time.Time            `json:"locksAt"`
+	ResolvesAt time.Time            `json:"resolvesAt"`
+	Resolver   *market.ResolverSpec `json:"resolver"`
+	FeePolicy  *market.FeePolicy    `json:"feePolicy"`
+	// Jetton master address of the collateral, empty for TON
+	Jetton string `json:"jetton"`
+	// Pricing optional, parimutuel if not set
+	Pricing *market.PricingSpec `json:"pricing"`
+	// OutcomeCap max collateral of each outcome pool, 0 means no cap
+	OutcomeCap float64 `json:"outcomeCap"`
+}
+
+func (h *handler) CreateEvent(c echo.Context) error {
+	ctx := context.TODO()
+	lg := log.WithContext(ctx).WithField("prefix", "CreateEvent")
+
+	b, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+
+	var createEventReq CreateEventReq
+	if err := json.Unmarshal(b, &createEventReq); err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+
+	if createEventReq.Title == "" {
+		return c.JSON(HttpResErrorWithLog("title is empty", http.StatusBadRequest, lg))
+	}
+
+	e := &market.Event{
+		Tag:        createEventReq.Tag,
+		LogoLink:   createEventReq.LogoLink,
+		Title:      createEventReq.Title,
+		BetMap:     make(map[token.Token]*market.Bet, len(createEventReq.Bets)),
+		OpensAt:    createEventReq.OpensAt,
+		LocksAt:    createEventReq.LocksAt,
+		ResolvesAt: createEventReq.ResolvesAt,
+		Resolver:   createEventReq.Resolver,
+		FeePolicy:  createEventReq.FeePolicy,
+		Jetton:     createEventReq.Jetton,
+		Pricing:    createEventReq.Pricing,
+		OutcomeCap: createEventReq.OutcomeCap,
+	}
+
+	if len(createEventReq.Bets) > market.MaxOutcomes {
+		return c.JSON(HttpResErrorWithLog(fmt.Sprintf("expected at most %d bets, got %d", market.MaxOutcomes,
+			len(createEventReq.Bets)), http.StatusBadRequest, lg))
+	}
+
+	for i, bet := range createEventReq.Bets {
+		t, err := token.FromIndex(i)
+		if err != nil {
+			return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+		}
+		e.BetMap[t] = &market.Bet{
+			Token:    t,
+			Title:    bet.Title,
+			LogoLink: bet.LogoLink,
+		}
+	}
+
+	if err := market.GetMarket().AddEvent(ctx, e); err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), adminErrorStatus(err), lg))
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"id": e.ID.String(),
+	})
+}
+
+type UpdateBetReq struct {
+	Token    token.Token `json:"token"`
+	Title    *string     `json:"title"`
+	LogoLink *string     `json:"logoLink"`
+}
+
+type UpdateEventReq struct {
+	Tag        *market.Tag          `json:"tag"`
+	LogoLink   *string              `json:"logoLink"`
+	Title      *string              `json:"title"`
+	Bets       []*UpdateBetReq      `json:"bets"`
+	OpensAt    *time.Time           `json:"opensAt"`
+	LocksAt    *time.Time           `json:"locksAt"`
+	ResolvesAt *time.Time           `json:"resolvesAt"`
+	Resolver   *market.ResolverSpec `json:"resolver"`
+	FeePolicy  *market.FeePolicy    `json:"feePolicy"`
+	OutcomeCap *float64             `json:"outcomeCap"`
+}
+
+func (h *handler) UpdateEvent(c echo.Context) error {
+	ctx := context.TODO()
+	lg := log.WithContext(ctx).WithField("prefix", "UpdateEvent")
+
+	eventId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+
+	b, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+
+	var updateEventReq UpdateEventReq
+	if err := json.Unmarshal(b, &updateEventReq); err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+
+	if updateEventReq.Title != nil && *updateEventReq.Title == "" {
+		return c.JSON(HttpResErrorWithLog("title is empty", http.StatusBadRequest, lg))
+	}
+
+	patch := &market.EventPatch{
+		Tag:        updateEventReq.Tag,
+		LogoLink:   updateEventReq.LogoLink,
+		Title:      updateEventReq.Title,
+		BetMap:     make(map[token.Token]*market.BetPatch, len(updateEventReq.Bets)),
+		OpensAt:    updateEventReq.OpensAt,
+		LocksAt:    updateEventReq.LocksAt,
+		ResolvesAt: updateEventReq.ResolvesAt,
+		Resolver:   updateEventReq.Resolver,
+		FeePolicy:  updateEventReq.FeePolicy,
+		OutcomeCap: updateEventReq.OutcomeCap,
+	}
+
+	for _, bet := range updateEventReq.Bets {
+		patch.BetMap[bet.Token] = &market.BetPatch{
+			Title:    bet.Title,
+			LogoLink: bet.LogoLink,
+		}
+	}
+
+	if err := market.GetMarket().UpdateEvent(ctx, eventId, patch); err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), adminErrorStatus(err), lg))
+	}
+
+	return c.JSON(http.StatusOK, HttpResOk())
+}
+
+func (h *handler) SuspendEvent(c echo.Context) error {
+	ctx := context.TODO()
+	lg := log.WithContext(ctx).WithField("prefix", "SuspendEvent")
+
+	eventId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+
+	if err := market.GetMarket().SuspendEvent(ctx, eventId); err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), adminErrorStatus(err), lg))
+	}
+
+	return c.JSON(http.StatusOK, HttpResOk())
+}
+
+func (h *handler) ResumeEvent(c echo.Context) error {
+	ctx := context.TODO()
+	lg := log.WithContext(ctx).WithField("prefix", "ResumeEvent")
+
+	eventId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+
+	if err := market.GetMarket().ResumeEvent(ctx, eventId); err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), adminErrorStatus(err), lg))
+	}
+
+	return c.JSON(http.StatusOK, HttpResOk())
+}
+
+type ResolveEventReq struct {
+	Token token.Token `json:"token"`
+}
+
+func (h *handler) ResolveEvent(c echo.Context) error {
+	ctx := context.TODO()
+	lg := log.WithContext(ctx).WithField("prefix", "ResolveEvent")
+
+	eventId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+
+	b, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+
+	var resolveEventReq ResolveEventReq
+	if err := json.Unmarshal(b, &resolveEventReq); err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+
+	if err := market.GetMarket().CloseEvent(ctx, eventId, resolveEventReq.Token); err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), adminErrorStatus(err), lg))
+	}
+
+	return c.JSON(http.StatusOK, HttpResOk())
+}
+
+func (h *handler) VoidEvent(c echo.Context) error {
+	ctx := context.TODO()
+	lg := log.WithContext(ctx).WithField("prefix", "VoidEvent")
+
+	eventId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+
+	if err := market.GetMarket().VoidEvent(ctx, eventId); err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), adminErrorStatus(err), lg))
+	}
+
+	return c.JSON(http.StatusOK, HttpResOk())
+}
+
+const (
+	orphanTransfersDefaultLimit = 50
+	orphanTransfersMaxLimit     = 500
+)
+
+func (h *handler) GetOrphanTransfers(c echo.Context) error {
+	ctx := context.TODO()
+	lg := log.WithContext(ctx).WithField("prefix", "GetOrphanTransfers")
+
+	limit := orphanTransfersDefaultLimit
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 || l > orphanTransfersMaxLimit {
+			return c.JSON(HttpResErrorWithLog("bad limit", http.StatusBadRequest, lg))
+		}
+		limit = l
+	}
+
+	offset := 0
+	if v := c.QueryParam("offset"); v != "" {
+		o, err := strconv.Atoi(v)
+		if err != nil || o < 0 {
+			return c.JSON(HttpResErrorWithLog("bad offset", http.StatusBadRequest, lg))
+		}
+		offset = o
+	}
+
+	orphanList, err := market.GetMarket().GetOrphanTransfers(ctx, limit, offset)
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusInternalServerError, lg))
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"transfers": orphanList,
+	})
+}
+
+func (h *handler) GetTreasury(c echo.Context) error {
+	ctx := context.TODO()
+	lg := log.WithContext(ctx).WithField("prefix", "GetTreasury")
+
+	treasuryDto, err := market.GetMarket().GetTreasury(ctx)
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusInternalServerError, lg))
+	}
+
+	return c.JSON(http.StatusOK, treasuryDto)
+}
+
+func (h *handler) GetSolvencyReport(c echo.Context) error {
+	ctx := context.TODO()
+	lg := log.WithContext(ctx).WithField("prefix", "GetSolvencyReport")
+
+	report, err := market.GetMarket().GetSolvencyReport(ctx)
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusInternalServerError, lg))
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/TON-Market/tma/server/datatype/market"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func (h *handler) SetTagFeePolicy(c echo.Context) error {
+	ctx := context.TODO()
+	lg := log.WithContext(ctx).WithField("prefix", "SetTagFeePolicy")
+
+	tag, err := strconv.Atoi(c.Param("tag"))
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+
+	b, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+
+	var policy market.FeePolicy
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+
+	if err := market.GetMarket().SetTagFeePolicy(ctx, market.Tag(tag), &policy); err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), adminErrorStatus(err), lg))
+	}
+
+	return c.JSON(http.StatusOK, HttpResOk())
+}
+
+func (h *handler) GetEventFee(c echo.Context) error {
+	ctx := context.TODO()
+	lg := log.WithContext(ctx).WithField("prefix", "GetEventFee")
+
+	eventId, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+
+	fee, err := market.GetMarket().GetEventFee(ctx, eventId)
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), adminErrorStatus(err), lg))
+	}
+
+	return c.JSON(http.StatusOK, fee)
+}
+
+// GetFeeReport reports fee revenue, from and to are RFC 3339 times, last 30 days by default
+func (h *handler) GetFeeReport(c echo.Context) error {
+	ctx := context.TODO()
+	lg := log.WithContext(ctx).WithField("prefix", "GetFeeReport")
+
+	to := time.Now()
+	if v := c.QueryParam("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+		}
+		to = t
+	}
+
+	from := to.AddDate(0, 0, -30)
+	if v := c.QueryParam("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+		}
+		from = t
+	}
+
+	period := c.QueryParam("period")
+	if period == "" {
+		period = "day"
+	}
+
+	feePeriodList, total, err := market.GetMarket().GetFeeReport(ctx, from, to, period)
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), adminErrorStatus(err), lg))
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"from":    from,
+		"to":      to,
+		"period":  period,
+		"total":   total,
+		"periods": feePeriodList,
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/TON-Market/tma/server/datatype/market"
+	"github.com/TON-Market/tma/server/datatype/token"
+	"github.com/TON-Market/tma/server/utils"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+)
+
+type PlaceOrderReq struct {
+	EventID string           `json:"eventID"`
+	Token   token.Token      `json:"token"`
+	Side    market.OrderSide `json:"side"`
+	// Price collateral per unit of size
+	Price float64 `json:"price"`
+	// Size in units of the event collateral
+	Size float64 `json:"size"`
+}
+
+// PlaceOrderResp Message and DepositID are set for buy order, the order is funded like a stake by Pay
+type PlaceOrderResp struct {
+	OrderID   string   `json:"orderID"`
+	Message   *Message `json:"message,omitempty"`
+	DepositID string   `json:"depositID,omitempty"`
+}
+
+func orderErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, market.ErrOrderNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, market.ErrInvalidOrder), errors.Is(err, market.ErrUnknownOutcome),
+		errors.Is(err, market.ErrEventClosed), errors.Is(err, market.ErrRuntimeEventNotExist),
+		errors.Is(err, market.ErrEventNotExist), errors.Is(err, market.ErrBettingNotOpen),
+		errors.Is(err, market.ErrBettingLocked), errors.Is(err, market.ErrNoPosition),
+		errors.Is(err, market.ErrInsufficientPosition):
+		return http.StatusBadRequest
+	case errors.Is(err, market.ErrOrderNotOpen):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (h *handler) PlaceOrder(c echo.Context) error {
+	ctx := context.TODO()
+	lg := log.WithContext(ctx).WithField("prefix", "PlaceOrder")
+
+	addr := c.Get("address").(string)
+	if addr == "" {
+		return c.JSON(HttpResErrorWithLog("address is empty", http.StatusUnauthorized, lg))
+	}
+
+	b, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+
+	var placeOrderReq PlaceOrderReq
+	if err := json.Unmarshal(b, &placeOrderReq); err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+	if placeOrderReq.Size <= 0 {
+		return c.JSON(HttpResErrorWithLog("incorrect size passed", http.StatusBadRequest, lg))
+	}
+
+	eventId, err := uuid.Parse(placeOrderReq.EventID)
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+	currency, err := market.GetMarket().EventCurrency(ctx, eventId)
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), orderErrorStatus(err), lg))
+	}
+
+	o := &market.Order{
+		EventID:     eventId,
+		UserRawAddr: addr,
+		Token:       placeOrderReq.Token,
+		Side:        placeOrderReq.Side,
+		Price:       placeOrderReq.Price,
+		Size:        currency.FromFloat(placeOrderReq.Size),
+	}
+	payment, err := market.GetMarket().PlaceOrder(ctx, o)
+	if err != nil {
+		if code := stakeLimitCode(err); code != "" {
+			return c.JSON(HttpResErrorWithCode(err.Error(), http.StatusBadRequest, code, lg))
+		}
+		return c.JSON(HttpResErrorWithLog(err.Error(), orderErrorStatus(err), lg))
+	}
+
+	placeOrderResp := &PlaceOrderResp{OrderID: o.ID.String()}
+	if payment != nil {
+		payload, err := payment.Payload.ToBoc()
+		if err != nil {
+			return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusInternalServerError, lg))
+		}
+		placeOrderResp.Message = &Message{
+			Addr:    payment.Address,
+			Amount:  utils.GramsToString(payment.Amount),
+			Payload: payload,
+		}
+		placeOrderResp.DepositID = o.DealID.String()
+	}
+
+	return c.JSON(http.StatusOK, placeOrderResp)
+}
+
+func (h *handler) CancelOrder(c echo.Context) error {
+	ctx := context.TODO()
+	lg := log.WithContext(ctx).WithField("prefix", "CancelOrder")
+
+	addr := c.Get("address").(string)
+	if addr == "" {
+		return c.JSON(HttpResErrorWithLog("address is empty", http.StatusUnauthorized, lg))
+	}
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+
+	if err := market.GetMarket().CancelOrder(ctx, addr, id); err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), orderErrorStatus(err), lg))
+	}
+
+	return c.JSON(http.StatusOK, HttpResOk())
+}
+
+func (h *handler) GetOrders(c echo.Context) error {
+	ctx := context.TODO()
+	lg := log.WithContext(ctx).WithField("prefix", "GetOrders")
+
+	addr := c.Get("address").(string)
+	if addr == "" {
+		return c.JSON(HttpResErrorWithLog("address is empty", http.StatusUnauthorized, lg))
+	}
+
+	orderList, err := market.GetMarket().GetUserOrders(ctx, addr)
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusInternalServerError, lg))
+	}
+
+	return c.JSON(http.StatusOK, orderList)
+}
+
+func (h *handler) GetOrderBook(c echo.Context) error {
+	ctx := context.TODO()
+	lg := log.WithContext(ctx).WithField("prefix", "GetOrderBook")
+
+	eventId, err := uuid.Parse(c.QueryParam("eventID"))
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog("incorrect eventID passed", http.StatusBadRequest, lg))
+	}
+
+	book, err := market.GetMarket().GetOrderBook(ctx, eventId, token.Token(c.QueryParam("token")))
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), orderErrorStatus(err), lg))
+	}
+
+	return c.JSON(http.StatusOK, book)
+}
@@ -3,17 +3,17 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"github.com/TON-Market/tma/server/datatype/market"
 	"github.com/TON-Market/tma/server/datatype/token"
 	"github.com/TON-Market/tma/server/utils"
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	log "github.com/sirupsen/logrus"
-	"github.com/tonkeeper/tongo/boc"
-	"github.com/tonkeeper/tongo/tlb"
-	"github.com/tonkeeper/tongo/wallet"
 	"io"
+	"math"
 	"net/http"
+	"strconv"
 )
 
 type Message struct {
@@ -27,6 +27,22 @@ type PayResp struct {
 	DepositID string   `json:"depositID"`
 }
 
+// stakeLimitCode returns error code of the broken stake limit, empty if err is not a limit error
+func stakeLimitCode(err error) string {
+	switch {
+	case errors.Is(err, market.ErrStakeTooSmall):
+		return "stake_too_small"
+	case errors.Is(err, market.ErrStakeTooLarge):
+		return "stake_too_large"
+	case errors.Is(err, market.ErrExposureLimit):
+		return "exposure_limit"
+	case errors.Is(err, market.ErrOutcomeCapReached):
+		return "outcome_cap_reached"
+	default:
+		return ""
+	}
+}
+
 type PayReq struct {
 	EventID    string      `json:"eventID"`
 	Collateral float64     `json:"collateral"`
@@ -54,12 +70,24 @@ func (h *handler) Pay(c echo.Context) error {
 		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
 	}
 
+	// negative and infinite collateral can't be converted to grams
+	if !(payReq.Collateral > 0) || math.IsInf(payReq.Collateral, 0) {
+		return c.JSON(HttpResErrorWithCode("incorrect collateral passed", http.StatusBadRequest, "invalid_stake", lg))
+	}
+
 	dealId := uuid.New()
 	eventId, err := uuid.Parse(payReq.EventID)
 	if err != nil {
 		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
 	}
-	grams := utils.FloatToGrams(payReq.Collateral)
+	currency, err := market.GetMarket().EventCurrency(ctx, eventId)
+	if err != nil {
+		if errors.Is(err, market.ErrEventNotExist) {
+			return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+		}
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusInternalServerError, lg))
+	}
+	grams := currency.FromFloat(payReq.Collateral)
 
 	d := &market.Deal{
 		ID:          dealId,
@@ -71,25 +99,31 @@ func (h *handler) Pay(c echo.Context) error {
 	}
 
 	if err := market.GetMarket().SaveDealUnchecked(ctx, d); err != nil {
+		if code := stakeLimitCode(err); code != "" {
+			return c.JSON(HttpResErrorWithCode(err.Error(), http.StatusBadRequest, code, lg))
+		}
+		if errors.Is(err, market.ErrUnknownOutcome) || errors.Is(err, market.ErrEventClosed) ||
+			errors.Is(err, market.ErrRuntimeEventNotExist) || errors.Is(err, market.ErrEventNotExist) ||
+			errors.Is(err, market.ErrBettingNotOpen) || errors.Is(err, market.ErrBettingLocked) {
+			return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+		}
 		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusInternalServerError, lg))
 	}
 
-	body := boc.NewCell()
-	if err := tlb.Marshal(body, wallet.TextComment(dealId.String())); err != nil {
+	payment, err := market.GetMarket().BuildPayment(ctx, d)
+	if err != nil {
 		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusInternalServerError, lg))
 	}
 
-	payload, err := body.ToBoc()
+	payload, err := payment.Payload.ToBoc()
 	if err != nil {
 		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusInternalServerError, lg))
 	}
 
-	gramsStr := utils.GramsToString(grams)
-
 	payResp := &PayResp{
 		Message: &Message{
-			Addr:    market.BANK_ADDR,
-			Amount:  gramsStr,
+			Addr:    payment.Address,
+			Amount:  utils.GramsToString(payment.Amount),
 			Payload: payload,
 		},
 		DepositID: dealId.String(),
@@ -98,6 +132,98 @@ func (h *handler) Pay(c echo.Context) error {
 	return c.JSON(http.StatusOK, payResp)
 }
 
+// Quote returns projected payout of the stake before the user signs the payment
+func (h *handler) Quote(c echo.Context) error {
+	ctx := context.TODO()
+	lg := log.WithContext(ctx).WithField("prefix", "Quote")
+
+	eventId, err := uuid.Parse(c.QueryParam("eventID"))
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog("incorrect eventID passed", http.StatusBadRequest, lg))
+	}
+	amount, err := strconv.ParseFloat(c.QueryParam("amount"), 64)
+	if err != nil || amount <= 0 {
+		return c.JSON(HttpResErrorWithLog("incorrect amount passed", http.StatusBadRequest, lg))
+	}
+
+	currency, err := market.GetMarket().EventCurrency(ctx, eventId)
+	if err != nil {
+		if errors.Is(err, market.ErrEventNotExist) {
+			return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+		}
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusInternalServerError, lg))
+	}
+
+	t := token.Token(c.QueryParam("token"))
+	quote, err := market.GetMarket().GetQuote(ctx, eventId, t, currency.FromFloat(amount))
+	if err != nil {
+		if errors.Is(err, market.ErrUnknownOutcome) || errors.Is(err, market.ErrEventClosed) ||
+			errors.Is(err, market.ErrRuntimeEventNotExist) || errors.Is(err, market.ErrInvalidAmount) {
+			return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+		}
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusInternalServerError, lg))
+	}
+
+	return c.JSON(http.StatusOK, quote)
+}
+
+type CashOutReq struct {
+	EventID string      `json:"eventID"`
+	Token   token.Token `json:"token"`
+	// Size to sell in units of the event collateral, 0 sells the whole position
+	Size float64 `json:"size"`
+}
+
+// CashOut sells the user position before the event is resolved, the value is sent by the payout processor
+func (h *handler) CashOut(c echo.Context) error {
+	ctx := context.TODO()
+	lg := log.WithContext(ctx).WithField("prefix", "CashOut")
+
+	addr := c.Get("address").(string)
+	if addr == "" {
+		return c.JSON(HttpResErrorWithLog("address is empty", http.StatusUnauthorized, lg))
+	}
+
+	b, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+
+	var cashOutReq CashOutReq
+	if err := json.Unmarshal(b, &cashOutReq); err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+	if cashOutReq.Size < 0 {
+		return c.JSON(HttpResErrorWithLog("incorrect size passed", http.StatusBadRequest, lg))
+	}
+
+	eventId, err := uuid.Parse(cashOutReq.EventID)
+	if err != nil {
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	}
+	currency, err := market.GetMarket().EventCurrency(ctx, eventId)
+	if err != nil {
+		if errors.Is(err, market.ErrEventNotExist) {
+			return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+		}
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusInternalServerError, lg))
+	}
+
+	cashOut, err := market.GetMarket().CashOut(ctx, addr, eventId, cashOutReq.Token, currency.FromFloat(cashOutReq.Size))
+	if err != nil {
+		if errors.Is(err, market.ErrUnknownOutcome) || errors.Is(err, market.ErrEventClosed) ||
+			errors.Is(err, market.ErrRuntimeEventNotExist) || errors.Is(err, market.ErrEventNotExist) ||
+			errors.Is(err, market.ErrBettingNotOpen) || errors.Is(err, market.ErrBettingLocked) ||
+			errors.Is(err, market.ErrNoPosition) || errors.Is(err, market.ErrInsufficientPosition) ||
+			errors.Is(err, market.ErrCashOutTooSmall) {
+			return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+		}
+		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusInternalServerError, lg))
+	}
+
+	return c.JSON(http.StatusOK, cashOut)
+}
+
 type DepositReq struct {
 	DepositStatus market.DepositStatus `json:"depositStatus"`
 	DepositID     string               `json:"depositID"`
@@ -139,8 +265,6 @@ type CloseReq struct {
 	SecretKey string      `json:"secretKey"`
 }
 
-const SECRET_KEY = "7ab340c6-c17d-463a-80d1-27d8ba169bd4"
-
 func (h *handler) Close(c echo.Context) error {
 	ctx := context.TODO()
 	lg := log.WithContext(ctx).WithField("prefix", "Close")
@@ -155,8 +279,8 @@ func (h *handler) Close(c echo.Context) error {
 		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
 	}
 
-	if closeReq.SecretKey != SECRET_KEY {
-		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusBadRequest, lg))
+	if ok, _ := h.validateAdmin(closeReq.SecretKey, c); !ok {
+		return c.JSON(HttpResErrorWithLog("invalid secret key", http.StatusBadRequest, lg))
 	}
 
 	eventId, err := uuid.Parse(closeReq.DealID)
@@ -165,7 +289,7 @@ func (h *handler) Close(c echo.Context) error {
 	}
 
 	if err := market.GetMarket().CloseEvent(ctx, eventId, closeReq.Token); err != nil {
-		return c.JSON(HttpResErrorWithLog(err.Error(), http.StatusInternalServerError, lg))
+		return c.JSON(HttpResErrorWithLog(err.Error(), adminErrorStatus(err), lg))
 	}
 
 	return c.JSON(http.StatusOK, "ok")
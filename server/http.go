@@ -5,7 +5,7 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 )
 
-func registerHandlers(e *echo.Echo, h *handler, w *socket) {
+func registerHandlers(e *echo.Echo, h *handler, w *socket, bw *bookSocket) {
 	g := e.Group("/api")
 	g.POST("/generate-payload", h.PayloadHandler, middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins: []string{"*"},
@@ -26,6 +26,11 @@ func registerHandlers(e *echo.Echo, h *handler, w *socket) {
 		AllowMethods: []string{echo.GET},
 	}))
 
+	g.GET("/quote", h.Quote, middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins: []string{"*"},
+		AllowMethods: []string{echo.GET},
+	}))
+
 	g.POST("/pay", h.Pay, middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins: []string{"*"},
 		AllowMethods: []string{echo.POST},
@@ -46,6 +51,32 @@ func registerHandlers(e *echo.Echo, h *handler, w *socket) {
 		Validator:  h.validateUser,
 	}))
 
+	g.POST("/cashout", h.CashOut, middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins: []string{"*"},
+		AllowMethods: []string{echo.POST},
+	}), middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+		Skipper:    middleware.DefaultSkipper,
+		KeyLookup:  "cookie:AuthToken",
+		AuthScheme: "Bearer",
+		Validator:  h.validateUser,
+	}))
+
+	orders := g.Group("/orders", middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins: []string{"*"},
+		AllowMethods: []string{echo.GET, echo.POST, echo.DELETE},
+	}))
+	orders.GET("/book", h.GetOrderBook)
+
+	userAuth := middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+		Skipper:    middleware.DefaultSkipper,
+		KeyLookup:  "cookie:AuthToken",
+		AuthScheme: "Bearer",
+		Validator:  h.validateUser,
+	})
+	orders.POST("", h.PlaceOrder, userAuth)
+	orders.GET("", h.GetOrders, userAuth)
+	orders.DELETE("/:id", h.CancelOrder, userAuth)
+
 	g.GET("/assets", h.GetAssets, middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins: []string{"*"},
 		AllowMethods: []string{echo.GET},
@@ -71,9 +102,38 @@ func registerHandlers(e *echo.Echo, h *handler, w *socket) {
 		AllowMethods: []string{echo.POST},
 	}))
 
+	admin := g.Group("/admin", middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins: []string{"*"},
+		AllowMethods: []string{echo.GET, echo.POST, echo.PUT},
+	}), middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+		Skipper:    middleware.DefaultSkipper,
+		KeyLookup:  "header:Authorization",
+		AuthScheme: "Bearer",
+		Validator:  h.validateAdmin,
+	}))
+
+	admin.POST("/events", h.CreateEvent)
+	admin.PUT("/events/:id", h.UpdateEvent)
+	admin.POST("/events/:id/suspend", h.SuspendEvent)
+	admin.POST("/events/:id/resume", h.ResumeEvent)
+	admin.POST("/events/:id/resolve", h.ResolveEvent)
+	admin.POST("/events/:id/void", h.VoidEvent)
+	admin.GET("/events/:id/fee", h.GetEventFee)
+	admin.PUT("/fees/tags/:tag", h.SetTagFeePolicy)
+	admin.GET("/fees", h.GetFeeReport)
+	admin.GET("/transfers/orphans", h.GetOrphanTransfers)
+	admin.GET("/treasury", h.GetTreasury)
+	admin.GET("/solvency", h.GetSolvencyReport)
+
 	e.GET("/ws", w.updateEvent, middleware.CORSWithConfig(
 		middleware.CORSConfig{
 			AllowOrigins: []string{"*"},
 			AllowMethods: []string{echo.GET},
 		}))
+
+	e.GET("/ws/book", bw.updateBook, middleware.CORSWithConfig(
+		middleware.CORSConfig{
+			AllowOrigins: []string{"*"},
+			AllowMethods: []string{echo.GET},
+		}))
 }
@@ -2,19 +2,28 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"github.com/TON-Market/tma/server/config"
 	"github.com/TON-Market/tma/server/datatype/market"
 	"github.com/TON-Market/tma/server/datatype/token"
+	"github.com/TON-Market/tma/server/utils"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	log "github.com/sirupsen/logrus"
-	"github.com/tonkeeper/tongo/liteapi"
 	"github.com/tonkeeper/tongo/tonconnect"
 	_ "net/http/pprof"
+	"os"
 )
 
 func main() {
+	keystorePath := flag.String("new-keystore", "", "encrypt SEED with KEYSTORE_PASSPHRASE into the file and exit")
+	flag.Parse()
+	if *keystorePath != "" {
+		writeKeystore(*keystorePath)
+		return
+	}
+
 	log.Info("Tonproof is running")
 	config.LoadConfig()
 
@@ -27,28 +36,48 @@ func main() {
 	e.Use(middleware.Logger())
 	e.Static("/", "./static")
 
-	mainNetClient, err := liteapi.NewClientWithDefaultMainnet()
+	client, err := utils.NewLiteClient(config.Config.Network)
 	if err != nil {
-		log.Fatalf("failed init mainnet liteapi client")
+		log.Fatalf("failed init liteapi client of network: %s", config.Config.Network)
 	}
-	networks["-239"] = mainNetClient
+	networks[config.Config.Network] = client
 
 	payloadLifeTime := config.Config.Proof.PayloadLifeTimeSec
 	proofLifeTime := config.Config.Proof.ProofLifeTimeSec
-	tonConnectMainNet, err := tonconnect.NewTonConnect(mainNetClient, config.Config.Proof.PayloadSignatureKey,
+	tonConnect, err := tonconnect.NewTonConnect(client, config.Config.Proof.PayloadSignatureKey,
 		tonconnect.WithLifeTimePayload(payloadLifeTime), tonconnect.WithLifeTimeProof(proofLifeTime))
+	if err != nil {
+		log.Fatalf("failed init tonconnect: %v", err)
+	}
 
-	h := newHandler(tonConnectMainNet)
+	h := newHandler(tonConnect)
 	w := newSocket()
+	bw := newBookSocket()
 
-	market.GetMarket().Start(context.TODO())
-	registerHandlers(e, h, w)
+	if err := market.GetMarket().Start(context.TODO()); err != nil {
+		log.Fatalln(err)
+	}
+	registerHandlers(e, h, w, bw)
 
-	testData()
+	if market.GetMarket().EventsCount() == 0 {
+		testData()
+	}
 
 	log.Fatal(e.Start(fmt.Sprintf(":%v", config.Config.Port)))
 }
 
+// writeKeystore saves the seed encrypted for KEYSTORE_FILE, so the plain seed is not kept with the deployment
+func writeKeystore(path string) {
+	data, err := config.EncryptKeystore(os.Getenv("SEED"), os.Getenv("KEYSTORE_PASSPHRASE"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		log.Fatalln(err)
+	}
+	log.Infof("keystore saved to %s", path)
+}
+
 func testData() {
 	e := &market.Event{
 		Tag:      market.Crypto,
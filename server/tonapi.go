@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/TON-Market/tma/server/datatype"
+	"github.com/TON-Market/tma/server/utils"
 	"github.com/tonkeeper/tongo"
 	"github.com/tonkeeper/tongo/liteapi"
 )
@@ -29,8 +30,8 @@ func getAccountInfo(ctx context.Context, addr string, net *liteapi.Client) (*dat
 	}
 
 	accountInfo.Address.Raw = accountId.ToRaw()
-	accountInfo.Address.Bounceable = accountId.ToHuman(true, false)
-	accountInfo.Address.NonBounceable = accountId.ToHuman(false, false)
+	accountInfo.Address.Bounceable = accountId.ToHuman(true, utils.IsTestnet())
+	accountInfo.Address.NonBounceable = accountId.ToHuman(false, utils.IsTestnet())
 
 	return &accountInfo, nil
 }
@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"fmt"
+	"github.com/TON-Market/tma/server/config"
+	"github.com/tonkeeper/tongo/liteapi"
+)
+
+// NewLiteClient returns liteapi client of the network with default config
+func NewLiteClient(network string) (*liteapi.Client, error) {
+	switch network {
+	case config.MainNet:
+		return liteapi.NewClientWithDefaultMainnet()
+	case config.TestNet:
+		return liteapi.NewClientWithDefaultTestnet()
+	default:
+		return nil, fmt.Errorf("unknown network: %s", network)
+	}
+}
+
+func IsTestnet() bool {
+	return config.Config.Network == config.TestNet
+}
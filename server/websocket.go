@@ -2,8 +2,10 @@ package main
 
 import (
 	"github.com/TON-Market/tma/server/datatype/market"
+	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"golang.org/x/net/websocket"
+	"net/http"
 	"sync"
 )
 
@@ -52,3 +54,61 @@ func (h *socket) updateEvent(c echo.Context) error {
 	}).ServeHTTP(c.Response(), c.Request())
 	return nil
 }
+
+// bookSocket streams order books, clients may subscribe to one event by the eventID query param
+type bookSocket struct {
+	bookCh  chan *market.OrderBookDTO
+	clients map[*websocket.Conn]uuid.UUID
+	mu      sync.Mutex
+}
+
+func newBookSocket() *bookSocket {
+	return &bookSocket{
+		bookCh:  market.GetMarket().BookCh,
+		clients: make(map[*websocket.Conn]uuid.UUID),
+		mu:      sync.Mutex{},
+	}
+}
+
+func (h *bookSocket) broadcastBook(book *market.OrderBookDTO) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for client, eventID := range h.clients {
+		if eventID != uuid.Nil && eventID != book.EventID {
+			continue
+		}
+		err := websocket.JSON.Send(client, book)
+		if err != nil {
+			client.Close()
+			delete(h.clients, client)
+		}
+	}
+}
+
+func (h *bookSocket) updateBook(c echo.Context) error {
+	var eventID uuid.UUID
+	if id := c.QueryParam("eventID"); id != "" {
+		var err error
+		if eventID, err = uuid.Parse(id); err != nil {
+			return c.JSON(HttpResError("incorrect eventID passed", http.StatusBadRequest))
+		}
+	}
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		h.mu.Lock()
+		h.clients[ws] = eventID
+		h.mu.Unlock()
+
+		defer func() {
+			h.mu.Lock()
+			delete(h.clients, ws)
+			h.mu.Unlock()
+			ws.Close()
+		}()
+		for book := range h.bookCh {
+			h.broadcastBook(book)
+		}
+	}).ServeHTTP(c.Response(), c.Request())
+	return nil
+}